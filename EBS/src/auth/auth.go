@@ -0,0 +1,116 @@
+// Package auth verifies requests signed by package signer. A Verifier
+// accepts a signature only within its skew window of the signing time and
+// only once: nonces are remembered until their timestamp leaves the
+// window. Nonces are kept in memory, so instances behind one load
+// balancer each reject replays they have seen themselves.
+package auth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"signer"
+	"sync"
+	"time"
+)
+
+// DefaultSkew is the skew window of a Verifier created with skew 0.
+const DefaultSkew = 5 * time.Minute
+
+// MaxBodyBytes is the largest body a signed request may have.
+const MaxBodyBytes = 1 << 20
+
+var (
+	ErrNoSignature  = errors.New("request is not signed")
+	ErrUnknownKey   = errors.New("unknown access key")
+	ErrExpired      = errors.New("signature timestamp is outside the skew window")
+	ErrBadSignature = errors.New("signature does not match")
+	ErrReplayed     = errors.New("nonce has already been used")
+	ErrBodyTooLarge = errors.New("request body is too large")
+)
+
+// Credential returns the parsed Authorization header of r, ErrNoSignature
+// when there is none and signer.ErrMalformed when it cannot be parsed.
+func Credential(r *http.Request) (*signer.Credential, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, ErrNoSignature
+	}
+	return signer.Parse(header)
+}
+
+type Verifier struct {
+	skew time.Duration
+	now  func() time.Time
+
+	mu sync.Mutex
+	// nonces maps access key and nonce to the unix time the nonce
+	// can be forgotten.
+	nonces    map[string]int64
+	nextSweep int64
+}
+
+func NewVerifier(skew time.Duration) *Verifier {
+	if skew <= 0 {
+		skew = DefaultSkew
+	}
+	return &Verifier{skew: skew, now: time.Now, nonces: make(map[string]int64)}
+}
+
+// readBody reads the body of r and replaces it so that it can be read
+// again.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodyBytes+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxBodyBytes {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Verify checks that c, taken from r, is a fresh signature of r with
+// secretKey and records its nonce. The body of r is read and replaced.
+func (v *Verifier) Verify(r *http.Request, c *signer.Credential, secretKey string) error {
+	now := v.now().Unix()
+	skew := int64(v.skew / time.Second)
+	if c.Timestamp < now-skew || c.Timestamp > now+skew {
+		return ErrExpired
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	expected := signer.Sign(secretKey, signer.StringToSign(r.Method, r.URL.EscapedPath(), r.URL.Query(), signer.HashBody(body), c))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(c.Signature)) != 1 {
+		return ErrBadSignature
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now >= v.nextSweep {
+		for key, expire := range v.nonces {
+			if expire < now {
+				delete(v.nonces, key)
+			}
+		}
+		v.nextSweep = now + skew
+	}
+
+	key := c.AccessKeyID + "\n" + c.Nonce
+	if expire, ok := v.nonces[key]; ok && expire >= now {
+		return ErrReplayed
+	}
+	v.nonces[key] = c.Timestamp + skew
+	return nil
+}
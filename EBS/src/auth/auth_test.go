@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"signer"
+	"strings"
+	"testing"
+	"time"
+)
+
+var signTime = time.Unix(1500000000, 0)
+
+func newTestVerifier(skew time.Duration, now time.Time) *Verifier {
+	v := NewVerifier(skew)
+	v.now = func() time.Time { return now }
+	return v
+}
+
+// signedRequest signs a client request to target with s and returns the
+// request the server receives.
+func signedRequest(t *testing.T, s *signer.Signer, method string, target string, body string) *http.Request {
+	client, err := http.NewRequest(method, "http://ebs:6666"+target, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sign(client); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, client.URL.RequestURI(), strings.NewReader(body))
+	r.Header.Set("Authorization", client.Header.Get("Authorization"))
+	return r
+}
+
+func verify(v *Verifier, r *http.Request, secretKey string) error {
+	c, err := Credential(r)
+	if err != nil {
+		return err
+	}
+	return v.Verify(r, c, secretKey)
+}
+
+func TestCredential(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?Action=ListVolumes", nil)
+	if _, err := Credential(r); err != ErrNoSignature {
+		t.Errorf("unsigned request: %v", err)
+	}
+	r.Header.Set("Authorization", "Basic YWRtaW46YWRtaW4=")
+	if _, err := Credential(r); err != signer.ErrMalformed {
+		t.Errorf("basic authorization: %v", err)
+	}
+}
+
+// The query the signer canonicalizes from the client URL must be the one
+// the verifier gets from the request line, whatever its order and escaping.
+func TestRoundTrip(t *testing.T) {
+	s := &signer.Signer{AccessKeyID: "AKID", SecretKey: "secret", Now: func() time.Time { return signTime }}
+	v := newTestVerifier(0, signTime)
+	targets := []struct {
+		method string
+		target string
+		body   string
+	}{
+		{http.MethodGet, "/", ""},
+		{http.MethodGet, "/?Action=ListVolumes", ""},
+		{http.MethodGet, "/?VolumeName=vol&Action=CreateDisk&PoolName=rbd&Size=1073741824", ""},
+		{http.MethodGet, "/?Action=TagVolume&Tag=owner:a+b&Tag=env:prod%20eu&Tag=env:dev", ""},
+		{http.MethodGet, "/?Action=ListVolumes&Tag=%E7%8E%AF%E5%A2%83&Tag=a%2Fb", ""},
+		{http.MethodGet, "/?Empty=&Action=ListVolumes", ""},
+		{http.MethodPost, "/v1/volumes?pool=rbd", `{"Name":"vol","Size":1073741824}`},
+		{http.MethodDelete, "/v1/volumes/rbd/vol%20one", ""},
+	}
+	for _, tt := range targets {
+		r := signedRequest(t, s, tt.method, tt.target, tt.body)
+		if err := verify(v, r, "secret"); err != nil {
+			t.Errorf("%v %v: %v", tt.method, tt.target, err)
+			continue
+		}
+		// The handler can still read the body.
+		if body, err := ioutil.ReadAll(r.Body); err != nil || string(body) != tt.body {
+			t.Errorf("%v %v: body %q, %v", tt.method, tt.target, body, err)
+		}
+	}
+}
+
+func TestSkew(t *testing.T) {
+	s := &signer.Signer{AccessKeyID: "AKID", SecretKey: "secret", Now: func() time.Time { return signTime }}
+	tests := []struct {
+		skew time.Duration
+		now  time.Time
+		err  error
+	}{
+		{time.Minute, signTime.Add(time.Minute), nil},
+		{time.Minute, signTime.Add(-time.Minute), nil},
+		{time.Minute, signTime.Add(time.Minute + time.Second), ErrExpired},
+		{time.Minute, signTime.Add(-time.Minute - time.Second), ErrExpired},
+		{0, signTime.Add(DefaultSkew), nil},
+		{0, signTime.Add(DefaultSkew + time.Second), ErrExpired},
+	}
+	for _, tt := range tests {
+		r := signedRequest(t, s, http.MethodGet, "/?Action=ListVolumes", "")
+		v := newTestVerifier(tt.skew, tt.now)
+		if err := verify(v, r, "secret"); err != tt.err {
+			t.Errorf("skew %v, %v after signing: %v, want %v", tt.skew, tt.now.Sub(signTime), err, tt.err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := &signer.Signer{AccessKeyID: "AKID", SecretKey: "secret", Now: func() time.Time { return signTime }}
+	now := signTime
+	v := NewVerifier(time.Minute)
+	v.now = func() time.Time { return now }
+
+	r := signedRequest(t, s, http.MethodGet, "/?Action=DelPool&PoolName=rbd", "")
+	header := r.Header.Get("Authorization")
+	replay := func() error {
+		r := httptest.NewRequest(http.MethodGet, "/?Action=DelPool&PoolName=rbd", nil)
+		r.Header.Set("Authorization", header)
+		return verify(v, r, "secret")
+	}
+	if err := verify(v, r, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := replay(); err != ErrReplayed {
+		t.Errorf("replay: %v", err)
+	}
+	// A replay within the window is rejected even after the nonces have
+	// been swept, and outside it the timestamp has expired.
+	now = signTime.Add(time.Minute)
+	if err := verify(v, signedRequest(t, s, http.MethodGet, "/", ""), "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := replay(); err != ErrReplayed {
+		t.Errorf("replay at the end of the window: %v", err)
+	}
+	now = signTime.Add(time.Minute + time.Second)
+	if err := replay(); err != ErrExpired {
+		t.Errorf("replay after the window: %v", err)
+	}
+
+	// A rejected signature does not use up the nonce.
+	now = signTime
+	r = signedRequest(t, s, http.MethodGet, "/?Action=ListVolumes", "")
+	header = r.Header.Get("Authorization")
+	if err := verify(v, r, "wrong"); err != ErrBadSignature {
+		t.Fatalf("wrong secret: %v", err)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/?Action=ListVolumes", nil)
+	r.Header.Set("Authorization", header)
+	if err := verify(v, r, "secret"); err != nil {
+		t.Errorf("after a bad signature with the nonce: %v", err)
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	s := &signer.Signer{AccessKeyID: "AKID", SecretKey: "secret", Now: func() time.Time { return signTime }}
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		secret string
+	}{
+		{"wrong secret", http.MethodGet, "/?Action=DelPool&PoolName=rbd", "", "other"},
+		{"changed query", http.MethodGet, "/?Action=DelPool&PoolName=data", "", "secret"},
+		{"added parameter", http.MethodGet, "/?Action=DelPool&PoolName=rbd&Force=true", "", "secret"},
+		{"changed method", http.MethodDelete, "/?Action=DelPool&PoolName=rbd", "", "secret"},
+		{"changed path", http.MethodGet, "/v1/?Action=DelPool&PoolName=rbd", "", "secret"},
+		{"changed body", http.MethodGet, "/?Action=DelPool&PoolName=rbd", "{}", "secret"},
+	}
+	for _, tt := range tests {
+		r := signedRequest(t, s, http.MethodGet, "/?Action=DelPool&PoolName=rbd", "")
+		tampered := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		tampered.Header.Set("Authorization", r.Header.Get("Authorization"))
+		v := newTestVerifier(0, signTime)
+		if err := verify(v, tampered, tt.secret); err != ErrBadSignature {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+	}
+
+	// The signature of another access key does not verify either.
+	other := &signer.Signer{AccessKeyID: "OTHER", SecretKey: "secret", Now: s.Now}
+	r := signedRequest(t, other, http.MethodGet, "/", "")
+	c, err := Credential(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AccessKeyID = "AKID"
+	if err := newTestVerifier(0, signTime).Verify(r, c, "secret"); err != ErrBadSignature {
+		t.Errorf("signature of another key: %v", err)
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	s := &signer.Signer{AccessKeyID: "AKID", SecretKey: "secret", Now: func() time.Time { return signTime }}
+	v := newTestVerifier(0, signTime)
+	body := strings.Repeat("x", MaxBodyBytes)
+	if err := verify(v, signedRequest(t, s, http.MethodPost, "/v1/volumes", body), "secret"); err != nil {
+		t.Errorf("body of MaxBodyBytes: %v", err)
+	}
+	if err := verify(v, signedRequest(t, s, http.MethodPost, "/v1/volumes", body+"x"), "secret"); err != ErrBodyTooLarge {
+		t.Errorf("body over MaxBodyBytes: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package conf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var configMap = make(map[string]map[string]string)
+
+var commentRegexp = regexp.MustCompile("^[[:space:]]*[#;].*")
+var emptyRegexp = regexp.MustCompile("^[[:space:]]*$")
+var sectionRegexp = regexp.MustCompile("^[[:space:]]*\\[([[:alnum:]._-]+)\\][[:space:]]*$")
+var configRegexp = regexp.MustCompile("^[[:space:]]*([[:word:].-]+)[[:space:]]*=[[:space:]]*(.*?)[[:space:]]*$")
+
+/*
+类ini配置解析
+[global]
+listen = 0.0.0.0:6666
+[cluster.default]
+cluster = ceph
+user = client.admin
+*/
+func Load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	parsed := make(map[string]map[string]string)
+	var data map[string]string
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+
+		//注释或空行跳过
+		if commentRegexp.MatchString(line) || emptyRegexp.MatchString(line) {
+			continue
+		}
+
+		//章节
+		if m := sectionRegexp.FindStringSubmatch(line); m != nil {
+			if data = parsed[m[1]]; data == nil {
+				data = make(map[string]string)
+				parsed[m[1]] = data
+			}
+			continue
+		}
+
+		//配置
+		m := configRegexp.FindStringSubmatch(line)
+		if m == nil || data == nil {
+			return fmt.Errorf("%v:%d: invalid configuration: %v", filename, lineno, line)
+		}
+		data[m[1]] = m[2]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	configMap = parsed
+	return nil
+}
+
+func GetSectionConf(section string) (map[string]string, bool) {
+	conf, ok := configMap[section]
+	return conf, ok
+}
+
+// 返回以prefix开头的所有章节名，按字典序排列
+func Sections(prefix string) []string {
+	var sections []string
+	for name := range configMap {
+		if strings.HasPrefix(name, prefix) {
+			sections = append(sections, name)
+		}
+	}
+	sort.Strings(sections)
+	return sections
+}
+
+func GetString(section string, key string, def string) string {
+	if value, ok := configMap[section][key]; ok {
+		return value
+	}
+	return def
+}
+
+func GetInt(section string, key string, def int) int {
+	if value, ok := configMap[section][key]; ok {
+		if rval, err := strconv.Atoi(value); err == nil {
+			return rval
+		}
+	}
+	return def
+}
+
+func GetBool(section string, key string, def bool) bool {
+	if value, ok := configMap[section][key]; ok {
+		if rval, err := strconv.ParseBool(value); err == nil {
+			return rval
+		}
+	}
+	return def
+}
+
+func GetDuration(section string, key string, def time.Duration) time.Duration {
+	if value, ok := configMap[section][key]; ok {
+		if rval, err := time.ParseDuration(value); err == nil {
+			return rval
+		}
+	}
+	return def
+}
@@ -2,25 +2,43 @@ package db
 
 import "database/sql"
 import _"github.com/go-sql-driver/mysql"
+import "conf"
 
 const (
-	VolumesTab         = "volumes"
-	ClientVolumesTab   = "client_volumes"
-	TargetVolumesTab   = "target_volumes"
+	VolumesTab               = "volumes"
+	ClientVolumesTab         = "client_volumes"
+	TargetVolumesTab         = "target_volumes"
+	JobsTab                  = "jobs"
+	BackupsTab               = "backups"
+	RestoresTab              = "restores"
+	SnapshotPoliciesTab      = "snapshot_policies"
+	SnapshotPolicyTargetsTab = "snapshot_policy_targets"
+	SnapshotRunsTab          = "snapshot_runs"
+	LeasesTab                = "leases"
+	VolumeQoSTab             = "volume_qos"
+	VolumeTagsTab            = "volume_tags"
+	TenantsTab               = "tenants"
+)
+
+const (
+	defaultDriver = "mysql"
+	defaultDSN    = "root:123456@tcp(172.7.102.214:3306)/ebs"
 )
 
 type dbHandle struct {
+	driver string
 	dsn string
 	handle *sql.DB
 }
 
 var handler = &dbHandle{
+	driver: "",
 	dsn: "",
 	handle: nil,
 }
 
 func connectDB() (*sql.DB, error) {
-	handle, err := sql.Open("mysql", handler.dsn)
+	handle, err := sql.Open(handler.driver, handler.dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -33,8 +51,10 @@ func connectDB() (*sql.DB, error) {
 	return handle, nil
 }
 
+//数据库由配置文件[db]章节的driver和dsn指定
 func Init() error {
-	handler.dsn = "root:123456@tcp(172.7.102.214:3306)/ebs"
+	handler.driver = conf.GetString("db", "driver", defaultDriver)
+	handler.dsn = conf.GetString("db", "dsn", defaultDSN)
 	handle, err := connectDB()
 	if err != nil {
 		return err
@@ -44,9 +64,16 @@ func Init() error {
 }
 
 func Destroy() {
+	if handler.handle == nil {
+		return
+	}
 	handler.handle.Close()
 }
 
+func GetDriver() string {
+	return handler.driver
+}
+
 func GetDBHandler() *sql.DB {
 	return handler.handle
 }
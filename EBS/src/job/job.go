@@ -0,0 +1,254 @@
+// Package job runs long-running operations in the background. Each job is
+// persisted, so its final state can still be queried after a restart.
+package job
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"utils"
+)
+
+var ErrNotFound = errors.New("Job not found")
+var ErrBusy = errors.New("Another job is running on the resource")
+
+type State string
+
+const (
+	StatePending   State = "pending"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+)
+
+// DefaultWorkers is the number of jobs that may run at the same time.
+const DefaultWorkers = 4
+
+// saveInterval limits how often progress is written to the store.
+const saveInterval = time.Second
+
+// Job is the externally visible state of a background operation.
+type Job struct {
+	Id         string
+	Action     string
+	Resource   string
+	State      State
+	Progress   int
+	Error      string
+	CreateTime string
+	UpdateTime string
+}
+
+func (j *Job) Finished() bool {
+	return j.State == StateSucceeded || j.State == StateFailed
+}
+
+// Store persists jobs.
+type Store interface {
+	Insert(job *Job) error
+	Update(job *Job) error
+	Get(id string) (*Job, error)
+	// FailUnfinished marks every pending or running job as failed.
+	FailUnfinished(reason string) (int64, error)
+}
+
+// Func is the body of a job. It reports progress through p and returns the
+// job's result.
+type Func func(p *Progress) error
+
+// Manager schedules jobs on a bounded number of workers. Only one job may
+// run on a resource at a time.
+type Manager struct {
+	store Store
+	slots chan struct{}
+
+	mu        sync.Mutex
+	active    map[string]*Job
+	resources map[string]string
+	wg        sync.WaitGroup
+}
+
+func NewManager(store Store, workers int) *Manager {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	return &Manager{
+		store:     store,
+		slots:     make(chan struct{}, workers),
+		active:    make(map[string]*Job),
+		resources: make(map[string]string),
+	}
+}
+
+// Recover fails the jobs that were left unfinished by a previous process.
+// It must be called before the first Submit.
+func (m *Manager) Recover() error {
+	n, err := m.store.FailUnfinished("Interrupted by service restart")
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		fmt.Fprintf(os.Stderr, "%v unfinished jobs marked failed\n", n)
+	}
+	return nil
+}
+
+// Submit records a new job and starts fn in the background. resource names
+// the object the job works on, e.g. "pool/volume".
+func (m *Manager) Submit(action string, resource string, fn Func) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	t := utils.CurrentTime()
+	j := &Job{
+		Id:         id,
+		Action:     action,
+		Resource:   resource,
+		State:      StatePending,
+		CreateTime: t,
+		UpdateTime: t,
+	}
+
+	m.mu.Lock()
+	if _, ok := m.resources[resource]; ok {
+		m.mu.Unlock()
+		return nil, ErrBusy
+	}
+	m.resources[resource] = id
+	m.active[id] = j
+	m.mu.Unlock()
+
+	if err := m.store.Insert(j); err != nil {
+		m.finish(j)
+		return nil, err
+	}
+
+	snapshot := *j
+	m.wg.Add(1)
+	go m.run(j, fn)
+	return &snapshot, nil
+}
+
+// Get returns a copy of the job, from memory while it is active.
+func (m *Manager) Get(id string) (*Job, error) {
+	m.mu.Lock()
+	if j, ok := m.active[id]; ok {
+		snapshot := *j
+		m.mu.Unlock()
+		return &snapshot, nil
+	}
+	m.mu.Unlock()
+
+	return m.store.Get(id)
+}
+
+// Wait blocks until all submitted jobs have finished.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+func (m *Manager) run(j *Job, fn Func) {
+	defer m.wg.Done()
+
+	m.slots <- struct{}{}
+	defer func() { <-m.slots }()
+
+	m.setState(j, StateRunning, "")
+
+	p := &Progress{manager: m, job: j}
+	if err := fn(p); err != nil {
+		fmt.Fprintf(os.Stderr, "Job %v %v on %v failed: %v\n", j.Id, j.Action, j.Resource, err)
+		m.setState(j, StateFailed, err.Error())
+	} else {
+		m.setState(j, StateSucceeded, "")
+	}
+	m.finish(j)
+}
+
+func (m *Manager) setState(j *Job, state State, reason string) {
+	m.mu.Lock()
+	j.State = state
+	j.Error = reason
+	if state == StateSucceeded {
+		j.Progress = 100
+	}
+	j.UpdateTime = utils.CurrentTime()
+	snapshot := *j
+	m.mu.Unlock()
+
+	m.save(&snapshot)
+}
+
+func (m *Manager) finish(j *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.active, j.Id)
+	if m.resources[j.Resource] == j.Id {
+		delete(m.resources, j.Resource)
+	}
+}
+
+func (m *Manager) save(j *Job) {
+	if err := m.store.Update(j); err != nil {
+		fmt.Fprintf(os.Stderr, "Save job %v failed: %v\n", j.Id, err)
+	}
+}
+
+// Progress lets a running job report how far it has got.
+type Progress struct {
+	manager   *Manager
+	job       *Job
+	lastSaved time.Time
+}
+
+// Update records that done out of total units are complete. It satisfies
+// storage.ProgressFunc.
+func (p *Progress) Update(done uint64, total uint64) {
+	if total == 0 {
+		return
+	}
+	if done > total {
+		done = total
+	}
+
+	percent := int(done * 100 / total)
+	if percent >= 100 {
+		//完成由任务状态表示
+		percent = 99
+	}
+
+	m := p.manager
+	m.mu.Lock()
+	if percent <= p.job.Progress {
+		m.mu.Unlock()
+		return
+	}
+	p.job.Progress = percent
+	now := time.Now()
+	if now.Sub(p.lastSaved) < saveInterval {
+		m.mu.Unlock()
+		return
+	}
+	p.lastSaved = now
+	p.job.UpdateTime = utils.CurrentTime()
+	snapshot := *p.job
+	m.mu.Unlock()
+
+	m.save(&snapshot)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "job-" + hex.EncodeToString(b), nil
+}
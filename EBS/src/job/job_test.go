@@ -0,0 +1,220 @@
+package job
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// blockingJob returns a job body that reports it has started and then
+// waits for release.
+func blockingJob() (Func, chan struct{}, chan struct{}) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	return func(p *Progress) error {
+		close(started)
+		<-release
+		return nil
+	}, started, release
+}
+
+func TestSubmitBusy(t *testing.T) {
+	m := NewManager(NewMemoryStore(), 2)
+	fn, started, release := blockingJob()
+	first, err := m.Submit("CreateDisk", "rbd/vol", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// Of concurrent submits on the busy resource none is accepted.
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = m.Submit("DelDisk", "rbd/vol", func(p *Progress) error { return nil })
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != ErrBusy {
+			t.Errorf("submit %v on a busy resource = %v", i, err)
+		}
+	}
+
+	other, err := m.Submit("CreateDisk", "rbd/other", func(p *Progress) error { return nil })
+	if err != nil {
+		t.Fatalf("submit on another resource = %v", err)
+	}
+	if j, err := m.Get(first.Id); err != nil || j.State != StateRunning {
+		t.Errorf("first job %+v, %v", j, err)
+	}
+
+	close(release)
+	m.Wait()
+	for _, id := range []string{first.Id, other.Id} {
+		if j, err := m.Get(id); err != nil || j.State != StateSucceeded || j.Progress != 100 {
+			t.Errorf("job %+v, %v", j, err)
+		}
+	}
+	if _, err := m.Submit("DelDisk", "rbd/vol", func(p *Progress) error { return nil }); err != nil {
+		t.Errorf("submit after the job finished = %v", err)
+	}
+	m.Wait()
+}
+
+func TestWorkers(t *testing.T) {
+	m := NewManager(NewMemoryStore(), 1)
+	fn, started, release := blockingJob()
+	if _, err := m.Submit("CreateDisk", "rbd/a", fn); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	queued, err := m.Submit("CreateDisk", "rbd/b", func(p *Progress) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := m.Get(queued.Id); j.State != StatePending {
+		t.Errorf("job beyond the workers is %v", j.State)
+	}
+	close(release)
+	m.Wait()
+	if j, _ := m.Get(queued.Id); j.State != StateSucceeded {
+		t.Errorf("queued job %v", j.State)
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		state State
+	}{
+		{"succeeded", nil, StateSucceeded},
+		{"failed", errors.New("Map Volume Failed"), StateFailed},
+	}
+	for _, tt := range tests {
+		store := NewMemoryStore()
+		m := NewManager(store, 1)
+		j, err := m.Submit("CreateDisk", "rbd/vol", func(p *Progress) error { return tt.err })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.State != StatePending || j.CreateTime == "" {
+			t.Errorf("%v: submitted job %+v", tt.name, j)
+		}
+		m.Wait()
+
+		// A finished job is only in the store.
+		got, err := m.Get(j.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := store.Get(j.Id)
+		if *got != *stored {
+			t.Errorf("%v: Get %+v, stored %+v", tt.name, got, stored)
+		}
+		reason := ""
+		if tt.err != nil {
+			reason = tt.err.Error()
+		}
+		if got.State != tt.state || got.Error != reason || !got.Finished() {
+			t.Errorf("%v: job %+v", tt.name, got)
+		}
+	}
+
+	m := NewManager(NewMemoryStore(), 1)
+	if _, err := m.Get("job-missing"); err != ErrNotFound {
+		t.Errorf("Get of an unknown job = %v", err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	store := NewMemoryStore()
+	m := NewManager(store, 1)
+	tests := []struct {
+		done, total uint64
+		want        int
+	}{
+		{0, 0, 0},
+		{1, 4, 25},
+		// Progress never goes back.
+		{1, 10, 25},
+		{3, 4, 75},
+		// Completion is shown by the state only.
+		{4, 4, 99},
+		{5, 4, 99},
+	}
+
+	step := make(chan int)
+	checked := make(chan struct{})
+	j, err := m.Submit("CopyVolume", "rbd/vol", func(p *Progress) error {
+		for i := range step {
+			p.Update(tests[i].done, tests[i].total)
+			checked <- struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range tests {
+		step <- i
+		<-checked
+		got, _ := m.Get(j.Id)
+		if got.Progress != tt.want {
+			t.Errorf("after Update(%v, %v) progress %v, want %v", tt.done, tt.total, got.Progress, tt.want)
+		}
+	}
+	// The first update is saved at once, later ones at most every
+	// saveInterval.
+	if stored, _ := store.Get(j.Id); stored.Progress != 25 {
+		t.Errorf("stored progress %v", stored.Progress)
+	}
+	close(step)
+	m.Wait()
+	if got, _ := m.Get(j.Id); got.Progress != 100 {
+		t.Errorf("progress of the finished job %v", got.Progress)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	store := NewMemoryStore()
+	jobs := []*Job{
+		{Id: "job-pending", State: StatePending},
+		{Id: "job-running", State: StateRunning, Progress: 40},
+		{Id: "job-succeeded", State: StateSucceeded, Progress: 100},
+		{Id: "job-failed", State: StateFailed, Error: "Map Volume Failed"},
+	}
+	for _, j := range jobs {
+		if err := store.Insert(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewManager(store, 1)
+	if err := m.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id    string
+		state State
+		err   string
+	}{
+		{"job-pending", StateFailed, "Interrupted by service restart"},
+		{"job-running", StateFailed, "Interrupted by service restart"},
+		{"job-succeeded", StateSucceeded, ""},
+		{"job-failed", StateFailed, "Map Volume Failed"},
+	}
+	for _, tt := range tests {
+		j, err := m.Get(tt.id)
+		if err != nil || j.State != tt.state || j.Error != tt.err {
+			t.Errorf("%v after recovery %+v, %v", tt.id, j, err)
+		}
+	}
+	if n, _ := store.FailUnfinished("again"); n != 0 {
+		t.Errorf("%v jobs left unfinished", n)
+	}
+}
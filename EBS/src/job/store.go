@@ -0,0 +1,114 @@
+package job
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"db"
+	"utils"
+)
+
+// SQLStore keeps jobs in the jobs table, created by the repository
+// migrations.
+type SQLStore struct {
+	handle *sql.DB
+}
+
+func NewSQLStore(handle *sql.DB) *SQLStore {
+	return &SQLStore{handle: handle}
+}
+
+func (s *SQLStore) Insert(job *Job) error {
+	_, err := s.handle.Exec(fmt.Sprintf("INSERT INTO %s (id, action, resource, state, progress, error, create_time, update_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		db.JobsTab), job.Id, job.Action, job.Resource, string(job.State), job.Progress, job.Error, job.CreateTime, job.UpdateTime)
+	return err
+}
+
+func (s *SQLStore) Update(job *Job) error {
+	_, err := s.handle.Exec(fmt.Sprintf("UPDATE %s SET state = ?, progress = ?, error = ?, update_time = ? WHERE id = ?",
+		db.JobsTab), string(job.State), job.Progress, job.Error, job.UpdateTime, job.Id)
+	return err
+}
+
+func (s *SQLStore) Get(id string) (*Job, error) {
+	job := &Job{}
+	var state string
+	var reason sql.NullString
+	row := s.handle.QueryRow(fmt.Sprintf("SELECT id, action, resource, state, progress, error, create_time, update_time FROM %s WHERE id = ?",
+		db.JobsTab), id)
+	if err := row.Scan(&job.Id, &job.Action, &job.Resource, &state, &job.Progress, &reason, &job.CreateTime, &job.UpdateTime); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	job.State = State(state)
+	job.Error = reason.String
+	return job, nil
+}
+
+func (s *SQLStore) FailUnfinished(reason string) (int64, error) {
+	result, err := s.handle.Exec(fmt.Sprintf("UPDATE %s SET state = ?, error = ?, update_time = ? WHERE state IN (?, ?)",
+		db.JobsTab), string(StateFailed), reason, utils.CurrentTime(), string(StatePending), string(StateRunning))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// MemoryStore keeps jobs in process memory; they do not survive a restart.
+type MemoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: make(map[string]Job)}
+}
+
+func (s *MemoryStore) Insert(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.Id] = *job
+	return nil
+}
+
+func (s *MemoryStore) Update(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[job.Id]; !ok {
+		return ErrNotFound
+	}
+	s.jobs[job.Id] = *job
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &job, nil
+}
+
+func (s *MemoryStore) FailUnfinished(reason string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for id, job := range s.jobs {
+		if !job.Finished() {
+			job.State = StateFailed
+			job.Error = reason
+			s.jobs[id] = job
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,377 @@
+// Package krbd maps rbd images to kernel block devices through the rbd
+// bus in sysfs, the same interface the rbd command line tool uses:
+//
+//	/sys/bus/rbd/add_single_major     map an image
+//	/sys/bus/rbd/remove_single_major  unmap a device by id
+//	/sys/bus/rbd/devices/<id>/        pool, name and current_snap of a mapping
+//
+// The sysfs root is injectable so the manager can run against a plain
+// directory that mimics the kernel tree.
+package krbd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultRoot = "/sys"
+
+// DefaultTimeout bounds how long Map and Unmap wait for the kernel.
+const DefaultTimeout = 30 * time.Second
+
+// headSnap is the snapshot name of a mapped image head.
+const headSnap = "-"
+
+var ErrNotFound = errors.New("Device not mapped")
+var ErrTimeout = errors.New("Timed out waiting for the kernel")
+var ErrInvalidOptions = errors.New("Invalid map options")
+
+// Options are the credentials and flags passed to the kernel client.
+type Options struct {
+	// Monitors are the monitor addresses, ip:port.
+	Monitors []string
+	// User is the cephx user without the "client." prefix, e.g. "admin".
+	User string
+	// Secret is the base64 cephx key of User.
+	Secret   string
+	ReadOnly bool
+}
+
+func (o *Options) String() string {
+	opts := []string{"name=" + o.User}
+	if o.Secret != "" {
+		opts = append(opts, "secret="+o.Secret)
+	}
+	if o.ReadOnly {
+		opts = append(opts, "ro")
+	}
+	return strings.Join(opts, ",")
+}
+
+// Mapping is an image mapped to /dev/rbd<ID>.
+type Mapping struct {
+	ID     int
+	Pool   string
+	Image  string
+	Snap   string
+	Device string
+}
+
+// Manager maps and unmaps images under one sysfs root.
+type Manager struct {
+	root    string
+	timeout time.Duration
+
+	// mu serializes Map so concurrent requests do not map the same image
+	// twice.
+	mu sync.Mutex
+	// abandoned holds the images whose Map timed out while the kernel may
+	// still map them; the device is unmapped once it appears.
+	abandoned map[string]bool
+}
+
+func NewManager(root string) *Manager {
+	if root == "" {
+		root = DefaultRoot
+	}
+	return &Manager{root: root, timeout: DefaultTimeout, abandoned: make(map[string]bool)}
+}
+
+func (m *Manager) SetTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		m.timeout = timeout
+	}
+}
+
+func (m *Manager) busPath() string {
+	return filepath.Join(m.root, "bus", "rbd")
+}
+
+func (m *Manager) devicePath(id int) string {
+	return filepath.Join(m.busPath(), "devices", strconv.Itoa(id))
+}
+
+// control returns add_single_major or remove_single_major, falling back to
+// add or remove on kernels without single-major support.
+func (m *Manager) control(name string) string {
+	path := filepath.Join(m.busPath(), name+"_single_major")
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if _, err := os.Stat(filepath.Join(m.busPath(), name)); err == nil {
+		return filepath.Join(m.busPath(), name)
+	}
+	return path
+}
+
+// start writes value to a control file in the background. The kernel only
+// returns once the request is done, which is reported on the channel.
+func (m *Manager) start(path string, value string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- ioutil.WriteFile(path, []byte(value), 0200)
+	}()
+	return result
+}
+
+// write writes value to a control file, bounded by the manager timeout.
+func (m *Manager) write(path string, value string) error {
+	select {
+	case err := <-m.start(path, value):
+		return err
+	case <-time.After(m.timeout):
+		return ErrTimeout
+	}
+}
+
+func imageKey(pool string, image string, snap string) string {
+	return pool + "/" + image + "@" + snap
+}
+
+// abandon gives up on a map request whose result comes on result, and
+// unmaps the device if the kernel maps it after all. m.mu must be held.
+func (m *Manager) abandon(result <-chan error, pool string, image string, snap string) {
+	key := imageKey(pool, image, snap)
+	m.abandoned[key] = true
+	go func() {
+		if err := <-result; err == nil {
+			m.unmapLate(pool, image, snap)
+		}
+		m.mu.Lock()
+		delete(m.abandoned, key)
+		m.mu.Unlock()
+	}()
+}
+
+// unmapLate waits for the device of an abandoned map to appear and
+// unmaps it.
+func (m *Manager) unmapLate(pool string, image string, snap string) {
+	deadline := time.Now().Add(m.timeout)
+	for {
+		mapping, err := m.Lookup(pool, image, snap)
+		if err == nil {
+			if err := m.Unmap(mapping.ID, false); err != nil {
+				fmt.Fprintf(os.Stderr, "Unmap %v after timed out map failed: %v\n", mapping.Device, err)
+			}
+			return
+		}
+		if err != ErrNotFound {
+			fmt.Fprintf(os.Stderr, "Lookup %v after timed out map failed: %v\n", imageKey(pool, image, snap), err)
+			return
+		}
+		if time.Now().After(deadline) {
+			fmt.Fprintf(os.Stderr, "Device of timed out map of %v not found\n", imageKey(pool, image, snap))
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Map maps pool/image, or its snapshot snap when not empty, and returns the
+// new device. An image that is already mapped is returned as is. When the
+// kernel does not answer in time the device it may still create is
+// unmapped in the background, and until then Map of the image returns
+// ErrTimeout.
+func (m *Manager) Map(pool string, image string, snap string, opts Options) (*Mapping, error) {
+	if pool == "" || image == "" || opts.User == "" || len(opts.Monitors) == 0 {
+		return nil, ErrInvalidOptions
+	}
+	for _, s := range append([]string{pool, image, snap, opts.User, opts.Secret}, opts.Monitors...) {
+		if strings.ContainsAny(s, " \n,") {
+			return nil, ErrInvalidOptions
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.abandoned[imageKey(pool, image, snap)] {
+		return nil, ErrTimeout
+	}
+	if mapping, err := m.Lookup(pool, image, snap); err == nil {
+		return mapping, nil
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	kernelSnap := snap
+	if kernelSnap == "" {
+		kernelSnap = headSnap
+	}
+	request := fmt.Sprintf("%s %s %s %s %s", strings.Join(opts.Monitors, ","), opts.String(), pool, image, kernelSnap)
+	result := m.start(m.control("add"), request)
+	select {
+	case err := <-result:
+		if err != nil {
+			return nil, err
+		}
+	case <-time.After(m.timeout):
+		m.abandon(result, pool, image, snap)
+		return nil, ErrTimeout
+	}
+
+	//写入返回时设备已创建，sysfs目录可能稍后才出现
+	deadline := time.Now().Add(m.timeout)
+	for {
+		mapping, err := m.Lookup(pool, image, snap)
+		if err != ErrNotFound {
+			return mapping, err
+		}
+		if time.Now().After(deadline) {
+			done := make(chan error, 1)
+			done <- nil
+			m.abandon(done, pool, image, snap)
+			return nil, ErrTimeout
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Unmap removes the device id. force unmaps it even while it is open.
+func (m *Manager) Unmap(id int, force bool) error {
+	if _, err := os.Stat(m.devicePath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	request := strconv.Itoa(id)
+	if force {
+		request += " force"
+	}
+	return m.write(m.control("remove"), request)
+}
+
+// UnmapImage unmaps pool/image, or its snapshot snap when not empty.
+func (m *Manager) UnmapImage(pool string, image string, snap string, force bool) error {
+	mapping, err := m.Lookup(pool, image, snap)
+	if err != nil {
+		return err
+	}
+	return m.Unmap(mapping.ID, force)
+}
+
+// Refresh makes the kernel re-read the size of a mapped image.
+func (m *Manager) Refresh(id int) error {
+	path := filepath.Join(m.devicePath(id), "refresh")
+	if _, err := os.Stat(m.devicePath(id)); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return m.write(path, "1")
+}
+
+// Lookup finds the mapping of pool/image, or of its snapshot snap when not
+// empty.
+func (m *Manager) Lookup(pool string, image string, snap string) (*Mapping, error) {
+	mappings, err := m.Mappings()
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range mappings {
+		if mapping.Pool == pool && mapping.Image == image && mapping.Snap == snap {
+			return mapping, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// LookupDevice finds the mapping of a device path such as /dev/rbd0.
+func (m *Manager) LookupDevice(device string) (*Mapping, error) {
+	id, err := DeviceID(device)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := m.mapping(id)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return mapping, err
+}
+
+// Mappings lists the mapped devices, sorted by id.
+func (m *Manager) Mappings() ([]*Mapping, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(m.busPath(), "devices"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var mappings []*Mapping
+	for _, info := range infos {
+		id, err := strconv.Atoi(info.Name())
+		if err != nil {
+			continue
+		}
+		mapping, err := m.mapping(id)
+		if err != nil {
+			//设备正在删除
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		mappings = append(mappings, mapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].ID < mappings[j].ID
+	})
+	return mappings, nil
+}
+
+func (m *Manager) mapping(id int) (*Mapping, error) {
+	dir := m.devicePath(id)
+	pool, err := readAttr(filepath.Join(dir, "pool"))
+	if err != nil {
+		return nil, err
+	}
+	image, err := readAttr(filepath.Join(dir, "name"))
+	if err != nil {
+		return nil, err
+	}
+	snap, err := readAttr(filepath.Join(dir, "current_snap"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &Mapping{ID: id, Pool: pool, Image: image, Snap: snapName(snap), Device: DevicePath(id)}, nil
+}
+
+func readAttr(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// snapName turns the kernel's "-" for the image head into "".
+func snapName(snap string) string {
+	if snap == headSnap {
+		return ""
+	}
+	return snap
+}
+
+// DevicePath returns the block device of mapping id.
+func DevicePath(id int) string {
+	return "/dev/rbd" + strconv.Itoa(id)
+}
+
+// DeviceID parses the id out of a device path such as /dev/rbd0.
+func DeviceID(device string) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(device, "/dev/rbd"))
+	if err != nil || id < 0 || !strings.HasPrefix(device, "/dev/rbd") {
+		return 0, fmt.Errorf("Unexpected device path %v", device)
+	}
+	return id, nil
+}
@@ -0,0 +1,301 @@
+package krbd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeKernel serves the rbd bus of a temporary sysfs tree. add_single_major
+// is a fifo, so a write blocks until the kernel reads it, as the real one
+// blocks until the image is mapped; remove_single_major is a plain file.
+type fakeKernel struct {
+	t    *testing.T
+	root string
+	// delay is how long the kernel takes to map an image.
+	delay time.Duration
+
+	mu       sync.Mutex
+	requests []string
+	next     int
+}
+
+func newFakeKernel(t *testing.T, delay time.Duration) *fakeKernel {
+	root, err := ioutil.TempDir("", "krbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	bus := filepath.Join(root, "bus", "rbd")
+	if err := os.MkdirAll(filepath.Join(bus, "devices"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(bus, "add_single_major"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bus, "remove_single_major"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &fakeKernel{t: t, root: root, delay: delay}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go k.serve(stop, done)
+	t.Cleanup(func() {
+		close(stop)
+		// Unblock the pending open of the fifo.
+		if f, err := os.OpenFile(filepath.Join(bus, "add_single_major"), os.O_WRONLY, 0); err == nil {
+			f.Close()
+		}
+		<-done
+	})
+	return k
+}
+
+func (k *fakeKernel) serve(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		// The writer stays blocked until the fifo is read.
+		time.Sleep(k.delay)
+		data, err := ioutil.ReadFile(filepath.Join(k.root, "bus", "rbd", "add_single_major"))
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			k.t.Errorf("read add: %v", err)
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+		k.mu.Lock()
+		k.requests = append(k.requests, string(data))
+		id := k.next
+		k.next++
+		k.mu.Unlock()
+
+		fields := strings.Fields(string(data))
+		k.addDevice(id, fields[2], fields[3], fields[4])
+	}
+}
+
+func (k *fakeKernel) addDevice(id int, pool string, image string, snap string) {
+	dir := filepath.Join(k.root, "bus", "rbd", "devices", strconv.Itoa(id))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		k.t.Error(err)
+		return
+	}
+	for name, value := range map[string]string{"pool": pool, "name": image, "current_snap": snap} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0644); err != nil {
+			k.t.Error(err)
+		}
+	}
+}
+
+func (k *fakeKernel) lastRequest() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.requests) == 0 {
+		return ""
+	}
+	return k.requests[len(k.requests)-1]
+}
+
+func (k *fakeKernel) removed() string {
+	data, _ := ioutil.ReadFile(filepath.Join(k.root, "bus", "rbd", "remove_single_major"))
+	return string(data)
+}
+
+var testOptions = Options{Monitors: []string{"10.0.0.1:6789", "10.0.0.2:6789"}, User: "admin", Secret: "AQBkey=="}
+
+func TestMap(t *testing.T) {
+	readOnly := testOptions
+	readOnly.ReadOnly = true
+	noMonitors := testOptions
+	noMonitors.Monitors = nil
+
+	tests := []struct {
+		name    string
+		pool    string
+		image   string
+		snap    string
+		opts    Options
+		request string
+		err     error
+	}{
+		{"head", "rbd", "vol", "", testOptions,
+			"10.0.0.1:6789,10.0.0.2:6789 name=admin,secret=AQBkey== rbd vol -", nil},
+		{"snapshot", "rbd", "vol", "snap1", testOptions,
+			"10.0.0.1:6789,10.0.0.2:6789 name=admin,secret=AQBkey== rbd vol snap1", nil},
+		{"read only", "rbd", "vol", "", readOnly,
+			"10.0.0.1:6789,10.0.0.2:6789 name=admin,secret=AQBkey==,ro rbd vol -", nil},
+		{"no monitors", "rbd", "vol", "", noMonitors, "", ErrInvalidOptions},
+		{"space in image", "rbd", "a vol", "", testOptions, "", ErrInvalidOptions},
+		{"comma in pool", "rbd,x", "vol", "", testOptions, "", ErrInvalidOptions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newFakeKernel(t, 0)
+			m := NewManager(k.root)
+			m.SetTimeout(5 * time.Second)
+
+			mapping, err := m.Map(tt.pool, tt.image, tt.snap, tt.opts)
+			if err != tt.err {
+				t.Fatalf("Map = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := k.lastRequest(); got != tt.request {
+				t.Errorf("request %q, want %q", got, tt.request)
+			}
+			want := Mapping{ID: 0, Pool: tt.pool, Image: tt.image, Snap: tt.snap, Device: "/dev/rbd0"}
+			if *mapping != want {
+				t.Errorf("mapping %+v, want %+v", *mapping, want)
+			}
+
+			// A second Map returns the existing device.
+			again, err := m.Map(tt.pool, tt.image, tt.snap, tt.opts)
+			if err != nil || *again != want {
+				t.Errorf("second Map = %+v, %v", again, err)
+			}
+			if found, err := m.LookupDevice("/dev/rbd0"); err != nil || *found != want {
+				t.Errorf("LookupDevice = %+v, %v", found, err)
+			}
+		})
+	}
+}
+
+func TestMapTimeout(t *testing.T) {
+	k := newFakeKernel(t, 300*time.Millisecond)
+	m := NewManager(k.root)
+	m.SetTimeout(50 * time.Millisecond)
+
+	if _, err := m.Map("rbd", "vol", "", testOptions); err != ErrTimeout {
+		t.Fatalf("Map = %v, want %v", err, ErrTimeout)
+	}
+	// The kernel is still mapping the image.
+	if _, err := m.Map("rbd", "vol", "", testOptions); err != ErrTimeout {
+		t.Fatalf("Map while pending = %v, want %v", err, ErrTimeout)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for k.removed() != "0" {
+		if time.Now().After(deadline) {
+			t.Fatalf("late device not unmapped, remove_single_major %q", k.removed())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		m.mu.Lock()
+		pending := m.abandoned[imageKey("rbd", "vol", "")]
+		m.mu.Unlock()
+		if !pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out map still pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUnmap(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      int
+		force   bool
+		request string
+		err     error
+	}{
+		{"unmap", 3, false, "3", nil},
+		{"force", 3, true, "3 force", nil},
+		{"not mapped", 4, false, "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newFakeKernel(t, 0)
+			k.addDevice(3, "rbd", "vol", "-")
+			m := NewManager(k.root)
+
+			if err := m.Unmap(tt.id, tt.force); err != tt.err {
+				t.Fatalf("Unmap = %v, want %v", err, tt.err)
+			}
+			if got := k.removed(); got != tt.request {
+				t.Errorf("remove request %q, want %q", got, tt.request)
+			}
+		})
+	}
+}
+
+func TestMappings(t *testing.T) {
+	k := newFakeKernel(t, 0)
+	k.addDevice(2, "rbd", "b", "-")
+	k.addDevice(0, "rbd", "a", "-")
+	k.addDevice(1, "rbd", "a", "snap1")
+	m := NewManager(k.root)
+
+	mappings, err := m.Mappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Mapping{
+		{ID: 0, Pool: "rbd", Image: "a", Device: "/dev/rbd0"},
+		{ID: 1, Pool: "rbd", Image: "a", Snap: "snap1", Device: "/dev/rbd1"},
+		{ID: 2, Pool: "rbd", Image: "b", Device: "/dev/rbd2"},
+	}
+	if len(mappings) != len(want) {
+		t.Fatalf("%v mappings, want %v", len(mappings), len(want))
+	}
+	for i := range want {
+		if *mappings[i] != want[i] {
+			t.Errorf("mapping %v = %+v, want %+v", i, *mappings[i], want[i])
+		}
+	}
+
+	lookups := []struct {
+		pool, image, snap string
+		id                int
+		err               error
+	}{
+		{"rbd", "a", "", 0, nil},
+		{"rbd", "a", "snap1", 1, nil},
+		{"rbd", "b", "", 2, nil},
+		{"rbd", "c", "", 0, ErrNotFound},
+	}
+	for _, l := range lookups {
+		mapping, err := m.Lookup(l.pool, l.image, l.snap)
+		if err != l.err || err == nil && mapping.ID != l.id {
+			t.Errorf("Lookup(%v, %v, %v) = %+v, %v", l.pool, l.image, l.snap, mapping, err)
+		}
+	}
+}
+
+func TestDeviceID(t *testing.T) {
+	tests := []struct {
+		device string
+		id     int
+		ok     bool
+	}{
+		{"/dev/rbd0", 0, true},
+		{"/dev/rbd12", 12, true},
+		{"/dev/sda", 0, false},
+		{"/dev/rbd", 0, false},
+		{"/dev/rbd-1", 0, false},
+		{"rbd3", 0, false},
+	}
+	for _, tt := range tests {
+		id, err := DeviceID(tt.device)
+		if (err == nil) != tt.ok || id != tt.id {
+			t.Errorf("DeviceID(%q) = %v, %v", tt.device, id, err)
+		}
+	}
+}
@@ -270,6 +270,31 @@ func (c *Conn) MakePool(name string) error {
 	}
 }
 
+// MakePoolWithCrushRule creates a new pool placed by the given CRUSH rule.
+func (c *Conn) MakePoolWithCrushRule(name string, rule uint8) error {
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+	ret := C.rados_pool_create_with_crush_rule(c.cluster, c_name, C.uint8_t(rule))
+	if ret == 0 {
+		return nil
+	} else {
+		return GetError(ret)
+	}
+}
+
+// MakePoolWithAll creates a new pool owned by auid and placed by the given
+// CRUSH rule.
+func (c *Conn) MakePoolWithAll(name string, auid uint64, rule uint8) error {
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+	ret := C.rados_pool_create_with_all(c.cluster, c_name, C.uint64_t(auid), C.uint8_t(rule))
+	if ret == 0 {
+		return nil
+	} else {
+		return GetError(ret)
+	}
+}
+
 // DeletePool deletes a pool and all the data inside the pool.
 func (c *Conn) DeletePool(name string) error {
 	c_name := C.CString(name)
@@ -72,6 +72,12 @@ func (ioctx *IOContext) Pointer() uintptr {
 	return uintptr(ioctx.ioctx)
 }
 
+// UnsafePointer returns the rados_ioctx_t of the IOContext, for the
+// bindings of other Ceph libraries such as librbd.
+func (ioctx *IOContext) UnsafePointer() unsafe.Pointer {
+	return unsafe.Pointer(ioctx.ioctx)
+}
+
 // SetNamespace sets the namespace for objects within this IO context (pool).
 // Setting namespace to a empty or zero length string sets the pool to the default namespace.
 func (ioctx *IOContext) SetNamespace(namespace string) {
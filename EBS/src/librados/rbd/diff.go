@@ -0,0 +1,58 @@
+package rbd
+
+// #include <stddef.h>
+// #include <stdint.h>
+import "C"
+
+import (
+	"sync"
+)
+
+// DiffFunc receives one extent reported by DiffIterate. exists is false when
+// the extent has become a hole, for example because it was discarded.
+// Returning an error stops the iteration and DiffIterate returns it.
+type DiffFunc func(offset uint64, length uint64, exists bool) error
+
+type diffCall struct {
+	cb  DiffFunc
+	err error
+}
+
+var diffLock sync.Mutex
+var diffCalls = make(map[uintptr]*diffCall)
+var diffNext uintptr
+
+// registerDiff stores cb under a handle that can be passed through C as the
+// callback data pointer, in the same way as registerProgress.
+func registerDiff(cb DiffFunc) (uintptr, *diffCall) {
+	diffLock.Lock()
+	defer diffLock.Unlock()
+
+	diffNext++
+	call := &diffCall{cb: cb}
+	diffCalls[diffNext] = call
+	return diffNext, call
+}
+
+func unregisterDiff(handle uintptr) {
+	diffLock.Lock()
+	defer diffLock.Unlock()
+
+	delete(diffCalls, handle)
+}
+
+//export rbdDiffCallback
+func rbdDiffCallback(offset C.uint64_t, length C.size_t, exists C.int, handle C.uintptr_t) C.int {
+	diffLock.Lock()
+	call := diffCalls[uintptr(handle)]
+	diffLock.Unlock()
+
+	if call == nil || call.err != nil {
+		return -1
+	}
+	if err := call.cb(uint64(offset), uint64(length), exists != 0); err != nil {
+		call.err = err
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+package rbd
+
+// #include <stdint.h>
+import "C"
+
+import (
+	"sync"
+)
+
+// ProgressFunc receives the progress of a long-running librbd operation.
+// It is called from librbd threads and must not block.
+type ProgressFunc func(offset uint64, total uint64)
+
+var progressLock sync.Mutex
+var progressFuncs = make(map[uintptr]ProgressFunc)
+var progressNext uintptr
+
+// registerProgress stores cb under a handle that can be passed through C as
+// the callback data pointer, since Go pointers may not be kept by C.
+func registerProgress(cb ProgressFunc) uintptr {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+
+	progressNext++
+	progressFuncs[progressNext] = cb
+	return progressNext
+}
+
+func unregisterProgress(handle uintptr) {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+
+	delete(progressFuncs, handle)
+}
+
+//export rbdProgressCallback
+func rbdProgressCallback(offset C.uint64_t, total C.uint64_t, handle C.uintptr_t) C.int {
+	progressLock.Lock()
+	cb := progressFuncs[uintptr(handle)]
+	progressLock.Unlock()
+
+	if cb != nil {
+		cb(uint64(offset), uint64(total))
+	}
+	return 0
+}
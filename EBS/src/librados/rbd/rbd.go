@@ -6,6 +6,43 @@ package rbd
 // #include <stdlib.h>
 // #include "rados/librados.h"
 // #include "rbd/librbd.h"
+//
+// extern int rbdProgressCallback(uint64_t offset, uint64_t total, uintptr_t handle);
+//
+// static int progress_trampoline(uint64_t offset, uint64_t total, void *ptr) {
+// 	return rbdProgressCallback(offset, total, (uintptr_t)ptr);
+// }
+//
+// static int do_resize_with_progress(rbd_image_t image, uint64_t size, uintptr_t handle) {
+// 	return rbd_resize_with_progress(image, size, progress_trampoline, (void *)handle);
+// }
+//
+// static int do_copy_with_progress(rbd_image_t image, rados_ioctx_t dest_p,
+// 		const char *destname, uintptr_t handle) {
+// 	return rbd_copy_with_progress(image, dest_p, destname, progress_trampoline, (void *)handle);
+// }
+//
+// static int do_remove_with_progress(rados_ioctx_t io, const char *name, uintptr_t handle) {
+// 	return rbd_remove_with_progress(io, name, progress_trampoline, (void *)handle);
+// }
+//
+// extern int rbdDiffCallback(uint64_t offset, size_t length, int exists, uintptr_t handle);
+//
+// static int diff_trampoline(uint64_t offset, size_t length, int exists, void *ptr) {
+// 	return rbdDiffCallback(offset, length, exists, (uintptr_t)ptr);
+// }
+//
+// static int do_diff_iterate(rbd_image_t image, const char *fromsnapname,
+// 		uint64_t ofs, uint64_t len, uintptr_t handle) {
+// 	return rbd_diff_iterate(image, fromsnapname, ofs, len, diff_trampoline, (void *)handle);
+// }
+//
+// static int do_diff_iterate2(rbd_image_t image, const char *fromsnapname,
+// 		uint64_t ofs, uint64_t len, uint8_t include_parent, uint8_t whole_object,
+// 		uintptr_t handle) {
+// 	return rbd_diff_iterate2(image, fromsnapname, ofs, len, include_parent, whole_object,
+// 		diff_trampoline, (void *)handle);
+// }
 import "C"
 
 import (
@@ -28,6 +65,29 @@ var RbdErrorProtected = errors.New("Device or resource busy")
 //Rdb feature
 var RbdFeatureLayering = uint64(1 << 0)
 var RbdFeatureStripingV2 = uint64(1 << 1)
+var RbdFeatureExclusiveLock = uint64(1 << 2)
+var RbdFeatureObjectMap = uint64(1 << 3)
+var RbdFeatureFastDiff = uint64(1 << 4)
+var RbdFeatureDeepFlatten = uint64(1 << 5)
+var RbdFeatureJournaling = uint64(1 << 6)
+var RbdFeatureDataPool = uint64(1 << 7)
+
+// Image options, the optname of the rbd_image_options_* functions.
+// RbdImageOptionDataPool is newer than the bundled librbd.h and needs a
+// Kraken or later librbd at run time.
+const (
+	RbdImageOptionFormat            = 0
+	RbdImageOptionFeatures          = 1
+	RbdImageOptionOrder             = 2
+	RbdImageOptionStripeUnit        = 3
+	RbdImageOptionStripeCount       = 4
+	RbdImageOptionJournalOrder      = 5
+	RbdImageOptionJournalSplayWidth = 6
+	RbdImageOptionJournalPool       = 7
+	RbdImageOptionFeaturesSet       = 8
+	RbdImageOptionFeaturesClear     = 9
+	RbdImageOptionDataPool          = 10
+)
 
 //
 type ImageInfo struct {
@@ -161,7 +221,7 @@ func Create(ioctx *rados.IOContext, name string, size uint64, order int,
 	defer C.free(unsafe.Pointer(c_name))
 
 	switch len(args) {
-	case 2:
+	case 3:
 		ret = C.rbd_create3(C.rados_ioctx_t(ioctx.Pointer()),
 			c_name, C.uint64_t(size),
 			C.uint64_t(args[0]), &c_order,
@@ -187,6 +247,126 @@ func Create(ioctx *rados.IOContext, name string, size uint64, order int,
 	}, nil
 }
 
+// ImageOptions holds the options of rbd_create4. It must be destroyed
+// after use.
+type ImageOptions struct {
+	options C.rbd_image_options_t
+}
+
+// void rbd_image_options_create(rbd_image_options_t* opts);
+func NewRbdImageOptions() *ImageOptions {
+	opts := &ImageOptions{}
+	C.rbd_image_options_create(&opts.options)
+	return opts
+}
+
+// void rbd_image_options_destroy(rbd_image_options_t opts);
+func (opts *ImageOptions) Destroy() {
+	C.rbd_image_options_destroy(opts.options)
+}
+
+// int rbd_image_options_set_string(rbd_image_options_t opts, int optname,
+//          const char* optval);
+func (opts *ImageOptions) SetString(optname int, optval string) error {
+	c_optval := C.CString(optval)
+	defer C.free(unsafe.Pointer(c_optval))
+
+	ret := C.rbd_image_options_set_string(opts.options, C.int(optname), c_optval)
+	if ret < 0 {
+		return RBDError(int(ret))
+	}
+	return nil
+}
+
+// int rbd_image_options_set_uint64(rbd_image_options_t opts, int optname,
+//          uint64_t optval);
+func (opts *ImageOptions) SetUint64(optname int, optval uint64) error {
+	ret := C.rbd_image_options_set_uint64(opts.options, C.int(optname), C.uint64_t(optval))
+	if ret < 0 {
+		return RBDError(int(ret))
+	}
+	return nil
+}
+
+// int rbd_image_options_get_string(rbd_image_options_t opts, int optname,
+//          char* optval, size_t maxlen);
+func (opts *ImageOptions) GetString(optname int) (string, error) {
+	size := C.size_t(256)
+	for {
+		c_optval := (*C.char)(C.malloc(size))
+		ret := C.rbd_image_options_get_string(opts.options, C.int(optname), c_optval, size)
+		if ret == -C.ERANGE && size < 65536 {
+			C.free(unsafe.Pointer(c_optval))
+			size *= 2
+			continue
+		}
+		defer C.free(unsafe.Pointer(c_optval))
+		if ret < 0 {
+			return "", GetError(ret)
+		}
+		return C.GoString(c_optval), nil
+	}
+}
+
+// int rbd_image_options_get_uint64(rbd_image_options_t opts, int optname,
+//          uint64_t* optval);
+func (opts *ImageOptions) GetUint64(optname int) (uint64, error) {
+	var c_optval C.uint64_t
+	ret := C.rbd_image_options_get_uint64(opts.options, C.int(optname), &c_optval)
+	if ret < 0 {
+		return 0, GetError(ret)
+	}
+	return uint64(c_optval), nil
+}
+
+// int rbd_image_options_is_set(rbd_image_options_t opts, int optname,
+//          bool* is_set);
+func (opts *ImageOptions) IsSet(optname int) (bool, error) {
+	var c_set C.bool
+	ret := C.rbd_image_options_is_set(opts.options, C.int(optname), &c_set)
+	if ret < 0 {
+		return false, RBDError(int(ret))
+	}
+	return bool(c_set), nil
+}
+
+// int rbd_image_options_unset(rbd_image_options_t opts, int optname);
+func (opts *ImageOptions) Unset(optname int) error {
+	ret := C.rbd_image_options_unset(opts.options, C.int(optname))
+	if ret < 0 {
+		return RBDError(int(ret))
+	}
+	return nil
+}
+
+// void rbd_image_options_clear(rbd_image_options_t opts);
+func (opts *ImageOptions) Clear() {
+	C.rbd_image_options_clear(opts.options)
+}
+
+// int rbd_image_options_is_empty(rbd_image_options_t opts);
+func (opts *ImageOptions) IsEmpty() bool {
+	return C.rbd_image_options_is_empty(opts.options) != 0
+}
+
+// int rbd_create4(rados_ioctx_t io, const char *name, uint64_t size,
+//          rbd_image_options_t opts);
+func Create4(ioctx *rados.IOContext, name string, size uint64, opts *ImageOptions) (image *Image, err error) {
+	var c_name *C.char = C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	ret := C.rbd_create4(C.rados_ioctx_t(ioctx.UnsafePointer()),
+		c_name, C.uint64_t(size), opts.options)
+	if ret < 0 {
+		return nil, GetError(ret)
+	}
+
+	return &Image{
+		ioctx: ioctx,
+		name:  name,
+	}, nil
+}
+
 // int rbd_clone(rados_ioctx_t p_ioctx, const char *p_name,
 //           const char *p_snapname, rados_ioctx_t c_ioctx,
 //           const char *c_name, uint64_t features, int *c_order);
@@ -226,6 +406,19 @@ func (image *Image) Remove() error {
 	return GetError(C.rbd_remove(C.rados_ioctx_t(image.ioctx.Pointer()), c_name))
 }
 
+// int rbd_remove_with_progress(rados_ioctx_t io, const char *name,
+//                  librbd_progress_fn_t cb, void *cbdata);
+func (image *Image) RemoveWithProgress(cb ProgressFunc) error {
+	var c_name *C.char = C.CString(image.name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	handle := registerProgress(cb)
+	defer unregisterProgress(handle)
+
+	return GetError(C.do_remove_with_progress(C.rados_ioctx_t(image.ioctx.UnsafePointer()),
+		c_name, C.uintptr_t(handle)))
+}
+
 // int rbd_rename(rados_ioctx_t src_io_ctx, const char *srcname, const char *destname);
 func (image *Image) Rename(destname string) error {
 	var c_srcname *C.char = C.CString(image.name)
@@ -302,6 +495,19 @@ func (image *Image) Resize(size uint64) error {
 	return GetError(C.rbd_resize(image.image, C.uint64_t(size)))
 }
 
+// int rbd_resize_with_progress(rbd_image_t image, uint64_t size,
+//                  librbd_progress_fn_t cb, void *cbdata);
+func (image *Image) ResizeWithProgress(size uint64, cb ProgressFunc) error {
+	if image.image == nil {
+		return RbdErrorImageNotOpen
+	}
+
+	handle := registerProgress(cb)
+	defer unregisterProgress(handle)
+
+	return GetError(C.do_resize_with_progress(image.image, C.uint64_t(size), C.uintptr_t(handle)))
+}
+
 // int rbd_stat(rbd_image_t image, rbd_image_info_t *info, size_t infosize);
 func (image *Image) Stat() (info *ImageInfo, err error) {
 	if image.image == nil {
@@ -371,6 +577,24 @@ func (image *Image) GetFeatures() (features uint64, err error) {
 	return features, nil
 }
 
+// int rbd_update_features(rbd_image_t image, uint64_t features,
+//          uint8_t enabled);
+func (image *Image) UpdateFeatures(features uint64, enabled bool) error {
+	if image.image == nil {
+		return RbdErrorImageNotOpen
+	}
+
+	var c_enabled C.uint8_t
+	if enabled {
+		c_enabled = 1
+	}
+	ret := C.rbd_update_features(image.image, C.uint64_t(features), c_enabled)
+	if ret < 0 {
+		return GetError(ret)
+	}
+	return nil
+}
+
 // int rbd_get_stripe_unit(rbd_image_t image, uint64_t *stripe_unit);
 func (image *Image) GetStripeUnit() (stripe_unit uint64, err error) {
 	if image.image == nil {
@@ -470,6 +694,23 @@ func (image *Image) Copy(args ...interface{}) error {
 	}
 }
 
+// int rbd_copy_with_progress(rbd_image_t image, rados_ioctx_t dest_p, const char *destname,
+//                librbd_progress_fn_t cb, void *cbdata);
+func (image *Image) CopyWithProgress(ioctx *rados.IOContext, destname string, cb ProgressFunc) error {
+	if image.image == nil {
+		return RbdErrorImageNotOpen
+	}
+
+	var c_destname *C.char = C.CString(destname)
+	defer C.free(unsafe.Pointer(c_destname))
+
+	handle := registerProgress(cb)
+	defer unregisterProgress(handle)
+
+	return GetError(C.do_copy_with_progress(image.image, C.rados_ioctx_t(ioctx.UnsafePointer()),
+		c_destname, C.uintptr_t(handle)))
+}
+
 // int rbd_flatten(rbd_image_t image);
 func (image *Image) Flatten() error {
 	if image.image == nil {
@@ -642,15 +883,183 @@ func (image *Image) BreakLock(client string, cookie string) error {
 	return GetError(C.rbd_break_lock(image.image, c_client, c_cookie))
 }
 
+// int rbd_metadata_get(rbd_image_t image, const char *key, char *value, size_t *val_len);
+func (image *Image) GetMetadata(key string) (string, error) {
+	if image.image == nil {
+		return "", RbdErrorImageNotOpen
+	}
+
+	c_key := C.CString(key)
+	defer C.free(unsafe.Pointer(c_key))
+
+	//值超过缓冲区时返回ERANGE，val_len为所需长度
+	size := C.size_t(256)
+	for {
+		c_value := (*C.char)(C.malloc(size))
+		c_len := size
+		ret := C.rbd_metadata_get(image.image, c_key, c_value, &c_len)
+		if ret == -C.ERANGE && c_len > size {
+			C.free(unsafe.Pointer(c_value))
+			size = c_len
+			continue
+		}
+		defer C.free(unsafe.Pointer(c_value))
+		if ret < 0 {
+			return "", GetError(ret)
+		}
+		return C.GoString(c_value), nil
+	}
+}
+
+// int rbd_metadata_set(rbd_image_t image, const char *key, const char *value);
+func (image *Image) SetMetadata(key string, value string) error {
+	if image.image == nil {
+		return RbdErrorImageNotOpen
+	}
+
+	c_key := C.CString(key)
+	c_value := C.CString(value)
+	defer C.free(unsafe.Pointer(c_key))
+	defer C.free(unsafe.Pointer(c_value))
+
+	return GetError(C.rbd_metadata_set(image.image, c_key, c_value))
+}
+
+// int rbd_metadata_remove(rbd_image_t image, const char *key);
+func (image *Image) RemoveMetadata(key string) error {
+	if image.image == nil {
+		return RbdErrorImageNotOpen
+	}
+
+	c_key := C.CString(key)
+	defer C.free(unsafe.Pointer(c_key))
+
+	return GetError(C.rbd_metadata_remove(image.image, c_key))
+}
+
+// int rbd_metadata_list(rbd_image_t image, const char *start, uint64_t max,
+//          char *keys, size_t *key_len, char *values, size_t *vals_len);
+func (image *Image) ListMetadata() (map[string]string, error) {
+	if image.image == nil {
+		return nil, RbdErrorImageNotOpen
+	}
+
+	c_start := C.CString("")
+	defer C.free(unsafe.Pointer(c_start))
+
+	//缓冲区不足时返回ERANGE并填入所需长度
+	keys_size, vals_size := C.size_t(4096), C.size_t(4096)
+	for {
+		c_keys := (*C.char)(C.malloc(keys_size))
+		c_vals := (*C.char)(C.malloc(vals_size))
+		c_keys_len, c_vals_len := keys_size, vals_size
+		ret := C.rbd_metadata_list(image.image, c_start, 0, c_keys, &c_keys_len, c_vals, &c_vals_len)
+		var keys_buf, vals_buf []byte
+		if ret >= 0 {
+			keys_buf = C.GoBytes(unsafe.Pointer(c_keys), C.int(c_keys_len))
+			vals_buf = C.GoBytes(unsafe.Pointer(c_vals), C.int(c_vals_len))
+		}
+		C.free(unsafe.Pointer(c_keys))
+		C.free(unsafe.Pointer(c_vals))
+		if ret == -C.ERANGE {
+			if c_keys_len <= keys_size && c_vals_len <= vals_size {
+				return nil, RBDError(int(ret))
+			}
+			if c_keys_len > keys_size {
+				keys_size = c_keys_len
+			}
+			if c_vals_len > vals_size {
+				vals_size = c_vals_len
+			}
+			continue
+		}
+		if ret < 0 {
+			return nil, GetError(ret)
+		}
+
+		metadata := make(map[string]string)
+		if c_keys_len == 0 {
+			return metadata, nil
+		}
+		//每个键和值后都有一个'\0'，值可以为空
+		keys := bytes.Split(keys_buf[:c_keys_len-1], []byte{0})
+		values := bytes.Split(vals_buf[:c_vals_len-1], []byte{0})
+		for i, key := range keys {
+			if len(key) == 0 || i >= len(values) {
+				continue
+			}
+			metadata[string(key)] = string(values[i])
+		}
+		return metadata, nil
+	}
+}
+
+// int rbd_diff_iterate(rbd_image_t image,
+//              const char *fromsnapname,
+//              uint64_t ofs, uint64_t len,
+//              int (*cb)(uint64_t, size_t, int, void *), void *arg);
+func (image *Image) DiffIterate(fromsnapname string, ofs uint64, length uint64, cb DiffFunc) error {
+	if image.image == nil {
+		return RbdErrorImageNotOpen
+	}
+
+	var c_fromsnapname *C.char
+	if fromsnapname != "" {
+		c_fromsnapname = C.CString(fromsnapname)
+		defer C.free(unsafe.Pointer(c_fromsnapname))
+	}
+
+	handle, call := registerDiff(cb)
+	defer unregisterDiff(handle)
+
+	ret := C.do_diff_iterate(image.image, c_fromsnapname, C.uint64_t(ofs), C.uint64_t(length), C.uintptr_t(handle))
+	if call.err != nil {
+		return call.err
+	}
+	return GetError(ret)
+}
+
+// int rbd_diff_iterate2(rbd_image_t image,
+//              const char *fromsnapname,
+//              uint64_t ofs, uint64_t len,
+//              uint8_t include_parent, uint8_t whole_object,
+//              int (*cb)(uint64_t, size_t, int, void *), void *arg);
+func (image *Image) DiffIterate2(fromsnapname string, ofs uint64, length uint64,
+	includeParent bool, wholeObject bool, cb DiffFunc) error {
+	if image.image == nil {
+		return RbdErrorImageNotOpen
+	}
+
+	var c_fromsnapname *C.char
+	if fromsnapname != "" {
+		c_fromsnapname = C.CString(fromsnapname)
+		defer C.free(unsafe.Pointer(c_fromsnapname))
+	}
+
+	var c_include_parent, c_whole_object C.uint8_t
+	if includeParent {
+		c_include_parent = 1
+	}
+	if wholeObject {
+		c_whole_object = 1
+	}
+
+	handle, call := registerDiff(cb)
+	defer unregisterDiff(handle)
+
+	ret := C.do_diff_iterate2(image.image, c_fromsnapname, C.uint64_t(ofs), C.uint64_t(length),
+		c_include_parent, c_whole_object, C.uintptr_t(handle))
+	if call.err != nil {
+		return call.err
+	}
+	return GetError(ret)
+}
+
 // ssize_t rbd_read(rbd_image_t image, uint64_t ofs, size_t len, char *buf);
 // TODO: int64_t rbd_read_iterate(rbd_image_t image, uint64_t ofs, size_t len,
 //              int (*cb)(uint64_t, size_t, const char *, void *), void *arg);
 // TODO: int rbd_read_iterate2(rbd_image_t image, uint64_t ofs, uint64_t len,
 //               int (*cb)(uint64_t, size_t, const char *, void *), void *arg);
-// TODO: int rbd_diff_iterate(rbd_image_t image,
-//              const char *fromsnapname,
-//              uint64_t ofs, uint64_t len,
-//              int (*cb)(uint64_t, size_t, int, void *), void *arg);
 func (image *Image) Read(data []byte) (n int, err error) {
 	if image.image == nil {
 		return 0, RbdErrorImageNotOpen
@@ -741,8 +1150,16 @@ func (image *Image) Seek(offset int64, whence int) (int64, error) {
 
 // int rbd_discard(rbd_image_t image, uint64_t ofs, uint64_t len);
 func (image *Image) Discard(ofs uint64, length uint64) error {
-	return RBDError(C.rbd_discard(image.image, C.uint64_t(ofs),
-		C.uint64_t(length)))
+	if image.image == nil {
+		return RbdErrorImageNotOpen
+	}
+
+	ret := C.rbd_discard(image.image, C.uint64_t(ofs), C.uint64_t(length))
+	if ret < 0 {
+		return GetError(ret)
+	}
+
+	return nil
 }
 
 func (image *Image) ReadAt(data []byte, off int64) (n int, err error) {
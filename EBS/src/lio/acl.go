@@ -0,0 +1,191 @@
+package lio
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NodeACL grants one initiator access to a portal group, acls/<iqn>.
+type NodeACL struct {
+	tpg  *TPG
+	WWN  string
+	path string
+}
+
+// CreateNodeACL creates the ACL of initiator wwn.
+func (tpg *TPG) CreateNodeACL(wwn string) (*NodeACL, error) {
+	if !ValidIQN(wwn) {
+		return nil, ErrInvalidWWN
+	}
+
+	acl := tpg.nodeACL(wwn)
+	if err := os.MkdirAll(filepath.Dir(acl.path), 0755); err != nil {
+		return nil, err
+	}
+	if err := mkdir(acl.path); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (tpg *TPG) LookupNodeACL(wwn string) (*NodeACL, error) {
+	if !ValidIQN(wwn) {
+		return nil, ErrInvalidWWN
+	}
+
+	acl := tpg.nodeACL(wwn)
+	if !exists(acl.path) {
+		return nil, ErrNotFound
+	}
+	return acl, nil
+}
+
+func (tpg *TPG) NodeACLs() ([]*NodeACL, error) {
+	names, err := listDirs(filepath.Join(tpg.path, "acls"), "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	acls := make([]*NodeACL, 0, len(names))
+	for _, name := range names {
+		acls = append(acls, tpg.nodeACL(name))
+	}
+	return acls, nil
+}
+
+func (tpg *TPG) nodeACL(wwn string) *NodeACL {
+	return &NodeACL{tpg: tpg, WWN: wwn, path: filepath.Join(tpg.path, "acls", wwn)}
+}
+
+func (acl *NodeACL) Path() string {
+	return acl.path
+}
+
+// SetCHAP sets the CHAP credentials the initiator has to log in with,
+// auth/userid and auth/password. Non empty mutual credentials make the
+// target authenticate itself to the initiator as well. CHAP is only
+// enforced when the portal group's authentication attribute is set.
+func (acl *NodeACL) SetCHAP(userid string, password string, mutualUserid string, mutualPassword string) error {
+	attrs := []struct{ name, value string }{
+		{"userid", userid},
+		{"password", password},
+		{"userid_mutual", mutualUserid},
+		{"password_mutual", mutualPassword},
+	}
+	for _, attr := range attrs {
+		if err := acl.tpg.target.root.writeAttr(filepath.Join(acl.path, "auth", attr.name), attr.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CHAPUser returns the CHAP user name of the initiator, empty if none.
+func (acl *NodeACL) CHAPUser() (string, error) {
+	userid, err := readAttr(filepath.Join(acl.path, "auth", "userid"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return userid, err
+}
+
+// Delete removes the ACL and its mapped LUNs.
+func (acl *NodeACL) Delete() error {
+	mluns, err := acl.MappedLUNs()
+	if err != nil {
+		return err
+	}
+	for _, mlun := range mluns {
+		if err := mlun.Delete(); err != nil {
+			return err
+		}
+	}
+	return acl.tpg.target.root.rmdir(acl.path)
+}
+
+// MappedLUN makes a portal group LUN visible to an initiator, under its
+// own LUN number, acls/<iqn>/lun_N.
+type MappedLUN struct {
+	acl    *NodeACL
+	Index  int
+	TPGLun int
+	path   string
+}
+
+// CreateMappedLUN maps the portal group LUN lun as number index for the
+// initiator.
+func (acl *NodeACL) CreateMappedLUN(index int, lun *LUN, writeProtect bool) (*MappedLUN, error) {
+	if index < 0 {
+		return nil, ErrInvalidName
+	}
+	if !exists(lun.path) {
+		return nil, ErrNotFound
+	}
+
+	mlun := &MappedLUN{acl: acl, Index: index, TPGLun: lun.Index, path: filepath.Join(acl.path, lunPrefix+strconv.Itoa(index))}
+	if err := mkdir(mlun.path); err != nil {
+		return nil, err
+	}
+
+	alias, err := randomHex(5)
+	if err == nil {
+		err = os.Symlink(lun.path, filepath.Join(mlun.path, alias))
+	}
+	if err == nil {
+		wp := "0"
+		if writeProtect {
+			wp = "1"
+		}
+		err = acl.tpg.target.root.writeAttr(filepath.Join(mlun.path, "write_protect"), wp)
+	}
+	if err != nil {
+		mlun.Delete()
+		return nil, err
+	}
+	return mlun, nil
+}
+
+func (acl *NodeACL) MappedLUNs() ([]*MappedLUN, error) {
+	names, err := listDirs(acl.path, lunPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var mluns []*MappedLUN
+	for _, name := range names {
+		index, err := strconv.Atoi(strings.TrimPrefix(name, lunPrefix))
+		if err != nil {
+			continue
+		}
+		mlun := &MappedLUN{acl: acl, Index: index, TPGLun: -1, path: filepath.Join(acl.path, name)}
+		if alias, err := findLink(mlun.path); err == nil {
+			if dest, err := os.Readlink(filepath.Join(mlun.path, alias)); err == nil {
+				if n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dest), lunPrefix)); err == nil {
+					mlun.TPGLun = n
+				}
+			}
+		}
+		mluns = append(mluns, mlun)
+	}
+	sort.Slice(mluns, func(i, j int) bool {
+		return mluns[i].Index < mluns[j].Index
+	})
+	return mluns, nil
+}
+
+func (mlun *MappedLUN) Path() string {
+	return mlun.path
+}
+
+func (mlun *MappedLUN) Delete() error {
+	if alias, err := findLink(mlun.path); err == nil {
+		if err := os.Remove(filepath.Join(mlun.path, alias)); err != nil {
+			return err
+		}
+	}
+	return mlun.acl.tpg.target.root.rmdir(mlun.path)
+}
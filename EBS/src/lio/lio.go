@@ -0,0 +1,176 @@
+// Package lio manages the Linux-IO (LIO) kernel target through configfs,
+// following the object model of rtslib: storage objects, iSCSI targets,
+// target portal groups, LUNs, network portals, node ACLs and mapped LUNs.
+//
+// Every object lives under a Root. The root defaults to the kernel's
+// /sys/kernel/config/target but may point at any directory, in which case
+// the tree is a plain file system that mimics configfs.
+package lio
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const DefaultPath = "/sys/kernel/config/target"
+
+var ErrExist = errors.New("Object already exist")
+var ErrNotFound = errors.New("Object not found")
+var ErrInvalidWWN = errors.New("Invalid WWN")
+var ErrInvalidName = errors.New("Invalid name")
+
+var iqnRegexp = regexp.MustCompile(`^iqn\.[0-9]{4}-[0-9]{2}\.[a-z0-9.-]+(:[a-z0-9.:-]+)?$`)
+
+// Root is the top of a target configfs tree.
+type Root struct {
+	Path string
+
+	// mu serializes allocation of storage object and LUN indexes.
+	mu sync.Mutex
+}
+
+func NewRoot(path string) *Root {
+	if path == "" {
+		path = DefaultPath
+	}
+	return &Root{Path: path}
+}
+
+// fake reports whether the tree is an ordinary directory rather than the
+// kernel configfs. Attribute files of a fake tree have to be removed along
+// with their directory.
+func (r *Root) fake() bool {
+	return filepath.Clean(r.Path) != DefaultPath
+}
+
+func (r *Root) corePath() string {
+	return filepath.Join(r.Path, "core")
+}
+
+// iscsiPath returns the iSCSI fabric directory. Creating it makes the
+// kernel load the iscsi_target_mod fabric module.
+func (r *Root) iscsiPath() (string, error) {
+	path := filepath.Join(r.Path, "iscsi")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func mkdir(path string) error {
+	if err := os.Mkdir(path, 0755); err != nil {
+		if os.IsExist(err) {
+			return ErrExist
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *Root) rmdir(path string) error {
+	err := os.Remove(path)
+	if err != nil && r.fake() && !os.IsNotExist(err) {
+		err = os.RemoveAll(path)
+	}
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// writeAttr writes an attribute. A fake tree has no kernel to populate
+// attribute groups such as attrib/ and param/, so they are created on
+// demand.
+func (r *Root) writeAttr(path string, value string) error {
+	err := ioutil.WriteFile(path, []byte(value), 0644)
+	if err != nil && os.IsNotExist(err) && r.fake() {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, []byte(value), 0644)
+	}
+	return err
+}
+
+func readAttr(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// listDirs returns the names of the sub directories of path that start
+// with prefix.
+func listDirs(path string, prefix string) ([]string, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), prefix) {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// findLink returns the name of the first symlink in path, the storage
+// object or LUN alias used by rtslib.
+func findLink(path string) (string, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			return info.Name(), nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ValidIQN reports whether wwn is a well formed iSCSI qualified name.
+func ValidIQN(wwn string) bool {
+	return len(wwn) <= 223 && iqnRegexp.MatchString(wwn)
+}
+
+// GenerateIQN returns a random IQN under prefix, e.g.
+// "iqn.2003-01.org.linux-iscsi.host:sn.0123456789ab".
+func GenerateIQN(prefix string) (string, error) {
+	serial, err := randomHex(6)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:sn.%s", strings.ToLower(prefix), serial), nil
+}
@@ -0,0 +1,161 @@
+package lio
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRoot returns a root in a temporary directory, a fake configfs.
+func newTestRoot(t *testing.T) *Root {
+	path, err := ioutil.TempDir("", "lio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	return NewRoot(path)
+}
+
+func TestValidIQN(t *testing.T) {
+	tests := []struct {
+		wwn   string
+		valid bool
+	}{
+		{"iqn.2018-01.com.dhcc.ebs", true},
+		{"iqn.2018-01.com.dhcc.ebs:rbd.vol", true},
+		{"iqn.1994-05.com.redhat:a1b2:c3", true},
+		{"iqn.2018-01.com.dhcc.ebs:Vol", false},
+		{"iqn.2018-1.com.dhcc.ebs", false},
+		{"iqn.2018-01.com dhcc", false},
+		{"eui.02004567a425678d", false},
+		{"iqn.2018-01.com.dhcc.ebs:" + strings.Repeat("a", 200), false},
+	}
+	for _, tt := range tests {
+		if got := ValidIQN(tt.wwn); got != tt.valid {
+			t.Errorf("ValidIQN(%q) = %v, want %v", tt.wwn, got, tt.valid)
+		}
+	}
+}
+
+func TestBlockStorageObjects(t *testing.T) {
+	r := newTestRoot(t)
+	tests := []struct {
+		name  string
+		dev   string
+		index int
+		err   error
+	}{
+		{"a", "/dev/rbd0", 0, nil},
+		{"b", "/dev/rbd1", 1, nil},
+		{"a", "/dev/rbd2", 0, ErrExist},
+		{"", "/dev/rbd2", 0, ErrInvalidName},
+		{"c/d", "/dev/rbd2", 0, ErrInvalidName},
+		{"c", "", 0, ErrInvalidName},
+	}
+	for _, tt := range tests {
+		so, err := r.CreateBlockStorageObject(tt.name, tt.dev, false)
+		if err != tt.err {
+			t.Errorf("CreateBlockStorageObject(%q, %q) = %v, want %v", tt.name, tt.dev, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if so.Index != tt.index {
+			t.Errorf("%v got HBA %v, want %v", tt.name, so.Index, tt.index)
+		}
+		if dev, err := so.UdevPath(); err != nil || dev != tt.dev {
+			t.Errorf("%v udev_path = %v, %v", tt.name, dev, err)
+		}
+	}
+
+	// A freed HBA index is reused.
+	a, err := r.LookupBlockStorageObject("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.LookupBlockStorageObject("a"); err != ErrNotFound {
+		t.Errorf("Lookup deleted object = %v", err)
+	}
+	c, err := r.CreateBlockStorageObject("c", "/dev/rbd2", false)
+	if err != nil || c.Index != 0 {
+		t.Errorf("CreateBlockStorageObject(c) = %+v, %v, want HBA 0", c, err)
+	}
+}
+
+func TestTargetLUNs(t *testing.T) {
+	r := newTestRoot(t)
+	const iqn = "iqn.2018-01.com.dhcc.ebs:rbd.vol"
+	const initiator = "iqn.1994-05.com.redhat:client"
+
+	so, err := r.CreateBlockStorageObject("vol", "/dev/rbd0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := r.CreateTarget(iqn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CreateTarget(iqn); err != ErrExist {
+		t.Errorf("CreateTarget twice = %v", err)
+	}
+	if _, err := r.CreateTarget("iqn.bad"); err != ErrInvalidWWN {
+		t.Errorf("CreateTarget(iqn.bad) = %v", err)
+	}
+	tpg, err := target.CreateTPG(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lun, err := tpg.CreateLUN(0, so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked, err := lun.StorageObject()
+	if err != nil || linked.Name != so.Name || linked.Index != so.Index {
+		t.Errorf("StorageObject = %+v, %v", linked, err)
+	}
+
+	acl, err := tpg.CreateNodeACL(initiator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acl.CreateMappedLUN(0, lun, false); err != nil {
+		t.Fatal(err)
+	}
+	mluns, err := acl.MappedLUNs()
+	if err != nil || len(mluns) != 1 || mluns[0].TPGLun != 0 {
+		t.Fatalf("MappedLUNs = %+v, %v", mluns, err)
+	}
+	if err := acl.SetCHAP("user", "password1234", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := acl.CHAPUser(); err != nil || user != "user" {
+		t.Errorf("CHAPUser = %v, %v", user, err)
+	}
+
+	// Deleting the LUN removes the mapped LUNs that point at it.
+	if err := lun.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if mluns, err := acl.MappedLUNs(); err != nil || len(mluns) != 0 {
+		t.Errorf("MappedLUNs after LUN delete = %+v, %v", mluns, err)
+	}
+	if _, err := tpg.LookupLUN(0); err != ErrNotFound {
+		t.Errorf("LookupLUN after delete = %v", err)
+	}
+
+	if err := target.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.LookupTarget(iqn); err != ErrNotFound {
+		t.Errorf("LookupTarget after delete = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(r.Path, "iscsi", iqn)); !os.IsNotExist(err) {
+		t.Errorf("target directory left: %v", err)
+	}
+}
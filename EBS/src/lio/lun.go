@@ -0,0 +1,130 @@
+package lio
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const lunPrefix = "lun_"
+
+// LUN exports a storage object through a portal group, lun/lun_N. The
+// storage object is linked into the LUN directory under a random alias.
+type LUN struct {
+	tpg   *TPG
+	Index int
+	path  string
+}
+
+// CreateLUN exports so as LUN index of the portal group.
+func (tpg *TPG) CreateLUN(index int, so *BlockStorageObject) (*LUN, error) {
+	if index < 0 {
+		return nil, ErrInvalidName
+	}
+	if !exists(so.Path()) {
+		return nil, ErrNotFound
+	}
+
+	lun := tpg.lun(index)
+	if err := os.MkdirAll(filepath.Dir(lun.path), 0755); err != nil {
+		return nil, err
+	}
+	if err := mkdir(lun.path); err != nil {
+		return nil, err
+	}
+
+	alias, err := randomHex(5)
+	if err == nil {
+		err = os.Symlink(so.Path(), filepath.Join(lun.path, alias))
+	}
+	if err != nil {
+		tpg.target.root.rmdir(lun.path)
+		return nil, err
+	}
+	return lun, nil
+}
+
+func (tpg *TPG) LookupLUN(index int) (*LUN, error) {
+	lun := tpg.lun(index)
+	if !exists(lun.path) {
+		return nil, ErrNotFound
+	}
+	return lun, nil
+}
+
+func (tpg *TPG) LUNs() ([]*LUN, error) {
+	names, err := listDirs(filepath.Join(tpg.path, "lun"), lunPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var luns []*LUN
+	for _, name := range names {
+		index, err := strconv.Atoi(strings.TrimPrefix(name, lunPrefix))
+		if err != nil {
+			continue
+		}
+		luns = append(luns, tpg.lun(index))
+	}
+	sort.Slice(luns, func(i, j int) bool {
+		return luns[i].Index < luns[j].Index
+	})
+	return luns, nil
+}
+
+func (tpg *TPG) lun(index int) *LUN {
+	return &LUN{tpg: tpg, Index: index, path: filepath.Join(tpg.path, "lun", lunPrefix+strconv.Itoa(index))}
+}
+
+func (lun *LUN) Path() string {
+	return lun.path
+}
+
+// StorageObject returns the storage object the LUN exports.
+func (lun *LUN) StorageObject() (*BlockStorageObject, error) {
+	alias, err := findLink(lun.path)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := os.Readlink(filepath.Join(lun.path, alias))
+	if err != nil {
+		return nil, err
+	}
+
+	hba := filepath.Base(filepath.Dir(dest))
+	index, err := strconv.Atoi(strings.TrimPrefix(hba, blockPrefix))
+	if err != nil || !strings.HasPrefix(hba, blockPrefix) {
+		return nil, ErrNotFound
+	}
+	return &BlockStorageObject{root: lun.tpg.target.root, Name: filepath.Base(dest), Index: index}, nil
+}
+
+// Delete removes the LUN and every mapped LUN that points at it.
+func (lun *LUN) Delete() error {
+	acls, err := lun.tpg.NodeACLs()
+	if err != nil {
+		return err
+	}
+	for _, acl := range acls {
+		mluns, err := acl.MappedLUNs()
+		if err != nil {
+			return err
+		}
+		for _, mlun := range mluns {
+			if mlun.TPGLun == lun.Index {
+				if err := mlun.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if alias, err := findLink(lun.path); err == nil {
+		if err := os.Remove(filepath.Join(lun.path, alias)); err != nil {
+			return err
+		}
+	}
+	return lun.tpg.target.root.rmdir(lun.path)
+}
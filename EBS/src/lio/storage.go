@@ -0,0 +1,160 @@
+package lio
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// blockPrefix is the HBA directory prefix of the block (iblock) backstore.
+const blockPrefix = "iblock_"
+
+// BlockStorageObject is a block device exported through the iblock
+// backstore, core/iblock_N/<name>. Like rtslib, each object gets an HBA
+// of its own.
+type BlockStorageObject struct {
+	root  *Root
+	Name  string
+	Index int
+}
+
+func (so *BlockStorageObject) hbaPath() string {
+	return filepath.Join(so.root.corePath(), blockPrefix+strconv.Itoa(so.Index))
+}
+
+func (so *BlockStorageObject) Path() string {
+	return filepath.Join(so.hbaPath(), so.Name)
+}
+
+// CreateBlockStorageObject creates and enables a storage object backed by
+// the block device dev, e.g. /dev/rbd0.
+func (r *Root) CreateBlockStorageObject(name string, dev string, readonly bool) (*BlockStorageObject, error) {
+	if !validName(name) || dev == "" {
+		return nil, ErrInvalidName
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	objects, err := r.listStorageObjects()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[int]bool)
+	for _, so := range objects {
+		if so.Name == name {
+			return nil, ErrExist
+		}
+		used[so.Index] = true
+	}
+
+	index := 0
+	for used[index] {
+		index++
+	}
+	so := &BlockStorageObject{root: r, Name: name, Index: index}
+
+	if err := os.MkdirAll(so.hbaPath(), 0755); err != nil {
+		return nil, err
+	}
+	if err := mkdir(so.Path()); err != nil {
+		r.rmdir(so.hbaPath())
+		return nil, err
+	}
+
+	ro := "0"
+	if readonly {
+		ro = "1"
+	}
+	err = so.root.writeAttr(filepath.Join(so.Path(), "control"), "udev_path="+dev)
+	if err == nil {
+		err = so.root.writeAttr(filepath.Join(so.Path(), "control"), "readonly="+ro)
+	}
+	if err == nil {
+		err = so.root.writeAttr(filepath.Join(so.Path(), "udev_path"), dev)
+	}
+	if err == nil {
+		err = so.root.writeAttr(filepath.Join(so.Path(), "enable"), "1")
+	}
+	if err != nil {
+		so.delete()
+		return nil, err
+	}
+	return so, nil
+}
+
+// LookupBlockStorageObject finds a block storage object by name.
+func (r *Root) LookupBlockStorageObject(name string) (*BlockStorageObject, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	objects, err := r.listStorageObjects()
+	if err != nil {
+		return nil, err
+	}
+	for _, so := range objects {
+		if so.Name == name {
+			return so, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// BlockStorageObjects lists the block storage objects, sorted by name.
+func (r *Root) BlockStorageObjects() ([]*BlockStorageObject, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.listStorageObjects()
+}
+
+// listStorageObjects must be called with r.mu held.
+func (r *Root) listStorageObjects() ([]*BlockStorageObject, error) {
+	hbas, err := listDirs(r.corePath(), blockPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*BlockStorageObject
+	for _, hba := range hbas {
+		index, err := strconv.Atoi(strings.TrimPrefix(hba, blockPrefix))
+		if err != nil {
+			continue
+		}
+		names, err := listDirs(filepath.Join(r.corePath(), hba), "")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			objects = append(objects, &BlockStorageObject{root: r, Name: name, Index: index})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+// UdevPath returns the backing device.
+func (so *BlockStorageObject) UdevPath() (string, error) {
+	return readAttr(filepath.Join(so.Path(), "udev_path"))
+}
+
+// Delete removes the storage object. LUNs that export it must have been
+// deleted first.
+func (so *BlockStorageObject) Delete() error {
+	so.root.mu.Lock()
+	defer so.root.mu.Unlock()
+	return so.delete()
+}
+
+func (so *BlockStorageObject) delete() error {
+	if err := so.root.rmdir(so.Path()); err != nil {
+		return err
+	}
+	if err := so.root.rmdir(so.hbaPath()); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
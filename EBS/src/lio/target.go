@@ -0,0 +1,304 @@
+package lio
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const tpgPrefix = "tpgt_"
+
+// Target is an iSCSI target, iscsi/<iqn>.
+type Target struct {
+	root *Root
+	WWN  string
+	path string
+}
+
+// CreateTarget creates the iSCSI target wwn.
+func (r *Root) CreateTarget(wwn string) (*Target, error) {
+	if !ValidIQN(wwn) {
+		return nil, ErrInvalidWWN
+	}
+
+	fabric, err := r.iscsiPath()
+	if err != nil {
+		return nil, err
+	}
+	t := &Target{root: r, WWN: wwn, path: filepath.Join(fabric, wwn)}
+	if err := mkdir(t.path); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LookupTarget finds an existing iSCSI target.
+func (r *Root) LookupTarget(wwn string) (*Target, error) {
+	if !ValidIQN(wwn) {
+		return nil, ErrInvalidWWN
+	}
+
+	t := &Target{root: r, WWN: wwn, path: filepath.Join(r.Path, "iscsi", wwn)}
+	if !exists(t.path) {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// Targets lists the iSCSI targets, sorted by WWN.
+func (r *Root) Targets() ([]*Target, error) {
+	fabric := filepath.Join(r.Path, "iscsi")
+	names, err := listDirs(fabric, "iqn.")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	targets := make([]*Target, 0, len(names))
+	for _, name := range names {
+		targets = append(targets, &Target{root: r, WWN: name, path: filepath.Join(fabric, name)})
+	}
+	return targets, nil
+}
+
+func (t *Target) Path() string {
+	return t.path
+}
+
+// CreateTPG creates the target portal group tag, numbered from 1.
+func (t *Target) CreateTPG(tag int) (*TPG, error) {
+	if tag < 1 {
+		return nil, ErrInvalidName
+	}
+	tpg := t.tpg(tag)
+	if err := mkdir(tpg.path); err != nil {
+		return nil, err
+	}
+	return tpg, nil
+}
+
+func (t *Target) LookupTPG(tag int) (*TPG, error) {
+	tpg := t.tpg(tag)
+	if !exists(tpg.path) {
+		return nil, ErrNotFound
+	}
+	return tpg, nil
+}
+
+func (t *Target) TPGs() ([]*TPG, error) {
+	names, err := listDirs(t.path, tpgPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var tpgs []*TPG
+	for _, name := range names {
+		tag, err := strconv.Atoi(strings.TrimPrefix(name, tpgPrefix))
+		if err != nil {
+			continue
+		}
+		tpgs = append(tpgs, t.tpg(tag))
+	}
+	sort.Slice(tpgs, func(i, j int) bool {
+		return tpgs[i].Tag < tpgs[j].Tag
+	})
+	return tpgs, nil
+}
+
+func (t *Target) tpg(tag int) *TPG {
+	return &TPG{target: t, Tag: tag, path: filepath.Join(t.path, tpgPrefix+strconv.Itoa(tag))}
+}
+
+// Delete removes the target together with all its TPGs.
+func (t *Target) Delete() error {
+	tpgs, err := t.TPGs()
+	if err != nil {
+		return err
+	}
+	for _, tpg := range tpgs {
+		if err := tpg.Delete(); err != nil {
+			return err
+		}
+	}
+	return t.root.rmdir(t.path)
+}
+
+// TPG is a target portal group, iscsi/<iqn>/tpgt_N.
+type TPG struct {
+	target *Target
+	Tag    int
+	path   string
+}
+
+func (tpg *TPG) Path() string {
+	return tpg.path
+}
+
+func (tpg *TPG) Target() *Target {
+	return tpg.target
+}
+
+// SetEnable enables or disables the portal group.
+func (tpg *TPG) SetEnable(enable bool) error {
+	value := "0"
+	if enable {
+		value = "1"
+	}
+	return tpg.target.root.writeAttr(filepath.Join(tpg.path, "enable"), value)
+}
+
+func (tpg *TPG) Enabled() (bool, error) {
+	value, err := readAttr(filepath.Join(tpg.path, "enable"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return value == "1", nil
+}
+
+// SetAttribute writes attrib/<name>, e.g. generate_node_acls.
+func (tpg *TPG) SetAttribute(name string, value string) error {
+	return tpg.target.root.writeAttr(filepath.Join(tpg.path, "attrib", name), value)
+}
+
+func (tpg *TPG) Attribute(name string) (string, error) {
+	return readAttr(filepath.Join(tpg.path, "attrib", name))
+}
+
+// SetParameter writes param/<name>, e.g. AuthMethod.
+func (tpg *TPG) SetParameter(name string, value string) error {
+	return tpg.target.root.writeAttr(filepath.Join(tpg.path, "param", name), value)
+}
+
+func (tpg *TPG) Parameter(name string) (string, error) {
+	return readAttr(filepath.Join(tpg.path, "param", name))
+}
+
+// SetAuthentication turns CHAP on or off for every initiator of the
+// portal group, like rtslib's set_attribute("authentication", ...).
+func (tpg *TPG) SetAuthentication(enable bool) error {
+	value, method := "0", "None"
+	if enable {
+		value, method = "1", "CHAP"
+	}
+	if err := tpg.SetAttribute("authentication", value); err != nil {
+		return err
+	}
+	return tpg.SetParameter("AuthMethod", method)
+}
+
+func (tpg *TPG) Authentication() (bool, error) {
+	value, err := tpg.Attribute("authentication")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return value == "1", nil
+}
+
+// Delete disables the portal group and removes its ACLs, LUNs and portals
+// before the group itself, in the order configfs requires.
+func (tpg *TPG) Delete() error {
+	if exists(filepath.Join(tpg.path, "enable")) {
+		if err := tpg.SetEnable(false); err != nil {
+			return err
+		}
+	}
+
+	acls, err := tpg.NodeACLs()
+	if err != nil {
+		return err
+	}
+	for _, acl := range acls {
+		if err := acl.Delete(); err != nil {
+			return err
+		}
+	}
+
+	luns, err := tpg.LUNs()
+	if err != nil {
+		return err
+	}
+	for _, lun := range luns {
+		if err := lun.Delete(); err != nil {
+			return err
+		}
+	}
+
+	portals, err := tpg.NetworkPortals()
+	if err != nil {
+		return err
+	}
+	for _, np := range portals {
+		if err := np.Delete(); err != nil {
+			return err
+		}
+	}
+
+	return tpg.target.root.rmdir(tpg.path)
+}
+
+// NetworkPortal is an address the portal group listens on, np/<ip>:<port>.
+type NetworkPortal struct {
+	tpg  *TPG
+	IP   string
+	Port int
+	path string
+}
+
+func portalName(ip string, port int) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("[%s]:%d", ip, port)
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// CreateNetworkPortal makes the portal group listen on ip:port.
+func (tpg *TPG) CreateNetworkPortal(ip string, port int) (*NetworkPortal, error) {
+	if net.ParseIP(ip) == nil || port <= 0 || port > 65535 {
+		return nil, ErrInvalidName
+	}
+
+	np := &NetworkPortal{tpg: tpg, IP: ip, Port: port, path: filepath.Join(tpg.path, "np", portalName(ip, port))}
+	if err := os.MkdirAll(filepath.Dir(np.path), 0755); err != nil {
+		return nil, err
+	}
+	if err := mkdir(np.path); err != nil {
+		return nil, err
+	}
+	return np, nil
+}
+
+func (tpg *TPG) NetworkPortals() ([]*NetworkPortal, error) {
+	names, err := listDirs(filepath.Join(tpg.path, "np"), "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var portals []*NetworkPortal
+	for _, name := range names {
+		host, port, err := net.SplitHostPort(name)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			continue
+		}
+		portals = append(portals, &NetworkPortal{tpg: tpg, IP: host, Port: n, path: filepath.Join(tpg.path, "np", name)})
+	}
+	return portals, nil
+}
+
+func (np *NetworkPortal) Delete() error {
+	return np.tpg.target.root.rmdir(np.path)
+}
@@ -6,25 +6,248 @@ import (
 	"fmt"
 	"os"
 	"db"
+	"processor"
+	"storage/ceph"
+	"conf"
+	"path/filepath"
+	"strings"
+	"time"
+	"job"
+	"repository"
+	"encoding/hex"
+	"s3"
+	"scheduler"
+	"metrics"
+	"auth"
 )
 
+const clusterSectionPrefix = "cluster."
+const memoryDriver = "memory"
+
 func main() {
-	if err := db.Init(); err != nil {
+	confFile := filepath.Join(os.Getenv("EBSROOT"), "conf", "ebs.conf")
+	if err := conf.Load(confFile); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Load config: %v\n", err)
+		return
+	}
+
+	jobStore, err := initRepository()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Init db: %v\n", err)
 		return
 	}
 	defer db.Destroy()
 
+	jobs, err := initJobs(jobStore)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Init jobs: %v\n", err)
+		return
+	}
+	processor.SetJobManager(jobs)
+	//任务中断的卷不能一直处于忙状态
+	if err := processor.RecoverVolumes(); err != nil {
+		fmt.Fprintf(os.Stderr, "Recover volumes: %v\n", err)
+		return
+	}
+	processor.SetMapTimeout(conf.GetDuration("global", "map_timeout", 5*time.Second))
+	processor.SetKRBDConfig(conf.GetString("krbd", "sysfs", ""), conf.GetString("krbd", "user", ""),
+		splitList(conf.GetString("krbd", "monitors", "")), conf.GetString("krbd", "secret", ""))
+	processor.SetISCSIConfig(conf.GetString("lio", "root", ""), conf.GetString("lio", "portal", ""),
+		conf.GetString("lio", "iqn_prefix", ""))
+
+	//[oss]章节配置了endpoint时可以导出卷到OSS
+	if endpoint := conf.GetString("oss", "endpoint", ""); endpoint != "" {
+		processor.SetOSSConfig(s3.Config{
+			Endpoint:  endpoint,
+			AccessKey: conf.GetString("oss", "access_key", ""),
+			SecretKey: conf.GetString("oss", "secret_key", ""),
+			Region:    conf.GetString("oss", "region", ""),
+			UseHTTPS:  conf.GetBool("oss", "use_https", false),
+			Timeout:   conf.GetDuration("oss", "timeout", 5*time.Minute),
+		}, uint64(conf.GetInt("oss", "part_size_mb", 0))<<20)
+	}
+	processor.SetBackupConfig(conf.GetInt("backup", "keep", 0), conf.GetInt("backup", "max_chain", 0))
+
+	//[placement]章节每项为一个pool类别和逗号分隔的pool
+	classes := make(map[string][]string)
+	if section, ok := conf.GetSectionConf("placement"); ok {
+		for class, pools := range section {
+			classes[class] = splitList(pools)
+		}
+	}
+	processor.SetPoolClasses(classes)
+
+	//所有请求都必须签名，没有管理员密钥时不能启动；只有明确配置allow_unsigned时不签名的请求按管理员处理
+	accessKey, secretKey := conf.GetString("auth", "access_key", ""), conf.GetString("auth", "secret_key", "")
+	unsigned := conf.GetBool("auth", "allow_unsigned", false)
+	if accessKey != "" && secretKey == "" {
+		fmt.Fprintf(os.Stderr, "Load config: auth secret_key is required with access_key\n")
+		return
+	}
+	if accessKey != "" && unsigned {
+		fmt.Fprintf(os.Stderr, "Load config: auth allow_unsigned can not be used with access_key\n")
+		return
+	}
+	if accessKey == "" && !unsigned {
+		fmt.Fprintf(os.Stderr, "Load config: auth access_key is required, or set allow_unsigned = true to serve unsigned requests as admin\n")
+		return
+	}
+	if unsigned {
+		fmt.Fprintf(os.Stderr, "Warning: auth allow_unsigned is set, unsigned requests are served as admin\n")
+	}
+	processor.SetAuthConfig(accessKey, secretKey, conf.GetDuration("auth", "skew", auth.DefaultSkew), unsigned)
+
+	registry, err := initClusters()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Init clusters: %v\n", err)
+		return
+	}
+	defer registry.Close()
+	processor.SetBackend(registry.Default())
+	if err := processor.ReconcileMappings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Reconcile rbd mappings: %v\n", err)
+	}
+	if err := processor.LoadTenants(); err != nil {
+		fmt.Fprintf(os.Stderr, "Load tenants: %v\n", err)
+		return
+	}
+
+	//[nbd]章节配置了listen时启用内置NBD服务
+	if listen := conf.GetString("nbd", "listen", ""); listen != "" {
+		if err := processor.StartNBDServer(listen, conf.GetString("nbd", "address", "")); err != nil {
+			fmt.Fprintf(os.Stderr, "Start NBD server: %v\n", err)
+			return
+		}
+		defer processor.StopNBDServer()
+		if err := processor.RestoreNBDExports(); err != nil {
+			fmt.Fprintf(os.Stderr, "Restore NBD exports: %v\n", err)
+		}
+	}
+
+	//[metrics]章节enabled为true时定时采样pool的读写计数，计算读写速率
+	if conf.GetBool("metrics", "enabled", true) {
+		processor.StartIOSampler(metrics.Config{
+			Interval: conf.GetDuration("metrics", "interval", metrics.DefaultInterval),
+			History:  conf.GetDuration("metrics", "history", metrics.DefaultHistory),
+		})
+		defer processor.StopIOSampler()
+	}
+
+	//[scheduler]章节enabled为true时按快照策略创建和清理快照
+	if conf.GetBool("scheduler", "enabled", false) {
+		processor.StartSnapshotScheduler(scheduler.Config{
+			Holder:   schedulerHolder(),
+			Interval: conf.GetDuration("scheduler", "interval", scheduler.DefaultInterval),
+			LeaseTTL: conf.GetDuration("scheduler", "lease_ttl", 0),
+		})
+		defer processor.StopSnapshotScheduler()
+	}
+
 	if err := initSvr(); err != nil {
 		fmt.Fprintf(os.Stderr, "initSvr failed: %v\n", err)
 		return
 	}
 }
 
+//逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+//租约持有者默认为主机名和进程号，每个实例必须不同
+func schedulerHolder() string {
+	if holder := conf.GetString("scheduler", "holder", ""); holder != "" {
+		return holder
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v:%v", host, os.Getpid())
+}
+
+//[db]章节driver为memory时不连接数据库，记录只保存在内存中
+func initRepository() (job.Store, error) {
+	if conf.GetString("db", "driver", "") == memoryDriver {
+		processor.SetRepository(repository.NewMemoryStore())
+		return job.NewMemoryStore(), nil
+	}
+
+	if err := db.Init(); err != nil {
+		return nil, err
+	}
+
+	dialect, err := repository.DialectOf(db.GetDriver())
+	if err != nil {
+		return nil, err
+	}
+	store := repository.NewSQLStore(db.GetDBHandler(), dialect)
+	//CHAP密码和租户密钥的加密密钥，32字节的十六进制串
+	if secret := conf.GetString("db", "secret_key", ""); secret != "" {
+		key, err := hex.DecodeString(secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret_key: %v", err)
+		}
+		if err := store.SetSecretKey(key); err != nil {
+			return nil, fmt.Errorf("invalid secret_key: %v", err)
+		}
+	}
+	if err := store.Migrate(); err != nil {
+		return nil, err
+	}
+	processor.SetRepository(store)
+	return job.NewSQLStore(db.GetDBHandler()), nil
+}
+
+//上次退出时未完成的任务标记为失败
+func initJobs(store job.Store) (*job.Manager, error) {
+	manager := job.NewManager(store, conf.GetInt("global", "job_workers", job.DefaultWorkers))
+	if err := manager.Recover(); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+//每个[cluster.xxx]章节对应一个长连接，没有配置时连接默认集群
+func initClusters() (*ceph.Registry, error) {
+	registry := ceph.NewRegistry()
+	registry.SetBackoff(
+		conf.GetDuration("global", "cluster_probe_interval", 10*time.Second),
+		conf.GetDuration("global", "cluster_min_backoff", time.Second),
+		conf.GetDuration("global", "cluster_max_backoff", 60*time.Second))
+
+	sections := conf.Sections(clusterSectionPrefix)
+	if len(sections) == 0 {
+		if err := registry.Add(ceph.ClusterConfig{Name: "default"}); err != nil {
+			registry.Close()
+			return nil, err
+		}
+		return registry, nil
+	}
+
+	for _, section := range sections {
+		cfg := ceph.ClusterConfig{
+			Name:       strings.TrimPrefix(section, clusterSectionPrefix),
+			Cluster:    conf.GetString(section, "cluster", ""),
+			User:       conf.GetString(section, "user", ""),
+			ConfigFile: conf.GetString(section, "conf", ""),
+			Keyring:    conf.GetString(section, "keyring", ""),
+		}
+		if err := registry.Add(cfg); err != nil {
+			registry.Close()
+			return nil, fmt.Errorf("cluster %v: %v", cfg.Name, err)
+		}
+	}
+	return registry, nil
+}
+
 func initSvr() error {
 	route.Init()
 
-	if err := http.ListenAndServe("0.0.0.0:6666", nil); err != nil {
+	if err := http.ListenAndServe(conf.GetString("global", "listen", "0.0.0.0:6666"), nil); err != nil {
 		return err
 	}
 
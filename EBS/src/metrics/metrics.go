@@ -0,0 +1,292 @@
+// Package metrics turns the cumulative IO counters of the pools into read
+// and write rates. A Sampler polls the counters periodically and keeps a
+// bounded history of samples per pool, from which it computes the rate
+// over a window or a time series of rates.
+package metrics
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"storage"
+)
+
+// DefaultInterval is the time between two samples.
+const DefaultInterval = 10 * time.Second
+
+// DefaultHistory is how long samples are kept.
+const DefaultHistory = time.Hour
+
+// Windows are the windows rates are reported over, as the load averages.
+var Windows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// Source reports the cumulative counters of every pool, as GetPoolStats.
+type Source interface {
+	PoolStats() (map[string]storage.PoolStat, error)
+}
+
+// Clock is the sampler's source of time, replaced in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
+
+type Config struct {
+	// Interval is the time between samples, DefaultInterval when 0.
+	Interval time.Duration
+	// History is how long samples are kept, DefaultHistory when 0. It is
+	// raised to the longest of Windows.
+	History time.Duration
+	// Clock is SystemClock when nil.
+	Clock Clock
+}
+
+// Sample is the counters of a pool at Time.
+type Sample struct {
+	Time time.Time
+	Stat storage.PoolStat
+}
+
+// Rate is the IO of a pool per second between Start and End.
+type Rate struct {
+	Start     time.Time
+	End       time.Time
+	ReadIOPS  float64
+	WriteIOPS float64
+	// ReadBps and WriteBps are in bytes per second.
+	ReadBps  float64
+	WriteBps float64
+}
+
+// ring keeps the latest samples of a pool, overwriting the oldest.
+type ring struct {
+	samples []Sample
+	next    int
+	full    bool
+}
+
+func newRing(capacity int) *ring {
+	return &ring{samples: make([]Sample, capacity)}
+}
+
+func (r *ring) add(s Sample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the samples, oldest first.
+func (r *ring) list() []Sample {
+	if !r.full {
+		return append([]Sample(nil), r.samples[:r.next]...)
+	}
+	return append(append([]Sample(nil), r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+type Sampler struct {
+	source   Source
+	cfg      Config
+	capacity int
+
+	mu    sync.Mutex
+	pools map[string]*ring
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func New(source Source, cfg Config) *Sampler {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.History <= 0 {
+		cfg.History = DefaultHistory
+	}
+	for _, window := range Windows {
+		if cfg.History < window {
+			cfg.History = window
+		}
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = SystemClock
+	}
+	return &Sampler{
+		source: source,
+		cfg:    cfg,
+		// One sample more than intervals, so the oldest window is covered
+		// from its start.
+		capacity: int(cfg.History/cfg.Interval) + 1,
+		pools:    make(map[string]*ring),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start samples in the background until Stop. It must be called once.
+func (s *Sampler) Start() {
+	s.done = make(chan struct{})
+	go s.loop()
+}
+
+// Stop waits for the current sample to be taken.
+func (s *Sampler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		if s.done != nil {
+			<-s.done
+		}
+	})
+}
+
+func (s *Sampler) loop() {
+	defer close(s.done)
+	for {
+		if err := s.Sample(); err != nil {
+			fmt.Fprintf(os.Stderr, "IO sampler: %v\n", err)
+		}
+		select {
+		case <-s.cfg.Clock.After(s.cfg.Interval):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Sample polls the source once and records a sample of every pool. The
+// history of a pool the source no longer reports is dropped.
+func (s *Sampler) Sample() error {
+	stats, err := s.source.PoolStats()
+	if err != nil {
+		return err
+	}
+	now := s.cfg.Clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for pool := range s.pools {
+		if _, ok := stats[pool]; !ok {
+			delete(s.pools, pool)
+		}
+	}
+	for pool, stat := range stats {
+		r := s.pools[pool]
+		if r == nil {
+			r = newRing(s.capacity)
+			s.pools[pool] = r
+		}
+		r.add(Sample{Time: now, Stat: stat})
+	}
+	return nil
+}
+
+// Pools returns the pools with samples, sorted.
+func (s *Sampler) Pools() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pools := make([]string, 0, len(s.pools))
+	for pool := range s.pools {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	return pools
+}
+
+// Samples returns the history of pool, oldest first.
+func (s *Sampler) Samples(pool string) []Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.pools[pool]
+	if r == nil {
+		return nil
+	}
+	return r.list()
+}
+
+// delta is how much a counter grew. A counter that went backwards, as
+// when the pool was recreated under the same name, restarted from 0.
+func delta(from uint64, to uint64) uint64 {
+	if to < from {
+		return to
+	}
+	return to - from
+}
+
+// rate is the IO per second over samples, which must be in time order.
+func rate(samples []Sample) Rate {
+	first, last := samples[0], samples[len(samples)-1]
+	r := Rate{Start: first.Time, End: last.Time}
+	seconds := last.Time.Sub(first.Time).Seconds()
+	if seconds <= 0 {
+		return r
+	}
+	var reads, writes, readKB, writeKB uint64
+	for i := 1; i < len(samples); i++ {
+		prev, cur := samples[i-1].Stat, samples[i].Stat
+		reads += delta(prev.Num_rd, cur.Num_rd)
+		writes += delta(prev.Num_wr, cur.Num_wr)
+		readKB += delta(prev.Num_rd_kb, cur.Num_rd_kb)
+		writeKB += delta(prev.Num_wr_kb, cur.Num_wr_kb)
+	}
+	r.ReadIOPS = float64(reads) / seconds
+	r.WriteIOPS = float64(writes) / seconds
+	r.ReadBps = float64(readKB) * 1024 / seconds
+	r.WriteBps = float64(writeKB) * 1024 / seconds
+	return r
+}
+
+// Rate returns the IO rate of pool over the window ending at its latest
+// sample. The window starts at the sample closest to window before it, so
+// Start and End tell the span actually covered, which is shorter while
+// the history is. ok is false with fewer than two samples.
+func (s *Sampler) Rate(pool string, window time.Duration) (Rate, bool) {
+	samples := s.Samples(pool)
+	if len(samples) < 2 {
+		return Rate{}, false
+	}
+	start := samples[len(samples)-1].Time.Add(-window)
+	first := 0
+	for i := range samples[:len(samples)-1] {
+		if samples[i].Time.After(start) {
+			break
+		}
+		first = i
+	}
+	// The next sample may be closer to the start of the window.
+	if next := first + 1; next < len(samples)-1 && samples[next].Time.Sub(start) < start.Sub(samples[first].Time) {
+		first = next
+	}
+	return rate(samples[first:]), true
+}
+
+// Range returns the rates of pool between consecutive samples ending in
+// (from, to], oldest first. A zero from or to is unbounded.
+func (s *Sampler) Range(pool string, from time.Time, to time.Time) []Rate {
+	samples := s.Samples(pool)
+	var rates []Rate
+	for i := 1; i < len(samples); i++ {
+		end := samples[i].Time
+		if !from.IsZero() && !end.After(from) || !to.IsZero() && end.After(to) {
+			continue
+		}
+		rates = append(rates, rate(samples[i-1:i+1]))
+	}
+	return rates
+}
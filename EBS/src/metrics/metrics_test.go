@@ -0,0 +1,256 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"storage"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return nil
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fakeSource reports counters the test sets.
+type fakeSource struct {
+	mu    sync.Mutex
+	stats map[string]storage.PoolStat
+}
+
+func (f *fakeSource) PoolStats() (map[string]storage.PoolStat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := make(map[string]storage.PoolStat)
+	for pool, stat := range f.stats {
+		stats[pool] = stat
+	}
+	return stats, nil
+}
+
+// add grows the counters of pool by the IO of seconds at the given rates.
+func (f *fakeSource) add(pool string, seconds uint64, iops uint64, kbps uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stat := f.stats[pool]
+	stat.Num_rd += seconds * iops
+	stat.Num_wr += seconds * iops / 2
+	stat.Num_rd_kb += seconds * kbps
+	stat.Num_wr_kb += seconds * kbps / 2
+	f.stats[pool] = stat
+}
+
+var start = time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+
+func newTestSampler(cfg Config) (*Sampler, *fakeSource, *fakeClock) {
+	clock := &fakeClock{now: start}
+	source := &fakeSource{stats: map[string]storage.PoolStat{"rbd": {}}}
+	cfg.Clock = clock
+	return New(source, cfg), source, clock
+}
+
+// phase is IO at a constant rate for a duration.
+type phase struct {
+	duration time.Duration
+	iops     uint64
+	kbps     uint64
+}
+
+// run samples every interval through the phases, starting with a sample
+// at the start.
+func run(t *testing.T, s *Sampler, source *fakeSource, clock *fakeClock, phases []phase) {
+	if err := s.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range phases {
+		for elapsed := time.Duration(0); elapsed < p.duration; elapsed += s.cfg.Interval {
+			source.add("rbd", uint64(s.cfg.Interval/time.Second), p.iops, p.kbps)
+			clock.advance(s.cfg.Interval)
+			if err := s.Sample(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		phases []phase
+		window time.Duration
+		// span is the time the rate covers, iops the read IOPS over it.
+		span time.Duration
+		iops float64
+	}{
+		{"constant 1m", []phase{{20 * time.Minute, 100, 400}}, time.Minute, time.Minute, 100},
+		{"constant 15m", []phase{{20 * time.Minute, 100, 400}}, 15 * time.Minute, 15 * time.Minute, 100},
+		{"burst ended 1m", []phase{{10 * time.Minute, 300, 1200}, {5 * time.Minute, 0, 0}}, time.Minute, time.Minute, 0},
+		{"burst ended 5m", []phase{{10 * time.Minute, 300, 1200}, {5 * time.Minute, 0, 0}}, 5 * time.Minute, 5 * time.Minute, 0},
+		{"burst ended 15m", []phase{{10 * time.Minute, 300, 1200}, {5 * time.Minute, 0, 0}}, 15 * time.Minute, 15 * time.Minute, 200},
+		{"recent burst 5m", []phase{{10 * time.Minute, 0, 0}, {time.Minute, 500, 2000}}, 5 * time.Minute, 5 * time.Minute, 100},
+		{"short history", []phase{{30 * time.Second, 60, 240}}, 15 * time.Minute, 30 * time.Second, 60},
+		{"window between samples", []phase{{5 * time.Minute, 10, 40}}, 64 * time.Second, time.Minute, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, source, clock := newTestSampler(Config{})
+			run(t, s, source, clock, tt.phases)
+
+			r, ok := s.Rate("rbd", tt.window)
+			if !ok {
+				t.Fatal("no rate")
+			}
+			if !r.End.Equal(clock.Now()) || r.End.Sub(r.Start) != tt.span {
+				t.Errorf("rate covers %v to %v, want %v up to %v", r.Start, r.End, tt.span, clock.Now())
+			}
+			// Writes are half the reads and every IO is 4 KiB.
+			if !near(r.ReadIOPS, tt.iops) || !near(r.WriteIOPS, tt.iops/2) ||
+				!near(r.ReadBps, tt.iops*4096) || !near(r.WriteBps, tt.iops*2048) {
+				t.Errorf("rate %+v, want %v read IOPS", r, tt.iops)
+			}
+		})
+	}
+}
+
+func TestRateNeedsTwoSamples(t *testing.T) {
+	s, _, _ := newTestSampler(Config{})
+	if _, ok := s.Rate("rbd", time.Minute); ok {
+		t.Error("rate without samples")
+	}
+	if err := s.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Rate("rbd", time.Minute); ok {
+		t.Error("rate from one sample")
+	}
+}
+
+func TestCounterReset(t *testing.T) {
+	s, source, clock := newTestSampler(Config{})
+	run(t, s, source, clock, []phase{{time.Minute, 100, 400}})
+
+	// The pool is recreated and its counters restart.
+	source.stats["rbd"] = storage.PoolStat{}
+	source.add("rbd", 10, 50, 200)
+	clock.advance(10 * time.Second)
+	if err := s.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	rates := s.Range("rbd", clock.Now().Add(-10*time.Second), time.Time{})
+	if len(rates) != 1 || !near(rates[0].ReadIOPS, 50) {
+		t.Errorf("rates after reset %+v, want 50 read IOPS", rates)
+	}
+}
+
+func TestHistoryBounded(t *testing.T) {
+	s, source, clock := newTestSampler(Config{Interval: time.Minute, History: time.Minute})
+	// History is raised to the longest window.
+	if s.cfg.History != 15*time.Minute || s.capacity != 16 {
+		t.Fatalf("history %v, capacity %v", s.cfg.History, s.capacity)
+	}
+	run(t, s, source, clock, []phase{{time.Hour, 1, 1}})
+
+	samples := s.Samples("rbd")
+	if len(samples) != s.capacity {
+		t.Fatalf("%v samples kept, want %v", len(samples), s.capacity)
+	}
+	for i, sample := range samples {
+		want := clock.Now().Add(-time.Duration(len(samples)-1-i) * time.Minute)
+		if !sample.Time.Equal(want) {
+			t.Errorf("sample %v at %v, want %v", i, sample.Time, want)
+		}
+	}
+	r, ok := s.Rate("rbd", 15*time.Minute)
+	if !ok || r.End.Sub(r.Start) != 15*time.Minute {
+		t.Errorf("15m rate %+v, %v", r, ok)
+	}
+}
+
+func TestRange(t *testing.T) {
+	s, source, clock := newTestSampler(Config{})
+	run(t, s, source, clock, []phase{{30 * time.Second, 10, 40}, {30 * time.Second, 20, 80}})
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		iops     []float64
+	}{
+		{"all", time.Time{}, time.Time{}, []float64{10, 10, 10, 20, 20, 20}},
+		{"from", start.Add(30 * time.Second), time.Time{}, []float64{20, 20, 20}},
+		{"to", time.Time{}, start.Add(20 * time.Second), []float64{10, 10}},
+		{"between", start.Add(20 * time.Second), start.Add(40 * time.Second), []float64{10, 20}},
+		{"after", start.Add(time.Hour), time.Time{}, nil},
+	}
+	for _, tt := range tests {
+		var iops []float64
+		for _, r := range s.Range("rbd", tt.from, tt.to) {
+			if r.End.Sub(r.Start) != 10*time.Second {
+				t.Errorf("%v: rate over %v", tt.name, r.End.Sub(r.Start))
+			}
+			iops = append(iops, r.ReadIOPS)
+		}
+		if !reflect.DeepEqual(iops, tt.iops) {
+			t.Errorf("%v: read IOPS %v, want %v", tt.name, iops, tt.iops)
+		}
+	}
+}
+
+func TestPools(t *testing.T) {
+	s, source, _ := newTestSampler(Config{})
+	source.stats["ssd"] = storage.PoolStat{}
+	if err := s.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if pools := s.Pools(); !reflect.DeepEqual(pools, []string{"rbd", "ssd"}) {
+		t.Errorf("pools %v", pools)
+	}
+
+	// The history of a deleted pool is dropped.
+	delete(source.stats, "ssd")
+	if err := s.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if pools := s.Pools(); !reflect.DeepEqual(pools, []string{"rbd"}) {
+		t.Errorf("pools after delete %v", pools)
+	}
+	if samples := s.Samples("ssd"); samples != nil {
+		t.Errorf("samples of deleted pool %v", samples)
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	s, _, _ := newTestSampler(Config{})
+	s.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Samples("rbd")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no sample taken after Start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop()
+	s.Stop()
+}
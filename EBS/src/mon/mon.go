@@ -0,0 +1,482 @@
+// Package mon sends typed commands to the Ceph monitors. A Client wraps
+// any Transport, usually a storage.Cluster, marshals each command as the
+// JSON the monitors expect and decodes the JSON they return. A command
+// that fails returns a *CommandError carrying the monitor's status line.
+package mon
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Transport sends one JSON encoded command to a monitor and returns its
+// output and status line. storage.Cluster and rados.Conn implement it.
+type Transport interface {
+	MonCommand(args []byte) ([]byte, string, error)
+}
+
+// CommandError is returned when the monitors reject a command. Err is the
+// error of the transport, Status the explanation of the monitor.
+type CommandError struct {
+	Prefix string
+	Status string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	if e.Status == "" {
+		return fmt.Sprintf("%v: %v", e.Prefix, e.Err)
+	}
+	return fmt.Sprintf("%v: %v: %v", e.Prefix, e.Err, e.Status)
+}
+
+// Cause returns the transport error of a *CommandError and err itself
+// otherwise.
+func Cause(err error) error {
+	if e, ok := err.(*CommandError); ok {
+		return e.Err
+	}
+	return err
+}
+
+// Command is a monitor command: its prefix and arguments.
+type Command map[string]interface{}
+
+type Client struct {
+	t Transport
+}
+
+func New(t Transport) *Client {
+	return &Client{t: t}
+}
+
+// Command sends cmd with JSON output and decodes the output into result,
+// which may be nil to ignore it.
+func (c *Client) Command(cmd Command, result interface{}) error {
+	prefix, _ := cmd["prefix"].(string)
+	args := Command{"format": "json"}
+	for k, v := range cmd {
+		args[k] = v
+	}
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	out, status, err := c.t.MonCommand(payload)
+	if err != nil {
+		return &CommandError{Prefix: prefix, Status: status, Err: err}
+	}
+	if result == nil || len(out) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(out, result); err != nil {
+		return fmt.Errorf("%v: decode output: %v", prefix, err)
+	}
+	return nil
+}
+
+// Pool variables read by GetPool and written by SetPool.
+const (
+	PoolSize      = "size"
+	PoolMinSize   = "min_size"
+	PoolPGNum     = "pg_num"
+	PoolPGPNum    = "pgp_num"
+	PoolCrushRule = "crush_rule"
+
+	PoolErasureCodeProfile = "erasure_code_profile"
+	PoolAllowECOverwrites  = "allow_ec_overwrites"
+)
+
+// PoolVar is the output of osd pool get. Only the requested variable is
+// set.
+type PoolVar struct {
+	Pool      string `json:"pool"`
+	PoolID    int64  `json:"pool_id"`
+	Size      int    `json:"size"`
+	MinSize   int    `json:"min_size"`
+	PGNum     int    `json:"pg_num"`
+	PGPNum    int    `json:"pgp_num"`
+	CrushRule string `json:"crush_rule"`
+
+	ErasureCodeProfile string `json:"erasure_code_profile"`
+}
+
+// GetPool runs osd pool get for variable of pool.
+func (c *Client) GetPool(pool string, variable string) (*PoolVar, error) {
+	var v PoolVar
+	if err := c.Command(Command{"prefix": "osd pool get", "pool": pool, "var": variable}, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// SetPool runs osd pool set for variable of pool.
+func (c *Client) SetPool(pool string, variable string, value string) error {
+	return c.Command(Command{"prefix": "osd pool set", "pool": pool, "var": variable, "val": value}, nil)
+}
+
+func (c *Client) GetPoolSize(pool string) (int, error) {
+	v, err := c.GetPool(pool, PoolSize)
+	if err != nil {
+		return 0, err
+	}
+	return v.Size, nil
+}
+
+func (c *Client) SetPoolSize(pool string, size int) error {
+	return c.SetPool(pool, PoolSize, strconv.Itoa(size))
+}
+
+func (c *Client) GetPoolMinSize(pool string) (int, error) {
+	v, err := c.GetPool(pool, PoolMinSize)
+	if err != nil {
+		return 0, err
+	}
+	return v.MinSize, nil
+}
+
+func (c *Client) SetPoolMinSize(pool string, size int) error {
+	return c.SetPool(pool, PoolMinSize, strconv.Itoa(size))
+}
+
+func (c *Client) GetPoolPGNum(pool string) (int, error) {
+	v, err := c.GetPool(pool, PoolPGNum)
+	if err != nil {
+		return 0, err
+	}
+	return v.PGNum, nil
+}
+
+// SetPoolPGNum sets pg_num and then pgp_num, so that the new placement
+// groups are also used for placement.
+func (c *Client) SetPoolPGNum(pool string, pgNum int) error {
+	if err := c.SetPool(pool, PoolPGNum, strconv.Itoa(pgNum)); err != nil {
+		return err
+	}
+	return c.SetPool(pool, PoolPGPNum, strconv.Itoa(pgNum))
+}
+
+func (c *Client) GetPoolCrushRule(pool string) (string, error) {
+	v, err := c.GetPool(pool, PoolCrushRule)
+	if err != nil {
+		return "", err
+	}
+	return v.CrushRule, nil
+}
+
+func (c *Client) SetPoolCrushRule(pool string, rule string) error {
+	return c.SetPool(pool, PoolCrushRule, rule)
+}
+
+// CreateErasurePool creates an erasure coded pool with pgNum placement
+// groups and the erasure code profile, placed by the CRUSH rule named
+// rule, or a rule generated from the profile when rule is empty.
+func (c *Client) CreateErasurePool(pool string, pgNum int, profile string, rule string) error {
+	cmd := Command{
+		"prefix":               "osd pool create",
+		"pool":                 pool,
+		"pg_num":               pgNum,
+		"pgp_num":              pgNum,
+		"pool_type":            "erasure",
+		"erasure_code_profile": profile,
+	}
+	if rule != "" {
+		cmd["rule"] = rule
+	}
+	return c.Command(cmd, nil)
+}
+
+// CrushRule is the output of osd crush rule dump for one rule.
+type CrushRule struct {
+	ID   int    `json:"rule_id"`
+	Name string `json:"rule_name"`
+	Type int    `json:"type"`
+}
+
+func (c *Client) GetCrushRule(name string) (*CrushRule, error) {
+	var rule CrushRule
+	if err := c.Command(Command{"prefix": "osd crush rule dump", "name": name}, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// Quota fields of osd pool set-quota.
+const (
+	QuotaMaxObjects = "max_objects"
+	QuotaMaxBytes   = "max_bytes"
+)
+
+// PoolQuota is the output of osd pool get-quota. Zero is unlimited.
+type PoolQuota struct {
+	Pool       string `json:"pool_name"`
+	PoolID     int64  `json:"pool_id"`
+	MaxObjects uint64 `json:"quota_max_objects"`
+	MaxBytes   uint64 `json:"quota_max_bytes"`
+}
+
+// SetPoolQuota sets the quota field of pool; 0 removes the quota.
+func (c *Client) SetPoolQuota(pool string, field string, value uint64) error {
+	return c.Command(Command{
+		"prefix": "osd pool set-quota",
+		"pool":   pool,
+		"field":  field,
+		"val":    strconv.FormatUint(value, 10),
+	}, nil)
+}
+
+func (c *Client) GetPoolQuota(pool string) (*PoolQuota, error) {
+	var q PoolQuota
+	if err := c.Command(Command{"prefix": "osd pool get-quota", "pool": pool}, &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// EnableApplication tags pool with app, such as "rbd".
+func (c *Client) EnableApplication(pool string, app string) error {
+	return c.Command(Command{"prefix": "osd pool application enable", "pool": pool, "app": app}, nil)
+}
+
+// ErasureCodeProfile is an erasure code profile. Empty fields take the
+// defaults of the monitors.
+type ErasureCodeProfile struct {
+	K             int
+	M             int
+	Plugin        string
+	Technique     string
+	FailureDomain string
+	Root          string
+}
+
+func (p *ErasureCodeProfile) args() []string {
+	args := []string{"k=" + strconv.Itoa(p.K), "m=" + strconv.Itoa(p.M)}
+	if p.Plugin != "" {
+		args = append(args, "plugin="+p.Plugin)
+	}
+	if p.Technique != "" {
+		args = append(args, "technique="+p.Technique)
+	}
+	if p.FailureDomain != "" {
+		args = append(args, "crush-failure-domain="+p.FailureDomain)
+	}
+	if p.Root != "" {
+		args = append(args, "crush-root="+p.Root)
+	}
+	return args
+}
+
+// SetErasureCodeProfile creates the profile name. An existing profile is
+// only overwritten when force is set.
+func (c *Client) SetErasureCodeProfile(name string, profile *ErasureCodeProfile, force bool) error {
+	if profile.K <= 0 || profile.M <= 0 {
+		return fmt.Errorf("invalid erasure code profile k=%v m=%v", profile.K, profile.M)
+	}
+	cmd := Command{"prefix": "osd erasure-code-profile set", "name": name, "profile": profile.args()}
+	if force {
+		cmd["force"] = true
+	}
+	return c.Command(cmd, nil)
+}
+
+// GetErasureCodeProfile returns the profile name. The monitors report
+// every value as a string.
+func (c *Client) GetErasureCodeProfile(name string) (*ErasureCodeProfile, error) {
+	var values map[string]string
+	if err := c.Command(Command{"prefix": "osd erasure-code-profile get", "name": name}, &values); err != nil {
+		return nil, err
+	}
+	k, errK := strconv.Atoi(values["k"])
+	m, errM := strconv.Atoi(values["m"])
+	if errK != nil || errM != nil {
+		return nil, fmt.Errorf("invalid erasure code profile %v: %v", name, values)
+	}
+	return &ErasureCodeProfile{
+		K:             k,
+		M:             m,
+		Plugin:        values["plugin"],
+		Technique:     values["technique"],
+		FailureDomain: values["crush-failure-domain"],
+		Root:          values["crush-root"],
+	}, nil
+}
+
+func (c *Client) ListErasureCodeProfiles() ([]string, error) {
+	var names []string
+	if err := c.Command(Command{"prefix": "osd erasure-code-profile ls"}, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Health states.
+const (
+	HealthOK   = "HEALTH_OK"
+	HealthWarn = "HEALTH_WARN"
+	HealthErr  = "HEALTH_ERR"
+)
+
+type HealthCheck struct {
+	Severity string `json:"severity"`
+	Summary  struct {
+		Message string `json:"message"`
+	} `json:"summary"`
+}
+
+// Health is the output of health. Monitors before Luminous report the
+// state as overall_status and the checks as summary; Health copies them
+// to Status and Checks.
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+
+	OverallStatus string `json:"overall_status"`
+	Summary       []struct {
+		Severity string `json:"severity"`
+		Summary  string `json:"summary"`
+	} `json:"summary"`
+}
+
+func (h *Health) normalize() {
+	if h.Status == "" {
+		h.Status = h.OverallStatus
+	}
+	if len(h.Checks) == 0 && len(h.Summary) > 0 {
+		h.Checks = make(map[string]HealthCheck)
+		for i, s := range h.Summary {
+			var check HealthCheck
+			check.Severity = s.Severity
+			check.Summary.Message = s.Summary
+			h.Checks["SUMMARY_"+strconv.Itoa(i)] = check
+		}
+	}
+}
+
+func (c *Client) Health() (*Health, error) {
+	var h Health
+	if err := c.Command(Command{"prefix": "health"}, &h); err != nil {
+		return nil, err
+	}
+	h.normalize()
+	return &h, nil
+}
+
+type DFStats struct {
+	TotalBytes      uint64 `json:"total_bytes"`
+	TotalUsedBytes  uint64 `json:"total_used_bytes"`
+	TotalAvailBytes uint64 `json:"total_avail_bytes"`
+}
+
+type DFPoolStats struct {
+	KbUsed      uint64  `json:"kb_used"`
+	BytesUsed   uint64  `json:"bytes_used"`
+	PercentUsed float64 `json:"percent_used"`
+	MaxAvail    uint64  `json:"max_avail"`
+	Objects     uint64  `json:"objects"`
+}
+
+type DFPool struct {
+	Name  string      `json:"name"`
+	ID    int64       `json:"id"`
+	Stats DFPoolStats `json:"stats"`
+}
+
+// DF is the output of df: the raw capacity of the cluster and the usage
+// of every pool. MaxAvail of a pool already accounts for its replicas.
+type DF struct {
+	Stats DFStats  `json:"stats"`
+	Pools []DFPool `json:"pools"`
+}
+
+// Pool returns the usage of the named pool, nil if there is none.
+func (df *DF) Pool(name string) *DFPool {
+	for i := range df.Pools {
+		if df.Pools[i].Name == name {
+			return &df.Pools[i]
+		}
+	}
+	return nil
+}
+
+func (c *Client) DF() (*DF, error) {
+	var df DF
+	if err := c.Command(Command{"prefix": "df"}, &df); err != nil {
+		return nil, err
+	}
+	return &df, nil
+}
+
+type MonMap struct {
+	Epoch int `json:"epoch"`
+	Mons  []struct {
+		Rank int    `json:"rank"`
+		Name string `json:"name"`
+		Addr string `json:"addr"`
+	} `json:"mons"`
+}
+
+type OSDMap struct {
+	Epoch     int  `json:"epoch"`
+	NumOSDs   int  `json:"num_osds"`
+	NumUpOSDs int  `json:"num_up_osds"`
+	NumInOSDs int  `json:"num_in_osds"`
+	Full      bool `json:"full"`
+	NearFull  bool `json:"nearfull"`
+}
+
+// UnmarshalJSON accepts the osdmap of status both as it is and nested in
+// another osdmap object, as monitors before Nautilus report it.
+func (m *OSDMap) UnmarshalJSON(data []byte) error {
+	type osdMap OSDMap
+	var nested struct {
+		OSDMap *osdMap `json:"osdmap"`
+	}
+	if err := json.Unmarshal(data, &nested); err != nil {
+		return err
+	}
+	if nested.OSDMap != nil {
+		*m = OSDMap(*nested.OSDMap)
+		return nil
+	}
+	return json.Unmarshal(data, (*osdMap)(m))
+}
+
+type PGState struct {
+	Name  string `json:"state_name"`
+	Count int    `json:"count"`
+}
+
+type PGMap struct {
+	PGsByState []PGState `json:"pgs_by_state"`
+	NumPGs     int       `json:"num_pgs"`
+	NumPools   int       `json:"num_pools"`
+	NumObjects uint64    `json:"num_objects"`
+	DataBytes  uint64    `json:"data_bytes"`
+	BytesUsed  uint64    `json:"bytes_used"`
+	BytesAvail uint64    `json:"bytes_avail"`
+	BytesTotal uint64    `json:"bytes_total"`
+	ReadBps    uint64    `json:"read_bytes_sec"`
+	WriteBps   uint64    `json:"write_bytes_sec"`
+	ReadOps    uint64    `json:"read_op_per_sec"`
+	WriteOps   uint64    `json:"write_op_per_sec"`
+}
+
+// Status is the output of status.
+type Status struct {
+	FSID   string `json:"fsid"`
+	Health Health `json:"health"`
+	MonMap MonMap `json:"monmap"`
+	OSDMap OSDMap `json:"osdmap"`
+	PGMap  PGMap  `json:"pgmap"`
+}
+
+func (c *Client) Status() (*Status, error) {
+	var s Status
+	if err := c.Command(Command{"prefix": "status"}, &s); err != nil {
+		return nil, err
+	}
+	s.Health.normalize()
+	return &s, nil
+}
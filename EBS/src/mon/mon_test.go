@@ -0,0 +1,249 @@
+package mon
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// newTestClient returns a client replaying testdata/recordings.json, which
+// holds the commands and responses of a Luminous cluster.
+func newTestClient(t *testing.T) (*Client, *Replay) {
+	f, err := os.Open("testdata/recordings.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	replay, err := LoadReplay(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(replay), replay
+}
+
+func TestGetPool(t *testing.T) {
+	c, _ := newTestClient(t)
+	tests := []struct {
+		name string
+		get  func() (interface{}, error)
+		want interface{}
+	}{
+		{"size", func() (interface{}, error) { return c.GetPoolSize("rbd") }, 3},
+		{"min_size", func() (interface{}, error) { return c.GetPoolMinSize("rbd") }, 2},
+		{"pg_num", func() (interface{}, error) { return c.GetPoolPGNum("rbd") }, 128},
+		{"crush_rule", func() (interface{}, error) { return c.GetPoolCrushRule("rbd") }, "replicated_rule"},
+	}
+	for _, tt := range tests {
+		got, err := tt.get()
+		if err != nil || got != tt.want {
+			t.Errorf("get %v = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSetPool(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(c *Client) error
+		sent  []Command
+		errno syscall.Errno
+	}{
+		{"size", func(c *Client) error { return c.SetPoolSize("rbd", 2) },
+			[]Command{{"prefix": "osd pool set", "pool": "rbd", "var": "size", "val": "2"}}, 0},
+		{"invalid min_size", func(c *Client) error { return c.SetPoolMinSize("rbd", 5) },
+			[]Command{{"prefix": "osd pool set", "pool": "rbd", "var": "min_size", "val": "5"}}, syscall.EINVAL},
+		{"pg_num sets pgp_num", func(c *Client) error { return c.SetPoolPGNum("rbd", 256) },
+			[]Command{
+				{"prefix": "osd pool set", "pool": "rbd", "var": "pg_num", "val": "256"},
+				{"prefix": "osd pool set", "pool": "rbd", "var": "pgp_num", "val": "256"},
+			}, 0},
+		{"crush_rule", func(c *Client) error { return c.SetPoolCrushRule("rbd", "ssd") },
+			[]Command{{"prefix": "osd pool set", "pool": "rbd", "var": "crush_rule", "val": "ssd"}}, 0},
+		{"quota", func(c *Client) error { return c.SetPoolQuota("rbd", QuotaMaxBytes, 1<<30) },
+			[]Command{{"prefix": "osd pool set-quota", "pool": "rbd", "field": "max_bytes", "val": "1073741824"}}, 0},
+		{"application", func(c *Client) error { return c.EnableApplication("rbd", "rbd") },
+			[]Command{{"prefix": "osd pool application enable", "pool": "rbd", "app": "rbd"}}, 0},
+		{"erasure pool", func(c *Client) error { return c.CreateErasurePool("ec", 64, "k4m2", "") },
+			[]Command{{"prefix": "osd pool create", "pool": "ec", "pg_num": float64(64), "pgp_num": float64(64),
+				"pool_type": "erasure", "erasure_code_profile": "k4m2"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, replay := newTestClient(t)
+			var want error
+			if tt.errno != 0 {
+				want = tt.errno
+			}
+			err := tt.set(c)
+			if Cause(err) != want {
+				t.Fatalf("err = %v, want %v", err, want)
+			}
+			if err != nil {
+				if e, ok := err.(*CommandError); !ok || e.Status == "" || e.Prefix != "osd pool set" {
+					t.Errorf("error %#v carries no monitor status", err)
+				}
+			}
+
+			sent := replay.Sent()
+			if len(sent) != len(tt.sent) {
+				t.Fatalf("sent %v, want %v", sent, tt.sent)
+			}
+			for i := range sent {
+				if sent[i]["format"] != "json" {
+					t.Errorf("command %v not sent with JSON output", sent[i])
+				}
+				delete(sent[i], "format")
+				if !reflect.DeepEqual(sent[i], tt.sent[i]) {
+					t.Errorf("sent %v, want %v", sent[i], tt.sent[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	c, _ := newTestClient(t)
+	_, err := c.GetPoolSize("missing")
+	e, ok := err.(*CommandError)
+	if !ok {
+		t.Fatalf("GetPoolSize(missing) = %v, want *CommandError", err)
+	}
+	if e.Err != syscall.ENOENT || e.Status != "unrecognized pool 'missing'" || e.Prefix != "osd pool get" {
+		t.Errorf("error %+v", e)
+	}
+
+	// A command without a recording fails like an unknown command.
+	if err := c.Command(Command{"prefix": "osd pool rm", "pool": "rbd"}, nil); Cause(err) != syscall.EINVAL {
+		t.Errorf("unrecorded command = %v", err)
+	}
+}
+
+func TestPoolQuota(t *testing.T) {
+	c, _ := newTestClient(t)
+	q, err := c.GetPoolQuota("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PoolQuota{Pool: "rbd", PoolID: 1, MaxBytes: 1 << 30}
+	if *q != want {
+		t.Errorf("quota %+v, want %+v", *q, want)
+	}
+}
+
+func TestCrushRule(t *testing.T) {
+	c, _ := newTestClient(t)
+	rule, err := c.GetCrushRule("ssd")
+	if err != nil || *rule != (CrushRule{ID: 1, Name: "ssd", Type: 1}) {
+		t.Errorf("GetCrushRule = %+v, %v", rule, err)
+	}
+}
+
+func TestErasureCodeProfile(t *testing.T) {
+	c, replay := newTestClient(t)
+	profile := &ErasureCodeProfile{K: 4, M: 2, Plugin: "jerasure", Technique: "reed_sol_van", FailureDomain: "host"}
+
+	tests := []struct {
+		name    string
+		profile *ErasureCodeProfile
+		errno   syscall.Errno
+		sent    bool
+	}{
+		{"k4m2", profile, 0, true},
+		{"default", &ErasureCodeProfile{K: 4, M: 2}, syscall.EPERM, true},
+		{"invalid", &ErasureCodeProfile{K: 0, M: 2}, 0, false},
+	}
+	for _, tt := range tests {
+		before := len(replay.Sent())
+		err := c.SetErasureCodeProfile(tt.name, tt.profile, false)
+		switch {
+		case !tt.sent:
+			if err == nil {
+				t.Errorf("SetErasureCodeProfile(%v) accepted k=%v", tt.name, tt.profile.K)
+			}
+		case tt.errno != 0:
+			if Cause(err) != tt.errno {
+				t.Errorf("SetErasureCodeProfile(%v) = %v, want %v", tt.name, err, tt.errno)
+			}
+		case err != nil:
+			t.Errorf("SetErasureCodeProfile(%v) = %v", tt.name, err)
+		}
+		if sent := len(replay.Sent()) > before; sent != tt.sent {
+			t.Errorf("SetErasureCodeProfile(%v) sent %v, want %v", tt.name, sent, tt.sent)
+		}
+	}
+
+	got, err := c.GetErasureCodeProfile("k4m2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := *profile
+	want.Root = "default"
+	if *got != want {
+		t.Errorf("profile %+v, want %+v", *got, want)
+	}
+	names, err := c.ListErasureCodeProfiles()
+	if err != nil || !reflect.DeepEqual(names, []string{"default", "k4m2"}) {
+		t.Errorf("ListErasureCodeProfiles = %v, %v", names, err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	c, _ := newTestClient(t)
+	// The recordings answer first as Luminous and then as Jewel does.
+	tests := []struct {
+		name    string
+		check   string
+		message string
+	}{
+		{"luminous", "POOL_NO_REDUNDANCY", "1 pool(s) have no replicas configured"},
+		{"jewel", "SUMMARY_0", "too few PGs per OSD (16 < min 30)"},
+	}
+	for _, tt := range tests {
+		h, err := c.Health()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		check, ok := h.Checks[tt.check]
+		if h.Status != HealthWarn || len(h.Checks) != 1 || !ok ||
+			check.Severity != HealthWarn || check.Summary.Message != tt.message {
+			t.Errorf("%v: health %+v", tt.name, h)
+		}
+	}
+}
+
+func TestDF(t *testing.T) {
+	c, _ := newTestClient(t)
+	df, err := c.DF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if df.Stats.TotalBytes != 300<<30 || df.Stats.TotalAvailBytes != 318901321728 {
+		t.Errorf("stats %+v", df.Stats)
+	}
+	pool := df.Pool("rbd")
+	if pool == nil || pool.ID != 1 || pool.Stats.BytesUsed != 1<<30 || pool.Stats.MaxAvail != 100931731456 || pool.Stats.Objects != 259 {
+		t.Errorf("pool rbd %+v", pool)
+	}
+	if df.Pool("missing") != nil {
+		t.Error("Pool(missing) found")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	c, _ := newTestClient(t)
+	s, err := c.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Health.Status != HealthOK || len(s.MonMap.Mons) != 1 || s.MonMap.Mons[0].Addr != "10.0.0.1:6789/0" {
+		t.Errorf("status %+v", s)
+	}
+	// The osdmap is nested in another osdmap before Nautilus.
+	if s.OSDMap != (OSDMap{Epoch: 42, NumOSDs: 3, NumUpOSDs: 3, NumInOSDs: 3}) {
+		t.Errorf("osdmap %+v", s.OSDMap)
+	}
+	if s.PGMap.NumPGs != 128 || len(s.PGMap.PGsByState) != 1 || s.PGMap.PGsByState[0].Name != "active+clean" {
+		t.Errorf("pgmap %+v", s.PGMap)
+	}
+}
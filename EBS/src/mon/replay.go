@@ -0,0 +1,101 @@
+package mon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// Recording is a command sent to the monitors and their response, as
+// captured from a real cluster. Ret is the negative errno the command
+// failed with, 0 on success.
+type Recording struct {
+	Command Command         `json:"command"`
+	Output  json.RawMessage `json:"output,omitempty"`
+	Status  string          `json:"status,omitempty"`
+	Ret     int             `json:"ret,omitempty"`
+}
+
+// Replay is a Transport for tests that answers commands from recordings
+// instead of a cluster. Commands match when their arguments other than
+// format are equal. Several recordings of one command are replayed in
+// order and the last one is repeated. A command without a recording
+// fails with EINVAL.
+type Replay struct {
+	mu      sync.Mutex
+	records map[string][]Recording
+	sent    []Command
+}
+
+// commandKey is the canonical form of cmd: JSON with sorted keys and
+// numbers as they decode from JSON.
+func commandKey(cmd Command) (string, error) {
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return "", err
+	}
+	delete(decoded, "format")
+	key, err := json.Marshal(decoded)
+	return string(key), err
+}
+
+func NewReplay(records []Recording) (*Replay, error) {
+	r := &Replay{records: make(map[string][]Recording)}
+	for _, rec := range records {
+		key, err := commandKey(rec.Command)
+		if err != nil {
+			return nil, err
+		}
+		r.records[key] = append(r.records[key], rec)
+	}
+	return r, nil
+}
+
+// LoadReplay reads a JSON array of recordings.
+func LoadReplay(in io.Reader) (*Replay, error) {
+	var records []Recording
+	if err := json.NewDecoder(in).Decode(&records); err != nil {
+		return nil, err
+	}
+	return NewReplay(records)
+}
+
+func (r *Replay) MonCommand(args []byte) ([]byte, string, error) {
+	var cmd Command
+	if err := json.Unmarshal(args, &cmd); err != nil {
+		return nil, "", syscall.EINVAL
+	}
+	key, err := commandKey(cmd)
+	if err != nil {
+		return nil, "", syscall.EINVAL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, cmd)
+	records := r.records[key]
+	if len(records) == 0 {
+		return nil, fmt.Sprintf("no recording of %v", key), syscall.EINVAL
+	}
+	rec := records[0]
+	if len(records) > 1 {
+		r.records[key] = records[1:]
+	}
+	if rec.Ret != 0 {
+		return nil, rec.Status, syscall.Errno(-rec.Ret)
+	}
+	return []byte(rec.Output), rec.Status, nil
+}
+
+// Sent returns the commands received so far.
+func (r *Replay) Sent() []Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Command(nil), r.sent...)
+}
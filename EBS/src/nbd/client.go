@@ -0,0 +1,258 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Client is a connection in transmission phase to one export. Requests
+// are sent one at a time.
+type Client struct {
+	mu     sync.Mutex
+	nc     net.Conn
+	r      *bufio.Reader
+	size   uint64
+	flags  uint16
+	handle uint64
+}
+
+// Dial connects to addr and selects export name with NBD_OPT_GO.
+func Dial(network string, addr string, name string) (*Client, error) {
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(nc, name)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient negotiates export name over an established connection.
+func NewClient(nc net.Conn, name string) (*Client, error) {
+	c := &Client{nc: nc, r: bufio.NewReader(nc)}
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 4+len(name)+2+2)
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(name)))
+	copy(data[4:], name)
+	binary.BigEndian.PutUint16(data[4+len(name):], 1)
+	binary.BigEndian.PutUint16(data[6+len(name):], infoBlockSize)
+	if err := c.sendOption(optGo, data); err != nil {
+		return nil, err
+	}
+
+	for {
+		typ, reply, err := c.readOptionReply(optGo)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case typ == repAck:
+			return c, nil
+		case typ == repInfo && len(reply) >= 12 && binary.BigEndian.Uint16(reply[0:2]) == infoExport:
+			c.size = binary.BigEndian.Uint64(reply[2:10])
+			c.flags = binary.BigEndian.Uint16(reply[10:12])
+		case typ == repInfo:
+		case typ&(1<<31) != 0:
+			return nil, fmt.Errorf("NBD export %q: error %#x %s", name, typ, reply)
+		}
+	}
+}
+
+// List returns the names of the exports of the server at addr.
+func List(network string, addr string) ([]string, error) {
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+
+	c := &Client{nc: nc, r: bufio.NewReader(nc)}
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+	if err := c.sendOption(optList, nil); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for {
+		typ, reply, err := c.readOptionReply(optList)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case repAck:
+			c.sendOption(optAbort, nil)
+			return names, nil
+		case repServer:
+			if len(reply) < 4 || uint64(len(reply)) < 4+uint64(binary.BigEndian.Uint32(reply[0:4])) {
+				return nil, ErrProtocol
+			}
+			names = append(names, string(reply[4:4+binary.BigEndian.Uint32(reply[0:4])]))
+		default:
+			return nil, fmt.Errorf("NBD list: error %#x", typ)
+		}
+	}
+}
+
+func (c *Client) hello() error {
+	var hello [18]byte
+	if _, err := io.ReadFull(c.r, hello[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(hello[0:8]) != nbdMagic || binary.BigEndian.Uint64(hello[8:16]) != optMagic {
+		return ErrProtocol
+	}
+	if binary.BigEndian.Uint16(hello[16:18])&flagFixedNewstyle == 0 {
+		return fmt.Errorf("server does not support fixed newstyle negotiation")
+	}
+	return binary.Write(c.nc, binary.BigEndian, clientFlagFixedNewstyle|clientFlagNoZeroes)
+}
+
+func (c *Client) sendOption(option uint32, data []byte) error {
+	buf := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint64(buf[0:8], optMagic)
+	binary.BigEndian.PutUint32(buf[8:12], option)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(len(data)))
+	copy(buf[16:], data)
+	_, err := c.nc.Write(buf)
+	return err
+}
+
+func (c *Client) readOptionReply(option uint32) (uint32, []byte, error) {
+	var header [20]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint64(header[0:8]) != optReplyMagic || binary.BigEndian.Uint32(header[8:12]) != option {
+		return 0, nil, ErrProtocol
+	}
+	length := binary.BigEndian.Uint32(header[16:20])
+	if length > maxOptionLength {
+		return 0, nil, ErrProtocol
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(header[12:16]), data, nil
+}
+
+// Size returns the export size announced by the server.
+func (c *Client) Size() uint64 {
+	return c.size
+}
+
+// Flags returns the transmission flags announced by the server.
+func (c *Client) Flags() uint16 {
+	return c.flags
+}
+
+// ReplyError is an error returned by the server for a request.
+type ReplyError struct {
+	Errno uint32
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("NBD request failed with errno %v", e.Errno)
+}
+
+// do sends one request and reads its reply, filling out for reads.
+func (c *Client) do(req *request, data []byte, out []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.handle++
+	req.handle = c.handle
+	if _, err := c.nc.Write(append(req.encode(), data...)); err != nil {
+		return err
+	}
+
+	var reply [16]byte
+	if _, err := io.ReadFull(c.r, reply[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(reply[0:4]) != simpleReplyMagic || binary.BigEndian.Uint64(reply[8:16]) != req.handle {
+		return ErrProtocol
+	}
+	if errno := binary.BigEndian.Uint32(reply[4:8]); errno != 0 {
+		return &ReplyError{Errno: errno}
+	}
+	if out != nil {
+		if _, err := io.ReadFull(c.r, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) ReadAt(p []byte, off int64) (int, error) {
+	for done := 0; done < len(p); {
+		n := len(p) - done
+		if n > maxPayload {
+			n = maxPayload
+		}
+		req := &request{typ: cmdRead, offset: uint64(off) + uint64(done), length: uint32(n)}
+		if err := c.do(req, nil, p[done:done+n]); err != nil {
+			return done, err
+		}
+		done += n
+	}
+	return len(p), nil
+}
+
+func (c *Client) WriteAt(p []byte, off int64) (int, error) {
+	return c.write(p, off, 0)
+}
+
+// WriteAtFUA writes p and returns once it is on stable storage.
+func (c *Client) WriteAtFUA(p []byte, off int64) (int, error) {
+	return c.write(p, off, cmdFlagFUA)
+}
+
+func (c *Client) write(p []byte, off int64, flags uint16) (int, error) {
+	for done := 0; done < len(p); {
+		n := len(p) - done
+		if n > maxPayload {
+			n = maxPayload
+		}
+		req := &request{typ: cmdWrite, flags: flags, offset: uint64(off) + uint64(done), length: uint32(n)}
+		if err := c.do(req, p[done:done+n], nil); err != nil {
+			return done, err
+		}
+		done += n
+	}
+	return len(p), nil
+}
+
+func (c *Client) Flush() error {
+	return c.do(&request{typ: cmdFlush}, nil, nil)
+}
+
+// Trim discards length bytes at off.
+func (c *Client) Trim(off uint64, length uint32) error {
+	return c.do(&request{typ: cmdTrim, offset: off, length: length}, nil, nil)
+}
+
+// WriteZeroes zeroes length bytes at off.
+func (c *Client) WriteZeroes(off uint64, length uint32) error {
+	return c.do(&request{typ: cmdWriteZeroes, offset: off, length: length}, nil, nil)
+}
+
+// Close sends NBD_CMD_DISC and closes the connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.nc.Write((&request{typ: cmdDisc}).encode())
+	c.mu.Unlock()
+	return c.nc.Close()
+}
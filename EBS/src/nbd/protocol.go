@@ -0,0 +1,166 @@
+// Package nbd implements the Network Block Device protocol: a server that
+// exports block devices, such as open rbd images, by name with fixed
+// newstyle negotiation, and a small client for the same subset.
+//
+// See https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md.
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// DefaultPort is the IANA assigned NBD port.
+const DefaultPort = 10809
+
+// Handshake.
+const (
+	nbdMagic         uint64 = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic         uint64 = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic    uint64 = 0x0003e889045565a9
+	requestMagic     uint32 = 0x25609513
+	simpleReplyMagic uint32 = 0x67446698
+)
+
+// Handshake flags, sent by the server.
+const (
+	flagFixedNewstyle uint16 = 1 << 0
+	flagNoZeroes      uint16 = 1 << 1
+)
+
+// Client flags.
+const (
+	clientFlagFixedNewstyle uint32 = 1 << 0
+	clientFlagNoZeroes      uint32 = 1 << 1
+)
+
+// Options.
+const (
+	optExportName uint32 = 1
+	optAbort      uint32 = 2
+	optList       uint32 = 3
+	optInfo       uint32 = 6
+	optGo         uint32 = 7
+)
+
+// Option replies.
+const (
+	repAck        uint32 = 1
+	repServer     uint32 = 2
+	repInfo       uint32 = 3
+	repErrUnsup   uint32 = 1<<31 + 1
+	repErrInvalid uint32 = 1<<31 + 3
+	repErrUnknown uint32 = 1<<31 + 6
+)
+
+// Info types of NBD_OPT_INFO and NBD_OPT_GO.
+const (
+	infoExport    uint16 = 0
+	infoBlockSize uint16 = 3
+)
+
+// Transmission flags, announced per export.
+const (
+	FlagHasFlags        uint16 = 1 << 0
+	FlagReadOnly        uint16 = 1 << 1
+	FlagSendFlush       uint16 = 1 << 2
+	FlagSendFUA         uint16 = 1 << 3
+	FlagSendTrim        uint16 = 1 << 5
+	FlagSendWriteZeroes uint16 = 1 << 6
+	FlagCanMultiConn    uint16 = 1 << 8
+)
+
+// Commands.
+const (
+	cmdRead        uint16 = 0
+	cmdWrite       uint16 = 1
+	cmdDisc        uint16 = 2
+	cmdFlush       uint16 = 3
+	cmdTrim        uint16 = 4
+	cmdWriteZeroes uint16 = 6
+)
+
+// Command flags.
+const (
+	cmdFlagFUA    uint16 = 1 << 0
+	cmdFlagNoHole uint16 = 1 << 1
+)
+
+// Errors carried in replies, errno values.
+const (
+	errPerm     uint32 = 1
+	errIO       uint32 = 5
+	errInval    uint32 = 22
+	errNoSpc    uint32 = 28
+	errOverflow uint32 = 75
+)
+
+// maxPayload bounds the data of one read or write request, the same
+// limit the reference server uses.
+const maxPayload = 32 << 20
+
+// maxOptionLength bounds option data during negotiation.
+const maxOptionLength = 4096
+
+// Block sizes announced with NBD_INFO_BLOCK_SIZE.
+const (
+	minBlockSize       = 1
+	preferredBlockSize = 4096
+)
+
+var ErrProtocol = errors.New("NBD protocol error")
+
+type request struct {
+	flags  uint16
+	typ    uint16
+	handle uint64
+	offset uint64
+	length uint32
+}
+
+func readRequest(r io.Reader) (*request, error) {
+	var buf [28]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(buf[0:4]) != requestMagic {
+		return nil, ErrProtocol
+	}
+	return &request{
+		flags:  binary.BigEndian.Uint16(buf[4:6]),
+		typ:    binary.BigEndian.Uint16(buf[6:8]),
+		handle: binary.BigEndian.Uint64(buf[8:16]),
+		offset: binary.BigEndian.Uint64(buf[16:24]),
+		length: binary.BigEndian.Uint32(buf[24:28]),
+	}, nil
+}
+
+func (req *request) encode() []byte {
+	buf := make([]byte, 28)
+	binary.BigEndian.PutUint32(buf[0:4], requestMagic)
+	binary.BigEndian.PutUint16(buf[4:6], req.flags)
+	binary.BigEndian.PutUint16(buf[6:8], req.typ)
+	binary.BigEndian.PutUint64(buf[8:16], req.handle)
+	binary.BigEndian.PutUint64(buf[16:24], req.offset)
+	binary.BigEndian.PutUint32(buf[24:28], req.length)
+	return buf
+}
+
+func simpleReply(handle uint64, errno uint32) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf[0:4], simpleReplyMagic)
+	binary.BigEndian.PutUint32(buf[4:8], errno)
+	binary.BigEndian.PutUint64(buf[8:16], handle)
+	return buf
+}
+
+func optionReply(option uint32, typ uint32, data []byte) []byte {
+	buf := make([]byte, 20+len(data))
+	binary.BigEndian.PutUint64(buf[0:8], optReplyMagic)
+	binary.BigEndian.PutUint32(buf[8:12], option)
+	binary.BigEndian.PutUint32(buf[12:16], typ)
+	binary.BigEndian.PutUint32(buf[16:20], uint32(len(data)))
+	copy(buf[20:], data)
+	return buf
+}
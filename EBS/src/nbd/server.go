@@ -0,0 +1,608 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrExist = errors.New("Export already exist")
+var ErrNotFound = errors.New("Export not found")
+var ErrServerClosed = errors.New("NBD server closed")
+
+// Device is the storage behind an export. storage.Image satisfies it.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	Flush() error
+	Discard(ofs uint64, length uint64) error
+}
+
+// Export is a device served under a name. When Allow is set only clients
+// from those networks can use the export, others are told it does not
+// exist, and it is left out of NBD_OPT_LIST.
+type Export struct {
+	Name     string
+	Device   Device
+	Size     uint64
+	ReadOnly bool
+	Allow    []*net.IPNet
+}
+
+// allows reports whether a client connecting from addr may use e.
+func (e *Export) allows(addr net.Addr) bool {
+	if e.Allow == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range e.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Export) flags() uint16 {
+	flags := FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagCanMultiConn
+	if e.ReadOnly {
+		flags |= FlagReadOnly
+	} else {
+		flags |= FlagSendTrim | FlagSendWriteZeroes
+	}
+	return flags
+}
+
+// maxWorkers bounds the requests of one connection served in parallel.
+const maxWorkers = 16
+
+// zeroBufferSize is the largest write NBD_CMD_WRITE_ZEROES is split into.
+const zeroBufferSize = preferredBlockSize * 64
+
+// Server serves any number of exports to any number of connections.
+type Server struct {
+	mu        sync.Mutex
+	exports   map[string]*Export
+	conns     map[*conn]struct{}
+	listeners map[net.Listener]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func NewServer() *Server {
+	return &Server{
+		exports:   make(map[string]*Export),
+		conns:     make(map[*conn]struct{}),
+		listeners: make(map[net.Listener]struct{}),
+	}
+}
+
+// AddExport makes e available to new connections.
+func (s *Server) AddExport(e *Export) error {
+	if e.Name == "" || len(e.Name) > maxOptionLength || e.Device == nil {
+		return ErrProtocol
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.exports[e.Name]; ok {
+		return ErrExist
+	}
+	s.exports[e.Name] = e
+	return nil
+}
+
+// RemoveExport withdraws an export and disconnects its clients. It
+// returns once they have stopped using the device.
+func (s *Server) RemoveExport(name string) (*Export, error) {
+	s.mu.Lock()
+	e, ok := s.exports[name]
+	if !ok {
+		s.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	delete(s.exports, name)
+
+	var users []*conn
+	for c := range s.conns {
+		if c.export == e {
+			users = append(users, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range users {
+		c.close()
+		<-c.done
+	}
+	return e, nil
+}
+
+func (s *Server) LookupExport(name string) (*Export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.exports[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+// Exports lists the exports, sorted by name.
+func (s *Server) Exports() []*Export {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exports := make([]*Export, 0, len(s.exports))
+	for _, e := range s.exports {
+		exports = append(exports, e)
+	}
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].Name < exports[j].Name
+	})
+	return exports
+}
+
+// Clients returns the number of connections in transmission on export
+// name.
+func (s *Server) Clients(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for c := range s.conns {
+		if c.export != nil && c.export.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		c := &conn{server: s, nc: nc, done: make(chan struct{})}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go c.serve()
+	}
+}
+
+// Close stops the listeners, disconnects every client and waits for them.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// conn is one client connection.
+type conn struct {
+	server *Server
+	nc     net.Conn
+	r      *bufio.Reader
+	export *Export
+	done   chan struct{}
+
+	// wmu serializes replies of parallel requests.
+	wmu       sync.Mutex
+	closeOnce sync.Once
+	// closed is set when the server hangs up, so the error that follows
+	// is not logged.
+	closed int32
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		c.nc.Close()
+	})
+}
+
+func (c *conn) logf(format string, args ...interface{}) {
+	if atomic.LoadInt32(&c.closed) == 0 {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+func (c *conn) serve() {
+	defer func() {
+		c.close()
+		c.server.mu.Lock()
+		delete(c.server.conns, c)
+		c.server.mu.Unlock()
+		close(c.done)
+		c.server.wg.Done()
+	}()
+
+	c.r = bufio.NewReader(c.nc)
+	export, err := c.negotiate()
+	if err != nil {
+		if err != io.EOF {
+			c.logf("NBD negotiation with %v failed: %v\n", c.nc.RemoteAddr(), err)
+		}
+		return
+	}
+	if export == nil {
+		return
+	}
+
+	if err := c.transmit(); err != nil && err != io.EOF {
+		c.logf("NBD connection %v on %v closed: %v\n", c.nc.RemoteAddr(), export.Name, err)
+	}
+}
+
+// negotiate runs the fixed newstyle handshake. It returns the export the
+// client selected, or nil when the client aborted.
+func (c *conn) negotiate() (*Export, error) {
+	var hello [18]byte
+	binary.BigEndian.PutUint64(hello[0:8], nbdMagic)
+	binary.BigEndian.PutUint64(hello[8:16], optMagic)
+	binary.BigEndian.PutUint16(hello[16:18], flagFixedNewstyle|flagNoZeroes)
+	if _, err := c.nc.Write(hello[:]); err != nil {
+		return nil, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(c.r, binary.BigEndian, &clientFlags); err != nil {
+		return nil, err
+	}
+	if clientFlags&clientFlagFixedNewstyle == 0 {
+		return nil, fmt.Errorf("client does not support fixed newstyle negotiation")
+	}
+	noZeroes := clientFlags&clientFlagNoZeroes != 0
+
+	for {
+		var header [16]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint64(header[0:8]) != optMagic {
+			return nil, ErrProtocol
+		}
+		option := binary.BigEndian.Uint32(header[8:12])
+		length := binary.BigEndian.Uint32(header[12:16])
+		if length > maxOptionLength {
+			return nil, ErrProtocol
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+
+		switch option {
+		case optExportName:
+			//旧式选项没有错误回复，找不到export时只能断开
+			e, err := c.lookup(string(data))
+			if err != nil {
+				return nil, err
+			}
+			reply := make([]byte, 10, 10+124)
+			binary.BigEndian.PutUint64(reply[0:8], e.Size)
+			binary.BigEndian.PutUint16(reply[8:10], e.flags())
+			if !noZeroes {
+				reply = append(reply, make([]byte, 124)...)
+			}
+			if _, err := c.nc.Write(reply); err != nil {
+				return nil, err
+			}
+			return c.attach(e)
+
+		case optAbort:
+			c.nc.Write(optionReply(option, repAck, nil))
+			return nil, nil
+
+		case optList:
+			if length != 0 {
+				if err := c.replyOption(option, repErrInvalid, nil); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			for _, e := range c.server.Exports() {
+				if e.Allow != nil {
+					continue
+				}
+				name := make([]byte, 4+len(e.Name))
+				binary.BigEndian.PutUint32(name[0:4], uint32(len(e.Name)))
+				copy(name[4:], e.Name)
+				if err := c.replyOption(option, repServer, name); err != nil {
+					return nil, err
+				}
+			}
+			if err := c.replyOption(option, repAck, nil); err != nil {
+				return nil, err
+			}
+
+		case optInfo, optGo:
+			e, err := c.info(option, data)
+			if err != nil {
+				return nil, err
+			}
+			if e != nil && option == optGo {
+				return c.attach(e)
+			}
+
+		default:
+			if err := c.replyOption(option, repErrUnsup, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (c *conn) replyOption(option uint32, typ uint32, data []byte) error {
+	_, err := c.nc.Write(optionReply(option, typ, data))
+	return err
+}
+
+// info answers NBD_OPT_INFO and NBD_OPT_GO. It returns the export when it
+// was found and acknowledged.
+func (c *conn) info(option uint32, data []byte) (*Export, error) {
+	if len(data) < 6 {
+		return nil, c.replyOption(option, repErrInvalid, nil)
+	}
+	nameLen := binary.BigEndian.Uint32(data[0:4])
+	if uint64(len(data)) < 4+uint64(nameLen)+2 {
+		return nil, c.replyOption(option, repErrInvalid, nil)
+	}
+	name := string(data[4 : 4+nameLen])
+	rest := data[4+nameLen:]
+	n := int(binary.BigEndian.Uint16(rest[0:2]))
+	if len(rest) != 2+2*n {
+		return nil, c.replyOption(option, repErrInvalid, nil)
+	}
+
+	e, err := c.lookup(name)
+	if err != nil {
+		return nil, c.replyOption(option, repErrUnknown, []byte("unknown export "+name))
+	}
+
+	for i := 0; i < n; i++ {
+		if binary.BigEndian.Uint16(rest[2+2*i:]) != infoBlockSize {
+			continue
+		}
+		block := make([]byte, 14)
+		binary.BigEndian.PutUint16(block[0:2], infoBlockSize)
+		binary.BigEndian.PutUint32(block[2:6], minBlockSize)
+		binary.BigEndian.PutUint32(block[6:10], preferredBlockSize)
+		binary.BigEndian.PutUint32(block[10:14], maxPayload)
+		if err := c.replyOption(option, repInfo, block); err != nil {
+			return nil, err
+		}
+	}
+
+	//NBD_INFO_EXPORT总是要回复
+	export := make([]byte, 12)
+	binary.BigEndian.PutUint16(export[0:2], infoExport)
+	binary.BigEndian.PutUint64(export[2:10], e.Size)
+	binary.BigEndian.PutUint16(export[10:12], e.flags())
+	if err := c.replyOption(option, repInfo, export); err != nil {
+		return nil, err
+	}
+	if err := c.replyOption(option, repAck, nil); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// lookup finds the export name for this client. An export the client is
+// not allowed to use is not found.
+func (c *conn) lookup(name string) (*Export, error) {
+	e, err := c.server.LookupExport(name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.allows(c.nc.RemoteAddr()) {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+// attach binds the connection to e, unless e was removed meanwhile.
+func (c *conn) attach(e *Export) (*Export, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.server.exports[e.Name] != e {
+		return nil, ErrNotFound
+	}
+	c.export = e
+	return e, nil
+}
+
+func (c *conn) transmit() error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	workers := make(chan struct{}, maxWorkers)
+
+	for {
+		req, err := readRequest(c.r)
+		if err != nil {
+			return err
+		}
+
+		if req.typ == cmdDisc {
+			return nil
+		}
+
+		var data []byte
+		if req.typ == cmdWrite {
+			if req.length > maxPayload {
+				return ErrProtocol
+			}
+			data = make([]byte, req.length)
+			if _, err := io.ReadFull(c.r, data); err != nil {
+				return err
+			}
+		}
+
+		workers <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			c.handle(req, data)
+		}()
+	}
+}
+
+func (c *conn) handle(req *request, data []byte) {
+	e := c.export
+	var payload []byte
+	errno := uint32(0)
+
+	switch {
+	case req.typ != cmdFlush && (req.offset > e.Size || uint64(req.length) > e.Size-req.offset):
+		errno = errInval
+		if req.typ == cmdWrite || req.typ == cmdWriteZeroes {
+			errno = errNoSpc
+		}
+
+	case req.typ == cmdRead:
+		if req.length > maxPayload {
+			errno = errOverflow
+			break
+		}
+		payload = make([]byte, req.length)
+		if _, err := e.Device.ReadAt(payload, int64(req.offset)); err != nil && err != io.EOF {
+			payload, errno = nil, errIO
+		}
+
+	case req.typ == cmdWrite:
+		if e.ReadOnly {
+			errno = errPerm
+		} else if _, err := e.Device.WriteAt(data, int64(req.offset)); err != nil {
+			errno = errIO
+		} else if req.flags&cmdFlagFUA != 0 && e.Device.Flush() != nil {
+			errno = errIO
+		}
+
+	case req.typ == cmdFlush:
+		if e.Device.Flush() != nil {
+			errno = errIO
+		}
+
+	case req.typ == cmdTrim:
+		if e.ReadOnly {
+			errno = errPerm
+		} else if err := e.Device.Discard(req.offset, uint64(req.length)); err != nil {
+			errno = errIO
+		} else if req.flags&cmdFlagFUA != 0 && e.Device.Flush() != nil {
+			errno = errIO
+		}
+
+	case req.typ == cmdWriteZeroes:
+		errno = c.writeZeroes(req)
+
+	default:
+		errno = errInval
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.nc.Write(simpleReply(req.handle, errno)); err != nil {
+		c.close()
+		return
+	}
+	if errno == 0 && payload != nil {
+		if _, err := c.nc.Write(payload); err != nil {
+			c.close()
+		}
+	}
+}
+
+// writeZeroes writes zero buffers over the range. Discard cannot stand in
+// for it: rbd skips the unaligned head and tail of a discard, and whole
+// objects under rbd_skip_partial_discard, leaving the old data in place.
+func (c *conn) writeZeroes(req *request) uint32 {
+	e := c.export
+	if e.ReadOnly {
+		return errPerm
+	}
+
+	zero := make([]byte, zeroBufferSize)
+	for done := uint64(0); done < uint64(req.length); {
+		n := uint64(len(zero))
+		if left := uint64(req.length) - done; left < n {
+			n = left
+		}
+		if _, err := e.Device.WriteAt(zero[:n], int64(req.offset+done)); err != nil {
+			return errIO
+		}
+		done += n
+	}
+
+	if req.flags&cmdFlagFUA != 0 && e.Device.Flush() != nil {
+		return errIO
+	}
+	return 0
+}
@@ -0,0 +1,306 @@
+package nbd
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+)
+
+// objectSize is the granularity memDevice discards at.
+const objectSize = 64 << 10
+
+// memDevice is an in-memory image. Like rbd with skip_partial_discard it
+// only discards whole objects and leaves the rest of the range in place.
+type memDevice struct {
+	mu      sync.Mutex
+	data    []byte
+	flushes int
+}
+
+func newMemDevice(size int) *memDevice {
+	return &memDevice{data: make([]byte, size)}
+}
+
+func (d *memDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return copy(p, d.data[off:]), nil
+}
+
+func (d *memDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return copy(d.data[off:], p), nil
+}
+
+func (d *memDevice) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flushes++
+	return nil
+}
+
+func (d *memDevice) Discard(ofs uint64, length uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	start := (ofs + objectSize - 1) / objectSize * objectSize
+	for pos := start; pos+objectSize <= ofs+length; pos += objectSize {
+		copy(d.data[pos:pos+objectSize], make([]byte, objectSize))
+	}
+	return nil
+}
+
+// serve starts a server on a loopback port with the exports and returns
+// its address.
+func serve(t *testing.T, exports ...*Export) (*Server, string) {
+	s := NewServer()
+	for _, e := range exports {
+		if err := s.AddExport(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, l.Addr().String()
+}
+
+func pattern(n int, seed byte) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = seed + byte(i%251)
+	}
+	return p
+}
+
+func TestHandshake(t *testing.T) {
+	const size = 1 << 20
+	_, addr := serve(t,
+		&Export{Name: "rw", Device: newMemDevice(size), Size: size},
+		&Export{Name: "ro", Device: newMemDevice(size), Size: size, ReadOnly: true})
+
+	tests := []struct {
+		name  string
+		ok    bool
+		flags uint16
+	}{
+		{"rw", true, FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagCanMultiConn | FlagSendTrim | FlagSendWriteZeroes},
+		{"ro", true, FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagCanMultiConn | FlagReadOnly},
+		{"missing", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Dial("tcp", addr, tt.name)
+			if !tt.ok {
+				if err == nil {
+					c.Close()
+					t.Fatal("Dial of unknown export succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if c.Size() != size || c.Flags() != tt.flags {
+				t.Errorf("size %v flags %#x, want %v %#x", c.Size(), c.Flags(), size, tt.flags)
+			}
+		})
+	}
+
+	names, err := List("tcp", addr)
+	if err != nil || len(names) != 2 || names[0] != "ro" || names[1] != "rw" {
+		t.Errorf("List = %v, %v", names, err)
+	}
+}
+
+func TestTransmission(t *testing.T) {
+	const size = 4 * objectSize
+	type step struct {
+		op     string
+		off    uint64
+		length int
+		errno  uint32
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// zeroes are the ranges expected to read back as zero; the rest
+		// holds what the write steps wrote.
+		zeroes [][2]uint64
+	}{
+		{
+			name:  "write and read back",
+			steps: []step{{"write", 100, 5000, 0}, {"read", 100, 5000, 0}},
+		},
+		{
+			name: "write zeroes unaligned",
+			steps: []step{{"fill", 0, size, 0}, {"zero", 1000, objectSize + 3000, 0},
+				{"read", 0, size, 0}},
+			zeroes: [][2]uint64{{1000, objectSize + 4000}},
+		},
+		{
+			name: "write zeroes across objects",
+			steps: []step{{"fill", 0, size, 0}, {"zero", objectSize / 2, 2 * objectSize, 0},
+				{"read", 0, size, 0}},
+			zeroes: [][2]uint64{{objectSize / 2, objectSize/2 + 2*objectSize}},
+		},
+		{
+			name: "trim whole object",
+			steps: []step{{"fill", 0, size, 0}, {"trim", objectSize, objectSize, 0},
+				{"read", 0, size, 0}},
+			zeroes: [][2]uint64{{objectSize, 2 * objectSize}},
+		},
+		{
+			name: "out of range",
+			steps: []step{{"read", size - 10, 20, errInval}, {"write", size, 1, errNoSpc},
+				{"zero", size - 1, 2, errNoSpc}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := newMemDevice(size)
+			_, addr := serve(t, &Export{Name: "vol", Device: dev, Size: size})
+			c, err := Dial("tcp", addr, "vol")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			want := make([]byte, size)
+			for _, s := range tt.steps {
+				var err error
+				switch s.op {
+				case "fill", "write":
+					p := pattern(s.length, byte(s.off))
+					if s.errno == 0 {
+						copy(want[s.off:], p)
+					}
+					_, err = c.WriteAt(p, int64(s.off))
+				case "read":
+					p := make([]byte, s.length)
+					_, err = c.ReadAt(p, int64(s.off))
+					if err == nil {
+						for _, z := range tt.zeroes {
+							copy(want[z[0]:z[1]], make([]byte, z[1]-z[0]))
+						}
+						if !bytes.Equal(p, want[s.off:s.off+uint64(s.length)]) {
+							t.Errorf("read %v+%v returned unexpected data", s.off, s.length)
+						}
+					}
+				case "zero":
+					err = c.WriteZeroes(s.off, uint32(s.length))
+				case "trim":
+					err = c.Trim(s.off, uint32(s.length))
+				}
+				if s.errno == 0 && err != nil {
+					t.Fatalf("%v %v+%v: %v", s.op, s.off, s.length, err)
+				}
+				if s.errno != 0 {
+					if re, ok := err.(*ReplyError); !ok || re.Errno != s.errno {
+						t.Errorf("%v %v+%v = %v, want errno %v", s.op, s.off, s.length, err, s.errno)
+					}
+				}
+			}
+			if err := c.Flush(); err != nil || dev.flushes == 0 {
+				t.Errorf("Flush = %v, %v device flushes", err, dev.flushes)
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	const size = objectSize
+	dev := newMemDevice(size)
+	copy(dev.data, pattern(size, 1))
+	_, addr := serve(t, &Export{Name: "ro", Device: dev, Size: size, ReadOnly: true})
+	c, err := Dial("tcp", addr, "ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ops := []struct {
+		name string
+		do   func() error
+	}{
+		{"write", func() error { _, err := c.WriteAt([]byte{0}, 0); return err }},
+		{"trim", func() error { return c.Trim(0, size) }},
+		{"write zeroes", func() error { return c.WriteZeroes(0, size) }},
+	}
+	for _, op := range ops {
+		if re, ok := op.do().(*ReplyError); !ok || re.Errno != errPerm {
+			t.Errorf("%v on read-only export = %v, want EPERM", op.name, re)
+		}
+	}
+	if !bytes.Equal(dev.data, pattern(size, 1)) {
+		t.Error("read-only export modified")
+	}
+}
+
+func TestRemoveExport(t *testing.T) {
+	const size = objectSize
+	s, addr := serve(t, &Export{Name: "vol", Device: newMemDevice(size), Size: size})
+	c, err := Dial("tcp", addr, "vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if n := s.Clients("vol"); n != 1 {
+		t.Errorf("Clients = %v, want 1", n)
+	}
+
+	if _, err := s.RemoveExport("vol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Error("read after RemoveExport succeeded")
+	}
+	if _, err := s.RemoveExport("vol"); err != ErrNotFound {
+		t.Errorf("second RemoveExport = %v", err)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	const size = objectSize
+	network := func(cidr string) *net.IPNet {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	_, addr := serve(t,
+		&Export{Name: "open", Device: newMemDevice(size), Size: size},
+		&Export{Name: "loopback", Device: newMemDevice(size), Size: size, Allow: []*net.IPNet{network("127.0.0.0/8")}},
+		&Export{Name: "remote", Device: newMemDevice(size), Size: size,
+			Allow: []*net.IPNet{network("10.0.0.0/8"), network("::1/128")}})
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"open", true},
+		{"loopback", true},
+		{"remote", false},
+	}
+	for _, tt := range tests {
+		c, err := Dial("tcp", addr, tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("Dial(%v) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err == nil {
+			c.Close()
+		}
+	}
+
+	// Exports restricted to some clients are never listed.
+	names, err := List("tcp", addr)
+	if err != nil || len(names) != 1 || names[0] != "open" {
+		t.Errorf("List = %v, %v", names, err)
+	}
+}
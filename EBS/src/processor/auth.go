@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"time"
+	"context"
+	"auth"
+	"repository"
+	"signer"
+)
+
+//管理员的AccessKey和SecretKey；allowUnsigned为true时不签名的请求按管理员处理，默认拒绝
+var adminAccessKey string
+var adminSecretKey string
+var allowUnsigned bool
+var verifier = auth.NewVerifier(0)
+
+//skew为签名时间与服务器时间允许的偏差，0为auth.DefaultSkew
+func SetAuthConfig(accessKey string, secretKey string, skew time.Duration, unsigned bool) {
+	adminAccessKey = accessKey
+	adminSecretKey = secretKey
+	allowUnsigned = unsigned
+	verifier = auth.NewVerifier(skew)
+}
+
+func sendUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", signer.Algorithm)
+	SendStatus(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+}
+
+/*
+校验请求的签名(见signer包)，AccessKeyId为管理员或租户的AccessKey；租户请求的租户保存在context中。
+没有签名(除非配置了allow_unsigned)、签名超出时间偏差、签名不符或Nonce已使用过时返回401
+*/
+func Authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	c, err := auth.Credential(r)
+	if err == auth.ErrNoSignature && allowUnsigned {
+		return r, true
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unauthorized request %v: %v\n", r.RequestURI, err)
+		sendUnauthorized(w)
+		return r, false
+	}
+
+	var t *repository.Tenant
+	secretKey := adminSecretKey
+	if adminAccessKey == "" || c.AccessKeyID != adminAccessKey {
+		t, err = repo.Tenants().GetByAccessKey(c.AccessKeyID)
+		if err == repository.ErrNotFound {
+			fmt.Fprintf(os.Stderr, "Unauthorized request %v: %v %v\n", r.RequestURI, auth.ErrUnknownKey, c.AccessKeyID)
+			sendUnauthorized(w)
+			return r, false
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Load tenant of access key %v failed: %v\n", c.AccessKeyID, err)
+			SendStatus(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return r, false
+		}
+		secretKey = t.SecretKey
+	}
+
+	if err := verifier.Verify(r, c, secretKey); err != nil {
+		fmt.Fprintf(os.Stderr, "Unauthorized request %v of access key %v: %v\n", r.RequestURI, c.AccessKeyID, err)
+		sendUnauthorized(w)
+		return r, false
+	}
+
+	if t != nil {
+		r = r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, t))
+	}
+	return r, true
+}
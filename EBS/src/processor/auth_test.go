@@ -0,0 +1,104 @@
+package processor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"repository"
+	"signer"
+)
+
+//签名并返回服务端收到的请求
+func signedRequest(t *testing.T, accessKey string, secretKey string, target string) *http.Request {
+	client, err := http.NewRequest(http.MethodGet, "http://ebs:6666"+target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.New(accessKey, secretKey).Sign(client); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, client.URL.RequestURI(), nil)
+	r.Header.Set("Authorization", client.Header.Get("Authorization"))
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := repository.NewMemoryStore()
+	SetRepository(store)
+	defer SetRepository(nil)
+	defer SetAuthConfig("", "", 0, false)
+	if err := store.Tenants().Create(&repository.Tenant{Name: "acme", AccessKey: "ACMEKEY", SecretKey: "acme-secret", Pool: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const target = "/?Action=DelPool&PoolName=rbd"
+	tests := []struct {
+		name     string
+		admin    string
+		unsigned bool
+		request  func() *http.Request
+		status   int
+		//通过时context中的租户，管理员为空
+		tenant string
+	}{
+		//默认拒绝不签名的请求，没有配置管理员密钥时也一样
+		{"unsigned", "ADMINKEY", false, func() *http.Request { return httptest.NewRequest(http.MethodGet, target, nil) }, http.StatusUnauthorized, ""},
+		{"unsigned without admin key", "", false, func() *http.Request { return httptest.NewRequest(http.MethodGet, target, nil) }, http.StatusUnauthorized, ""},
+		{"unsigned allowed", "", true, func() *http.Request { return httptest.NewRequest(http.MethodGet, target, nil) }, http.StatusOK, ""},
+		{"malformed", "", true, func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("Authorization", "Basic YWRtaW46YWRtaW4=")
+			return r
+		}, http.StatusUnauthorized, ""},
+		{"admin", "ADMINKEY", false, func() *http.Request { return signedRequest(t, "ADMINKEY", "admin-secret", target) }, http.StatusOK, ""},
+		{"admin with wrong secret", "ADMINKEY", false, func() *http.Request { return signedRequest(t, "ADMINKEY", "acme-secret", target) }, http.StatusUnauthorized, ""},
+		//租户的AccessKey从数据库中查找，用租户的SecretKey校验
+		{"tenant", "ADMINKEY", false, func() *http.Request { return signedRequest(t, "ACMEKEY", "acme-secret", target) }, http.StatusOK, "acme"},
+		{"tenant allowing unsigned", "", true, func() *http.Request { return signedRequest(t, "ACMEKEY", "acme-secret", target) }, http.StatusOK, "acme"},
+		{"tenant with admin secret", "ADMINKEY", false, func() *http.Request { return signedRequest(t, "ACMEKEY", "admin-secret", target) }, http.StatusUnauthorized, ""},
+		{"unknown key", "ADMINKEY", false, func() *http.Request { return signedRequest(t, "NOBODY", "admin-secret", target) }, http.StatusUnauthorized, ""},
+		//没有管理员密钥时不能用空的AccessKey冒充管理员
+		{"admin key not configured", "", true, func() *http.Request { return signedRequest(t, "ADMINKEY", "", target) }, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		secret := ""
+		if tt.admin != "" {
+			secret = "admin-secret"
+		}
+		SetAuthConfig(tt.admin, secret, time.Minute, tt.unsigned)
+		w := httptest.NewRecorder()
+		r, ok := Authenticate(w, tt.request())
+		if ok != (tt.status == http.StatusOK) || w.Code != tt.status {
+			t.Errorf("%v: authenticated %v, status %v %v", tt.name, ok, w.Code, w.Body)
+			continue
+		}
+		if !ok {
+			if w.Header().Get("WWW-Authenticate") != signer.Algorithm {
+				t.Errorf("%v: headers %v", tt.name, w.Header())
+			}
+			continue
+		}
+		name := ""
+		if tenant := requestTenant(r); tenant != nil {
+			name = tenant.Name
+		}
+		if name != tt.tenant {
+			t.Errorf("%v: tenant %q", tt.name, name)
+		}
+	}
+
+	//签名只能使用一次
+	SetAuthConfig("ADMINKEY", "admin-secret", time.Minute, false)
+	r := signedRequest(t, "ACMEKEY", "acme-secret", target)
+	header := r.Header.Get("Authorization")
+	if _, ok := Authenticate(httptest.NewRecorder(), r); !ok {
+		t.Fatal("tenant request refused")
+	}
+	r = httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Authorization", header)
+	w := httptest.NewRecorder()
+	if _, ok := Authenticate(w, r); ok || w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed tenant request: %v", w.Code)
+	}
+}
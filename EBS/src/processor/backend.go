@@ -0,0 +1,95 @@
+package processor
+
+import (
+	"net/http"
+	"errors"
+	"storage"
+	"mon"
+)
+
+var backend storage.Backend
+
+var errNoBackend = errors.New("Storage backend not set")
+
+//设置存储后端，启动时为ceph，测试时可替换为内存实现
+func SetBackend(b storage.Backend) {
+	backend = b
+}
+
+func connectCluster() (storage.Cluster, error) {
+	if backend == nil {
+		return nil, errNoBackend
+	}
+	conn, err := backend.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return &tenantCluster{Cluster: conn}, nil
+}
+
+//租户的pool用租户的cephx用户打开，其他操作仍使用管理员连接
+type tenantCluster struct {
+	storage.Cluster
+	opened []storage.Cluster
+}
+
+func (c *tenantCluster) OpenPool(name string) (storage.Pool, error) {
+	b := tenantBackend(name)
+	if b == nil {
+		return c.Cluster.OpenPool(name)
+	}
+	conn, err := b.Connect()
+	if err != nil {
+		return nil, err
+	}
+	c.opened = append(c.opened, conn)
+	return conn.OpenPool(name)
+}
+
+func (c *tenantCluster) Shutdown() {
+	for _, conn := range c.opened {
+		conn.Shutdown()
+	}
+	c.opened = nil
+	c.Cluster.Shutdown()
+}
+
+//存储错误对应的应答，X-Ebs-Code仍为errcode；不存在的统一为旧接口的404
+var storageErrors = map[error]apiError {
+	storage.ErrNotFound        : {http.StatusNotFound, "NotFound", false},
+	storage.ErrPoolNotFound    : {http.StatusNotFound, "PoolNotFound", false},
+	storage.ErrImageNotFound   : {http.StatusNotFound, "VolumeNotFound", false},
+	storage.ErrExist           : {http.StatusConflict, "AlreadyExists", false},
+	storage.ErrBusy            : {http.StatusConflict, "ResourceBusy", true},
+	storage.ErrReadOnly        : {http.StatusConflict, "ReadOnly", false},
+	storage.ErrInvalidArgument : {http.StatusBadRequest, "InvalidArgument", false},
+	storage.ErrNotSupported    : {http.StatusNotImplemented, "NotSupported", false},
+}
+
+//按存储错误返回对应的状态码，其他错误返回errcode
+func sendStorageError(w http.ResponseWriter, err error, errcode int) {
+	if storage.IsNotFound(err) {
+		errcode = statusNotFoundErr
+	}
+	if e, ok := storageErrors[err]; ok {
+		sendError(w, errcode, e, err.Error())
+		return
+	}
+	SendStatus(w, errcode, "")
+}
+
+//mon命令的错误按存储错误返回，命令中找不到的对象就是pool
+func sendMonError(w http.ResponseWriter, err error, errcode int) {
+	cause := mon.Cause(err)
+	if cause == storage.ErrNotFound {
+		cause = storage.ErrPoolNotFound
+	}
+	if e, ok := storageErrors[cause]; ok {
+		if storage.IsNotFound(cause) {
+			errcode = statusNotFoundErr
+		}
+		sendError(w, errcode, e, err.Error())
+		return
+	}
+	SendStatus(w, errcode, err.Error())
+}
@@ -0,0 +1,467 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+	"job"
+	"repository"
+)
+
+//每个卷保留的可用备份数，0表示全部保留；被保留的增量备份依赖的备份也会保留
+var backupKeep = 0
+
+//一条备份链最多包含的备份数，达到后下一次做全量备份
+var backupMaxChain = 7
+
+func SetBackupConfig(keep int, maxChain int) {
+	backupKeep = keep
+	if maxChain > 0 {
+		backupMaxChain = maxChain
+	}
+}
+
+//备份写入{pool}/{volume}/{id}/data和manifest.json
+//全量备份只包含已分配的非零数据；增量备份包含自Parent以来改变的区段，Zeroed为被清零或丢弃的区段
+type BackupManifest struct {
+	Id           string
+	Pool         string
+	Volume       string
+	Type         string
+	Chain        string
+	Parent       string
+	Snapshot     string
+	Size         uint64
+	StripePeriod uint64
+	DataObject   string
+	DataSize     uint64
+	Extents      []Extent
+	Zeroed       []Extent
+	CreateTime   string
+}
+
+type BackupInfo struct {
+	Id         string
+	Pool       string
+	Volume     string
+	Type       string
+	Chain      string
+	Parent     string
+	Snapshot   string
+	Bucket     string
+	Prefix     string
+	Size       uint64
+	DataSize   uint64
+	State      string
+	CreateTime string
+}
+
+func backupInfo(b *repository.Backup) *BackupInfo {
+	return &BackupInfo{
+		Id:         b.Id,
+		Pool:       b.Pool,
+		Volume:     b.Volume,
+		Type:       b.Type,
+		Chain:      b.Chain,
+		Parent:     b.Parent,
+		Snapshot:   b.Snapshot,
+		Bucket:     b.Bucket,
+		Prefix:     b.Prefix,
+		Size:       b.Size,
+		DataSize:   b.DataSize,
+		State:      b.State,
+		CreateTime: b.CreateTime,
+	}
+}
+
+//备份ID同时作为备份所用快照的名称
+func newBackupID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "backup-" + hex.EncodeToString(b), nil
+}
+
+//backups按Seq排序，返回最新的可用备份和它所在链中可用备份的数量
+func latestBackup(backups []*repository.Backup) (*repository.Backup, int) {
+	var latest *repository.Backup
+	for _, b := range backups {
+		if b.State == repository.BackupAvailable {
+			latest = b
+		}
+	}
+	if latest == nil {
+		return nil, 0
+	}
+
+	length := 0
+	for _, b := range backups {
+		if b.Chain == latest.Chain && b.State == repository.BackupAvailable {
+			length++
+		}
+	}
+	return latest, length
+}
+
+//合并相邻的区段
+func appendExtent(extents []Extent, offset uint64, length uint64) []Extent {
+	if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Length == offset {
+		extents[n-1].Length += length
+		return extents
+	}
+	return append(extents, Extent{Offset: offset, Length: length})
+}
+
+//上一次备份的快照仍在且链未满时做增量备份，否则做全量备份
+//新备份的快照保留在卷上作为下一次增量的基准，上一次的快照随后删除
+func (volume *Volume) backup(bucket string, full bool, p *job.Progress) (*repository.Backup, error) {
+	backups, err := repo.Backups().List(volume.parentPool, volume.name)
+	if err != nil {
+		return nil, err
+	}
+	latest, chainLength := latestBackup(backups)
+
+	conn, ioctx, err := NewConnAndOpenPool(volume.parentPool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := ioctx.OpenImage(volume.name, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		return nil, err
+	}
+	defer head.Close()
+
+	baseExists := false
+	if latest != nil {
+		snaps, err := head.ListSnapshots()
+		if err != nil {
+			return nil, err
+		}
+		for _, snap := range snaps {
+			if snap.Name == latest.Snapshot {
+				baseExists = true
+			}
+		}
+	}
+
+	id, err := newBackupID()
+	if err != nil {
+		return nil, err
+	}
+	b := &repository.Backup{
+		Id:       id,
+		Pool:     volume.parentPool,
+		Volume:   volume.name,
+		Type:     repository.BackupFull,
+		Chain:    id,
+		Snapshot: id,
+		Bucket:   bucket,
+		Prefix:   volume.resource() + "/" + id,
+		State:    repository.BackupCreating,
+	}
+	from := ""
+	if !full && baseExists && latest.Bucket == bucket && chainLength < backupMaxChain {
+		b.Type = repository.BackupIncremental
+		b.Chain = latest.Chain
+		b.Parent = latest.Id
+		from = latest.Snapshot
+	}
+
+	if err := head.CreateSnapshot(b.Snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "CreateSnapshot %v of %v failed: %v\n", b.Snapshot, volume.resource(), err)
+		return nil, err
+	}
+	if b.Size, err = head.GetSize(); err == nil {
+		err = repo.Backups().Add(b)
+	}
+	if err != nil {
+		head.RemoveSnapshot(b.Snapshot)
+		return nil, err
+	}
+
+	manifest, err := volume.uploadBackup(b, from, p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Backup %v of %v failed: %v\n", b.Id, volume.resource(), err)
+		if err := head.RemoveSnapshot(b.Snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "RemoveSnapshot %v of %v failed: %v\n", b.Snapshot, volume.resource(), err)
+		}
+		b.State = repository.BackupError
+		repo.Backups().Update(b)
+		return nil, err
+	}
+
+	b.State = repository.BackupAvailable
+	b.DataSize = manifest.DataSize
+	if err := repo.Backups().Update(b); err != nil {
+		return nil, err
+	}
+
+	if baseExists {
+		if err := head.RemoveSnapshot(latest.Snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "RemoveSnapshot %v of %v failed: %v\n", latest.Snapshot, volume.resource(), err)
+		}
+	}
+	pruneBackups(volume.parentPool, volume.name)
+	return b, nil
+}
+
+//上传快照b.Snapshot中自from以来改变的区段，from为空时上传全部已分配的区段
+func (volume *Volume) uploadBackup(b *repository.Backup, from string, p *job.Progress) (*BackupManifest, error) {
+	conn, ioctx, err := NewConnAndOpenPool(volume.parentPool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := ioctx.OpenImage(volume.name, b.Snapshot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Open snapshot %v of %v failed: %v\n", b.Snapshot, volume.resource(), err)
+		return nil, err
+	}
+	defer image.Close()
+
+	period, err := image.GetStripePeriod()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "GetStripePeriod failed: %v\n", err)
+		return nil, err
+	}
+
+	manifest := &BackupManifest{
+		Id:           b.Id,
+		Pool:         b.Pool,
+		Volume:       b.Volume,
+		Type:         b.Type,
+		Chain:        b.Chain,
+		Parent:       b.Parent,
+		Snapshot:     b.Snapshot,
+		Size:         b.Size,
+		StripePeriod: period,
+		DataObject:   dataObjectName(b.Prefix),
+		Zeroed:       []Extent{},
+	}
+
+	var changed []span
+	var total uint64
+	err = image.DiffIterate(from, 0, b.Size, func(offset uint64, length uint64, exists bool) error {
+		if exists {
+			changed = append(changed, span{offset, length})
+			total += length
+		} else if from != "" {
+			manifest.Zeroed = appendExtent(manifest.Zeroed, offset, length)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DiffIterate %v from %q failed: %v\n", volume.resource(), from, err)
+		return nil, err
+	}
+
+	//全量备份恢复到新镜像上，全零的块可以直接跳过；增量备份中全零的块要记录下来覆盖旧数据
+	object := newDataObject(b.Bucket, manifest.DataObject, b.Size)
+	var done uint64
+	throttled, err := throttle(image, volume.parentPool, volume.name)
+	if err != nil {
+		return nil, err
+	}
+	err = forEachChunk(throttled, changed, period, func(c *chunk) error {
+		done += uint64(len(c.data))
+		p.Update(done, total)
+		if isZero(c.data) {
+			if from != "" {
+				manifest.Zeroed = appendExtent(manifest.Zeroed, c.offset, uint64(len(c.data)))
+			}
+			return nil
+		}
+		return object.write(c.offset, c.data)
+	})
+	if err == nil {
+		err = object.close()
+	}
+	if err != nil {
+		object.abort()
+		return nil, err
+	}
+	manifest.Extents = object.extents
+	manifest.DataSize = object.size
+
+	manifest.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	payload, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := ossClient.PutObject(b.Bucket, manifestObjectName(b.Prefix), payload, "application/json"); err != nil {
+		fmt.Fprintf(os.Stderr, "Put manifest of %v failed: %v\n", b.Id, err)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+//保留最新的backupKeep个可用备份、未完成的恢复正在使用的备份及它们依赖的备份，
+//其余可用的备份从新到旧删除，先删除依赖者；创建中和失败的备份不删除
+func pruneBackups(pool string, volume string) {
+	if backupKeep <= 0 {
+		return
+	}
+
+	backups, err := repo.Backups().List(pool, volume)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List backups of %v/%v failed: %v\n", pool, volume, err)
+		return
+	}
+	//恢复的目标可以是其它卷，所以要检查所有的检查点
+	restores, err := repo.Restores().List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List restores failed: %v\n", err)
+		return
+	}
+
+	byId := make(map[string]*repository.Backup, len(backups))
+	for _, b := range backups {
+		byId[b.Id] = b
+	}
+	keep := make(map[string]bool)
+	keepChain := func(b *repository.Backup) {
+		for ; b != nil && !keep[b.Id]; b = byId[b.Parent] {
+			keep[b.Id] = true
+		}
+	}
+	for _, restore := range restores {
+		keepChain(byId[restore.BackupId])
+	}
+	kept := 0
+	for i := len(backups) - 1; i >= 0 && kept < backupKeep; i-- {
+		if backups[i].State != repository.BackupAvailable {
+			continue
+		}
+		kept++
+		keepChain(backups[i])
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].State == repository.BackupAvailable && !keep[backups[i].Id] {
+			deleteBackup(backups[i])
+		}
+	}
+}
+
+//先删除目录记录，仍被依赖时不删除对象
+func deleteBackup(b *repository.Backup) error {
+	if err := repo.Backups().Delete(b.Id); err != nil {
+		fmt.Fprintf(os.Stderr, "Delete backup %v failed: %v\n", b.Id, err)
+		return err
+	}
+	for _, key := range []string{dataObjectName(b.Prefix), manifestObjectName(b.Prefix)} {
+		if err := ossClient.DeleteObject(b.Bucket, key); err != nil {
+			fmt.Fprintf(os.Stderr, "Delete object %v/%v of backup %v failed: %v\n", b.Bucket, key, b.Id, err)
+		}
+	}
+	return nil
+}
+
+/*
+有可用的上一次备份时做增量备份，Full=true时强制全量备份
+GET /?Action=BackupDisk&PoolName={PoolName}&VolumeName={volumeName}&OSSBucket={bucket}[&Full=true] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 202 Accepted
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"JobId":"job-..."}
+*/
+func BackupDisk(w http.ResponseWriter, r *http.Request) {
+	poolName := r.FormValue("PoolName")
+	volumeName := r.FormValue("VolumeName")
+	bucket := r.FormValue("OSSBucket")
+	full := false
+	if value := r.FormValue("Full"); value != "" {
+		var err error
+		if full, err = strconv.ParseBool(value); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+			SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+	}
+	if poolName == "" || volumeName == "" || bucket == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if ossClient == nil {
+		fmt.Fprintf(os.Stderr, "Backup %v/%v failed: %v\n", poolName, volumeName, errOSSDisabled)
+		SendStatus(w, statusBackupDiskErr, errOSSDisabled.Error())
+		return
+	}
+	if err := ossClient.HeadBucket(bucket); err != nil {
+		fmt.Fprintf(os.Stderr, "Head bucket %v failed: %v\n", bucket, err)
+		SendStatus(w, statusBackupDiskErr, err.Error())
+		return
+	}
+
+	volume, err := LoadVolume(volumeName, poolName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", poolName, volumeName, err)
+		SendNotFound(w, "Volume")
+		return
+	}
+
+	submitJob(w, "BackupDisk", volume.resource(), statusBackupDiskErr, func(p *job.Progress) error {
+		_, err := volume.backup(bucket, full, p)
+		return err
+	})
+}
+
+/*
+按卷和创建顺序列出备份；不指定VolumeName时列出池中所有卷的备份，都不指定时列出全部
+GET /?Action=ListBackups[&PoolName={PoolName}[&VolumeName={volumeName}]] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+Content-Length: n
+
+[{"Id":"backup-...","Pool":"rbd","Volume":"vol","Type":"full","Chain":"backup-...","Parent":"",...,"State":"available"}]
+*/
+func ListBackups(w http.ResponseWriter, r *http.Request) {
+	poolName := r.FormValue("PoolName")
+	volumeName := r.FormValue("VolumeName")
+	if poolName == "" && volumeName != "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	backups, err := repo.Backups().List(poolName, volumeName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List backups failed: %v\n", err)
+		SendStatus(w, statusListBackupsErr, "")
+		return
+	}
+
+	infos := make([]*BackupInfo, len(backups))
+	for i, b := range backups {
+		infos[i] = backupInfo(b)
+	}
+	payload, err := json.Marshal(infos)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusListBackupsErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, string(payload))
+}
@@ -0,0 +1,103 @@
+package processor
+
+import (
+	"reflect"
+	"repository"
+	"sort"
+	"testing"
+)
+
+func TestPruneBackups(t *testing.T) {
+	type backup struct {
+		id     string
+		parent string
+		state  string
+	}
+	available := repository.BackupAvailable
+	tests := []struct {
+		name     string
+		keep     int
+		backups  []backup
+		restores []string
+		deleted  []string
+	}{
+		{
+			name:    "keeps newest",
+			keep:    1,
+			backups: []backup{{"f1", "", available}, {"i1", "f1", available}, {"f2", "", available}},
+			deleted: []string{"f1", "i1"},
+		},
+		{
+			name:    "keeps parents",
+			keep:    1,
+			backups: []backup{{"f1", "", available}, {"i1", "f1", available}, {"i2", "i1", available}},
+		},
+		{
+			name: "skips unavailable",
+			keep: 1,
+			backups: []backup{{"f1", "", available}, {"f2", "", repository.BackupError},
+				{"f3", "", repository.BackupCreating}, {"f4", "", available}},
+			deleted: []string{"f1"},
+		},
+		{
+			name:     "keeps restoring chain",
+			keep:     1,
+			backups:  []backup{{"f1", "", available}, {"i1", "f1", available}, {"i2", "i1", available}, {"f2", "", available}},
+			restores: []string{"i1"},
+			deleted:  []string{"i2"},
+		},
+		{
+			name:    "disabled",
+			keep:    0,
+			backups: []backup{{"f1", "", available}, {"f2", "", available}},
+		},
+	}
+
+	defer SetRepository(nil)
+	defer SetBackupConfig(backupKeep, backupMaxChain)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oss := startFakeOSS(t)
+			store := repository.NewMemoryStore()
+			SetRepository(store)
+			SetBackupConfig(tt.keep, backupMaxChain)
+
+			for _, b := range tt.backups {
+				prefix := "rbd/vol/" + b.id
+				err := store.Backups().Add(&repository.Backup{Id: b.id, Pool: "rbd", Volume: "vol", Parent: b.parent,
+					Bucket: "backup", Prefix: prefix, State: b.state})
+				if err != nil {
+					t.Fatalf("Add %v: %v", b.id, err)
+				}
+				if err := ossClient.PutObject("backup", dataObjectName(prefix), []byte(b.id), ""); err != nil {
+					t.Fatalf("PutObject %v: %v", b.id, err)
+				}
+			}
+			//恢复到其它卷的检查点同样保护备份
+			for _, id := range tt.restores {
+				if err := store.Restores().Save(&repository.Restore{Pool: "rbd", Volume: "from-" + id, BackupId: id}); err != nil {
+					t.Fatalf("Save restore: %v", err)
+				}
+			}
+
+			pruneBackups("rbd", "vol")
+
+			var deleted []string
+			for _, b := range tt.backups {
+				_, err := store.Backups().Get(b.id)
+				if err == repository.ErrNotFound {
+					deleted = append(deleted, b.id)
+					if oss.has("backup", dataObjectName("rbd/vol/"+b.id)) {
+						t.Errorf("data object of deleted backup %v remains", b.id)
+					}
+				} else if err != nil {
+					t.Fatalf("Get %v: %v", b.id, err)
+				}
+			}
+			sort.Strings(deleted)
+			if !reflect.DeepEqual(deleted, tt.deleted) {
+				t.Errorf("deleted %v, want %v", deleted, tt.deleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"encoding/json"
+	"storage"
+)
+
+/*
+GET /?Action=InfoCluster HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+Content-Length: n
+
+n bytes json result
+*/
+func InfoCluster(w http.ResponseWriter, r *http.Request) {
+	health := []storage.ConnHealth{}
+	if checker, ok := backend.(storage.HealthChecker); ok {
+		health = checker.Health()
+	}
+
+	payload, err := json.Marshal(health)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusInfoClusterErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, string(payload))
+}
@@ -0,0 +1,122 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"krbd"
+	"repository"
+	"mon"
+)
+
+const defaultKRBDUser = "admin"
+
+var devices = krbd.NewManager(krbd.DefaultRoot)
+var krbdUser = defaultKRBDUser
+var krbdMonitors []string
+var krbdSecret string
+
+//设置内核rbd映射：sysfs根目录、cephx用户、monitor地址和密钥
+//monitors或secret为空时映射前通过mon命令查询
+func SetKRBDConfig(root string, user string, monitors []string, secret string) {
+	devices = krbd.NewManager(root)
+	devices.SetTimeout(mapTimeout)
+	if user != "" {
+		krbdUser = strings.TrimPrefix(user, "client.")
+	}
+	krbdMonitors = monitors
+	krbdSecret = secret
+}
+
+//mon dump中每个monitor的addr形如1.2.3.4:6789/0
+type monDump struct {
+	Mons []struct {
+		Name string
+		Addr string
+	}
+}
+
+type authKey struct {
+	Key string
+}
+
+//result为nil时忽略命令的输出
+func monCommand(cmd mon.Command, result interface{}) error {
+	conn, err := connectCluster()
+	if err != nil {
+		return err
+	}
+	defer conn.Shutdown()
+
+	return mon.New(conn).Command(cmd, result)
+}
+
+//内核客户端的连接参数，未配置的部分从集群查询
+func mapOptions() (krbd.Options, error) {
+	opts := krbd.Options{Monitors: krbdMonitors, User: krbdUser, Secret: krbdSecret}
+
+	if len(opts.Monitors) == 0 {
+		var dump monDump
+		if err := monCommand(mon.Command{"prefix": "mon dump"}, &dump); err != nil {
+			return opts, err
+		}
+		for _, mon := range dump.Mons {
+			if addr := strings.SplitN(mon.Addr, "/", 2)[0]; addr != "" {
+				opts.Monitors = append(opts.Monitors, addr)
+			}
+		}
+		if len(opts.Monitors) == 0 {
+			return opts, fmt.Errorf("No monitor address in mon dump")
+		}
+	}
+
+	if opts.Secret == "" {
+		var key authKey
+		cmd := mon.Command{"prefix": "auth get-key", "entity": "client." + opts.User}
+		if err := monCommand(cmd, &key); err != nil {
+			return opts, err
+		}
+		opts.Secret = key.Key
+	}
+	return opts, nil
+}
+
+//启动时按内核中的实际映射修正数据库中的设备路径
+func ReconcileMappings() error {
+	mappings, err := devices.Mappings()
+	if err != nil {
+		return err
+	}
+	mapped := make(map[string]*krbd.Mapping)
+	for _, m := range mappings {
+		if m.Snap == "" {
+			mapped[m.Pool+"/"+m.Image] = m
+		}
+	}
+
+	volumes, err := repo.Volumes().List("")
+	if err != nil {
+		return err
+	}
+	for _, record := range volumes {
+		devPath := ""
+		if m, ok := mapped[record.Pool+"/"+record.Name]; ok {
+			devPath = m.Device
+			delete(mapped, record.Pool+"/"+record.Name)
+		}
+		if devPath == record.DevPath {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is mapped to %q, recorded %q\n", record.Pool, record.Name, devPath, record.DevPath)
+		record.DevPath = devPath
+		if err := repo.Volumes().Update(record); err != nil && err != repository.ErrNotFound {
+			return err
+		}
+	}
+
+	for _, m := range mapped {
+		fmt.Fprintf(os.Stderr, "Image %v/%v is mapped to %v but not managed\n", m.Pool, m.Image, m.Device)
+	}
+	return nil
+}
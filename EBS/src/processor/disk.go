@@ -5,13 +5,39 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"encoding/json"
+	"job"
+	"lio"
+	"qos"
+	"repository"
 )
 
+/*
+Features为逗号分隔的feature名(layering,striping,exclusive-lock,object-map,fast-diff,deep-flatten,journaling)，
+默认只开启layering；Order为对象大小的2的幂(12-25)；StripeUnit与StripeCount需同时指定；
+DataPool将数据放在另一个(如开启overwrites的纠删码)存储池中。
+卷由krbd映射，内核不支持的feature会使映射失败并回滚创建。
+QoS参数与ModifyVolumeQoS相同。
+PoolName为[placement]中配置的pool类别或不指定时，按剩余容量、副本数和已分配的卷在类别(不指定时为default类别，
+没有配置时为所有非租户的pool)中选择pool；指定的pool同样检查容量。容量不足时返回507 InsufficientCapacity，
+选中的pool见DescribeJob的Resource。
+GET /?Action=CreateDisk[&PoolName={PoolName|class}]&VolumeName={volumeName}&Size={size}[&Features={features}][&Order={order}][&StripeUnit={unit}&StripeCount={count}][&DataPool={pool}][&ReadIOPS={n}][&WriteIOPS={n}][&ReadBps={n}][&WriteBps={n}][&Burst={seconds}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 202 Accepted
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"JobId":"job-..."}
+*/
 func CreateDisk(w http.ResponseWriter, r *http.Request) {
 	poolName := r.FormValue("PoolName")
 	volumeName := r.FormValue("VolumeName")
 	size := r.FormValue("Size")
-	if poolName == "" || volumeName == "" || size == "" {
+	if volumeName == "" || size == "" {
 		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
 		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
@@ -24,45 +50,624 @@ func CreateDisk(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var limits qos.Limits
+	opts, err := parseImageOptions(r)
+	if err == nil {
+		limits, err = parseQoS(r, qos.Limits{})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if opts.DataPool != "" {
+		conn, err := connectCluster()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
+			SendStatus(w, statusCreateDiskErr, "")
+			return
+		}
+		err = conn.LookupPool(opts.DataPool)
+		conn.Shutdown()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LookupPool failed, pool name:%v, %v\n", opts.DataPool, err)
+			sendStorageError(w, err, statusCreateDiskErr)
+			return
+		}
+	}
+
+	requested := poolName
+	poolName, placed, ok := checkPlacement(w, requested, volumeSize, statusCreateDiskErr)
+	if !ok {
+		return
+	}
+	defer placed()
+	if poolName != requested {
+		fmt.Fprintf(os.Stderr, "CreateDisk : %v placed in pool %v\n", volumeName, poolName)
+	}
+
+	release, ok := checkQuota(w, poolName, TenantUsage{Volumes: 1, Bytes: volumeSize}, statusCreateDiskErr)
+	if !ok {
+		return
+	}
+
 	volume := NewVolume(volumeName, poolName, volumeSize)
-	if err := volume.Create(); err != nil {
-		fmt.Fprintf(os.Stderr, "Create volume error: %v\n", err)
-		SendStatus(w, statusCreateDiskErr, "")
+	err = volume.Register()
+	placed()
+	if err != nil {
+		release()
+		fmt.Fprintf(os.Stderr, "Register volume %v error: %v\n", volume.resource(), err)
+		if err == repository.ErrExist {
+			SendStatus(w, statusVolumeExistErr, "")
+		} else {
+			SendStatus(w, statusCreateDiskErr, "")
+		}
 		return
 	}
 
+	err = submitJob(w, "CreateDisk", volume.resource(), statusCreateDiskErr, func(p *job.Progress) error {
+		defer release()
+		return createDisk(volume, func() error {
+			if err := volume.Create(opts); err != nil || limits.Unlimited() {
+				return err
+			}
+			//QoS设置失败时删除刚创建的镜像
+			if err := volume.SetQoS(limits); err != nil {
+				if err := volume.Remove(nil); err != nil {
+					fmt.Fprintf(os.Stderr, "Rollback remove volume error: %v\n", err)
+				}
+				deleteQoS(volume)
+				return err
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		release()
+		if err := volume.Unregister(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unregister volume %v error: %v\n", volume.resource(), err)
+		}
+	}
+}
+
+//create生成镜像并设置fullname，之后映射设备并保存记录
+func createDisk(volume *Volume, create func() error) error {
+	if err := create(); err != nil {
+		fmt.Fprintf(os.Stderr, "Create volume error: %v\n", err)
+		volume.abortCreate(nil)
+		return err
+	}
+
 	if err := volume.Map(); err != nil {
 		fmt.Fprintf(os.Stderr, "Map volume error: %v\n", err)
-		SendStatus(w, statusCreateDiskErr, "")
-		return
+		rbErr := volume.Remove(nil)
+		if rbErr != nil {
+			fmt.Fprintf(os.Stderr, "Rollback remove volume error: %v\n", rbErr)
+		}
+		volume.abortCreate(rbErr)
+		return err
 	}
 
 	if err := volume.UpdateCreateResult(); err != nil {
 		fmt.Fprintf(os.Stderr, "Update db error: %v\n", err)
-		SendStatus(w, statusCreateDiskErr, "")
-		return
+		rbErr := volume.Unmap()
+		if rbErr != nil {
+			fmt.Fprintf(os.Stderr, "Rollback unmap volume error: %v\n", rbErr)
+		} else if rbErr = volume.Remove(nil); rbErr != nil {
+			fmt.Fprintf(os.Stderr, "Rollback remove volume error: %v\n", rbErr)
+		}
+		volume.abortCreate(rbErr)
+		return err
 	}
 
-	fmt.Fprintf(os.Stderr, "device path: %v\n", volume.devPath)
-	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+	return nil
 }
 
+//创建失败后释放卷名；镜像未能回滚时保留记录并置为error状态
+func (volume *Volume) abortCreate(rollbackErr error) {
+	if rollbackErr != nil {
+		if err := volume.SetState(repository.StateError); err != nil {
+			fmt.Fprintf(os.Stderr, "Set volume %v error state failed: %v\n", volume.resource(), err)
+		}
+		return
+	}
+	if err := volume.Unregister(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unregister volume %v error: %v\n", volume.resource(), err)
+	}
+}
+
+/*
+GET /?Action=DelDisk&PoolName={PoolName}&VolumeName={volumeName} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 202 Accepted
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"JobId":"job-..."}
+*/
 func DelDisk(w http.ResponseWriter, r *http.Request) {
+	poolName := r.FormValue("PoolName")
+	volumeName := r.FormValue("VolumeName")
+	if poolName == "" || volumeName == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
 
+	volume, err := LoadVolume(volumeName, poolName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", poolName, volumeName, err)
+		SendNotFound(w, "Volume")
+		return
+	}
+
+	if volume.state == repository.StateInUse {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is still attached\n", poolName, volumeName)
+		SendStatus(w, statusVolumeAttachedErr, "")
+		return
+	}
+
+	//available或error的卷都可以删除，失败时回到原来的状态
+	prior := volume.state
+	if err := volume.SetState(repository.StateDeleting); err != nil {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v can not be deleted: %v\n", poolName, volumeName, err)
+		sendStateError(w, err, statusDelDiskErr)
+		return
+	}
+
+	err = submitJob(w, "DelDisk", volume.resource(), statusDelDiskErr, func(p *job.Progress) error {
+		return deleteDisk(volume, prior, p)
+	})
+	if err != nil {
+		volume.restoreState(prior)
+	}
 }
 
+//记录在镜像删除成功后才删除，失败时恢复映射和删除前的状态
+func deleteDisk(volume *Volume, prior repository.VolumeState, p *job.Progress) error {
+	devPath := volume.devPath
+	if devPath != "" {
+		if err := volume.Unmap(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unmap volume error: %v\n", err)
+			volume.restoreState(prior)
+			return err
+		}
+	}
+
+	if err := volume.Remove(p.Update); err != nil {
+		fmt.Fprintf(os.Stderr, "Remove volume error: %v\n", err)
+		state := prior
+		if devPath != "" {
+			if err := volume.Map(); err != nil {
+				fmt.Fprintf(os.Stderr, "Rollback map volume error: %v\n", err)
+				state = repository.StateError
+			} else if volume.devPath != devPath {
+				fmt.Fprintf(os.Stderr, "Volume remapped to %v, was %v\n", volume.devPath, devPath)
+				if err := volume.Save(); err != nil {
+					fmt.Fprintf(os.Stderr, "Update device path error: %v\n", err)
+				}
+			}
+		}
+		volume.restoreState(state)
+		return err
+	}
+
+	if err := volume.Unregister(); err != nil {
+		fmt.Fprintf(os.Stderr, "Delete record of %v error, image already removed: %v\n", volume.resource(), err)
+		volume.restoreState(repository.StateError)
+		return err
+	}
+	if err := detachPolicies(volume); err != nil {
+		fmt.Fprintf(os.Stderr, "Detach snapshot policies of %v error: %v\n", volume.resource(), err)
+	}
+	if err := deleteQoS(volume); err != nil {
+		fmt.Fprintf(os.Stderr, "Delete QoS of %v error: %v\n", volume.resource(), err)
+	}
+	if err := deleteTags(volume); err != nil {
+		fmt.Fprintf(os.Stderr, "Delete tags of %v error: %v\n", volume.resource(), err)
+	}
+	return nil
+}
+
+/*
+通过NBD挂载的卷不能扩容，返回409 VolumeAttached，需要先卸载NBD客户端
+GET /?Action=ExtendDisk&PoolName={PoolName}&VolumeName={volumeName}&Size={newSize} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 202 Accepted
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"JobId":"job-..."}
+*/
 func ExtendDisk(w http.ResponseWriter, r *http.Request) {
+	poolName := r.FormValue("PoolName")
+	volumeName := r.FormValue("VolumeName")
+	size := r.FormValue("Size")
+	if poolName == "" || volumeName == "" || size == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	newSize, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
 
+	volume, err := LoadVolume(volumeName, poolName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", poolName, volumeName, err)
+		SendNotFound(w, "Volume")
+		return
+	}
+
+	if volume.state != repository.StateAvailable && volume.state != repository.StateInUse {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is %v\n", poolName, volumeName, volume.state)
+		SendStatus(w, statusInvalidStateErr, "")
+		return
+	}
+
+	//只允许扩容
+	oldSize := volume.size
+	if newSize <= oldSize {
+		fmt.Fprintf(os.Stderr, "Invalid size %v, current size %v\n", newSize, oldSize)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if !checkNBDResize(w, volume, statusExtendDiskErr) {
+		return
+	}
+
+	release, ok := checkQuota(w, poolName, TenantUsage{Bytes: newSize - oldSize}, statusExtendDiskErr)
+	if !ok {
+		return
+	}
+
+	err = submitJob(w, "ExtendDisk", volume.resource(), statusExtendDiskErr, func(p *job.Progress) error {
+		defer release()
+		return resizeDisk(volume, newSize, p)
+	})
+	if err != nil {
+		release()
+	}
 }
 
+func resizeDisk(volume *Volume, newSize uint64, p *job.Progress) error {
+	oldSize := volume.size
+	if err := volume.Resize(newSize, p.Update); err != nil {
+		fmt.Fprintf(os.Stderr, "Resize volume error: %v\n", err)
+		return err
+	}
+
+	if err := volume.Refresh(); err != nil {
+		fmt.Fprintf(os.Stderr, "Refresh device error: %v\n", err)
+		if err := volume.Resize(oldSize, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Rollback resize volume error: %v\n", err)
+		}
+		return err
+	}
+
+	if err := volume.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Update db error: %v\n", err)
+		if err := volume.Resize(oldSize, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Rollback resize volume error: %v\n", err)
+		} else if err := volume.Refresh(); err != nil {
+			fmt.Fprintf(os.Stderr, "Rollback refresh device error: %v\n", err)
+		}
+		return err
+	}
+	return nil
+}
+
+/*
+Transport为iscsi（默认）或nbd
+iscsi: Client为initiator的IQN，卷通过LIO以iSCSI target导出，每个initiator一个ACL
+       ChapUser/ChapPassword可选，设置后initiator必须通过CHAP登录；
+       MutualChapUser/MutualChapPassword可选，target同时向initiator认证
+       同一个卷的initiator必须全部使用或全部不使用CHAP
+nbd:   Client为客户端标识，不支持CHAP；ClientAddress必填，为允许连接的IP或CIDR，逗号分隔
+       每次挂载由内置NBD服务以随机的export名称<pool>/<volume>/<随机串>导出，
+       只接受ClientAddress中的地址连接，不在export列表中出现；
+       第一次导出前解除卷的krbd映射，解除失败时挂载失败
+同一个卷的客户端必须使用相同的Transport
+GET /?Action=AttachDisk&PoolName={PoolName}&VolumeName={volumeName}&Client={client}[&Transport={iscsi|nbd}][&ClientAddress={ip|cidr,...}][&ChapUser={user}&ChapPassword={password}[&MutualChapUser={user}&MutualChapPassword={password}]] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+Content-Length: n
+
+{"Transport":"iscsi","Target":"iqn...","Portal":"ip:port","Lun":0,"Export":"","Initiator":"iqn...","ChapUser":"","MutualChapUser":""}
+{"Transport":"nbd","Target":"","Portal":"ip:port","Lun":0,"Export":"pool/volume/3f9a...","Initiator":"client","ChapUser":"","MutualChapUser":""}
+*/
 func AttachDisk(w http.ResponseWriter, r *http.Request) {
+	poolName := r.FormValue("PoolName")
+	volumeName := r.FormValue("VolumeName")
+	client := r.FormValue("Client")
+	transport := r.FormValue("Transport")
+	if transport == "" {
+		transport = repository.TransportISCSI
+	}
+	if poolName == "" || volumeName == "" || !validClient(transport, client) {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	chap, err := parseChapCredentials(r)
+	if err == nil && chap != nil && transport != repository.TransportISCSI {
+		err = fmt.Errorf("CHAP is only supported by iSCSI")
+	}
+	//NBD没有认证，只允许挂载时给出的地址连接
+	allow := r.FormValue("ClientAddress")
+	if err == nil && transport == repository.TransportNBD {
+		_, allow, err = parseNBDAllow(allow)
+	} else if err == nil && allow != "" {
+		err = fmt.Errorf("ClientAddress is only supported by NBD")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", err)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	volume, err := LoadVolume(volumeName, poolName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", poolName, volumeName, err)
+		SendNotFound(w, "Volume")
+		return
+	}
 
+	attachments, err := repo.Attachments().List(poolName, volumeName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query attachment error: %v\n", err)
+		SendStatus(w, statusAttachDiskErr, "")
+		return
+	}
+	for _, a := range attachments {
+		if a.Client == client {
+			fmt.Fprintf(os.Stderr, "Volume %v/%v is already attached to %v\n", poolName, volumeName, client)
+			SendStatus(w, statusVolumeAttachedErr, "")
+			return
+		}
+		//krbd设备和librbd各有缓存，不能同时写
+		if a.Transport != transport {
+			fmt.Fprintf(os.Stderr, "Volume %v/%v is attached through %v\n", poolName, volumeName, a.Transport)
+			SendStatus(w, statusTransportErr, "")
+			return
+		}
+	}
+
+	//失败时回到attach之前的状态
+	prevState := volume.state
+	first := len(attachments) == 0
+	if err := volume.SetState(repository.StateAttaching); err != nil {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v can not be attached: %v\n", poolName, volumeName, err)
+		sendStateError(w, err, statusAttachDiskErr)
+		return
+	}
+
+	info, err := volume.exportTo(client, transport, chap, allow)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export volume error: %v\n", err)
+		if err != errChapConflict {
+			if err := volume.unexportFrom(client, transport, "", first); err != nil {
+				fmt.Fprintf(os.Stderr, "Rollback export error: %v\n", err)
+			}
+		}
+		volume.restoreState(prevState)
+		switch err {
+		case errChapConflict:
+			SendStatus(w, statusChapConflictErr, "")
+		case errNBDDisabled:
+			SendStatus(w, statusAttachDiskErr, err.Error())
+		default:
+			SendStatus(w, statusAttachDiskErr, "")
+		}
+		return
+	}
+
+	if err := volume.Attach(client, transport, info.Export, allow); err != nil {
+		fmt.Fprintf(os.Stderr, "Attach volume error: %v\n", err)
+		if err := volume.unexportFrom(client, transport, info.Export, first); err != nil {
+			fmt.Fprintf(os.Stderr, "Rollback export error: %v\n", err)
+		}
+		volume.restoreState(prevState)
+		SendStatus(w, statusAttachDiskErr, "")
+		return
+	}
+
+	if err := volume.SetState(repository.StateInUse); err != nil {
+		fmt.Fprintf(os.Stderr, "Set volume in-use error: %v\n", err)
+		SendStatus(w, statusAttachDiskErr, "")
+		return
+	}
+
+	payload, err := json.Marshal(info)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusAttachDiskErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, string(payload))
 }
 
+/*
+GET /?Action=DetachDisk&PoolName={PoolName}&VolumeName={volumeName}&Client={client} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
 func DetachDisk(w http.ResponseWriter, r *http.Request) {
+	poolName := r.FormValue("PoolName")
+	volumeName := r.FormValue("VolumeName")
+	client := r.FormValue("Client")
+	if poolName == "" || volumeName == "" || client == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	volume, err := LoadVolume(volumeName, poolName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", poolName, volumeName, err)
+		SendNotFound(w, "Volume")
+		return
+	}
+
+	attachments, err := repo.Attachments().List(poolName, volumeName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query attachment error: %v\n", err)
+		SendStatus(w, statusDetachDiskErr, "")
+		return
+	}
+	var attachment *repository.Attachment
+	for _, a := range attachments {
+		if a.Client == client {
+			attachment = a
+		}
+	}
+	if attachment == nil {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is not attached to %v\n", poolName, volumeName, client)
+		SendNotFound(w, "Attachment")
+		return
+	}
+
+	if err := volume.SetState(repository.StateDetaching); err != nil {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v can not be detached: %v\n", poolName, volumeName, err)
+		sendStateError(w, err, statusDetachDiskErr)
+		return
+	}
+
+	last := len(attachments) == 1
+	if err := volume.unexportFrom(client, attachment.Transport, attachment.Export, last); err != nil {
+		fmt.Fprintf(os.Stderr, "Unexport volume from %v error: %v\n", client, err)
+		volume.restoreState(repository.StateInUse)
+		SendStatus(w, statusDetachDiskErr, "")
+		return
+	}
 
+	if err := volume.Detach(client); err != nil {
+		fmt.Fprintf(os.Stderr, "Detach volume from %v error: %v\n", client, err)
+		volume.restoreState(repository.StateError)
+		SendStatus(w, statusDetachDiskErr, "")
+		return
+	}
+
+	state := repository.StateInUse
+	if last {
+		state = repository.StateAvailable
+	}
+	if err := volume.SetState(state); err != nil {
+		fmt.Fprintf(os.Stderr, "Set volume %v error: %v\n", state, err)
+		SendStatus(w, statusDetachDiskErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
 }
 
-func BackupDisk(w http.ResponseWriter, r *http.Request) {
+/*
+返回客户端登录所需的信息，不返回CHAP密码；Client为空时返回所有客户端
+iSCSI为target、portal和LUN，NBD为服务地址和export名称
+GET /?Action=DescribeAttachment&PoolName={PoolName}&VolumeName={volumeName}[&Client={initiatorIQN}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+Content-Length: n
 
+[{"Transport":"iscsi","Target":"iqn...","Portal":"ip:port","Lun":0,"Export":"","Initiator":"iqn...","ChapUser":"user","MutualChapUser":""}]
+*/
+func DescribeAttachment(w http.ResponseWriter, r *http.Request) {
+	poolName := r.FormValue("PoolName")
+	volumeName := r.FormValue("VolumeName")
+	client := r.FormValue("Client")
+	if poolName == "" || volumeName == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	volume, err := LoadVolume(volumeName, poolName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", poolName, volumeName, err)
+		SendNotFound(w, "Volume")
+		return
+	}
+
+	infos, err := volume.Attachments(client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query attachment of %v/%v error: %v\n", poolName, volumeName, err)
+		if err == repository.ErrNotFound {
+			SendNotFound(w, "Attachment")
+		} else {
+			SendStatus(w, statusDescribeAttachErr, "")
+		}
+		return
+	}
+
+	payload, err := json.Marshal(infos)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusDescribeAttachErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, string(payload))
+}
+
+//iSCSI客户端为IQN，NBD客户端为任意标识
+func validClient(transport string, client string) bool {
+	switch transport {
+	case repository.TransportISCSI:
+		return lio.ValidIQN(client)
+	case repository.TransportNBD:
+		return validNBDClient(client)
+	}
+	return false
+}
+
+func (volume *Volume) exportTo(client string, transport string, chap *ChapCredentials, allow string) (*AttachmentInfo, error) {
+	if transport == repository.TransportNBD {
+		return volume.ExportNBD(client, allow)
+	}
+	return volume.Export(client, chap)
+}
+
+//NBD每个客户端有自己的export，export为空表示还没有导出
+func (volume *Volume) unexportFrom(client string, transport string, export string, last bool) error {
+	if transport == repository.TransportNBD {
+		if export == "" {
+			return nil
+		}
+		return volume.UnexportNBD(export)
+	}
+	return volume.Unexport(client, last)
 }
@@ -0,0 +1,208 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"job"
+	"repository"
+	"storage"
+	"storage/memory"
+)
+
+//内存集群中有pool rbd，仓库和任务都使用内存，rbd/vol和mapped中的镜像已由内核映射，见setupKRBD
+func setupDisk(t *testing.T, mapped ...string) *memory.Cluster {
+	cluster := memory.NewCluster()
+	if err := cluster.MakePool("rbd"); err != nil {
+		t.Fatal(err)
+	}
+	SetBackend(cluster)
+	SetRepository(repository.NewMemoryStore())
+	SetJobManager(job.NewManager(job.NewMemoryStore(), 1))
+	setupKRBD(t, true, mapped...)
+	t.Cleanup(func() {
+		SetJobManager(nil)
+		SetRepository(nil)
+		SetBackend(nil)
+	})
+	return cluster
+}
+
+//以GET /?Action=的方式调用handler
+func callHandler(handler http.HandlerFunc, query url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil))
+	return w
+}
+
+//提交任务的handler返回202和JobId，等待任务结束后通过DescribeJob查询结果
+func runHandlerJob(t *testing.T, handler http.HandlerFunc, query url.Values) *job.Job {
+	w := callHandler(handler, query)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("%v: status %v %v", query.Get("Action"), w.Code, w.Body)
+	}
+	var reply JobReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.JobId == "" {
+		t.Fatalf("%v: reply %v, %v", query.Get("Action"), w.Body, err)
+	}
+	jobs.Wait()
+
+	w = callHandler(DescribeJob, url.Values{"Action": {"DescribeJob"}, "JobId": {reply.JobId}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("DescribeJob: status %v %v", w.Code, w.Body)
+	}
+	var j job.Job
+	if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil {
+		t.Fatal(err)
+	}
+	return &j
+}
+
+func TestCreateDisk(t *testing.T) {
+	setupDisk(t)
+
+	j := runHandlerJob(t, CreateDisk, url.Values{"Action": {"CreateDisk"}, "PoolName": {"rbd"},
+		"VolumeName": {"vol"}, "Size": {"1048576"}})
+	if j.State != job.StateSucceeded || j.Action != "CreateDisk" || j.Resource != "rbd/vol" || j.Progress != 100 {
+		t.Errorf("job %+v", j)
+	}
+
+	w := callHandler(ListVolumes, url.Values{"Action": {"ListVolumes"}})
+	var volumes []VolumeInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &volumes); err != nil {
+		t.Fatalf("ListVolumes: %v %v", w.Body, err)
+	}
+	if len(volumes) != 1 || volumes[0].Pool != "rbd" || volumes[0].Name != "vol" || volumes[0].Size != 1<<20 ||
+		volumes[0].State != repository.StateAvailable || volumes[0].DevPath != "/dev/rbd0" {
+		t.Errorf("volumes %+v", volumes)
+	}
+
+	//同名的卷已存在
+	w = callHandler(CreateDisk, url.Values{"Action": {"CreateDisk"}, "PoolName": {"rbd"},
+		"VolumeName": {"vol"}, "Size": {"1048576"}})
+	if w.Code != http.StatusConflict || w.Header().Get(LegacyCodeHeader) != strconv.Itoa(statusVolumeExistErr) {
+		t.Errorf("second CreateDisk: status %v %v", w.Code, w.Body)
+	}
+}
+
+//映射失败时回滚删除镜像并释放卷名，任务必须失败
+func TestCreateDiskMapFails(t *testing.T) {
+	cluster := setupDisk(t)
+
+	//rbd/new没有映射，总线的add不可写
+	j := runHandlerJob(t, CreateDisk, url.Values{"Action": {"CreateDisk"}, "PoolName": {"rbd"},
+		"VolumeName": {"new"}, "Size": {"1048576"}})
+	if j.State != job.StateFailed || j.Error != codeDesc[statusMapVolumeErr] {
+		t.Errorf("job %+v", j)
+	}
+
+	if _, err := repo.Volumes().Get("rbd", "new"); err != repository.ErrNotFound {
+		t.Errorf("volume record after failed create: %v", err)
+	}
+	pool, err := cluster.OpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if images, err := pool.ListImages(); err != nil || len(images) != 0 {
+		t.Errorf("images after failed create %v, %v", images, err)
+	}
+}
+
+func TestParseImageOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		query url.Values
+		//want为nil时应返回错误
+		want *storage.ImageOptions
+	}{
+		{"default", url.Values{}, &storage.ImageOptions{Features: storage.FeatureLayering}},
+		{"features", url.Values{"Features": {"layering, exclusive-lock,object-map"}},
+			&storage.ImageOptions{Features: storage.FeatureLayering | storage.FeatureExclusiveLock | storage.FeatureObjectMap}},
+		{"missing dependency", url.Values{"Features": {"object-map"}}, nil},
+		{"unknown feature", url.Values{"Features": {"layering,bogus"}}, nil},
+		{"order", url.Values{"Order": {"20"}}, &storage.ImageOptions{Features: storage.FeatureLayering, Order: 20}},
+		{"order too small", url.Values{"Order": {"11"}}, nil},
+		{"order too large", url.Values{"Order": {"26"}}, nil},
+		{"order not a number", url.Values{"Order": {"4M"}}, nil},
+		//条带单元小于对象时开启striping
+		{"striping", url.Values{"StripeUnit": {"65536"}, "StripeCount": {"16"}},
+			&storage.ImageOptions{Features: storage.FeatureLayering | storage.FeatureStripingV2, StripeUnit: 65536, StripeCount: 16}},
+		{"default striping", url.Values{"StripeUnit": {"4194304"}, "StripeCount": {"1"}},
+			&storage.ImageOptions{Features: storage.FeatureLayering, StripeUnit: 4194304, StripeCount: 1}},
+		{"stripe unit without count", url.Values{"StripeUnit": {"65536"}}, nil},
+		{"stripe unit not dividing the object", url.Values{"StripeUnit": {"65537"}, "StripeCount": {"2"}}, nil},
+		{"stripe unit larger than the object", url.Values{"Order": {"16"}, "StripeUnit": {"131072"}, "StripeCount": {"2"}}, nil},
+		{"data pool", url.Values{"DataPool": {"ec"}},
+			&storage.ImageOptions{Features: storage.FeatureLayering | storage.FeatureDataPool, DataPool: "ec"}},
+	}
+	for _, tt := range tests {
+		opts, err := parseImageOptions(httptest.NewRequest(http.MethodGet, "/?"+tt.query.Encode(), nil))
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%v: options %+v accepted", tt.name, opts)
+			}
+			continue
+		}
+		if err != nil || *opts != *tt.want {
+			t.Errorf("%v: options %+v, %v, want %+v", tt.name, opts, err, tt.want)
+		}
+	}
+}
+
+//CreateDisk按选项创建镜像，数据池必须存在
+func TestCreateDiskOptions(t *testing.T) {
+	cluster := setupDisk(t, "rbd/striped")
+	if err := cluster.MakePool("ec"); err != nil {
+		t.Fatal(err)
+	}
+
+	j := runHandlerJob(t, CreateDisk, url.Values{"Action": {"CreateDisk"}, "PoolName": {"rbd"}, "VolumeName": {"striped"},
+		"Size": {"1048576"}, "Features": {"layering,exclusive-lock"}, "Order": {"20"},
+		"StripeUnit": {"65536"}, "StripeCount": {"8"}, "DataPool": {"ec"}})
+	if j.State != job.StateSucceeded {
+		t.Fatalf("job %+v", j)
+	}
+	pool, err := cluster.OpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := pool.OpenImage("striped", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	features, err := image.GetFeatures()
+	want := storage.FeatureLayering | storage.FeatureExclusiveLock | storage.FeatureStripingV2 | storage.FeatureDataPool
+	if err != nil || features != want {
+		t.Errorf("features %v, %v", storage.FeatureList(features), err)
+	}
+	if info, err := image.Stat(); err != nil || info.Order != 20 || info.Size != 1<<20 {
+		t.Errorf("image %+v, %v", info, err)
+	}
+	if period, err := image.GetStripePeriod(); err != nil || period != 8<<20 {
+		t.Errorf("stripe period %v, %v", period, err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"invalid order", url.Values{"Order": {"30"}}, http.StatusBadRequest},
+		{"missing data pool", url.Values{"DataPool": {"missing"}}, http.StatusNotFound},
+	} {
+		tt.query.Set("Action", "CreateDisk")
+		tt.query.Set("PoolName", "rbd")
+		tt.query.Set("VolumeName", "refused")
+		tt.query.Set("Size", "1048576")
+		if w := callHandler(CreateDisk, tt.query); w.Code != tt.status {
+			t.Errorf("%v: status %v %v", tt.name, w.Code, w.Body)
+		}
+	}
+	if _, err := repo.Volumes().Get("rbd", "refused"); err != repository.ErrNotFound {
+		t.Errorf("volume record of a refused create: %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"errors"
+	"io"
+	"sync"
+	"time"
+	"crypto/sha256"
+	"hash"
+	"encoding/hex"
+	"encoding/json"
+	"job"
+	"s3"
+	"storage"
+)
+
+//同时上传的分片数
+const maxUploadParts = 4
+
+const defaultPartSize = 20 << 20
+
+//描述文件中一个区段的最大长度
+const maxExtentLength = 64 << 20
+
+var errOSSDisabled = errors.New("OSS is not configured")
+
+var ossClient *s3.Client
+var ossPartSize uint64 = defaultPartSize
+
+//设置导出使用的OSS网关；partSize为0时使用默认分片大小
+func SetOSSConfig(cfg s3.Config, partSize uint64) {
+	ossClient = s3.New(cfg)
+	if partSize > 0 {
+		ossPartSize = partSize
+	}
+}
+
+//镜像中非零数据的区段，ObjectOffset为数据在数据对象中的位置，Checksum为该段数据的sha256
+type Extent struct {
+	Offset       uint64
+	Length       uint64
+	ObjectOffset uint64
+	Checksum     string
+}
+
+//导出时与数据对象一起写入的描述文件
+type ExportManifest struct {
+	Pool         string
+	Volume       string
+	Size         uint64
+	Snapshot     string
+	StripePeriod uint64
+	Checksum     string
+	DataObject   string
+	Extents      []Extent
+	CreateTime   string
+}
+
+func dataObjectName(prefix string) string {
+	return prefix + "/data"
+}
+
+func manifestObjectName(prefix string) string {
+	return prefix + "/manifest.json"
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//分片大小不小于S3下限，且分片数不超过上限
+func exportPartSize(size uint64) uint64 {
+	partSize := ossPartSize
+	if min := (size + s3.MaxParts - 1) / s3.MaxParts; partSize < min {
+		partSize = min
+	}
+	if partSize < s3.MinPartSize {
+		partSize = s3.MinPartSize
+	}
+	return partSize
+}
+
+//第一个分片到达时才创建多段上传，全零的镜像只写一个空对象
+type partUploader struct {
+	client   *s3.Client
+	bucket   string
+	key      string
+	uploadID string
+	number   int
+	sem      chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	parts    []s3.Part
+	err      error
+}
+
+func newPartUploader(client *s3.Client, bucket string, key string) *partUploader {
+	return &partUploader{client: client, bucket: bucket, key: key, sem: make(chan struct{}, maxUploadParts)}
+}
+
+func (u *partUploader) failed() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+//异步上传一个分片，data在上传完成前不能被修改
+func (u *partUploader) upload(data []byte) error {
+	if err := u.failed(); err != nil {
+		return err
+	}
+	if u.uploadID == "" {
+		id, err := u.client.CreateMultipartUpload(u.bucket, u.key)
+		if err != nil {
+			return err
+		}
+		u.uploadID = id
+	}
+
+	u.number++
+	number := u.number
+	u.sem <- struct{}{}
+	u.wg.Add(1)
+	go func() {
+		defer func() {
+			<-u.sem
+			u.wg.Done()
+		}()
+		etag, err := u.client.UploadPart(u.bucket, u.key, u.uploadID, number, data)
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if err != nil {
+			if u.err == nil {
+				u.err = err
+			}
+			return
+		}
+		u.parts = append(u.parts, s3.Part{PartNumber: number, ETag: etag})
+	}()
+	return nil
+}
+
+//等待所有分片上传完成后合并为对象
+func (u *partUploader) complete() error {
+	u.wg.Wait()
+	if u.err != nil {
+		return u.err
+	}
+	if u.uploadID == "" {
+		return u.client.PutObject(u.bucket, u.key, nil, "application/octet-stream")
+	}
+
+	parts := make([]s3.Part, len(u.parts))
+	for _, part := range u.parts {
+		parts[part.PartNumber-1] = part
+	}
+	return u.client.CompleteMultipartUpload(u.bucket, u.key, u.uploadID, parts)
+}
+
+func (u *partUploader) abort() {
+	u.wg.Wait()
+	if u.uploadID == "" {
+		return
+	}
+	if err := u.client.AbortMultipartUpload(u.bucket, u.key, u.uploadID); err != nil {
+		fmt.Fprintf(os.Stderr, "Abort upload of %v/%v failed: %v\n", u.bucket, u.key, err)
+	}
+}
+
+//读取时一块不跨越period边界
+type chunk struct {
+	offset uint64
+	data   []byte
+	err    error
+}
+
+//镜像中要读取的一段
+type span struct {
+	offset uint64
+	length uint64
+}
+
+//按period切分spans并发读取，按偏移顺序从返回的通道中取出，最多MaxProcessorNumber块同时在读
+//关闭stop后不再发起新的读取
+func readChunks(image storage.Image, spans []span, period uint64, stop <-chan struct{}) <-chan chan *chunk {
+	pending := make(chan chan *chunk, MaxProcessorNumber)
+	go func() {
+		defer close(pending)
+		for _, s := range spans {
+			for offset, end := s.offset, s.offset+s.length; offset < end; {
+				length := (offset/period+1)*period - offset
+				if end-offset < length {
+					length = end - offset
+				}
+
+				result := make(chan *chunk, 1)
+				select {
+				case pending <- result:
+				case <-stop:
+					return
+				}
+				go func(offset uint64, length uint64) {
+					c := &chunk{offset: offset, data: make([]byte, length)}
+					n, err := image.ReadAt(c.data, int64(offset))
+					if err != nil && !(err == io.EOF && uint64(n) == length) {
+						c.err = err
+					}
+					result <- c
+				}(offset, length)
+				offset += length
+			}
+		}
+	}()
+	return pending
+}
+
+//按偏移顺序对每一块调用fn，读取失败或fn返回错误时停止
+func forEachChunk(image storage.Image, spans []span, period uint64, fn func(c *chunk) error) error {
+	stop := make(chan struct{})
+	pending := readChunks(image, spans, period, stop)
+	for result := range pending {
+		c := <-result
+		err := c.err
+		if err == nil {
+			err = fn(c)
+		}
+		if err != nil {
+			close(stop)
+			for result := range pending {
+				<-result
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+//把镜像的区段依次写入一个数据对象，记录每段在对象中的位置和校验和
+type dataObject struct {
+	uploader *partUploader
+	partSize uint64
+	part     []byte
+	size     uint64
+	extents  []Extent
+	hash     hash.Hash
+}
+
+func newDataObject(bucket string, key string, imageSize uint64) *dataObject {
+	return &dataObject{
+		uploader: newPartUploader(ossClient, bucket, key),
+		partSize: exportPartSize(imageSize),
+		extents:  []Extent{},
+	}
+}
+
+func (o *dataObject) sealExtent() {
+	if o.hash != nil {
+		o.extents[len(o.extents)-1].Checksum = "sha256:" + hex.EncodeToString(o.hash.Sum(nil))
+		o.hash = nil
+	}
+}
+
+//连续的区段合并，但不超过maxExtentLength，恢复时按区段校验
+func (o *dataObject) write(offset uint64, data []byte) error {
+	length := uint64(len(data))
+	n := len(o.extents)
+	if n == 0 || o.hash == nil || o.extents[n-1].Offset+o.extents[n-1].Length != offset ||
+		o.extents[n-1].Length+length > maxExtentLength {
+		o.sealExtent()
+		o.extents = append(o.extents, Extent{Offset: offset, ObjectOffset: o.size})
+		o.hash = sha256.New()
+		n++
+	}
+	o.extents[n-1].Length += length
+	o.hash.Write(data)
+	o.size += length
+
+	o.part = append(o.part, data...)
+	if uint64(len(o.part)) >= o.partSize {
+		if err := o.uploader.upload(o.part); err != nil {
+			return err
+		}
+		o.part = nil
+	}
+	return nil
+}
+
+//上传剩余数据并合并分片
+func (o *dataObject) close() error {
+	o.sealExtent()
+	if len(o.part) > 0 {
+		if err := o.uploader.upload(o.part); err != nil {
+			return err
+		}
+		o.part = nil
+	}
+	return o.uploader.complete()
+}
+
+func (o *dataObject) abort() {
+	o.uploader.abort()
+}
+
+//从临时快照读取卷，跳过全零区段，数据通过多段上传写入bucket，最后写入描述文件
+func (volume *Volume) exportToOSS(bucket string, prefix string, p *job.Progress) (*ExportManifest, error) {
+	conn, ioctx, err := NewConnAndOpenPool(volume.parentPool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := ioctx.OpenImage(volume.name, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		return nil, err
+	}
+	defer head.Close()
+
+	//从快照导出保证数据崩溃一致
+	snapshot := "export-" + time.Now().UTC().Format("20060102150405")
+	if err := head.CreateSnapshot(snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "CreateSnapshot %v of %v failed: %v\n", snapshot, volume.resource(), err)
+		return nil, err
+	}
+	defer func() {
+		if err := head.RemoveSnapshot(snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "RemoveSnapshot %v of %v failed: %v\n", snapshot, volume.resource(), err)
+		}
+	}()
+
+	image, err := ioctx.OpenImage(volume.name, snapshot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Open snapshot %v of %v failed: %v\n", snapshot, volume.resource(), err)
+		return nil, err
+	}
+	defer image.Close()
+
+	size, err := image.GetSize()
+	if err != nil {
+		return nil, err
+	}
+	period, err := image.GetStripePeriod()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "GetStripePeriod failed: %v\n", err)
+		return nil, err
+	}
+
+	if prefix == "" {
+		prefix = volume.resource() + "/" + snapshot
+	}
+	manifest := &ExportManifest{
+		Pool:         volume.parentPool,
+		Volume:       volume.name,
+		Size:         size,
+		Snapshot:     snapshot,
+		StripePeriod: period,
+		DataObject:   dataObjectName(prefix),
+	}
+
+	object := newDataObject(bucket, manifest.DataObject, size)
+	sum := sha256.New()
+	throttled, err := throttle(image, volume.parentPool, volume.name)
+	if err != nil {
+		return nil, err
+	}
+	err = forEachChunk(throttled, []span{{0, size}}, period, func(c *chunk) error {
+		sum.Write(c.data)
+		p.Update(c.offset+uint64(len(c.data)), size)
+		if isZero(c.data) {
+			return nil
+		}
+		return object.write(c.offset, c.data)
+	})
+	if err == nil {
+		err = object.close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export %v to %v/%v failed: %v\n", volume.resource(), bucket, manifest.DataObject, err)
+		object.abort()
+		return nil, err
+	}
+	manifest.Extents = object.extents
+
+	manifest.Checksum = "sha256:" + hex.EncodeToString(sum.Sum(nil))
+	manifest.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	payload, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := ossClient.PutObject(bucket, manifestObjectName(prefix), payload, "application/json"); err != nil {
+		fmt.Fprintf(os.Stderr, "Put manifest of %v failed: %v\n", volume.resource(), err)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+/*
+GET /?Action=ExportVolume&PoolName={PoolName}&VolumeName={volumeName}&OSSBucket={bucket}[&ObjectName={prefix}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 202 Accepted
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"JobId":"job-..."}
+
+数据写入{prefix}/data，描述文件写入{prefix}/manifest.json
+prefix默认为{PoolName}/{VolumeName}/{临时快照名}
+*/
+func ExportVolume(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	name := r.FormValue("VolumeName")
+	bucket := r.FormValue("OSSBucket")
+	prefix := r.FormValue("ObjectName")
+	if pool == "" || name == "" || bucket == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if ossClient == nil {
+		fmt.Fprintf(os.Stderr, "Export %v/%v failed: %v\n", pool, name, errOSSDisabled)
+		SendStatus(w, statusExportVolumeErr, errOSSDisabled.Error())
+		return
+	}
+	if err := ossClient.HeadBucket(bucket); err != nil {
+		fmt.Fprintf(os.Stderr, "Head bucket %v failed: %v\n", bucket, err)
+		SendStatus(w, statusExportVolumeErr, err.Error())
+		return
+	}
+
+	volume, err := LoadVolume(name, pool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", pool, name, err)
+		SendNotFound(w, "Volume")
+		return
+	}
+
+	submitJob(w, "ExportVolume", volume.resource(), statusExportVolumeErr, func(p *job.Progress) error {
+		_, err := volume.exportToOSS(bucket, prefix, p)
+		return err
+	})
+}
@@ -0,0 +1,410 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"crypto/sha256"
+	"encoding/hex"
+	"lio"
+	"repository"
+)
+
+const (
+	defaultISCSIPortal = "0.0.0.0:3260"
+	defaultIQNPrefix   = "iqn.2018-01.com.dhcc.ebs"
+	targetTPGTag       = 1
+	targetLun          = 0
+)
+
+var lioRoot = lio.NewRoot(lio.DefaultPath)
+var iscsiPortal = defaultISCSIPortal
+var iqnPrefix = defaultIQNPrefix
+
+//LIO的CHAP开关是TPG级别的，同一个卷的initiator必须全部使用或全部不使用CHAP
+var errChapConflict = errors.New("CHAP setting conflicts with other initiators of the target")
+
+//已存在的存储对象或LUN属于其它设备时不能复用，否则会把其它卷的数据导出给initiator
+var errExportMismatch = errors.New("Existing LIO object does not belong to the volume")
+
+//IQN的最大长度和存储对象名称中可读部分的最大长度，名称的唯一性由摘要保证
+const (
+	maxIQNLen        = 223
+	maxObjectNameLen = 128
+)
+
+//CHAP用户名最长255，密码长度12~16兼容Windows initiator
+const (
+	maxChapUserLen     = 255
+	minChapPasswordLen = 12
+	maxChapPasswordLen = 16
+)
+
+//Transport为iscsi时使用Target、Portal和Lun登录；为nbd时Portal为NBD服务地址，Export为export名称
+type AttachmentInfo struct {
+	Transport      string
+	Target         string
+	Portal         string
+	Lun            int
+	Export         string
+	Initiator      string
+	ChapUser       string
+	MutualChapUser string
+}
+
+//initiator登录时使用的CHAP凭据，Mutual为target向initiator认证
+type ChapCredentials struct {
+	User           string
+	Password       string
+	MutualUser     string
+	MutualPassword string
+}
+
+func (c *ChapCredentials) Enabled() bool {
+	return c != nil && c.User != ""
+}
+
+//请求中的ChapUser、ChapPassword、MutualChapUser、MutualChapPassword，都为空时返回nil
+func parseChapCredentials(r *http.Request) (*ChapCredentials, error) {
+	c := &ChapCredentials{
+		User:           r.FormValue("ChapUser"),
+		Password:       r.FormValue("ChapPassword"),
+		MutualUser:     r.FormValue("MutualChapUser"),
+		MutualPassword: r.FormValue("MutualChapPassword"),
+	}
+	if *c == (ChapCredentials{}) {
+		return nil, nil
+	}
+
+	if !validChap(c.User, c.Password) {
+		return nil, fmt.Errorf("Invalid CHAP credentials")
+	}
+	if c.MutualUser != "" || c.MutualPassword != "" {
+		if !validChap(c.MutualUser, c.MutualPassword) {
+			return nil, fmt.Errorf("Invalid mutual CHAP credentials")
+		}
+		//RFC 3720要求双向认证的两个密码不同
+		if c.MutualPassword == c.Password {
+			return nil, fmt.Errorf("Mutual CHAP password must differ from CHAP password")
+		}
+	}
+	return c, nil
+}
+
+func validChap(user string, password string) bool {
+	if user == "" || len(user) > maxChapUserLen || strings.ContainsAny(user, "\n\x00") {
+		return false
+	}
+	return len(password) >= minChapPasswordLen && len(password) <= maxChapPasswordLen &&
+		!strings.ContainsAny(password, "\n\x00")
+}
+
+func attachmentInfo(t *repository.Target) *AttachmentInfo {
+	return &AttachmentInfo{
+		Transport:      repository.TransportISCSI,
+		Target:         t.Target,
+		Portal:         iscsiPortal,
+		Lun:            t.Lun,
+		Initiator:      t.Initiator,
+		ChapUser:       t.ChapUser,
+		MutualChapUser: t.MutualChapUser,
+	}
+}
+
+//设置LIO配置：configfs根目录、监听地址和target名称前缀，空值使用默认值
+func SetISCSIConfig(root string, portal string, prefix string) {
+	lioRoot = lio.NewRoot(root)
+	if portal != "" {
+		iscsiPortal = portal
+	}
+	if prefix != "" {
+		iqnPrefix = prefix
+	}
+}
+
+//IQN只允许小写字母、数字、'.'、'-'和':'
+func iqnName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, s)
+}
+
+//pool和卷名的摘要，不同的卷摘要不同；iqnName和名称的拼接都不是单射，不能单独作为名称
+func (volume *Volume) digest() string {
+	sum := sha256.Sum256([]byte(volume.parentPool + "\x00" + volume.name))
+	return hex.EncodeToString(sum[:10])
+}
+
+//可读部分过长时截断
+func truncateName(name string, max int) string {
+	if len(name) > max {
+		return name[:max]
+	}
+	return name
+}
+
+//每个卷对应一个target，iqn.xxx:<pool>.<volume>.<digest>
+func (volume *Volume) targetIQN() string {
+	suffix := "." + volume.digest()
+	readable := iqnName(volume.parentPool) + "." + iqnName(volume.name)
+	return iqnPrefix + ":" + truncateName(readable, maxIQNLen-len(iqnPrefix)-1-len(suffix)) + suffix
+}
+
+//<pool>-<volume>-<digest>
+func (volume *Volume) storageObjectName() string {
+	return truncateName(volume.parentPool + "-" + volume.name, maxObjectNameLen) + "-" + volume.digest()
+}
+
+func splitPortal(portal string) (string, int, error) {
+	host, port, err := net.SplitHostPort(portal)
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, n, nil
+}
+
+/*
+通过LIO导出卷，已存在的对象检查属于该卷后复用：
+core/iblock_N/<pool>-<volume>-<digest>   后端为/dev/rbdN
+iscsi/<iqn>/tpgt_1/lun/lun_0    指向上面的存储对象
+iscsi/<iqn>/tpgt_1/np/<portal>
+iscsi/<iqn>/tpgt_1/acls/<initiator>/lun_0
+iscsi/<iqn>/tpgt_1/acls/<initiator>/auth/  chap不为nil时写入CHAP凭据
+*/
+func (volume *Volume) Export(initiator string, chap *ChapCredentials) (*AttachmentInfo, error) {
+	if volume.devPath == "" {
+		if err := volume.Map(); err != nil {
+			return nil, err
+		}
+		if err := volume.Save(); err != nil {
+			return nil, err
+		}
+	}
+
+	so, err := lioRoot.LookupBlockStorageObject(volume.storageObjectName())
+	if err == lio.ErrNotFound {
+		so, err = lioRoot.CreateBlockStorageObject(volume.storageObjectName(), volume.devPath, false)
+	} else if err == nil {
+		var dev string
+		if dev, err = so.UdevPath(); err == nil && dev != volume.devPath {
+			fmt.Fprintf(os.Stderr, "Storage object %v is backed by %v, not %v\n", so.Name, dev, volume.devPath)
+			err = errExportMismatch
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Storage object of %v error: %v\n", volume.resource(), err)
+		return nil, err
+	}
+
+	iqn := volume.targetIQN()
+	target, err := lioRoot.LookupTarget(iqn)
+	if err == lio.ErrNotFound {
+		target, err = lioRoot.CreateTarget(iqn)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Target %v error: %v\n", iqn, err)
+		return nil, err
+	}
+
+	tpg, err := target.LookupTPG(targetTPGTag)
+	if err == lio.ErrNotFound {
+		tpg, err = target.CreateTPG(targetTPGTag)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "TPG of %v error: %v\n", iqn, err)
+		return nil, err
+	}
+
+	ip, port, err := splitPortal(iscsiPortal)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid portal %v: %v\n", iscsiPortal, err)
+		return nil, err
+	}
+	if _, err := tpg.CreateNetworkPortal(ip, port); err != nil && err != lio.ErrExist {
+		fmt.Fprintf(os.Stderr, "Portal %v of %v error: %v\n", iscsiPortal, iqn, err)
+		return nil, err
+	}
+
+	lun, err := tpg.LookupLUN(targetLun)
+	if err == lio.ErrNotFound {
+		lun, err = tpg.CreateLUN(targetLun, so)
+	} else if err == nil {
+		var linked *lio.BlockStorageObject
+		if linked, err = lun.StorageObject(); err == nil && (linked.Name != so.Name || linked.Index != so.Index) {
+			fmt.Fprintf(os.Stderr, "LUN %v of %v exports %v, not %v\n", targetLun, iqn, linked.Name, so.Name)
+			err = errExportMismatch
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LUN of %v error: %v\n", iqn, err)
+		return nil, err
+	}
+
+	//只允许ACL中的initiator访问
+	if err := tpg.SetAttribute("generate_node_acls", "0"); err != nil {
+		return nil, err
+	}
+	if err := tpg.SetAttribute("demo_mode_write_protect", "1"); err != nil {
+		return nil, err
+	}
+
+	//第一个initiator决定TPG是否启用CHAP，之后的initiator必须一致
+	acls, err := tpg.NodeACLs()
+	if err != nil {
+		return nil, err
+	}
+	others := 0
+	for _, acl := range acls {
+		if acl.WWN != initiator {
+			others++
+		}
+	}
+	if others == 0 {
+		if err := tpg.SetAuthentication(chap.Enabled()); err != nil {
+			fmt.Fprintf(os.Stderr, "Set authentication of %v error: %v\n", iqn, err)
+			return nil, err
+		}
+	} else if auth, err := tpg.Authentication(); err != nil {
+		return nil, err
+	} else if auth != chap.Enabled() {
+		return nil, errChapConflict
+	}
+
+	acl, err := tpg.LookupNodeACL(initiator)
+	if err == lio.ErrNotFound {
+		acl, err = tpg.CreateNodeACL(initiator)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ACL %v of %v error: %v\n", initiator, iqn, err)
+		return nil, err
+	}
+	if chap.Enabled() {
+		if err := acl.SetCHAP(chap.User, chap.Password, chap.MutualUser, chap.MutualPassword); err != nil {
+			fmt.Fprintf(os.Stderr, "CHAP of %v on %v error: %v\n", initiator, iqn, err)
+			return nil, err
+		}
+	}
+	if _, err := acl.CreateMappedLUN(targetLun, lun, false); err != nil && err != lio.ErrExist {
+		fmt.Fprintf(os.Stderr, "Mapped LUN for %v of %v error: %v\n", initiator, iqn, err)
+		return nil, err
+	}
+
+	if err := tpg.SetEnable(true); err != nil {
+		return nil, err
+	}
+
+	//凭据由仓库加密保存，重复导出时以本次为准
+	record := &repository.Target{Pool: volume.parentPool, Volume: volume.name, Target: iqn, Lun: targetLun, Initiator: initiator}
+	if chap.Enabled() {
+		record.ChapUser, record.ChapSecret = chap.User, chap.Password
+		record.MutualChapUser, record.MutualChapSecret = chap.MutualUser, chap.MutualPassword
+	}
+	err = repo.Targets().Add(record)
+	if err == repository.ErrExist {
+		if err = repo.Targets().Remove(volume.parentPool, volume.name, initiator); err == nil {
+			err = repo.Targets().Add(record)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Save target of %v for %v error: %v\n", volume.resource(), initiator, err)
+		return nil, err
+	}
+
+	return attachmentInfo(record), nil
+}
+
+//只删除该initiator的ACL；last为true时同时删除target和存储对象
+//target以导出时记录的名称为准，存储对象以LUN指向的为准，名称规则改变前的导出也能删除
+func (volume *Volume) Unexport(initiator string, last bool) error {
+	iqn := volume.targetIQN()
+	if record, err := repo.Targets().Get(volume.parentPool, volume.name, initiator); err == nil {
+		iqn = record.Target
+	} else if err != repository.ErrNotFound {
+		return err
+	}
+	target, err := lioRoot.LookupTarget(iqn)
+	if err != nil && err != lio.ErrNotFound {
+		return err
+	}
+
+	var so *lio.BlockStorageObject
+	if target != nil {
+		if tpg, err := target.LookupTPG(targetTPGTag); err == nil {
+			if lun, err := tpg.LookupLUN(targetLun); err == nil {
+				so, _ = lun.StorageObject()
+			}
+			if acl, err := tpg.LookupNodeACL(initiator); err == nil {
+				if err := acl.Delete(); err != nil {
+					fmt.Fprintf(os.Stderr, "Delete ACL %v of %v error: %v\n", initiator, iqn, err)
+					return err
+				}
+			}
+		}
+		if last {
+			if err := target.Delete(); err != nil {
+				fmt.Fprintf(os.Stderr, "Delete target %v error: %v\n", iqn, err)
+				return err
+			}
+		}
+	}
+
+	if last {
+		if so == nil {
+			so, _ = lioRoot.LookupBlockStorageObject(volume.storageObjectName())
+		}
+		if so != nil {
+			if err := so.Delete(); err != nil && err != lio.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Delete storage object of %v error: %v\n", volume.resource(), err)
+				return err
+			}
+		}
+	}
+
+	if err := repo.Targets().Remove(volume.parentPool, volume.name, initiator); err != nil && err != repository.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//卷导出给客户端的登录信息，client为空时返回所有客户端
+func (volume *Volume) Attachments(client string) ([]*AttachmentInfo, error) {
+	attachments, err := repo.Attachments().List(volume.parentPool, volume.name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*AttachmentInfo, 0, len(attachments))
+	for _, a := range attachments {
+		if client != "" && a.Client != client {
+			continue
+		}
+		if a.Transport == repository.TransportNBD {
+			infos = append(infos, nbdAttachmentInfo(a.Export, a.Client))
+			continue
+		}
+		t, err := repo.Targets().Get(volume.parentPool, volume.name, a.Client)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, attachmentInfo(t))
+	}
+
+	if client != "" && len(infos) == 0 {
+		return nil, repository.ErrNotFound
+	}
+	return infos, nil
+}
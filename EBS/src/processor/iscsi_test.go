@@ -0,0 +1,170 @@
+package processor
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"lio"
+	"repository"
+)
+
+func TestTargetNames(t *testing.T) {
+	long := strings.Repeat("v", 300)
+	tests := []struct {
+		name string
+		a, b *Volume
+	}{
+		{"dot in names", NewVolume("c", "a.b", 1), NewVolume("b.c", "a", 1)},
+		{"dash in names", NewVolume("c", "a-b", 1), NewVolume("b-c", "a", 1)},
+		{"case", NewVolume("Vol", "rbd", 1), NewVolume("vol", "rbd", 1)},
+		{"mapped characters", NewVolume("a_b", "rbd", 1), NewVolume("a-b", "rbd", 1)},
+		{"long names", NewVolume(long+"1", "rbd", 1), NewVolume(long+"2", "rbd", 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range []*Volume{tt.a, tt.b} {
+				if iqn := v.targetIQN(); !lio.ValidIQN(iqn) {
+					t.Errorf("invalid IQN %q for %v", iqn, v.resource())
+				}
+			}
+			if tt.a.targetIQN() == tt.b.targetIQN() {
+				t.Errorf("%v and %v share IQN %v", tt.a.resource(), tt.b.resource(), tt.a.targetIQN())
+			}
+			if tt.a.storageObjectName() == tt.b.storageObjectName() {
+				t.Errorf("%v and %v share storage object %v", tt.a.resource(), tt.b.resource(), tt.a.storageObjectName())
+			}
+		})
+	}
+}
+
+//临时目录作为LIO的configfs，仓库使用内存
+func setupISCSI(t *testing.T) string {
+	root, err := ioutil.TempDir("", "lio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedRoot, savedPortal := lioRoot, iscsiPortal
+	SetISCSIConfig(root, "127.0.0.1:3260", "")
+	SetRepository(repository.NewMemoryStore())
+	t.Cleanup(func() {
+		lioRoot, iscsiPortal = savedRoot, savedPortal
+		SetRepository(nil)
+		os.RemoveAll(root)
+	})
+	return root
+}
+
+const (
+	initiator1 = "iqn.1994-05.com.redhat:client1"
+	initiator2 = "iqn.1994-05.com.redhat:client2"
+)
+
+func mappedVolume(name string, dev string) *Volume {
+	volume := NewVolume(name, "rbd", 1<<30)
+	volume.SetDevicePath(dev)
+	return volume
+}
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		name string
+		//导出前在configfs中留下的对象
+		setup func(t *testing.T, volume *Volume)
+		err   error
+	}{
+		{"new", func(t *testing.T, volume *Volume) {}, nil},
+		{"reuse own objects", func(t *testing.T, volume *Volume) {
+			if _, err := volume.Export(initiator2, nil); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+		{"storage object of another device", func(t *testing.T, volume *Volume) {
+			if _, err := lioRoot.CreateBlockStorageObject(volume.storageObjectName(), "/dev/rbd9", false); err != nil {
+				t.Fatal(err)
+			}
+		}, errExportMismatch},
+		{"LUN of another storage object", func(t *testing.T, volume *Volume) {
+			so, err := lioRoot.CreateBlockStorageObject("other", "/dev/rbd9", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target, err := lioRoot.CreateTarget(volume.targetIQN())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tpg, err := target.CreateTPG(targetTPGTag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tpg.CreateLUN(targetLun, so); err != nil {
+				t.Fatal(err)
+			}
+		}, errExportMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupISCSI(t)
+			volume := mappedVolume("vol", "/dev/rbd0")
+			tt.setup(t, volume)
+
+			info, err := volume.Export(initiator1, nil)
+			if err != tt.err {
+				t.Fatalf("Export = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if info.Target != volume.targetIQN() || info.Lun != targetLun || info.Portal != "127.0.0.1:3260" {
+				t.Errorf("attachment %+v", info)
+			}
+			so, err := lioRoot.LookupBlockStorageObject(volume.storageObjectName())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev, err := so.UdevPath(); err != nil || dev != "/dev/rbd0" {
+				t.Errorf("udev_path %v, %v", dev, err)
+			}
+		})
+	}
+}
+
+func TestUnexport(t *testing.T) {
+	setupISCSI(t)
+	volume := mappedVolume("vol", "/dev/rbd0")
+	other := mappedVolume("other", "/dev/rbd1")
+	for _, initiator := range []string{initiator1, initiator2} {
+		if _, err := volume.Export(initiator, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := other.Export(initiator1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := volume.Unexport(initiator1, false); err != nil {
+		t.Fatal(err)
+	}
+	target, err := lioRoot.LookupTarget(volume.targetIQN())
+	if err != nil {
+		t.Fatalf("target removed with initiators left: %v", err)
+	}
+	tpg, _ := target.LookupTPG(targetTPGTag)
+	if _, err := tpg.LookupNodeACL(initiator1); err != lio.ErrNotFound {
+		t.Errorf("ACL of %v left: %v", initiator1, err)
+	}
+
+	if err := volume.Unexport(initiator2, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lioRoot.LookupTarget(volume.targetIQN()); err != lio.ErrNotFound {
+		t.Errorf("target left: %v", err)
+	}
+	if _, err := lioRoot.LookupBlockStorageObject(volume.storageObjectName()); err != lio.ErrNotFound {
+		t.Errorf("storage object left: %v", err)
+	}
+	//其它卷的导出不受影响
+	if _, err := lioRoot.LookupBlockStorageObject(other.storageObjectName()); err != nil {
+		t.Errorf("storage object of other volume: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"encoding/json"
+	"errors"
+	"strings"
+	"job"
+)
+
+var jobs *job.Manager
+
+var errNoJobManager = errors.New("Job manager not set")
+
+type JobReply struct {
+	JobId string
+}
+
+//设置后台任务管理器，耗时操作通过它异步执行
+func SetJobManager(m *job.Manager) {
+	jobs = m
+}
+
+//提交后台任务并立即返回任务ID，errcode为提交失败时返回的状态码
+//返回错误时已发送应答，调用者只需撤销提交前的准备
+func submitJob(w http.ResponseWriter, action string, resource string, errcode int, fn job.Func) error {
+	if jobs == nil {
+		fmt.Fprintf(os.Stderr, "Job manager not set\n")
+		SendStatus(w, errcode, "")
+		return errNoJobManager
+	}
+
+	j, err := jobs.Submit(action, resource, fn)
+	if err == job.ErrBusy {
+		fmt.Fprintf(os.Stderr, "Submit %v on %v failed: %v\n", action, resource, err)
+		SendStatus(w, statusResourceBusyErr, "")
+		return err
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Submit %v on %v failed: %v\n", action, resource, err)
+		SendStatus(w, errcode, "")
+		return err
+	}
+
+	payload, _ := json.Marshal(JobReply{JobId: j.Id})
+	SendResponse(w, http.StatusAccepted, string(payload))
+	return nil
+}
+
+/*
+GET /?Action=DescribeJob&JobId={jobId} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+Content-Length: n
+
+n bytes json result
+*/
+func DescribeJob(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("JobId")
+	if id == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if jobs == nil {
+		fmt.Fprintf(os.Stderr, "Job manager not set\n")
+		SendStatus(w, statusDescribeJobErr, "")
+		return
+	}
+
+	//租户只能查询自己pool上的任务
+	j, err := jobs.Get(id)
+	if err == job.ErrNotFound || err == nil && !tenantOwns(r, strings.SplitN(j.Resource, "/", 2)[0]) {
+		SendNotFound(w, "Job")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get job %v failed: %v\n", id, err)
+		SendStatus(w, statusDescribeJobErr, "")
+		return
+	}
+
+	payload, err := json.Marshal(j)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusDescribeJobErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, string(payload))
+}
@@ -0,0 +1,95 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"storage"
+	"metrics"
+)
+
+var ioSampler *metrics.Sampler
+
+//所有pool的读写计数，删除中的pool跳过
+type poolStatsSource struct{}
+
+func (poolStatsSource) PoolStats() (map[string]storage.PoolStat, error) {
+	conn, err := connectCluster()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Shutdown()
+
+	pools, err := conn.ListPools()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]storage.PoolStat)
+	for _, pool := range pools {
+		ioctx, err := conn.OpenPool(pool)
+		if storage.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stat, err := ioctx.GetPoolStats()
+		ioctx.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "GetPoolStats failed, pool name:%v, %v\n", pool, err)
+			continue
+		}
+		stats[pool] = stat
+	}
+	return stats, nil
+}
+
+//启动pool读写速率的采样，InfoPoolIO的Window参数和InfoPoolIOHistory使用采样结果
+func StartIOSampler(cfg metrics.Config) {
+	ioSampler = metrics.New(poolStatsSource{}, cfg)
+	ioSampler.Start()
+}
+
+func StopIOSampler() {
+	if ioSampler != nil {
+		ioSampler.Stop()
+	}
+}
+
+//Window只能是1m、5m或15m
+func parseWindow(value string) (time.Duration, bool) {
+	window, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, false
+	}
+	for _, w := range metrics.Windows {
+		if window == w {
+			return window, true
+		}
+	}
+	return 0, false
+}
+
+type PoolIORate struct {
+	Window    string
+	Start     string `json:",omitempty"`
+	End       string `json:",omitempty"`
+	ReadIOPS  float64
+	WriteIOPS float64
+	ReadBps   float64
+	WriteBps  float64
+}
+
+//采样不足两次时只有Window
+func newPoolIORate(window string, rate metrics.Rate, ok bool) PoolIORate {
+	r := PoolIORate{Window: window}
+	if ok {
+		r.Start = rate.Start.UTC().Format(time.RFC3339)
+		r.End = rate.End.UTC().Format(time.RFC3339)
+		r.ReadIOPS = rate.ReadIOPS
+		r.WriteIOPS = rate.WriteIOPS
+		r.ReadBps = rate.ReadBps
+		r.WriteBps = rate.WriteBps
+	}
+	return r
+}
@@ -0,0 +1,305 @@
+package processor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"nbd"
+	"repository"
+	"storage"
+)
+
+var errNBDDisabled = errors.New("NBD transport is not enabled")
+
+var nbdServer *nbd.Server
+var nbdAddress string
+
+//卷有export时镜像一直保持打开，所有挂载的export共用，最后一个撤销时关闭
+type nbdExport struct {
+	conn   storage.Cluster
+	pool   storage.Pool
+	image  storage.Image
+	device storage.Image //限速后的镜像
+	size   uint64
+	names  map[string]bool
+}
+
+var nbdMu sync.Mutex
+//按卷的<pool>/<volume>索引
+var nbdExports = make(map[string]*nbdExport)
+
+//启动内置NBD服务；address为返回给客户端的地址，为空时使用listen
+func StartNBDServer(listen string, address string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+
+	nbdServer = nbd.NewServer()
+	nbdAddress = address
+	if nbdAddress == "" {
+		nbdAddress = l.Addr().String()
+	}
+
+	go func(server *nbd.Server) {
+		if err := server.Serve(l); err != nil && err != nbd.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "NBD server stopped: %v\n", err)
+		}
+	}(nbdServer)
+	return nil
+}
+
+//断开所有NBD客户端并关闭镜像
+func StopNBDServer() {
+	if nbdServer == nil {
+		return
+	}
+	nbdServer.Close()
+
+	nbdMu.Lock()
+	defer nbdMu.Unlock()
+	for resource, export := range nbdExports {
+		export.close()
+		delete(nbdExports, resource)
+	}
+}
+
+func (export *nbdExport) close() {
+	if export.image != nil {
+		export.image.Close()
+	}
+	DisConnAndClosePool(export.conn, export.pool)
+}
+
+//NBD的客户端只是一个标识，不能含空白和控制字符
+func validNBDClient(client string) bool {
+	if client == "" || len(client) > 255 {
+		return false
+	}
+	return strings.IndexFunc(client, func(r rune) bool {
+		return r <= ' ' || r == 0x7f
+	}) < 0
+}
+
+//客户端地址为逗号分隔的IP或CIDR，返回规范化后的写法
+func parseNBDAllow(value string) ([]*net.IPNet, string, error) {
+	var networks []*net.IPNet
+	var names []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		var network *net.IPNet
+		if strings.Contains(field, "/") {
+			_, n, err := net.ParseCIDR(field)
+			if err != nil {
+				return nil, "", err
+			}
+			network = n
+		} else {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, "", fmt.Errorf("invalid client address %v", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		networks = append(networks, network)
+		names = append(names, network.String())
+	}
+	if len(networks) == 0 {
+		return nil, "", fmt.Errorf("no client address")
+	}
+	return networks, strings.Join(names, ","), nil
+}
+
+//每次挂载的export名称为<pool>/<volume>/<随机串>，其他客户端猜不到
+func (volume *Volume) newNBDExportName() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return volume.resource() + "/" + hex.EncodeToString(b[:]), nil
+}
+
+func nbdAttachmentInfo(name string, client string) *AttachmentInfo {
+	return &AttachmentInfo{
+		Transport: repository.TransportNBD,
+		Portal:    nbdAddress,
+		Export:    name,
+		Initiator: client,
+	}
+}
+
+//通过内置NBD服务为一个客户端导出卷，allow为允许连接的客户端地址
+func (volume *Volume) ExportNBD(client string, allow string) (*AttachmentInfo, error) {
+	if nbdServer == nil {
+		return nil, errNBDDisabled
+	}
+
+	name, err := volume.newNBDExportName()
+	if err != nil {
+		return nil, err
+	}
+	if err := volume.addNBDExport(name, allow); err != nil {
+		return nil, err
+	}
+	return nbdAttachmentInfo(name, client), nil
+}
+
+//第一个export打开镜像，之后的共用
+func (volume *Volume) addNBDExport(name string, allow string) error {
+	networks, _, err := parseNBDAllow(allow)
+	if err != nil {
+		return err
+	}
+
+	resource := volume.resource()
+	nbdMu.Lock()
+	defer nbdMu.Unlock()
+	export, ok := nbdExports[resource]
+	if !ok {
+		if export, err = volume.openNBDExport(); err != nil {
+			return err
+		}
+	}
+
+	err = nbdServer.AddExport(&nbd.Export{Name: name, Device: export.device, Size: export.size, Allow: networks})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Add NBD export %v failed: %v\n", name, err)
+		if !ok {
+			export.close()
+		}
+		return err
+	}
+	export.names[name] = true
+	nbdExports[resource] = export
+	return nil
+}
+
+//krbd设备和librbd各有缓存，不能同时写，打开镜像前先解除映射，解除失败时不导出
+func (volume *Volume) openNBDExport() (*nbdExport, error) {
+	if volume.devPath != "" {
+		if err := volume.Unmap(); err != nil {
+			return nil, err
+		}
+		if err := volume.Save(); err != nil {
+			return nil, err
+		}
+	}
+
+	export := &nbdExport{names: make(map[string]bool)}
+	var err error
+	export.conn, export.pool, err = NewConnAndOpenPool(volume.parentPool)
+	if err != nil {
+		export.close()
+		return nil, err
+	}
+	if export.image, err = export.pool.OpenImage(volume.name, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Open image %v failed: %v\n", volume.resource(), err)
+		export.close()
+		return nil, err
+	}
+	if export.size, err = export.image.GetSize(); err != nil {
+		export.close()
+		return nil, err
+	}
+	if export.device, err = throttle(export.image, volume.parentPool, volume.name); err != nil {
+		export.close()
+		return nil, err
+	}
+	return export, nil
+}
+
+//NBD客户端在握手时取得卷的大小，之后不会更新，有NBD挂载的卷不能改变大小
+//返回false时已发送应答
+func checkNBDResize(w http.ResponseWriter, volume *Volume, errcode int) bool {
+	attachments, err := repo.Attachments().List(volume.parentPool, volume.name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List attachments of %v failed: %v\n", volume.resource(), err)
+		SendStatus(w, errcode, "")
+		return false
+	}
+	for _, a := range attachments {
+		if a.Transport == repository.TransportNBD {
+			fmt.Fprintf(os.Stderr, "Volume %v is attached to %v over NBD, can not resize\n", volume.resource(), a.Client)
+			SendStatus(w, statusVolumeAttachedErr, "Volume is attached over NBD, detach the NBD clients before resizing")
+			return false
+		}
+	}
+	return true
+}
+
+//撤销一个客户端的export并断开其连接，最后一个撤销时刷新并关闭镜像
+func (volume *Volume) UnexportNBD(name string) error {
+	resource := volume.resource()
+	nbdMu.Lock()
+	defer nbdMu.Unlock()
+
+	export, ok := nbdExports[resource]
+	if !ok || !export.names[name] {
+		return nil
+	}
+	if nbdServer != nil {
+		if _, err := nbdServer.RemoveExport(name); err != nil && err != nbd.ErrNotFound {
+			return err
+		}
+	}
+	delete(export.names, name)
+	if len(export.names) > 0 {
+		return nil
+	}
+	if err := export.image.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Flush NBD export of %v failed: %v\n", resource, err)
+	}
+	export.close()
+	delete(nbdExports, resource)
+	return nil
+}
+
+//NBD导出只在进程内存中，重启后按数据库中的挂载记录恢复
+//没有export名称的旧记录不再按<pool>/<volume>导出，客户端需要重新挂载
+func RestoreNBDExports() error {
+	if nbdServer == nil {
+		return nil
+	}
+
+	volumes, err := repo.Volumes().List("")
+	if err != nil {
+		return err
+	}
+	for _, record := range volumes {
+		if record.State != repository.StateInUse {
+			continue
+		}
+		attachments, err := repo.Attachments().List(record.Pool, record.Name)
+		if err != nil {
+			return err
+		}
+		volume := &Volume{name: record.Name, parentPool: record.Pool, size: record.Size, devPath: record.DevPath,
+			fullname: record.Fullname, state: record.State}
+		for _, a := range attachments {
+			if a.Transport != repository.TransportNBD {
+				continue
+			}
+			if a.Export == "" || a.Allow == "" {
+				fmt.Fprintf(os.Stderr, "NBD attachment of %v to %v has no export, attach it again\n", volume.resource(), a.Client)
+				continue
+			}
+			if err := volume.addNBDExport(a.Export, a.Allow); err != nil {
+				fmt.Fprintf(os.Stderr, "Restore NBD export of %v to %v failed: %v\n", volume.resource(), a.Client, err)
+			}
+		}
+	}
+	return nil
+}
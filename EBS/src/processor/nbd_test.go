@@ -0,0 +1,352 @@
+package processor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"job"
+	"nbd"
+	"repository"
+	"storage/memory"
+)
+
+//内存集群中的rbd/vol，仓库使用内存，NBD服务监听本机随机端口
+func setupNBD(t *testing.T) *Volume {
+	cluster := memory.NewCluster()
+	if err := cluster.MakePool("rbd"); err != nil {
+		t.Fatal(err)
+	}
+	SetBackend(cluster)
+	SetRepository(repository.NewMemoryStore())
+	conn, pool, err := NewConnAndOpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.CreateImage("vol", 1<<20, 22, 0); err != nil {
+		t.Fatal(err)
+	}
+	DisConnAndClosePool(conn, pool)
+
+	if err := StartNBDServer("127.0.0.1:0", ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		StopNBDServer()
+		nbdServer = nil
+		SetRepository(nil)
+		SetBackend(nil)
+	})
+	return NewVolume("vol", "rbd", 1<<20)
+}
+
+func TestParseNBDAllow(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"10.0.0.1", "10.0.0.1/32", true},
+		{"10.0.0.1, 192.168.1.0/24", "10.0.0.1/32,192.168.1.0/24", true},
+		{"192.168.1.7/24", "192.168.1.0/24", true},
+		{"fe80::1", "fe80::1/128", true},
+		{"", "", false},
+		{" , ", "", false},
+		{"10.0.0.256", "", false},
+		{"10.0.0.0/33", "", false},
+		{"host.example.com", "", false},
+	}
+	for _, tt := range tests {
+		_, got, err := parseNBDAllow(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseNBDAllow(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestExportNBD(t *testing.T) {
+	volume := setupNBD(t)
+	tests := []struct {
+		client string
+		allow  string
+		//本机能否连接
+		ok bool
+	}{
+		{"local", "127.0.0.1", true},
+		{"remote", "10.0.0.0/8", false},
+	}
+
+	var names []string
+	for _, tt := range tests {
+		info, err := volume.ExportNBD(tt.client, tt.allow)
+		if err != nil {
+			t.Fatalf("ExportNBD(%v) = %v", tt.client, err)
+		}
+		if !strings.HasPrefix(info.Export, "rbd/vol/") || info.Initiator != tt.client || info.Portal != nbdAddress {
+			t.Errorf("attachment %+v", info)
+		}
+		for _, name := range names {
+			if name == info.Export {
+				t.Errorf("export name %v reused", name)
+			}
+		}
+		names = append(names, info.Export)
+
+		c, err := nbd.Dial("tcp", nbdAddress, info.Export)
+		if (err == nil) != tt.ok {
+			t.Errorf("Dial export of %v = %v, want ok %v", tt.client, err, tt.ok)
+		}
+		if err == nil {
+			c.Close()
+		}
+	}
+
+	//卷名不是export名称，export也不能列出
+	if c, err := nbd.Dial("tcp", nbdAddress, "rbd/vol"); err == nil {
+		c.Close()
+		t.Error("volume exported under rbd/vol")
+	}
+	if list, err := nbd.List("tcp", nbdAddress); err != nil || len(list) != 0 {
+		t.Errorf("List = %v, %v", list, err)
+	}
+
+	//其它export撤销后镜像仍然打开
+	if err := volume.UnexportNBD(names[1]); err != nil {
+		t.Fatal(err)
+	}
+	c, err := nbd.Dial("tcp", nbdAddress, names[0])
+	if err != nil {
+		t.Fatalf("Dial after unexport of another client: %v", err)
+	}
+	data := []byte("nbd data")
+	if _, err := c.WriteAt(data, 4096); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if err := volume.UnexportNBD(names[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := nbdExports[volume.resource()]; ok {
+		t.Error("image left open after the last unexport")
+	}
+	if c, err := nbd.Dial("tcp", nbdAddress, names[0]); err == nil {
+		c.Close()
+		t.Error("Dial after unexport succeeded")
+	}
+
+	conn, pool, err := NewConnAndOpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DisConnAndClosePool(conn, pool)
+	image, err := pool.OpenImage("vol", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	got := make([]byte, len(data))
+	if _, err := image.ReadAt(got, 4096); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("image data %q, %v", got, err)
+	}
+}
+
+func TestRestoreNBDExports(t *testing.T) {
+	volume := setupNBD(t)
+	if err := repo.Volumes().Create(&repository.Volume{Pool: "rbd", Name: "vol", Size: 1 << 20, State: repository.StateCreating}); err != nil {
+		t.Fatal(err)
+	}
+	from := repository.StateCreating
+	for _, to := range statePaths[repository.StateInUse] {
+		if err := repo.Volumes().Transition("rbd", "vol", from, to); err != nil {
+			t.Fatal(err)
+		}
+		from = to
+	}
+	attachments := []*repository.Attachment{
+		{Pool: "rbd", Volume: "vol", Client: "a", Transport: repository.TransportNBD, Export: "rbd/vol/a1", Allow: "127.0.0.1/32"},
+		{Pool: "rbd", Volume: "vol", Client: "b", Transport: repository.TransportNBD, Export: "rbd/vol/b1", Allow: "127.0.0.0/8"},
+		//升级前的记录没有export名称
+		{Pool: "rbd", Volume: "vol", Client: "legacy", Transport: repository.TransportNBD},
+	}
+	for _, a := range attachments {
+		if err := repo.Attachments().Add(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RestoreNBDExports(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"rbd/vol/a1", "rbd/vol/b1"} {
+		c, err := nbd.Dial("tcp", nbdAddress, name)
+		if err != nil {
+			t.Errorf("Dial restored export %v: %v", name, err)
+			continue
+		}
+		c.Close()
+	}
+	if export := nbdExports[volume.resource()]; export == nil || len(export.names) != 2 {
+		t.Errorf("restored exports %+v", export)
+	}
+
+	infos, err := volume.Attachments("a")
+	if err != nil || len(infos) != 1 || infos[0].Export != "rbd/vol/a1" {
+		t.Errorf("Attachments(a) = %+v, %v", infos, err)
+	}
+}
+
+//内核rbd总线：/dev/rbd0为rbd/vol，之后依次为mapped中的<pool>/<image>；
+//remove为解除映射的控制文件；add为目录，映射其它镜像失败
+func setupKRBD(t *testing.T, removable bool, mapped ...string) string {
+	root, err := ioutil.TempDir("", "krbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := filepath.Join(root, "bus", "rbd")
+	for id, image := range append([]string{"rbd/vol"}, mapped...) {
+		device := filepath.Join(bus, "devices", strconv.Itoa(id))
+		if err := os.MkdirAll(device, 0755); err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.SplitN(image, "/", 2)
+		for name, value := range map[string]string{"pool": parts[0], "name": parts[1], "current_snap": "-"} {
+			if err := ioutil.WriteFile(filepath.Join(device, name), []byte(value+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	//控制文件为目录时写入失败
+	remove := filepath.Join(bus, "remove_single_major")
+	if removable {
+		err = ioutil.WriteFile(remove, nil, 0600)
+	} else {
+		err = os.Mkdir(remove, 0755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(bus, "add_single_major"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	//内存集群不支持mon dump，直接配置monitor和密钥
+	saved, monitors, secret := devices, krbdMonitors, krbdSecret
+	SetKRBDConfig(root, "", []string{"127.0.0.1:6789"}, "AQBkey==")
+	t.Cleanup(func() {
+		devices, krbdMonitors, krbdSecret = saved, monitors, secret
+		os.RemoveAll(root)
+	})
+	return remove
+}
+
+func TestExportNBDMapped(t *testing.T) {
+	tests := []struct {
+		name      string
+		removable bool
+		ok        bool
+	}{
+		{"unmapped first", true, true},
+		{"unmap fails", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupNBD(t)
+			remove := setupKRBD(t, tt.removable)
+			if err := repo.Volumes().Create(&repository.Volume{Pool: "rbd", Name: "vol", Size: 1 << 20,
+				DevPath: "/dev/rbd0", State: repository.StateCreating}); err != nil {
+				t.Fatal(err)
+			}
+			volume, err := LoadVolume("vol", "rbd")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = volume.ExportNBD("client", "127.0.0.1")
+			if (err == nil) != tt.ok {
+				t.Fatalf("ExportNBD = %v, want ok %v", err, tt.ok)
+			}
+			record, err := repo.Volumes().Get("rbd", "vol")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.ok {
+				if _, ok := nbdExports[volume.resource()]; ok {
+					t.Error("image opened while mapped by krbd")
+				}
+				if record.DevPath != "/dev/rbd0" {
+					t.Errorf("device path %q after failed unmap", record.DevPath)
+				}
+				return
+			}
+			if data, err := ioutil.ReadFile(remove); err != nil || string(data) != "0" {
+				t.Errorf("remove request %q, %v", data, err)
+			}
+			if volume.devPath != "" || record.DevPath != "" {
+				t.Errorf("device path %q, recorded %q", volume.devPath, record.DevPath)
+			}
+		})
+	}
+}
+
+//NBD客户端不会得知新的大小，有NBD挂载时拒绝改变大小
+func TestResizeNBDAttached(t *testing.T) {
+	tests := []struct {
+		transport string
+		ok        bool
+	}{
+		{repository.TransportNBD, false},
+		{repository.TransportISCSI, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.transport, func(t *testing.T) {
+			setupNBD(t)
+			SetJobManager(job.NewManager(job.NewMemoryStore(), 1))
+			defer SetJobManager(nil)
+			if err := repo.Volumes().Create(&repository.Volume{Pool: "rbd", Name: "vol", Size: 1 << 20, State: repository.StateCreating}); err != nil {
+				t.Fatal(err)
+			}
+			from := repository.StateCreating
+			for _, to := range statePaths[repository.StateInUse] {
+				if err := repo.Volumes().Transition("rbd", "vol", from, to); err != nil {
+					t.Fatal(err)
+				}
+				from = to
+			}
+			if err := repo.Attachments().Add(&repository.Attachment{Pool: "rbd", Volume: "vol", Client: "client",
+				Transport: tt.transport}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, action := range []string{"ExtendDisk", "ResizeVolume"} {
+				handler := ExtendDisk
+				if action == "ResizeVolume" {
+					handler = ResizeVolume
+				}
+				w := callHandler(handler, url.Values{"Action": {action}, "PoolName": {"rbd"}, "VolumeName": {"vol"},
+					"Size": {"2097152"}})
+				jobs.Wait()
+				if tt.ok && w.Code != http.StatusAccepted {
+					t.Errorf("%v: status %v %v", action, w.Code, w.Body)
+				}
+				if !tt.ok && (w.Code != http.StatusConflict || w.Header().Get(LegacyCodeHeader) != strconv.Itoa(statusVolumeAttachedErr)) {
+					t.Errorf("%v: status %v %v", action, w.Code, w.Body)
+				}
+			}
+
+			record, err := repo.Volumes().Get("rbd", "vol")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resized := record.Size != 1<<20; resized != tt.ok {
+				t.Errorf("size %v", record.Size)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"s3"
+)
+
+//内存中的OSS网关，对象以/bucket/key为键，GET支持Range，支持分片上传
+type fakeOSS struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	//uploadId对应的分片
+	uploads map[string]map[int][]byte
+	next    int
+}
+
+func (f *fakeOSS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.Path
+	query := r.URL.Query()
+	if _, ok := query["uploads"]; ok || query.Get("uploadId") != "" {
+		f.multipart(w, r, path, query.Get("uploadId"))
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+		if strings.Count(path, "/") > 1 {
+			if _, ok := f.objects[path]; !ok {
+				http.NotFound(w, r)
+			}
+		}
+	case "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[path] = data
+	case "GET":
+		data, ok := f.objects[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, path, time.Time{}, bytes.NewReader(data))
+	case "DELETE":
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeOSS) multipart(w http.ResponseWriter, r *http.Request, path string, id string) {
+	switch {
+	case r.Method == "POST" && id == "":
+		f.next++
+		id = fmt.Sprintf("upload-%d", f.next)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case f.uploads[id] == nil:
+		http.NotFound(w, r)
+	case r.Method == "PUT":
+		var number int
+		fmt.Sscan(r.URL.Query().Get("partNumber"), &number)
+		data, _ := ioutil.ReadAll(r.Body)
+		f.uploads[id][number] = data
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", number))
+	case r.Method == "POST":
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+			} `xml:"Part"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, f.uploads[id][part.PartNumber]...)
+		}
+		f.objects[path] = data
+		delete(f.uploads, id)
+	case r.Method == "DELETE":
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeOSS) has(bucket string, key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.objects["/"+bucket+"/"+key]
+	return ok
+}
+
+//测试期间ossClient指向内存网关
+func startFakeOSS(t *testing.T) *fakeOSS {
+	f := &fakeOSS{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	server := httptest.NewServer(f)
+	saved := ossClient
+	ossClient = s3.New(s3.Config{Endpoint: strings.TrimPrefix(server.URL, "http://"), AccessKey: "test", SecretKey: "test"})
+	t.Cleanup(func() {
+		ossClient = saved
+		server.Close()
+	})
+	return f
+}
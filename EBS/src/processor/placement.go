@@ -0,0 +1,296 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"storage"
+	"repository"
+	"mon"
+)
+
+//CreateDisk不指定PoolName时使用的pool类别，没有配置时在所有非租户的pool中选择
+const defaultPoolClass = "default"
+
+//无法得知副本数时按ceph默认的3副本估算
+const defaultReplicaSize = 3
+
+//rbd镜像默认的对象大小，按max_objects配额估算可用容量
+const rbdObjectSize = 4 << 20
+
+//pool类别到pool列表，见配置的[placement]章节
+var poolClasses = make(map[string][]string)
+
+func SetPoolClasses(classes map[string][]string) {
+	poolClasses = classes
+}
+
+//已选定pool但还没有登记到数据库的卷，选择时计入，避免并发请求选中同一份空闲容量
+var placementMu sync.Mutex
+var placementReserved = make(map[string]uint64)
+
+//pool的容量：dataChunks份数据占用size份原始容量，副本池dataChunks为1
+type poolCapacity struct {
+	pool        string
+	size        uint64
+	dataChunks  uint64
+	used        uint64
+	objects     uint64
+	provisioned uint64
+	free        uint64
+}
+
+//数据占用的原始容量
+func (c *poolCapacity) raw(bytes uint64) uint64 {
+	return bytes * c.size / c.dataChunks
+}
+
+//原始容量能存放的数据
+func (c *poolCapacity) usable(raw uint64) uint64 {
+	return raw / c.size * c.dataChunks
+}
+
+//已分配给卷但还没有写入的容量，精简配置的卷写满时会占用
+func (c *poolCapacity) pending() uint64 {
+	if c.provisioned > c.used {
+		return c.provisioned - c.used
+	}
+	return 0
+}
+
+type capacityError struct {
+	class string
+	size  uint64
+	pools []*poolCapacity
+}
+
+func (e *capacityError) Error() string {
+	var free []string
+	for _, c := range e.pools {
+		free = append(free, fmt.Sprintf("%v %v bytes free", c.pool, c.free))
+	}
+	if len(free) == 0 {
+		return fmt.Sprintf("No pool in %v for %v bytes", e.class, e.size)
+	}
+	return fmt.Sprintf("Not enough capacity in %v for %v bytes: %v", e.class, e.size, strings.Join(free, ", "))
+}
+
+//name为pool类别时返回类别中的pool，为空时返回默认类别，否则为指定的pool
+func placementCandidates(conn storage.Cluster, name string) (string, []string, error) {
+	if name == "" {
+		name = defaultPoolClass
+		if _, ok := poolClasses[name]; !ok {
+			pools, err := unownedPools(conn)
+			return "all pools", pools, err
+		}
+	}
+	pools, ok := poolClasses[name]
+	if !ok {
+		if err := conn.LookupPool(name); err != nil {
+			return "", nil, storage.ErrPoolNotFound
+		}
+		return "pool " + name, []string{name}, nil
+	}
+
+	var existing []string
+	for _, pool := range pools {
+		if err := conn.LookupPool(pool); err != nil {
+			fmt.Fprintf(os.Stderr, "Pool %v of class %v not found: %v\n", pool, name, err)
+			continue
+		}
+		existing = append(existing, pool)
+	}
+	return "class " + name, existing, nil
+}
+
+//不属于租户的pool
+func unownedPools(conn storage.Cluster) ([]string, error) {
+	pools, err := conn.ListPools()
+	if err != nil {
+		return nil, err
+	}
+	var unowned []string
+	for _, pool := range pools {
+		_, err := repo.Tenants().GetByPool(pool)
+		if err == repository.ErrNotFound {
+			unowned = append(unowned, pool)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return unowned, nil
+}
+
+//纠删码池按k+m份原始容量存放k份数据；查询纠删码配置失败的按副本池处理
+func getPoolCapacity(conn storage.Cluster, client *mon.Client, pool string) (*poolCapacity, error) {
+	ioctx, err := conn.OpenPool(pool)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := ioctx.GetPoolStats()
+	ioctx.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &poolCapacity{pool: pool, dataChunks: 1, used: stat.Num_bytes, objects: stat.Num_objects}
+	size, err := client.GetPoolSize(pool)
+	if err == nil && size > 0 {
+		c.size = uint64(size)
+	} else if stat.Num_objects > 0 && stat.Num_object_copies >= stat.Num_objects {
+		c.size = stat.Num_object_copies / stat.Num_objects
+	} else {
+		c.size = defaultReplicaSize
+	}
+	if v, err := client.GetPool(pool, mon.PoolErasureCodeProfile); err == nil && v.ErasureCodeProfile != "" {
+		if profile, err := client.GetErasureCodeProfile(v.ErasureCodeProfile); err == nil && uint64(profile.K) < c.size {
+			c.dataChunks = uint64(profile.K)
+		}
+	}
+	return c, nil
+}
+
+//按pool的配额限制可用容量，max_objects按每个对象4MiB估算
+func limitByQuota(c *poolCapacity, quota *mon.PoolQuota) {
+	if quota.MaxBytes > 0 {
+		committed := c.provisioned
+		if c.used > committed {
+			committed = c.used
+		}
+		var left uint64
+		if quota.MaxBytes > committed {
+			left = quota.MaxBytes - committed
+		}
+		if left < c.free {
+			c.free = left
+		}
+	}
+	if quota.MaxObjects > 0 {
+		objects := (c.provisioned + rbdObjectSize - 1) / rbdObjectSize
+		if c.objects > objects {
+			objects = c.objects
+		}
+		var left uint64
+		if quota.MaxObjects > objects {
+			left = (quota.MaxObjects - objects) * rbdObjectSize
+		}
+		if left < c.free {
+			c.free = left
+		}
+	}
+}
+
+/*
+为size字节的卷选择pool：集群剩余的原始容量减去所有pool中已分配未写入的部分，
+按pool的副本数换算后再受pool配额限制，选择能放下且剩余最多的pool。
+选中的容量一直预留到调用返回的release，卷登记到数据库后调用
+*/
+func placeVolume(name string, size uint64) (string, func(), error) {
+	conn, err := connectCluster()
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Shutdown()
+
+	placementMu.Lock()
+	defer placementMu.Unlock()
+
+	class, candidates, err := placementCandidates(conn, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	provisioned := make(map[string]uint64)
+	volumes, err := repo.Volumes().List("")
+	if err != nil {
+		return "", nil, err
+	}
+	for _, v := range volumes {
+		provisioned[v.Pool] += v.Size
+	}
+	for pool, bytes := range placementReserved {
+		provisioned[pool] += bytes
+	}
+
+	stat, err := conn.GetClusterStats()
+	if err != nil {
+		return "", nil, err
+	}
+	pools, err := conn.ListPools()
+	if err != nil {
+		return "", nil, err
+	}
+
+	//各pool都从集群的剩余容量中分配，所以要计入所有pool已分配的容量
+	client := mon.New(conn)
+	capacities := make(map[string]*poolCapacity)
+	var pending uint64
+	for _, pool := range pools {
+		c, err := getPoolCapacity(conn, client, pool)
+		if err != nil {
+			return "", nil, err
+		}
+		c.provisioned = provisioned[pool]
+		capacities[pool] = c
+		pending += c.raw(c.pending())
+	}
+	var rawFree uint64
+	if stat.Kb_avail * 1024 > pending {
+		rawFree = stat.Kb_avail * 1024 - pending
+	}
+
+	sort.Strings(candidates)
+	var checked []*poolCapacity
+	var best *poolCapacity
+	for _, pool := range candidates {
+		c, ok := capacities[pool]
+		if !ok {
+			continue
+		}
+		quota, err := client.GetPoolQuota(pool)
+		if err != nil {
+			return "", nil, err
+		}
+		c.free = c.usable(rawFree)
+		limitByQuota(c, quota)
+		checked = append(checked, c)
+		if c.free >= size && (best == nil || c.free > best.free) {
+			best = c
+		}
+	}
+	if best == nil {
+		return "", nil, &capacityError{class: class, size: size, pools: checked}
+	}
+
+	pool := best.pool
+	placementReserved[pool] += size
+	var once sync.Once
+	return pool, func() {
+		once.Do(func() {
+			placementMu.Lock()
+			defer placementMu.Unlock()
+			if placementReserved[pool] -= size; placementReserved[pool] == 0 {
+				delete(placementReserved, pool)
+			}
+		})
+	}, nil
+}
+
+//选择失败时发送错误，容量不足返回statusInsufficientCapacityErr和各pool的剩余容量
+func checkPlacement(w http.ResponseWriter, name string, size uint64, errcode int) (string, func(), bool) {
+	pool, release, err := placeVolume(name, size)
+	if cerr, ok := err.(*capacityError); ok {
+		fmt.Fprintf(os.Stderr, "%v\n", cerr)
+		SendStatus(w, statusInsufficientCapacityErr, cerr.Error())
+		return "", nil, false
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Place volume in %v failed: %v\n", name, err)
+		sendMonError(w, err, errcode)
+		return "", nil, false
+	}
+	return pool, release, true
+}
@@ -0,0 +1,209 @@
+package processor
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"job"
+	"mon"
+	"repository"
+	"storage"
+	"storage/memory"
+)
+
+const mib = 1 << 20
+
+//原始容量为capacity的内存集群，结束时清除pool类别和未释放的预留
+func setupPlacement(t *testing.T, capacity uint64) (*memory.Cluster, *mon.Client) {
+	cluster := setupDisk(t)
+	cluster.SetCapacity(capacity)
+	t.Cleanup(func() {
+		SetPoolClasses(make(map[string][]string))
+		placementMu.Lock()
+		placementReserved = make(map[string]uint64)
+		placementMu.Unlock()
+	})
+	return cluster, mon.New(cluster)
+}
+
+//登记一个未写入数据的卷，计入pool已分配的容量
+func provision(t *testing.T, pool string, name string, size uint64) {
+	if err := repo.Volumes().Create(&repository.Volume{Pool: pool, Name: name, Size: size, State: repository.StateCreating}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectPlaced(t *testing.T, name string, size uint64, want string) func() {
+	pool, release, err := placeVolume(name, size)
+	if err != nil || pool != want {
+		t.Fatalf("placeVolume(%q, %v) = %v, %v, want %v", name, size, pool, err, want)
+	}
+	return release
+}
+
+//free为按pool名排列的各pool剩余容量
+func expectNoCapacity(t *testing.T, name string, size uint64, class string, free ...uint64) {
+	_, _, err := placeVolume(name, size)
+	cerr, ok := err.(*capacityError)
+	if !ok {
+		t.Fatalf("placeVolume(%q, %v) = %v, want capacityError", name, size, err)
+	}
+	var got []uint64
+	for _, c := range cerr.pools {
+		got = append(got, c.free)
+	}
+	if cerr.class != class || cerr.size != size || len(got) != len(free) {
+		t.Fatalf("placeVolume(%q, %v): %v", name, size, cerr)
+	}
+	for i := range free {
+		if got[i] != free[i] {
+			t.Errorf("placeVolume(%q, %v): %v", name, size, cerr)
+		}
+	}
+}
+
+//3副本的pool只能存放原始容量的三分之一，选中的容量在释放前一直预留
+func TestPlaceVolumeReplicas(t *testing.T) {
+	setupPlacement(t, 3*64*mib)
+
+	release := expectPlaced(t, "", 64*mib, "rbd")
+	expectNoCapacity(t, "", 1, "all pools", 0)
+	release()
+	release()
+	release = expectPlaced(t, "", 64*mib, "rbd")
+	release()
+	expectNoCapacity(t, "", 64*mib+1, "all pools", 64*mib)
+}
+
+//选择剩余最多的pool，纠删码pool按k份数据占用k+m份原始容量
+func TestPlaceVolumeMostFree(t *testing.T) {
+	cluster, client := setupPlacement(t, 192*mib)
+	if err := cluster.MakePool("two"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetPoolSize("two", 2); err != nil {
+		t.Fatal(err)
+	}
+	//默认的纠删码配置为k=2 m=1
+	if err := client.CreateErasurePool("ec", 8, "default", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNoCapacity(t, "", 129*mib, "all pools", 128*mib, 64*mib, 96*mib)
+	release := expectPlaced(t, "", 100*mib, "ec")
+	//ec预留的100MiB占用150MiB原始容量，所有pool共用剩下的42MiB
+	expectNoCapacity(t, "", 100*mib, "all pools", 28*mib, 14*mib, 21*mib)
+	expectPlaced(t, "", 20*mib, "ec")
+	release()
+	expectPlaced(t, "", 100*mib, "ec")
+
+	_, _, err := placeVolume("", 1<<40)
+	if msg := err.Error(); !strings.Contains(msg, "Not enough capacity in all pools") || !strings.Contains(msg, "two ") {
+		t.Errorf("error %q", msg)
+	}
+}
+
+//已写入的数据计入集群的已用容量，已分配未写入的部分另外扣除，不会重复计算
+func TestPlaceVolumeProvisioned(t *testing.T) {
+	cluster, _ := setupPlacement(t, 192*mib)
+	provision(t, "rbd", "vol", 32*mib)
+	expectNoCapacity(t, "", 32*mib+1, "all pools", 32*mib)
+
+	pool, err := cluster.OpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.CreateImage("vol", 32*mib, 0, storage.FeatureLayering); err != nil {
+		t.Fatal(err)
+	}
+	writeImage(t, pool, "vol", bytes.Repeat([]byte{1}, 8*mib), 0)
+	expectNoCapacity(t, "", 32*mib+1, "all pools", 32*mib)
+	expectPlaced(t, "", 32*mib, "rbd")
+}
+
+//pool配额限制可用容量，max_objects按每个对象4MiB估算
+func TestPlaceVolumeQuota(t *testing.T) {
+	_, client := setupPlacement(t, 3<<30)
+	provision(t, "rbd", "vol", 30*mib)
+
+	tests := []struct {
+		field string
+		value uint64
+		free  uint64
+	}{
+		{mon.QuotaMaxBytes, 64 * mib, 34 * mib},
+		{mon.QuotaMaxBytes, 16 * mib, 0},
+		{mon.QuotaMaxBytes, 0, 1<<30 - 30*mib},
+		//30MiB按8个对象计算
+		{mon.QuotaMaxObjects, 10, 8 * mib},
+		{mon.QuotaMaxObjects, 8, 0},
+	}
+	for _, tt := range tests {
+		if err := client.SetPoolQuota("rbd", tt.field, tt.value); err != nil {
+			t.Fatal(err)
+		}
+		expectNoCapacity(t, "rbd", tt.free+1, "pool rbd", tt.free)
+		if tt.free > 0 {
+			expectPlaced(t, "rbd", tt.free, "rbd")()
+		}
+	}
+}
+
+//默认类别没有配置时不使用租户的pool；类别中不存在的pool被忽略
+func TestPlaceVolumeClasses(t *testing.T) {
+	cluster, client := setupPlacement(t, 3<<30)
+	for _, pool := range []string{"two", "acme"} {
+		if err := cluster.MakePool(pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pool, size := range map[string]int{"two": 2, "acme": 1} {
+		if err := client.SetPoolSize(pool, size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.Tenants().Create(&repository.Tenant{Name: "acme", AccessKey: "ACMEKEY", Pool: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectPlaced(t, "", mib, "two")
+	expectPlaced(t, "acme", mib, "acme")
+	if _, _, err := placeVolume("missing", mib); err != storage.ErrPoolNotFound {
+		t.Errorf("placeVolume in a missing pool = %v", err)
+	}
+
+	SetPoolClasses(map[string][]string{
+		defaultPoolClass: {"rbd"},
+		"fast":           {"missing", "two"},
+		"gone":           {"missing"},
+	})
+	expectPlaced(t, "", mib, "rbd")
+	expectPlaced(t, "fast", mib, "two")
+	expectNoCapacity(t, "gone", mib, "class gone")
+	if _, _, err := placeVolume("gone", mib); err.Error() != "No pool in class gone for 1048576 bytes" {
+		t.Errorf("error %q", err)
+	}
+}
+
+//CreateDisk容量不足时返回507和各pool的剩余容量
+func TestCreateDiskNoCapacity(t *testing.T) {
+	setupPlacement(t, 3*64*mib)
+
+	w := callHandler(CreateDisk, url.Values{"Action": {"CreateDisk"}, "VolumeName": {"vol"},
+		"Size": {strconv.Itoa(128 * mib)}})
+	if w.Code != http.StatusInsufficientStorage || w.Header().Get(LegacyCodeHeader) != strconv.Itoa(statusInsufficientCapacityErr) ||
+		!strings.Contains(w.Body.String(), "rbd 67108864 bytes free") {
+		t.Errorf("status %v %v", w.Code, w.Body)
+	}
+	if _, err := repo.Volumes().Get("rbd", "vol"); err != repository.ErrNotFound {
+		t.Errorf("volume record: %v", err)
+	}
+	j := runHandlerJob(t, CreateDisk, url.Values{"Action": {"CreateDisk"}, "VolumeName": {"vol"},
+		"Size": {strconv.Itoa(64 * mib)}})
+	if j.State != job.StateSucceeded || j.Resource != "rbd/vol" {
+		t.Errorf("job %+v", j)
+	}
+}
@@ -0,0 +1,409 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"strconv"
+	"encoding/json"
+	"repository"
+	"scheduler"
+	"storage"
+)
+
+var snapshotScheduler *scheduler.Scheduler
+
+//按策略创建、删除快照，供scheduler使用
+type policySnapshots struct{}
+
+//快照已存在时视为成功，卷在本次运行前可能已创建了快照；租户的快照数超出配额时失败
+func (policySnapshots) CreateSnapshot(pool string, volume string, name string) error {
+	release, err := reserveQuota(pool, TenantUsage{Snapshots: 1})
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return err
+	}
+
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	if err := image.CreateSnapshot(name); err != nil && err != storage.ErrExist {
+		return err
+	}
+	return nil
+}
+
+//受保护的快照不删除；快照或镜像已不存在时视为成功
+func (policySnapshots) RemoveSnapshot(pool string, volume string, name string) error {
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return err
+	}
+
+	image, err := ioctx.OpenImage(volume, "")
+	if storage.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	protected, err := image.IsSnapshotProtected(name)
+	if storage.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if protected {
+		return scheduler.ErrProtected
+	}
+
+	if err := image.RemoveSnapshot(name); err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+//启动快照策略的调度，多个实例通过数据库中的租约选出一个执行
+func StartSnapshotScheduler(cfg scheduler.Config) {
+	snapshotScheduler = scheduler.New(repo, policySnapshots{}, cfg)
+	snapshotScheduler.Start()
+}
+
+func StopSnapshotScheduler() {
+	if snapshotScheduler != nil {
+		snapshotScheduler.Stop()
+	}
+}
+
+//删除卷时解除直接作用于它的策略，以免同名的新卷继承
+func detachPolicies(volume *Volume) error {
+	targets, err := repo.Policies().Targets("")
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if t.Pool == volume.parentPool && t.Volume == volume.name {
+			if err := repo.Policies().Detach(t.Policy, t.Pool, t.Volume); err != nil && err != repository.ErrNotFound {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//未提供的整数参数为0
+func formInt(r *http.Request, name string) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+type PolicyTargetInfo struct {
+	Pool   string
+	Volume string
+}
+
+type PolicyInfo struct {
+	Name         string
+	Schedule     string
+	Minute       int
+	Hour         int
+	Weekday      int
+	Retention    int
+	NameTemplate string
+	Targets      []PolicyTargetInfo
+	CreateTime   string
+}
+
+/*
+Schedule为hourly、daily或weekly：hourly在每小时的Minute分，daily在每天的Hour:Minute，
+weekly在每周的Weekday(0为周日) Hour:Minute创建快照
+Retention为保留的快照数，0为全部保留；受保护的快照不会被删除
+NameTemplate可以使用{policy} {schedule} {pool} {volume} {time}，必须含{time}，默认为auto-{policy}-{time}
+GET /?Action=CreateSnapshotPolicy&PolicyName={name}&Schedule={hourly|daily|weekly}[&Minute={m}][&Hour={h}][&Weekday={d}][&Retention={n}][&NameTemplate={template}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
+func CreateSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := &repository.SnapshotPolicy{
+		Name:         r.FormValue("PolicyName"),
+		Schedule:     r.FormValue("Schedule"),
+		NameTemplate: r.FormValue("NameTemplate"),
+	}
+	if policy.NameTemplate == "" {
+		policy.NameTemplate = scheduler.DefaultNameTemplate
+	}
+
+	var err error
+	if policy.Minute, err = formInt(r, "Minute"); err == nil {
+		if policy.Hour, err = formInt(r, "Hour"); err == nil {
+			if policy.Weekday, err = formInt(r, "Weekday"); err == nil {
+				policy.Retention, err = formInt(r, "Retention")
+			}
+		}
+	}
+	if err == nil {
+		err = scheduler.Validate(policy)
+	}
+	if policy.Name == "" || err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if err := repo.Policies().Create(policy); err != nil {
+		fmt.Fprintf(os.Stderr, "Create snapshot policy %v failed: %v\n", policy.Name, err)
+		if err == repository.ErrExist {
+			SendStatus(w, statusPolicyExistErr, "")
+		} else {
+			SendStatus(w, statusCreatePolicyErr, "")
+		}
+		return
+	}
+
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+/*
+删除策略并解除它作用的卷和pool，已创建的快照保留
+GET /?Action=DelSnapshotPolicy&PolicyName={name} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
+func DelSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("PolicyName")
+	if name == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if err := repo.Policies().Delete(name); err != nil {
+		fmt.Fprintf(os.Stderr, "Delete snapshot policy %v failed: %v\n", name, err)
+		if err == repository.ErrNotFound {
+			SendNotFound(w, "SnapshotPolicy")
+		} else {
+			SendStatus(w, statusDelPolicyErr, "")
+		}
+		return
+	}
+
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+/*
+GET /?Action=ListSnapshotPolicies HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+Content-Length: n
+
+[{"Name":"daily","Schedule":"daily","Minute":0,"Hour":2,"Weekday":0,"Retention":7,"NameTemplate":"auto-{policy}-{time}","Targets":[{"Pool":"rbd","Volume":""}],"CreateTime":"..."}]
+*/
+func ListSnapshotPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := repo.Policies().List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List snapshot policies failed: %v\n", err)
+		SendStatus(w, statusListPoliciesErr, "")
+		return
+	}
+	targets, err := repo.Policies().Targets("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List snapshot policy targets failed: %v\n", err)
+		SendStatus(w, statusListPoliciesErr, "")
+		return
+	}
+
+	infos := make([]PolicyInfo, 0, len(policies))
+	for _, p := range policies {
+		info := PolicyInfo{
+			Name:         p.Name,
+			Schedule:     p.Schedule,
+			Minute:       p.Minute,
+			Hour:         p.Hour,
+			Weekday:      p.Weekday,
+			Retention:    p.Retention,
+			NameTemplate: p.NameTemplate,
+			Targets:      []PolicyTargetInfo{},
+			CreateTime:   p.CreateTime,
+		}
+		for _, t := range targets {
+			if t.Policy == p.Name {
+				info.Targets = append(info.Targets, PolicyTargetInfo{Pool: t.Pool, Volume: t.Volume})
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	payload, err := json.Marshal(infos)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusListPoliciesErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, string(payload))
+}
+
+/*
+不指定VolumeName时策略作用于pool中所有EBS管理的卷；已作用时直接返回成功
+GET /?Action=AttachSnapshotPolicy&PolicyName={name}&PoolName={PoolName}[&VolumeName={volumeName}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
+func AttachSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("PolicyName")
+	pool := r.FormValue("PoolName")
+	volume := r.FormValue("VolumeName")
+	if name == "" || pool == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if _, err := repo.Policies().Get(name); err != nil {
+		fmt.Fprintf(os.Stderr, "Load snapshot policy %v failed: %v\n", name, err)
+		sendStateError(w, err, statusAttachPolicyErr)
+		return
+	}
+
+	if volume != "" {
+		if _, err := LoadVolume(volume, pool); err != nil {
+			fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", pool, volume, err)
+			sendStateError(w, err, statusAttachPolicyErr)
+			return
+		}
+	} else {
+		conn, err := connectCluster()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
+			SendStatus(w, statusAttachPolicyErr, "")
+			return
+		}
+		err = conn.LookupPool(pool)
+		conn.Shutdown()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LookupPool failed, pool name:%v, %v\n", pool, err)
+			sendStorageError(w, err, statusAttachPolicyErr)
+			return
+		}
+	}
+
+	err := repo.Policies().Attach(&repository.PolicyTarget{Policy: name, Pool: pool, Volume: volume})
+	if err != nil && err != repository.ErrExist {
+		fmt.Fprintf(os.Stderr, "Attach snapshot policy %v to %v/%v failed: %v\n", name, pool, volume, err)
+		SendStatus(w, statusAttachPolicyErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+/*
+GET /?Action=DetachSnapshotPolicy&PolicyName={name}&PoolName={PoolName}[&VolumeName={volumeName}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
+func DetachSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("PolicyName")
+	pool := r.FormValue("PoolName")
+	volume := r.FormValue("VolumeName")
+	if name == "" || pool == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if err := repo.Policies().Detach(name, pool, volume); err != nil {
+		fmt.Fprintf(os.Stderr, "Detach snapshot policy %v from %v/%v failed: %v\n", name, pool, volume, err)
+		sendStateError(w, err, statusDetachPolicyErr)
+		return
+	}
+
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+/*
+策略创建和删除快照的记录，按计划时间排序；参数均可选，State为created、failed或deleted
+GET /?Action=ListSnapshotRuns[&PolicyName={name}][&PoolName={PoolName}][&VolumeName={volumeName}][&State={state}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+Content-Length: n
+
+[{"Policy":"daily","Pool":"rbd","Volume":"vol","ScheduledTime":"...","Snapshot":"auto-daily-20180101-0200","State":"created","Error":"","CreateTime":"...","UpdateTime":"..."}]
+*/
+func ListSnapshotRuns(w http.ResponseWriter, r *http.Request) {
+	runs, err := repo.SnapshotRuns().List(r.FormValue("PolicyName"), r.FormValue("PoolName"),
+		r.FormValue("VolumeName"), r.FormValue("State"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List snapshot runs failed: %v\n", err)
+		SendStatus(w, statusListSnapRunsErr, "")
+		return
+	}
+	if runs == nil {
+		runs = []*repository.SnapshotRun{}
+	}
+
+	payload, err := json.Marshal(runs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusListSnapRunsErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, string(payload))
+}
@@ -2,13 +2,20 @@ package processor
 
 import (
 	"net/http"
-	"librados/rados"
+	"storage"
 	"fmt"
 	"os"
 	"encoding/json"
 	"db"
+	"repository"
+	"strconv"
+	"mon"
+	"time"
 )
 
+//副本数上限，ceph的osd pool set size只允许1到10
+const maxReplicaSize = 10
+
 type PoolSummarize struct {
 	Replica_num     uint64
 	Objects_num     uint64
@@ -34,24 +41,14 @@ func Test(w http.ResponseWriter, r *http.Request) {
 	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
 }
 
-func NewConnAndOpenPool(pool string) (*rados.Conn, *rados.IOContext, error) {
-	conn, err := rados.NewConn()
+func NewConnAndOpenPool(pool string) (storage.Cluster, storage.Pool, error) {
+	conn, err := connectCluster()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		return nil, nil, err
-	}
-
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		return conn, nil, err
-	}
-
-	if err := conn.Connect(); err != nil {
 		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
-		return conn, nil, err
+		return nil, nil, err
 	}
 
-	ioctx, err := conn.OpenIOContext(pool)
+	ioctx, err := conn.OpenPool(pool)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "OpenIOContext failed: %v\n", err)
 		return conn, nil, err
@@ -60,9 +57,9 @@ func NewConnAndOpenPool(pool string) (*rados.Conn, *rados.IOContext, error) {
 	return conn, ioctx, nil
 }
 
-func DisConnAndClosePool(conn *rados.Conn, context *rados.IOContext) {
+func DisConnAndClosePool(conn storage.Cluster, context storage.Pool) {
 	if context != nil {
-		context.Destroy()
+		context.Close()
 	}
 
 	if conn != nil {
@@ -70,17 +67,207 @@ func DisConnAndClosePool(conn *rados.Conn, context *rados.IOContext) {
 	}
 }
 
+//创建pool的参数，为0或空时使用集群的默认值
+type PoolOptions struct {
+	PgNum     int
+	Size      int
+	MinSize   int
+	CrushRule string
+	//纠删码的k和m，都为0时为副本pool
+	ErasureK  int
+	ErasureM  int
+}
+
+//pool创建后实际生效的设置
+type PoolSettings struct {
+	Name               string
+	PgNum              int
+	Size               int
+	MinSize            int
+	CrushRule          string
+	ErasureCodeProfile string `json:",omitempty"`
+	Application        string `json:",omitempty"`
+}
+
+const (
+	maxPGNum = 32768
+	//每个OSD上的PG数上限，与ceph的mon_max_pg_per_osd默认值一致
+	maxPGPerOSD = 250
+	//创建纠删码pool时必须指定pg_num
+	defaultECPGNum = 32
+	poolApplication = "rbd"
+)
+
+func parsePoolOptions(r *http.Request) (*PoolOptions, error) {
+	opts := &PoolOptions{CrushRule: r.FormValue("CrushRule")}
+	fields := []struct {
+		name  string
+		value *int
+	}{
+		{"PgNum", &opts.PgNum},
+		{"Size", &opts.Size},
+		{"MinSize", &opts.MinSize},
+		{"ErasureK", &opts.ErasureK},
+		{"ErasureM", &opts.ErasureM},
+	}
+	for _, f := range fields {
+		n, err := formInt(r, f.name)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid %v %v", f.name, r.FormValue(f.name))
+		}
+		*f.value = n
+	}
+
+	if opts.PgNum > maxPGNum {
+		return nil, fmt.Errorf("PgNum must not exceed %v", maxPGNum)
+	}
+	if opts.Size > maxReplicaSize {
+		return nil, fmt.Errorf("Size must be between 1 and %v", maxReplicaSize)
+	}
+	if (opts.ErasureK == 0) != (opts.ErasureM == 0) {
+		return nil, fmt.Errorf("ErasureK and ErasureM must be given together")
+	}
+	if opts.erasure() {
+		if opts.Size != 0 {
+			return nil, fmt.Errorf("Size of an erasure coded pool is ErasureK+ErasureM")
+		}
+		if opts.MinSize != 0 && (opts.MinSize < opts.ErasureK || opts.MinSize > opts.ErasureK + opts.ErasureM) {
+			return nil, fmt.Errorf("MinSize must be between ErasureK and ErasureK+ErasureM")
+		}
+	} else if opts.Size != 0 && opts.MinSize > opts.Size {
+		return nil, fmt.Errorf("MinSize must not exceed Size")
+	}
+	return opts, nil
+}
+
+func (opts *PoolOptions) erasure() bool {
+	return opts.ErasureK > 0
+}
+
+func (opts *PoolOptions) defaults() bool {
+	return opts.PgNum == 0 && opts.Size == 0 && opts.MinSize == 0 && !opts.erasure()
+}
+
+//按集群中的OSD数检查副本数、k+m和每个OSD上的PG数
+func (opts *PoolOptions) validate(osds int) error {
+	size := opts.Size
+	if opts.erasure() {
+		size = opts.ErasureK + opts.ErasureM
+	}
+	if size > osds {
+		return fmt.Errorf("Pool needs %v OSDs, the cluster has %v", size, osds)
+	}
+	if size > 0 && opts.PgNum * size > maxPGPerOSD * osds {
+		return fmt.Errorf("PgNum %v with size %v exceeds %v PGs per OSD on %v OSDs", opts.PgNum, size, maxPGPerOSD, osds)
+	}
+	return nil
+}
+
+func (opts *PoolOptions) erasureProfile() string {
+	return fmt.Sprintf("ebs-k%v-m%v", opts.ErasureK, opts.ErasureM)
+}
+
+//创建pool，副本pool通过librados按CRUSH规则创建，纠删码pool通过mon命令创建
+func makePool(conn storage.Cluster, client *mon.Client, pool string, opts *PoolOptions) error {
+	if opts.erasure() {
+		profile := &mon.ErasureCodeProfile{K: opts.ErasureK, M: opts.ErasureM}
+		if err := client.SetErasureCodeProfile(opts.erasureProfile(), profile, false); err != nil {
+			return err
+		}
+		pgNum := opts.PgNum
+		if pgNum == 0 {
+			pgNum = defaultECPGNum
+		}
+		return client.CreateErasurePool(pool, pgNum, opts.erasureProfile(), opts.CrushRule)
+	}
+
+	if opts.CrushRule == "" {
+		return conn.MakePool(pool)
+	}
+	rule, err := client.GetCrushRule(opts.CrushRule)
+	if err != nil {
+		return err
+	}
+	if rule.ID < 0 || rule.ID > 255 {
+		return fmt.Errorf("CRUSH rule %v has invalid id %v", rule.Name, rule.ID)
+	}
+	return conn.MakePoolWithCrushRule(pool, uint8(rule.ID))
+}
+
+//修改创建时不能指定的设置；纠删码pool要允许覆盖写才能存放rbd数据
+func configurePool(client *mon.Client, pool string, opts *PoolOptions) error {
+	if opts.erasure() {
+		if err := client.SetPool(pool, mon.PoolAllowECOverwrites, "true"); err != nil {
+			return err
+		}
+	} else {
+		if opts.PgNum > 0 {
+			if err := client.SetPoolPGNum(pool, opts.PgNum); err != nil {
+				return err
+			}
+		}
+		if opts.Size > 0 {
+			if err := client.SetPoolSize(pool, opts.Size); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.MinSize > 0 {
+		return client.SetPoolMinSize(pool, opts.MinSize)
+	}
+	return nil
+}
+
+//查询失败的设置保留请求中的值
+func poolSettings(client *mon.Client, pool string, opts *PoolOptions) *PoolSettings {
+	settings := &PoolSettings{Name: pool, PgNum: opts.PgNum, Size: opts.Size, MinSize: opts.MinSize, CrushRule: opts.CrushRule}
+	if opts.erasure() {
+		settings.Size = opts.ErasureK + opts.ErasureM
+		settings.ErasureCodeProfile = opts.erasureProfile()
+	}
+	for _, variable := range []string{mon.PoolPGNum, mon.PoolSize, mon.PoolMinSize, mon.PoolCrushRule} {
+		v, err := client.GetPool(pool, variable)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Get %v of pool %v failed: %v\n", variable, pool, err)
+			continue
+		}
+		switch variable {
+		case mon.PoolPGNum:
+			settings.PgNum = v.PGNum
+		case mon.PoolSize:
+			settings.Size = v.Size
+		case mon.PoolMinSize:
+			settings.MinSize = v.MinSize
+		case mon.PoolCrushRule:
+			settings.CrushRule = v.CrushRule
+		}
+	}
+	return settings
+}
+
+//给EBS创建的pool加上rbd应用标记，失败时只记录，老版本的ceph没有这个命令
+func tagPool(client *mon.Client, pool string) bool {
+	if err := client.EnableApplication(pool, poolApplication); err != nil {
+		fmt.Fprintf(os.Stderr, "Enable application %v on pool %v failed: %v\n", poolApplication, pool, err)
+		return false
+	}
+	return true
+}
+
 /*
-GET /?Action=CreatePool&PoolName={PoolName|*} HTTP/1.1
+创建pool，可指定PG数、副本数、CRUSH规则，或者纠删码的k和m，参数都不指定时使用集群的默认值。
+返回pool实际生效的设置
+GET /?Action=CreatePool&PoolName={PoolName}[&PgNum={PgNum}][&Size={Size}][&MinSize={MinSize}][&CrushRule={CrushRule}][&ErasureK={k}&ErasureM={m}] HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
 HTTP /1.1 200 OK
 Server: dhcc.ebs
 Date: GMT Date
+Content-Type: application/json
 
-OK
+{"Name":"rbd2","PgNum":64,"Size":3,"MinSize":2,"CrushRule":"replicated_rule","Application":"rbd"}
 */
 func CreatePool(w http.ResponseWriter, r *http.Request) {
 	pool := r.FormValue("PoolName")
@@ -89,41 +276,82 @@ func CreatePool(w http.ResponseWriter, r *http.Request) {
 		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
 	}
+	opts, err := parsePoolOptions(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+		SendStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	conn, err := rados.NewConn()
+	conn, err := connectCluster()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
 		SendStatus(w, statusCreatePoolErr, "")
 		return
 	}
 	defer conn.Shutdown()
+	client := mon.New(conn)
 
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusCreatePoolErr, "")
+	//osd pool create对已存在的pool也返回成功
+	if err := conn.LookupPool(pool); err == nil {
+		sendStorageError(w, storage.ErrExist, statusCreatePoolErr)
 		return
 	}
 
-	if err := conn.Connect(); err != nil {
-		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
-		SendStatus(w, statusCreatePoolErr, "")
-		return
+	if !opts.defaults() {
+		status, err := client.Status()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Get cluster status failed: %v\n", err)
+			sendMonError(w, err, statusCreatePoolErr)
+			return
+		}
+		if err := opts.validate(status.OSDMap.NumInOSDs); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+			SendStatus(w, http.StatusBadRequest, err.Error())
+			return
+		}
 	}
 
-	if err := conn.MakePool(pool); err != nil {
+	if err := makePool(conn, client, pool, opts); err != nil {
 		fmt.Fprintf(os.Stderr, "MakePool failed, pool name:%v, %v\n", pool, err)
-		SendStatus(w, statusCreatePoolErr, err.Error())
+		if cause := mon.Cause(err); cause == storage.ErrNotFound && opts.CrushRule != "" {
+			SendStatus(w, http.StatusBadRequest, "Unknown CRUSH rule " + opts.CrushRule)
+		} else {
+			sendStorageError(w, cause, statusCreatePoolErr)
+		}
 		return
 	}
 
-	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+	//设置失败时删除刚创建的pool，mon不允许删除pool时只能保留
+	if err := configurePool(client, pool, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Configure pool %v failed: %v\n", pool, err)
+		if derr := conn.DeletePool(pool); derr != nil {
+			fmt.Fprintf(os.Stderr, "Delete pool %v failed: %v\n", pool, derr)
+		}
+		sendStorageError(w, mon.Cause(err), statusCreatePoolErr)
+		return
+	}
+
+	settings := poolSettings(client, pool, opts)
+	if tagPool(client, pool) {
+		settings.Application = poolApplication
+	}
+	fmt.Fprintf(os.Stderr, "CreatePool : %+v\n", *settings)
+
+	payload, err := json.Marshal(settings)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusCreatePoolErr, "")
+		return
+	}
+	SendResponse(w, http.StatusOK, string(payload))
 }
 
 /*
 GET /?Action=InfoPool&PoolName={PoolName|*} HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
 HTTP /1.1 200 OK
 Server: dhcc.ebs
@@ -141,25 +369,13 @@ func InfoPools(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := rados.NewConn()
+	conn, err := connectCluster()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusInfoPoolErr, "")
-		return
-	}
-	defer conn.Shutdown()
-
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusInfoPoolErr, "")
-		return
-	}
-
-	if err := conn.Connect(); err != nil {
 		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
 		SendStatus(w, statusInfoPoolErr, "")
 		return
 	}
+	defer conn.Shutdown()
 
 	var pools []string
 	if pool == "*" {
@@ -171,7 +387,7 @@ func InfoPools(w http.ResponseWriter, r *http.Request) {
 	} else {
 		if err := conn.LookupPool(pool); err != nil {
 			fmt.Fprintf(os.Stderr, "LookupPool failed, pool name:%v, %v\n", pool, err)
-			SendStatus(w, statusNotFoundErr, "")
+			SendNotFound(w, "Pool")
 			return
 		}
 		pools = append(pools, pool)
@@ -179,13 +395,13 @@ func InfoPools(w http.ResponseWriter, r *http.Request) {
 
 	poolsInfo := make(map[string]PoolSummarize)
 	for i := 0; i < len(pools); i++ {
-		ioctx, err := conn.OpenIOContext(pools[i])
+		ioctx, err := conn.OpenPool(pools[i])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", pools[i], err)
 			SendStatus(w, statusInfoPoolErr, "")
 			return
 		}
-		defer ioctx.Destroy()
+		defer ioctx.Close()
 
 		PoolStat, err := ioctx.GetPoolStats()
 		if err != nil {
@@ -194,8 +410,12 @@ func InfoPools(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		var replicaNum uint64
+		if PoolStat.Num_objects > 0 {
+			replicaNum = PoolStat.Num_object_copies / PoolStat.Num_objects
+		}
 		poolsInfo[pools[i]] = PoolSummarize{
-			Replica_num: PoolStat.Num_object_copies / PoolStat.Num_objects,
+			Replica_num: replicaNum,
 			Used_bytes: PoolStat.Num_bytes,
 			Objects_num: PoolStat.Num_objects,
 		}
@@ -212,10 +432,12 @@ func InfoPools(w http.ResponseWriter, r *http.Request) {
 }
 
 /*
-GET /?Action=InfoPoolsIO&PoolName={PoolName|*} HTTP/1.1
+不指定Window时返回累计的读写次数和KB；Window为1m、5m或15m时返回该时间内的每秒读写次数和字节数，
+Start和End为实际覆盖的采样时间，服务刚启动时短于Window，采样不足两次时没有Start和End
+GET /?Action=InfoPoolIO&PoolName={PoolName|*}[&Window={1m|5m|15m}] HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
 HTTP /1.1 200 OK
 Server: dhcc.ebs
@@ -225,34 +447,28 @@ Content-Length: n
 
 n bytes json result
 */
-//TODO 读写时的IO
 func InfoPoolsIO(w http.ResponseWriter, r *http.Request) {
 	pool := r.FormValue("PoolName")
-	if pool == "" {
+	windowName := r.FormValue("Window")
+	window, ok := parseWindow(windowName)
+	if pool == "" || windowName != "" && !ok {
 		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
 		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
 	}
-
-	conn, err := rados.NewConn()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusInfoPoolIOErr, "")
-		return
-	}
-	defer conn.Shutdown()
-
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusInfoPoolIOErr, "")
+	if windowName != "" && ioSampler == nil {
+		fmt.Fprintf(os.Stderr, "IO sampler not started\n")
+		SendStatus(w, http.StatusServiceUnavailable, "IO sampler is not running")
 		return
 	}
 
-	if err := conn.Connect(); err != nil {
+	conn, err := connectCluster()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
 		SendStatus(w, statusInfoPoolIOErr, "")
 		return
 	}
+	defer conn.Shutdown()
 
 	var pools []string
 	if pool == "*" {
@@ -264,21 +480,37 @@ func InfoPoolsIO(w http.ResponseWriter, r *http.Request) {
 	} else {
 		if err := conn.LookupPool(pool); err != nil {
 			fmt.Fprintf(os.Stderr, "LookupPool failed, pool name:%v, %v\n", pool, err)
-			SendStatus(w, statusNotFoundErr, "")
+			SendNotFound(w, "Pool")
 			return
 		}
 		pools = append(pools, pool)
 	}
 
+	if windowName != "" {
+		rates := make(map[string]PoolIORate)
+		for _, name := range pools {
+			rate, ok := ioSampler.Rate(name, window)
+			rates[name] = newPoolIORate(windowName, rate, ok)
+		}
+		payload, err := json.Marshal(rates)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+			SendStatus(w, statusInfoPoolIOErr, "")
+			return
+		}
+		SendResponse(w, http.StatusOK, string(payload))
+		return
+	}
+
 	poolsIOInfo := make(map[string]PoolIOSummarize)
 	for i := 0; i < len(pools); i++ {
-		ioctx, err := conn.OpenIOContext(pools[i])
+		ioctx, err := conn.OpenPool(pools[i])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", pools[i], err)
 			SendStatus(w, statusInfoPoolIOErr, "")
 			return
 		}
-		defer ioctx.Destroy()
+		defer ioctx.Close()
 
 		PoolStat, err := ioctx.GetPoolStats()
 		if err != nil {
@@ -305,45 +537,135 @@ func InfoPoolsIO(w http.ResponseWriter, r *http.Request) {
 	SendResponse(w, http.StatusOK, string(payload))
 }
 
+type PoolIOPoint struct {
+	Start     string
+	End       string
+	ReadIOPS  float64
+	WriteIOPS float64
+	ReadBps   float64
+	WriteBps  float64
+}
+
 /*
-GET /?Action=DelPool&PoolName={PoolName} HTTP/1.1
+pool在相邻两次采样之间的每秒读写次数和字节数，按时间排列；Start和End为RFC3339时间，
+只返回结束时间在(Start, End]内的点，不指定时为保留的全部历史(见配置的[metrics]章节)
+GET /?Action=InfoPoolIOHistory&PoolName={PoolName}[&Start={time}][&End={time}] HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
 HTTP /1.1 200 OK
 Server: dhcc.ebs
 Date: GMT Date
+Content-Type: application/json
 
-OK
+[{"Start":"2018-06-01T08:00:00Z","End":"2018-06-01T08:00:10Z","ReadIOPS":12.5,"WriteIOPS":40,"ReadBps":51200,"WriteBps":163840},...]
 */
-func DelPool(w http.ResponseWriter, r *http.Request) {
+func InfoPoolIOHistory(w http.ResponseWriter, r *http.Request) {
 	pool := r.FormValue("PoolName")
+	var bounds [2]time.Time
+	for i, name := range []string{"Start", "End"} {
+		value := r.FormValue(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+			SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		bounds[i] = t
+	}
 	if pool == "" {
 		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
 		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
 	}
+	if ioSampler == nil {
+		fmt.Fprintf(os.Stderr, "IO sampler not started\n")
+		SendStatus(w, http.StatusServiceUnavailable, "IO sampler is not running")
+		return
+	}
 
-	conn, err := rados.NewConn()
+	//还没有采样的pool要确认存在
+	if ioSampler.Samples(pool) == nil {
+		conn, err := connectCluster()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
+			SendStatus(w, statusInfoPoolIOErr, "")
+			return
+		}
+		err = conn.LookupPool(pool)
+		conn.Shutdown()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LookupPool failed, pool name:%v, %v\n", pool, err)
+			SendNotFound(w, "Pool")
+			return
+		}
+	}
+
+	points := []PoolIOPoint{}
+	for _, rate := range ioSampler.Range(pool, bounds[0], bounds[1]) {
+		points = append(points, PoolIOPoint{
+			Start: rate.Start.UTC().Format(time.RFC3339),
+			End: rate.End.UTC().Format(time.RFC3339),
+			ReadIOPS: rate.ReadIOPS,
+			WriteIOPS: rate.WriteIOPS,
+			ReadBps: rate.ReadBps,
+			WriteBps: rate.WriteBps,
+		})
+	}
+
+	payload, err := json.Marshal(points)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusDelPoolErr, "")
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusInfoPoolIOErr, "")
 		return
 	}
-	defer conn.Shutdown()
 
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusDelPoolErr, "")
+	SendResponse(w, http.StatusOK, string(payload))
+}
+
+/*
+GET /?Action=DelPool&PoolName={PoolName} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
+func DelPool(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	if pool == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	//租户的pool要先删除租户
+	if owner, err := repo.Tenants().GetByPool(pool); err != repository.ErrNotFound {
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Pool %v is owned by tenant %v\n", pool, owner.Name)
+			SendStatus(w, statusTenantInUseErr, "")
+		} else {
+			fmt.Fprintf(os.Stderr, "Load tenant of pool %v failed: %v\n", pool, err)
+			SendStatus(w, statusDelPoolErr, "")
+		}
 		return
 	}
 
-	if err := conn.Connect(); err != nil {
+	conn, err := connectCluster()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
 		SendStatus(w, statusDelPoolErr, "")
 		return
 	}
+	defer conn.Shutdown()
 
 	if err := conn.DeletePool(pool); err != nil {
 		fmt.Fprintf(os.Stderr, "DeletePool failed, pool name:%v, %v\n", pool, err)
@@ -358,7 +680,7 @@ func DelPool(w http.ResponseWriter, r *http.Request) {
 GET /?Action=ModPoolRepSize&PoolName={PoolName}&Size={replicaSize} HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
 HTTP /1.1 200 OK
 Server: dhcc.ebs
@@ -368,53 +690,141 @@ OK
 */
 func ModPoolRepSize(w http.ResponseWriter, r *http.Request) {
 	pool := r.FormValue("PoolName")
-	if pool == "" {
+	size, err := strconv.Atoi(r.FormValue("Size"))
+	if pool == "" || err != nil || size < 1 || size > maxReplicaSize {
 		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
 		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
 	}
 
-	conn, err := rados.NewConn()
+	conn, err := connectCluster()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
 		SendStatus(w, statusModPoolErr, "")
 		return
 	}
 	defer conn.Shutdown()
 
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusModPoolErr, "")
+	if err := mon.New(conn).SetPoolSize(pool, size); err != nil {
+		fmt.Fprintf(os.Stderr, "Set size of pool %v to %v failed: %v\n", pool, size, err)
+		sendMonError(w, err, statusModPoolErr)
 		return
 	}
+	fmt.Fprintf(os.Stderr, "ModPoolRepSize : %v size %v\n", pool, size)
 
-	if err := conn.Connect(); err != nil {
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+type PoolQuota struct {
+	PoolName   string
+	MaxBytes   uint64
+	MaxObjects uint64
+}
+
+/*
+设置pool的配额(osd pool set-quota)，达到配额后pool不能再写入；0为取消配额，不指定的配额不变。
+CreateDisk选择pool时不会超出MaxBytes，MaxObjects按每个对象4MiB估算
+GET /?Action=SetPoolQuota&PoolName={PoolName}[&MaxBytes={bytes}][&MaxObjects={n}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
+func SetPoolQuota(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	params := map[string]string{mon.QuotaMaxBytes: "MaxBytes", mon.QuotaMaxObjects: "MaxObjects"}
+	var fields []string
+	values := make(map[string]uint64)
+	for _, field := range []string{mon.QuotaMaxBytes, mon.QuotaMaxObjects} {
+		value := r.FormValue(params[field])
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+			SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		fields = append(fields, field)
+		values[field] = n
+	}
+	if pool == "" || len(fields) == 0 {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	conn, err := connectCluster()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
-		SendStatus(w, statusModPoolErr, "")
+		SendStatus(w, statusPoolQuotaErr, "")
 		return
 	}
+	defer conn.Shutdown()
 
-	size := r.FormValue("Size")
-	var cmd = map[string]string{
-		"prefix" : "osd pool set",
-		"pool" : pool,
-		"var" : "size",
-		"val" : size,
+	client := mon.New(conn)
+	for _, field := range fields {
+		n := values[field]
+		if err := client.SetPoolQuota(pool, field, n); err != nil {
+			fmt.Fprintf(os.Stderr, "Set %v of pool %v to %v failed: %v\n", field, pool, n, err)
+			sendMonError(w, err, statusPoolQuotaErr)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "SetPoolQuota : %v %v %v\n", pool, field, n)
 	}
-	payload, err := json.Marshal(cmd)
+
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+/*
+pool的配额，0为没有配额
+GET /?Action=InfoPoolQuota&PoolName={PoolName} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"PoolName":"rbd","MaxBytes":1099511627776,"MaxObjects":0}
+*/
+func InfoPoolQuota(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	if pool == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	conn, err := connectCluster()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Encode command failed: %v\n", err)
-		SendStatus(w, statusModPoolErr, "")
+		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
+		SendStatus(w, statusPoolQuotaErr, "")
 		return
 	}
+	defer conn.Shutdown()
 
-	content, info, err := conn.MonCommand(payload)
+	quota, err := mon.New(conn).GetPoolQuota(pool)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "MonCommand failed, cmd:%v, %v\n", string(payload), err)
-		SendStatus(w, statusModPoolErr, err.Error())
+		fmt.Fprintf(os.Stderr, "Get quota of pool %v failed: %v\n", pool, err)
+		sendMonError(w, err, statusPoolQuotaErr)
 		return
 	}
-	fmt.Fprintf(os.Stderr, "content:[%v]\ninfo:[%v]\n", content, info)
 
-	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
-}
\ No newline at end of file
+	payload, err := json.Marshal(PoolQuota{PoolName: pool, MaxBytes: quota.MaxBytes, MaxObjects: quota.MaxObjects})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusPoolQuotaErr, "")
+		return
+	}
+
+	SendResponse(w, http.StatusOK, string(payload))
+}
@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"mon"
+)
+
+func TestParsePoolOptions(t *testing.T) {
+	tests := []struct {
+		query string
+		//want为nil时应返回错误
+		want *PoolOptions
+	}{
+		{"", &PoolOptions{}},
+		{"PgNum=64&Size=2&MinSize=1&CrushRule=ssd", &PoolOptions{PgNum: 64, Size: 2, MinSize: 1, CrushRule: "ssd"}},
+		{"ErasureK=4&ErasureM=2&MinSize=5", &PoolOptions{MinSize: 5, ErasureK: 4, ErasureM: 2}},
+		{"PgNum=-1", nil},
+		{"PgNum=x", nil},
+		{"PgNum=" + strconv.Itoa(maxPGNum+1), nil},
+		{"Size=" + strconv.Itoa(maxReplicaSize+1), nil},
+		{"Size=2&MinSize=3", nil},
+		{"ErasureK=4", nil},
+		{"ErasureM=2", nil},
+		{"ErasureK=4&ErasureM=2&Size=6", nil},
+		{"ErasureK=4&ErasureM=2&MinSize=3", nil},
+		{"ErasureK=4&ErasureM=2&MinSize=7", nil},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		opts, err := parsePoolOptions(r)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q accepted: %+v", tt.query, opts)
+			}
+			continue
+		}
+		if err != nil || *opts != *tt.want {
+			t.Errorf("%q: %+v, %v", tt.query, opts, err)
+		}
+	}
+}
+
+func TestCreatePool(t *testing.T) {
+	cluster := setupDisk(t)
+	cluster.SetOSDs(6)
+	cluster.AddCrushRule("ssd")
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   PoolSettings
+	}{
+		{"defaults", "PoolName=plain", http.StatusOK,
+			PoolSettings{Name: "plain", PgNum: 8, Size: 3, MinSize: 2, CrushRule: "replicated_rule", Application: poolApplication}},
+		{"replicated", "PoolName=small&PgNum=64&Size=2&MinSize=1", http.StatusOK,
+			PoolSettings{Name: "small", PgNum: 64, Size: 2, MinSize: 1, CrushRule: "replicated_rule", Application: poolApplication}},
+		{"crush rule", "PoolName=fast&CrushRule=ssd", http.StatusOK,
+			PoolSettings{Name: "fast", PgNum: 8, Size: 3, MinSize: 2, CrushRule: "ssd", Application: poolApplication}},
+		//纠删码pool的规则以pool命名
+		{"erasure", "PoolName=ec&ErasureK=4&ErasureM=2", http.StatusOK,
+			PoolSettings{Name: "ec", PgNum: defaultECPGNum, Size: 6, MinSize: 5, CrushRule: "ec",
+				ErasureCodeProfile: "ebs-k4-m2", Application: poolApplication}},
+		{"erasure with rule", "PoolName=ecssd&ErasureK=4&ErasureM=2&PgNum=16&MinSize=4&CrushRule=ssd", http.StatusOK,
+			PoolSettings{Name: "ecssd", PgNum: 16, Size: 6, MinSize: 4, CrushRule: "ssd",
+				ErasureCodeProfile: "ebs-k4-m2", Application: poolApplication}},
+		{"existing pool", "PoolName=rbd", http.StatusConflict, PoolSettings{}},
+		{"unknown crush rule", "PoolName=bad&CrushRule=nvme", http.StatusBadRequest, PoolSettings{}},
+		{"not enough OSDs", "PoolName=bad&Size=7", http.StatusBadRequest, PoolSettings{}},
+		{"not enough OSDs for erasure", "PoolName=bad&ErasureK=6&ErasureM=2", http.StatusBadRequest, PoolSettings{}},
+		{"too many PGs per OSD", "PoolName=bad&PgNum=512&Size=3", http.StatusBadRequest, PoolSettings{}},
+		//min_size大于副本数，设置失败时删除创建的pool
+		{"configure fails", "PoolName=bad&MinSize=5", http.StatusBadRequest, PoolSettings{}},
+		{"missing name", "PgNum=8", http.StatusBadRequest, PoolSettings{}},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		query.Set("Action", "CreatePool")
+		w := callHandler(CreatePool, query)
+		if w.Code != tt.status {
+			t.Errorf("%v: status %v %v", tt.name, w.Code, w.Body)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var got PoolSettings
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got != tt.want {
+			t.Errorf("%v: settings %v, %v", tt.name, w.Body, err)
+		}
+	}
+	if err := cluster.LookupPool("bad"); err == nil {
+		t.Error("pool of a refused CreatePool exists")
+	}
+
+	//纠删码pool允许覆盖写才能存放rbd数据
+	client := mon.New(cluster)
+	var overwrites struct {
+		Allow bool `json:"allow_ec_overwrites"`
+	}
+	err := client.Command(mon.Command{"prefix": "osd pool get", "pool": "ec", "var": mon.PoolAllowECOverwrites}, &overwrites)
+	if err != nil || !overwrites.Allow {
+		t.Errorf("allow_ec_overwrites of ec: %v, %v", overwrites.Allow, err)
+	}
+	profile, err := client.GetErasureCodeProfile("ebs-k4-m2")
+	if err != nil || profile.K != 4 || profile.M != 2 {
+		t.Errorf("profile %+v, %v", profile, err)
+	}
+}
@@ -0,0 +1,266 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"encoding/json"
+	"qos"
+	"repository"
+	"storage"
+)
+
+//每个卷一个限速器，NBD导出与导出、备份、恢复共用，修改QoS后立即生效
+var limiterMu sync.Mutex
+var limiters = make(map[string]*qos.Limiter)
+
+//librbd从镜像元数据中读取conf_前缀的配置覆盖
+const qosMetadataPrefix = "conf_rbd_qos_"
+
+type VolumeQoS struct {
+	ReadIOPS  uint64
+	WriteIOPS uint64
+	ReadBps   uint64
+	WriteBps  uint64
+	Burst     uint64
+}
+
+func qosInfo(limits qos.Limits) *VolumeQoS {
+	return &VolumeQoS{
+		ReadIOPS: limits.ReadIOPS,
+		WriteIOPS: limits.WriteIOPS,
+		ReadBps: limits.ReadBps,
+		WriteBps: limits.WriteBps,
+		Burst: limits.Burst,
+	}
+}
+
+//没有记录的卷不限速
+func loadQoS(pool string, name string) (qos.Limits, error) {
+	record, err := repo.QoS().Get(pool, name)
+	if err == repository.ErrNotFound {
+		return qos.Limits{}, nil
+	}
+	if err != nil {
+		return qos.Limits{}, err
+	}
+	return qos.Limits{
+		ReadIOPS: record.ReadIOPS,
+		WriteIOPS: record.WriteIOPS,
+		ReadBps: record.ReadBps,
+		WriteBps: record.WriteBps,
+		Burst: record.Burst,
+	}, nil
+}
+
+func volumeLimiter(pool string, name string) (*qos.Limiter, error) {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+
+	key := pool + "/" + name
+	if limiter, ok := limiters[key]; ok {
+		return limiter, nil
+	}
+	limits, err := loadQoS(pool, name)
+	if err != nil {
+		return nil, err
+	}
+	limiter := qos.NewLimiter(limits)
+	limiters[key] = limiter
+	return limiter, nil
+}
+
+//读写前按卷的限速等待
+type throttledImage struct {
+	storage.Image
+	limiter *qos.Limiter
+}
+
+func (image *throttledImage) ReadAt(data []byte, off int64) (int, error) {
+	image.limiter.Read(uint64(len(data)))
+	return image.Image.ReadAt(data, off)
+}
+
+func (image *throttledImage) WriteAt(data []byte, off int64) (int, error) {
+	image.limiter.Write(uint64(len(data)))
+	return image.Image.WriteAt(data, off)
+}
+
+func (image *throttledImage) Discard(ofs uint64, length uint64) error {
+	image.limiter.Write(0)
+	return image.Image.Discard(ofs, length)
+}
+
+//image为卷pool/name或其快照
+func throttle(image storage.Image, pool string, name string) (storage.Image, error) {
+	limiter, err := volumeLimiter(pool, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load QoS of %v/%v failed: %v\n", pool, name, err)
+		return nil, err
+	}
+	return &throttledImage{Image: image, limiter: limiter}, nil
+}
+
+//未给出的参数沿用limits中的值，0表示不限
+func parseQoS(r *http.Request, limits qos.Limits) (qos.Limits, error) {
+	fields := []struct {
+		name  string
+		value *uint64
+	}{
+		{"ReadIOPS", &limits.ReadIOPS},
+		{"WriteIOPS", &limits.WriteIOPS},
+		{"ReadBps", &limits.ReadBps},
+		{"WriteBps", &limits.WriteBps},
+		{"Burst", &limits.Burst},
+	}
+	for _, f := range fields {
+		value := r.FormValue(f.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return limits, err
+		}
+		*f.value = n
+	}
+	return limits, nil
+}
+
+//所有键都写入，取消的限制写0，使librbd客户端不再限速
+func qosMetadata(limits qos.Limits) map[string]string {
+	metadata := make(map[string]string)
+	set := func(name string, limit uint64) {
+		metadata[qosMetadataPrefix + name + "_limit"] = strconv.FormatUint(limit, 10)
+		metadata[qosMetadataPrefix + name + "_burst"] = strconv.FormatUint(limits.Capacity(limit), 10)
+	}
+	set("read_iops", limits.ReadIOPS)
+	set("write_iops", limits.WriteIOPS)
+	set("read_bps", limits.ReadBps)
+	set("write_bps", limits.WriteBps)
+	return metadata
+}
+
+//先写镜像元数据再保存记录，最后更新正在使用的限速器
+func (volume *Volume) SetQoS(limits qos.Limits) error {
+	conn, ioctx, err := NewConnAndOpenPool(volume.parentPool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return err
+	}
+
+	image, err := ioctx.OpenImage(volume.name, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		return err
+	}
+	defer image.Close()
+
+	for key, value := range qosMetadata(limits) {
+		if err := image.SetMetadata(key, value); err != nil {
+			fmt.Fprintf(os.Stderr, "Set metadata %v of %v failed: %v\n", key, volume.resource(), err)
+			return err
+		}
+	}
+
+	err = repo.QoS().Save(&repository.VolumeQoS{
+		Pool: volume.parentPool,
+		Volume: volume.name,
+		ReadIOPS: limits.ReadIOPS,
+		WriteIOPS: limits.WriteIOPS,
+		ReadBps: limits.ReadBps,
+		WriteBps: limits.WriteBps,
+		Burst: limits.Burst,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Save QoS of %v failed: %v\n", volume.resource(), err)
+		return err
+	}
+
+	limiterMu.Lock()
+	if limiter, ok := limiters[volume.resource()]; ok {
+		limiter.SetLimits(limits)
+	}
+	limiterMu.Unlock()
+	return nil
+}
+
+//删除卷后清除QoS记录和限速器
+func deleteQoS(volume *Volume) error {
+	limiterMu.Lock()
+	delete(limiters, volume.resource())
+	limiterMu.Unlock()
+
+	err := repo.QoS().Delete(volume.parentPool, volume.name)
+	if err == repository.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+/*
+修改卷的读写IOPS、带宽(字节/秒)限制和突发秒数，未给出的参数保持不变，0表示不限；不带参数时返回当前设置。
+限制由EBS提供的NBD、导出、备份和恢复执行，同时写入镜像元数据供librbd客户端使用
+GET /?Action=ModifyVolumeQoS&PoolName={PoolName}&VolumeName={volumeName}[&ReadIOPS={n}][&WriteIOPS={n}][&ReadBps={n}][&WriteBps={n}][&Burst={seconds}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"ReadIOPS":1000,"WriteIOPS":500,"ReadBps":104857600,"WriteBps":52428800,"Burst":2}
+*/
+func ModifyVolumeQoS(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	name := r.FormValue("VolumeName")
+	if pool == "" || name == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	volume, err := LoadVolume(name, pool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", pool, name, err)
+		sendStateError(w, err, statusModifyQoSErr)
+		return
+	}
+	if volume.state.Busy() || volume.state == repository.StateError {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is %v\n", pool, name, volume.state)
+		SendStatus(w, statusInvalidStateErr, "")
+		return
+	}
+
+	current, err := loadQoS(pool, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load QoS of %v/%v failed: %v\n", pool, name, err)
+		SendStatus(w, statusModifyQoSErr, "")
+		return
+	}
+	limits, err := parseQoS(r, current)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if limits != current {
+		if err := volume.SetQoS(limits); err != nil {
+			sendStorageError(w, err, statusModifyQoSErr)
+			return
+		}
+	}
+
+	payload, err := json.Marshal(qosInfo(limits))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusModifyQoSErr, "")
+		return
+	}
+	SendResponse(w, http.StatusOK, string(payload))
+}
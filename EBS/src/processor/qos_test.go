@@ -0,0 +1,87 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"qos"
+)
+
+func TestModifyVolumeQoS(t *testing.T) {
+	cluster := setupDisk(t)
+	createTestDisk(t, "vol", 1<<20)
+	defer deleteQoS(&Volume{parentPool: "rbd", name: "vol"})
+	limiter, err := volumeLimiter("rbd", "vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name   string
+		query  url.Values
+		status int
+		want   VolumeQoS
+	}{
+		{"query", url.Values{}, http.StatusOK, VolumeQoS{}},
+		{"set", url.Values{"ReadIOPS": {"1000"}, "WriteBps": {"1048576"}, "Burst": {"2"}}, http.StatusOK,
+			VolumeQoS{ReadIOPS: 1000, WriteBps: 1048576, Burst: 2}},
+		//未给出的参数保持不变
+		{"partial", url.Values{"WriteIOPS": {"500"}}, http.StatusOK,
+			VolumeQoS{ReadIOPS: 1000, WriteIOPS: 500, WriteBps: 1048576, Burst: 2}},
+		{"clear", url.Values{"ReadIOPS": {"0"}}, http.StatusOK,
+			VolumeQoS{WriteIOPS: 500, WriteBps: 1048576, Burst: 2}},
+		{"negative", url.Values{"ReadIOPS": {"-1"}}, http.StatusBadRequest, VolumeQoS{}},
+		{"not a number", url.Values{"Burst": {"2s"}}, http.StatusBadRequest, VolumeQoS{}},
+		{"missing volume", url.Values{"VolumeName": {"missing"}}, http.StatusNotFound, VolumeQoS{}},
+	}
+	for _, step := range steps {
+		q := url.Values{"Action": {"ModifyVolumeQoS"}, "PoolName": {"rbd"}, "VolumeName": {"vol"}}
+		for key, value := range step.query {
+			q[key] = value
+		}
+		w := callHandler(ModifyVolumeQoS, q)
+		if w.Code != step.status {
+			t.Errorf("%v: status %v %v", step.name, w.Code, w.Body)
+			continue
+		}
+		if step.status != http.StatusOK {
+			continue
+		}
+		var got VolumeQoS
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got != step.want {
+			t.Errorf("%v: QoS %v, %v", step.name, w.Body, err)
+		}
+	}
+
+	//正在使用的限速器立即生效，镜像元数据供librbd客户端使用
+	want := qos.Limits{WriteIOPS: 500, WriteBps: 1048576, Burst: 2}
+	if got := limiter.Limits(); got != want {
+		t.Errorf("limiter %+v", got)
+	}
+	pool, err := cluster.OpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := pool.OpenImage("vol", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	metadata, err := image.ListMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"conf_rbd_qos_read_iops_limit":  "0",
+		"conf_rbd_qos_read_iops_burst":  "0",
+		"conf_rbd_qos_write_iops_limit": "500",
+		"conf_rbd_qos_write_iops_burst": "1000",
+		"conf_rbd_qos_write_bps_limit":  "1048576",
+		"conf_rbd_qos_write_bps_burst":  "2097152",
+	} {
+		if metadata[key] != value {
+			t.Errorf("metadata %v = %q, want %q", key, metadata[key], value)
+		}
+	}
+}
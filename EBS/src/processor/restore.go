@@ -0,0 +1,539 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"job"
+	"repository"
+	"storage"
+)
+
+//同时下载校验的区段数，每个区段最大maxExtentLength
+const maxRestoreExtents = 4
+
+//恢复进度的保存间隔
+const restoreCheckpointInterval = 5 * time.Second
+
+var errChecksumMismatch = errors.New("Backup extent checksum mismatch")
+var errBackupNotAvailable = errors.New("Backup is not available")
+
+//从全量备份到id的备份链，按应用顺序排列
+func backupChain(id string) ([]*repository.Backup, error) {
+	var chain []*repository.Backup
+	for id != "" {
+		b, err := repo.Backups().Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if b.State != repository.BackupAvailable {
+			return nil, errBackupNotAvailable
+		}
+		chain = append([]*repository.Backup{b}, chain...)
+		id = b.Parent
+	}
+	return chain, nil
+}
+
+func loadBackupManifest(b *repository.Backup) (*BackupManifest, error) {
+	body, err := ossClient.GetObject(b.Bucket, manifestObjectName(b.Prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	manifest := &BackupManifest{}
+	if err := json.NewDecoder(body).Decode(manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Id != b.Id {
+		return nil, fmt.Errorf("Manifest of backup %v belongs to %v", b.Id, manifest.Id)
+	}
+	return manifest, nil
+}
+
+//按period切分后并发写入，sem限制整个恢复中同时进行的WriteAt数
+func writeChunks(image storage.Image, offset uint64, data []byte, period uint64, sem chan struct{}) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for pos := uint64(0); pos < uint64(len(data)); {
+		length := ((offset+pos)/period+1)*period - (offset + pos)
+		if uint64(len(data))-pos < length {
+			length = uint64(len(data)) - pos
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(buf []byte, off uint64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if _, err := image.WriteAt(buf, int64(off)); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(data[pos:pos+length], offset+pos)
+		pos += length
+	}
+	wg.Wait()
+	return firstErr
+}
+
+//rbd的discard跳过对象中不完整的部分，不能用来清零，只能写入全零的数据
+func zeroExtent(image storage.Image, offset uint64, length uint64, period uint64, sem chan struct{}) error {
+	zeros := make([]byte, maxExtentLength)
+	if length < maxExtentLength {
+		zeros = zeros[:length]
+	}
+	for pos := uint64(0); pos < length; pos += uint64(len(zeros)) {
+		if length-pos < uint64(len(zeros)) {
+			zeros = zeros[:length-pos]
+		}
+		if err := writeChunks(image, offset+pos, zeros, period, sem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//下载一个区段，校验后写入镜像
+func restoreExtent(image storage.Image, b *repository.Backup, manifest *BackupManifest, e Extent, sem chan struct{}) error {
+	data, err := ossClient.GetObjectRange(b.Bucket, manifest.DataObject, e.ObjectOffset, e.Length)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if "sha256:"+hex.EncodeToString(sum[:]) != e.Checksum {
+		fmt.Fprintf(os.Stderr, "Extent %v+%v of backup %v: %v\n", e.Offset, e.Length, b.Id, errChecksumMismatch)
+		return errChecksumMismatch
+	}
+	return writeChunks(image, e.Offset, data, manifest.StripePeriod, sem)
+}
+
+//恢复过程：准备镜像，按顺序应用备份链，完成后删除检查点
+//每个备份的区段并发下载写入，按顺序确认完成后推进检查点，中断后从检查点继续
+type restorer struct {
+	volume     *Volume
+	checkpoint *repository.Restore
+	chain      []*repository.Backup
+	manifests  []*BackupManifest
+	progress   *job.Progress
+	total      uint64
+	done       uint64
+	lastSaved  time.Time
+}
+
+func (rs *restorer) save(force bool) error {
+	if !force && time.Since(rs.lastSaved) < restoreCheckpointInterval {
+		return nil
+	}
+	rs.lastSaved = time.Now()
+	return repo.Restores().Save(rs.checkpoint)
+}
+
+//新卷创建镜像；原地恢复时将已分配的区段清零。镜像先按链中最大的大小准备，最后调整为备份的大小
+func (rs *restorer) prepare(ioctx storage.Pool, size uint64, sem chan struct{}) error {
+	volume := rs.volume
+	if !rs.checkpoint.InPlace {
+		volume.size = size
+		if err := ioctx.CreateImage(volume.name, size, storage.DefaultOrder, storage.FeatureLayering); err != nil && err != storage.ErrExist {
+			fmt.Fprintf(os.Stderr, "RBD create volume failed: %v\n", err)
+			return err
+		}
+	}
+
+	image, err := ioctx.OpenImage(volume.name, "")
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	current, err := image.GetSize()
+	if err != nil {
+		return err
+	}
+	if rs.checkpoint.InPlace {
+		if err := zeroAllocated(image, current, sem); err != nil {
+			fmt.Fprintf(os.Stderr, "Zero %v failed: %v\n", volume.resource(), err)
+			return err
+		}
+	}
+	if current != size {
+		if err := image.Resize(size); err != nil {
+			fmt.Fprintf(os.Stderr, "Resize %v failed: %v\n", volume.resource(), err)
+			return err
+		}
+	}
+	if info, err := image.Stat(); err == nil {
+		volume.SetFullname(ioctx.ID(), info.Block_name_prefix)
+	}
+
+	rs.checkpoint.Prepared = true
+	return rs.save(true)
+}
+
+//未分配的区段读出来已经是零
+func zeroAllocated(image storage.Image, size uint64, sem chan struct{}) error {
+	period, err := image.GetStripePeriod()
+	if err != nil {
+		return err
+	}
+	var allocated []Extent
+	err = image.DiffIterate("", 0, size, func(offset uint64, length uint64, exists bool) error {
+		if exists {
+			allocated = appendExtent(allocated, offset, length)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range allocated {
+		if err := zeroExtent(image, e.Offset, e.Length, period, sem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//从检查点开始应用manifest中的区段，再清零Zeroed区段
+func (rs *restorer) apply(image storage.Image, step int, sem chan struct{}) error {
+	b, manifest := rs.chain[step], rs.manifests[step]
+	extents := manifest.Extents[rs.checkpoint.Extent:]
+
+	stop := make(chan struct{})
+	pending := make(chan chan error, maxRestoreExtents)
+	go func() {
+		defer close(pending)
+		for _, e := range extents {
+			result := make(chan error, 1)
+			select {
+			case pending <- result:
+			case <-stop:
+				return
+			}
+			go func(e Extent) {
+				result <- restoreExtent(image, b, manifest, e, sem)
+			}(e)
+		}
+	}()
+
+	i := 0
+	for result := range pending {
+		if err := <-result; err != nil {
+			close(stop)
+			for result := range pending {
+				<-result
+			}
+			return err
+		}
+		rs.done += extents[i].Length
+		rs.progress.Update(rs.done, rs.total)
+		rs.checkpoint.Extent++
+		i++
+		if err := rs.save(false); err != nil {
+			fmt.Fprintf(os.Stderr, "Save restore checkpoint of %v failed: %v\n", rs.volume.resource(), err)
+		}
+	}
+
+	for _, e := range manifest.Zeroed {
+		if err := zeroExtent(image, e.Offset, e.Length, manifest.StripePeriod, sem); err != nil {
+			return err
+		}
+	}
+	rs.checkpoint.Step++
+	rs.checkpoint.Extent = 0
+	return rs.save(true)
+}
+
+func (rs *restorer) run() error {
+	volume, checkpoint := rs.volume, rs.checkpoint
+	chain, err := backupChain(checkpoint.BackupId)
+	if err != nil {
+		return err
+	}
+	rs.chain = chain
+
+	var maxSize uint64
+	for i, b := range chain {
+		manifest, err := loadBackupManifest(b)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Load manifest of backup %v failed: %v\n", b.Id, err)
+			return err
+		}
+		rs.manifests = append(rs.manifests, manifest)
+		if manifest.Size > maxSize {
+			maxSize = manifest.Size
+		}
+		for j, e := range manifest.Extents {
+			rs.total += e.Length
+			if i < checkpoint.Step || (i == checkpoint.Step && j < checkpoint.Extent) {
+				rs.done += e.Length
+			}
+		}
+	}
+
+	conn, ioctx, err := NewConnAndOpenPool(volume.parentPool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, MaxProcessorNumber)
+	if !checkpoint.Prepared {
+		if err := rs.prepare(ioctx, maxSize, sem); err != nil {
+			return err
+		}
+	}
+
+	opened, err := ioctx.OpenImage(volume.name, "")
+	if err != nil {
+		return err
+	}
+	defer opened.Close()
+	image, err := throttle(opened, volume.parentPool, volume.name)
+	if err != nil {
+		return err
+	}
+
+	for step := checkpoint.Step; step < len(chain); step++ {
+		if err := rs.apply(image, step, sem); err != nil {
+			fmt.Fprintf(os.Stderr, "Apply backup %v to %v failed: %v\n", chain[step].Id, volume.resource(), err)
+			return err
+		}
+	}
+
+	size := chain[len(chain)-1].Size
+	if err := image.Flush(); err != nil {
+		return err
+	}
+	if current, err := image.GetSize(); err != nil {
+		return err
+	} else if current != size {
+		if err := image.Resize(size); err != nil {
+			return err
+		}
+	}
+	volume.size = size
+	return nil
+}
+
+//新卷恢复完成后映射并置为available；原地恢复刷新已映射设备的大小
+func (volume *Volume) restore(checkpoint *repository.Restore, p *job.Progress) error {
+	if volume.state != repository.StateRestoring {
+		if err := volume.SetState(repository.StateRestoring); err != nil {
+			return err
+		}
+	}
+
+	rs := &restorer{volume: volume, checkpoint: checkpoint, progress: p}
+	err := rs.run()
+	if err == nil {
+		if checkpoint.InPlace {
+			err = volume.Refresh()
+		} else {
+			err = volume.Map()
+		}
+	}
+	if err == nil {
+		err = volume.Save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore %v from %v failed: %v\n", volume.resource(), checkpoint.BackupId, err)
+		if err := repo.Restores().Save(checkpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "Save restore checkpoint of %v failed: %v\n", volume.resource(), err)
+		}
+		if err := volume.SetState(repository.StateError); err != nil {
+			fmt.Fprintf(os.Stderr, "Set volume %v error state failed: %v\n", volume.resource(), err)
+		}
+		return err
+	}
+
+	if err := volume.SetState(repository.StateAvailable); err != nil {
+		return err
+	}
+	if err := repo.Restores().Delete(volume.parentPool, volume.name); err != nil {
+		fmt.Fprintf(os.Stderr, "Delete restore checkpoint of %v failed: %v\n", volume.resource(), err)
+	}
+	return nil
+}
+
+/*
+从备份链恢复到新卷；InPlace=true时覆盖已存在且未挂载的卷
+对中断或失败的恢复以相同参数再次请求时从检查点继续
+GET /?Action=RestoreDisk&BackupId={backupId}&PoolName={PoolName}&VolumeName={volumeName}[&InPlace=true] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 202 Accepted
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"JobId":"job-..."}
+*/
+func RestoreDisk(w http.ResponseWriter, r *http.Request) {
+	backupId := r.FormValue("BackupId")
+	poolName := r.FormValue("PoolName")
+	volumeName := r.FormValue("VolumeName")
+	inPlace := false
+	if value := r.FormValue("InPlace"); value != "" {
+		var err error
+		if inPlace, err = strconv.ParseBool(value); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+			SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+	}
+	if backupId == "" || poolName == "" || volumeName == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if ossClient == nil {
+		fmt.Fprintf(os.Stderr, "Restore %v/%v failed: %v\n", poolName, volumeName, errOSSDisabled)
+		SendStatus(w, statusRestoreDiskErr, errOSSDisabled.Error())
+		return
+	}
+
+	b, err := repo.Backups().Get(backupId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get backup %v error: %v\n", backupId, err)
+		if err == repository.ErrNotFound {
+			SendNotFound(w, "Backup")
+		} else {
+			SendStatus(w, statusRestoreDiskErr, "")
+		}
+		return
+	}
+	if !tenantOwns(r, b.Pool) {
+		fmt.Fprintf(os.Stderr, "Backup %v of pool %v is not owned by the tenant\n", backupId, b.Pool)
+		SendNotFound(w, "Backup")
+		return
+	}
+	if b.State != repository.BackupAvailable {
+		fmt.Fprintf(os.Stderr, "Restore from backup %v in state %v\n", backupId, b.State)
+		SendStatus(w, statusRestoreDiskErr, errBackupNotAvailable.Error())
+		return
+	}
+
+	checkpoint, err := repo.Restores().Get(poolName, volumeName)
+	if err != nil && err != repository.ErrNotFound {
+		fmt.Fprintf(os.Stderr, "Get restore checkpoint of %v/%v error: %v\n", poolName, volumeName, err)
+		SendStatus(w, statusRestoreDiskErr, "")
+		return
+	}
+	volume, err := LoadVolume(volumeName, poolName)
+	if err != nil && err != repository.ErrNotFound {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", poolName, volumeName, err)
+		SendStatus(w, statusRestoreDiskErr, "")
+		return
+	}
+
+	//只有未完成恢复的卷才能继续，其它情况下的检查点已失效
+	if checkpoint != nil && (volume == nil || (volume.state != repository.StateCreating &&
+		volume.state != repository.StateRestoring && volume.state != repository.StateError)) {
+		repo.Restores().Delete(poolName, volumeName)
+		checkpoint = nil
+	}
+
+	registered, resume := false, false
+	switch {
+	case checkpoint != nil && checkpoint.BackupId != backupId:
+		//原地恢复可以改用其它备份重新开始
+		if !inPlace || !checkpoint.InPlace {
+			fmt.Fprintf(os.Stderr, "Volume %v has an unfinished restore of %v\n", volume.resource(), checkpoint.BackupId)
+			SendStatus(w, statusRestoreDiskErr, "Unfinished restore of " + checkpoint.BackupId)
+			return
+		}
+		checkpoint = &repository.Restore{Pool: poolName, Volume: volumeName, BackupId: backupId, InPlace: true}
+	case checkpoint != nil:
+		resume = true
+	case volume != nil:
+		if !inPlace {
+			SendStatus(w, statusVolumeExistErr, "")
+			return
+		}
+		if volume.state != repository.StateAvailable {
+			fmt.Fprintf(os.Stderr, "Restore %v in state %v\n", volume.resource(), volume.state)
+			if volume.state == repository.StateInUse {
+				SendStatus(w, statusVolumeAttachedErr, "")
+			} else {
+				SendStatus(w, statusInvalidStateErr, "")
+			}
+			return
+		}
+		checkpoint = &repository.Restore{Pool: poolName, Volume: volumeName, BackupId: backupId, InPlace: true}
+	default:
+		if inPlace {
+			SendNotFound(w, "Volume")
+			return
+		}
+		volume = NewVolume(volumeName, poolName, b.Size)
+		if err := volume.Register(); err != nil {
+			fmt.Fprintf(os.Stderr, "Register volume %v error: %v\n", volume.resource(), err)
+			SendStatus(w, statusRestoreDiskErr, "")
+			return
+		}
+		registered = true
+		checkpoint = &repository.Restore{Pool: poolName, Volume: volumeName, BackupId: backupId}
+	}
+
+	//新卷计入卷数和容量，原地恢复只计入增加的容量
+	delta := TenantUsage{}
+	switch {
+	case resume:
+	case registered:
+		delta = TenantUsage{Volumes: 1, Bytes: b.Size}
+	case b.Size > volume.size:
+		delta.Bytes = b.Size - volume.size
+	}
+	release, ok := checkQuota(w, poolName, delta, statusRestoreDiskErr)
+	if !ok {
+		if registered {
+			volume.Unregister()
+		}
+		return
+	}
+
+	//继续恢复时检查点可能正被运行中的任务更新，不能覆盖
+	if !resume {
+		if err := repo.Restores().Save(checkpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "Save restore checkpoint of %v error: %v\n", volume.resource(), err)
+			release()
+			if registered {
+				volume.Unregister()
+			}
+			SendStatus(w, statusRestoreDiskErr, "")
+			return
+		}
+	}
+
+	err = submitJob(w, "RestoreDisk", volume.resource(), statusRestoreDiskErr, func(p *job.Progress) error {
+		defer release()
+		return volume.restore(checkpoint, p)
+	})
+	if err != nil {
+		release()
+	}
+	if err != nil && registered {
+		repo.Restores().Delete(poolName, volumeName)
+		if err := volume.Unregister(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unregister volume %v error: %v\n", volume.resource(), err)
+		}
+	}
+}
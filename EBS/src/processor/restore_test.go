@@ -0,0 +1,206 @@
+package processor
+
+import (
+	"testing"
+	"job"
+	"repository"
+	"storage"
+	"storage/memory"
+)
+
+//与rbd_skip_partial_discard相同，discard只释放完整的对象，其余部分原样保留
+type skipPartialBackend struct {
+	storage.Backend
+}
+
+func (b skipPartialBackend) Connect() (storage.Cluster, error) {
+	conn, err := b.Backend.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return skipPartialCluster{conn}, nil
+}
+
+type skipPartialCluster struct {
+	storage.Cluster
+}
+
+func (c skipPartialCluster) OpenPool(name string) (storage.Pool, error) {
+	pool, err := c.Cluster.OpenPool(name)
+	if err != nil {
+		return nil, err
+	}
+	return skipPartialPool{pool}, nil
+}
+
+type skipPartialPool struct {
+	storage.Pool
+}
+
+func (p skipPartialPool) OpenImage(name string, snapshot string) (storage.Image, error) {
+	image, err := p.Pool.OpenImage(name, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return skipPartialImage{image}, nil
+}
+
+type skipPartialImage struct {
+	storage.Image
+}
+
+func (i skipPartialImage) Discard(ofs uint64, length uint64) error {
+	period, err := i.GetStripePeriod()
+	if err != nil {
+		return err
+	}
+	start := (ofs + period - 1) / period * period
+	end := (ofs + length) / period * period
+	if start >= end {
+		return nil
+	}
+	return i.Image.Discard(start, end-start)
+}
+
+//对象大小64K，镜像末尾有一个不完整的对象
+const (
+	restoreOrder      = 16
+	restoreObjectSize = 1 << restoreOrder
+	restoreImageSize  = 4*restoreObjectSize + 1000
+)
+
+type restoreWrite struct {
+	offset uint64
+	data   []byte
+}
+
+func nonZero(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = seed + byte(i%250) + 1
+	}
+	return data
+}
+
+//在任务中执行fn，返回其结果
+func runJob(t *testing.T, fn func(p *job.Progress) error) error {
+	manager := job.NewManager(job.NewMemoryStore(), 1)
+	var err error
+	if _, submitErr := manager.Submit("Test", "rbd/vol", func(p *job.Progress) error {
+		err = fn(p)
+		return err
+	}); submitErr != nil {
+		t.Fatal(submitErr)
+	}
+	manager.Wait()
+	return err
+}
+
+func TestRestoreInPlace(t *testing.T) {
+	tests := []struct {
+		name string
+		//每次备份前写入的数据，第一次为全量备份，之后为增量备份
+		backups [][]restoreWrite
+		//恢复前写入的数据，恢复后必须被覆盖
+		junk []restoreWrite
+	}{
+		{
+			name:    "full backup over unaligned data",
+			backups: [][]restoreWrite{{{1000, nonZero(5000, 1)}, {2*restoreObjectSize - 300, nonZero(600, 2)}}},
+			junk: []restoreWrite{{3000, nonZero(100, 3)}, {restoreObjectSize + 17, nonZero(restoreObjectSize, 4)},
+				{4*restoreObjectSize + 10, nonZero(900, 5)}},
+		},
+		{
+			name: "incremental zeroed extents",
+			backups: [][]restoreWrite{
+				{{0, nonZero(restoreImageSize, 1)}},
+				{{restoreObjectSize, make([]byte, restoreObjectSize)}, {4 * restoreObjectSize, make([]byte, 1000)}},
+			},
+			junk: []restoreWrite{{restoreObjectSize + 50, nonZero(100, 2)}, {4*restoreObjectSize + 999, nonZero(1, 3)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := memory.NewCluster()
+			if err := cluster.MakePool("rbd"); err != nil {
+				t.Fatal(err)
+			}
+			SetBackend(skipPartialBackend{cluster})
+			SetRepository(repository.NewMemoryStore())
+			defer SetBackend(nil)
+			defer SetRepository(nil)
+			startFakeOSS(t)
+
+			conn, pool, err := NewConnAndOpenPool("rbd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer DisConnAndClosePool(conn, pool)
+			if err := pool.CreateImage("vol", restoreImageSize, restoreOrder, 0); err != nil {
+				t.Fatal(err)
+			}
+			image, err := pool.OpenImage("vol", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer image.Close()
+			write := func(writes []restoreWrite) {
+				for _, w := range writes {
+					if _, err := image.WriteAt(w.data, int64(w.offset)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			if err := repo.Volumes().Create(&repository.Volume{Pool: "rbd", Name: "vol", Size: restoreImageSize,
+				State: repository.StateCreating}); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.Volumes().Transition("rbd", "vol", repository.StateCreating, repository.StateAvailable); err != nil {
+				t.Fatal(err)
+			}
+			volume, err := LoadVolume("vol", "rbd")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var last *repository.Backup
+			for i, writes := range tt.backups {
+				write(writes)
+				err := runJob(t, func(p *job.Progress) error {
+					b, err := volume.backup("bucket", i == 0, p)
+					last = b
+					return err
+				})
+				if err != nil {
+					t.Fatalf("backup %v: %v", i, err)
+				}
+			}
+			want := make([]byte, restoreImageSize)
+			if _, err := image.ReadAt(want, 0); err != nil {
+				t.Fatal(err)
+			}
+			write(tt.junk)
+
+			checkpoint := &repository.Restore{Pool: "rbd", Volume: "vol", BackupId: last.Id, InPlace: true}
+			if err := repo.Restores().Save(checkpoint); err != nil {
+				t.Fatal(err)
+			}
+			if err := runJob(t, func(p *job.Progress) error {
+				return volume.restore(checkpoint, p)
+			}); err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+
+			got := make([]byte, restoreImageSize)
+			if _, err := image.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			for off := range want {
+				if got[off] != want[off] {
+					t.Fatalf("restored data differs from the backup at %v", off)
+				}
+			}
+		})
+	}
+}
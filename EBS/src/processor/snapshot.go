@@ -4,16 +4,79 @@ import (
 	"net/http"
 	"fmt"
 	"os"
-	"librados/rados"
-	"librados/rbd"
+	"strings"
 	"encoding/json"
+	"job"
+	"storage"
+	"repository"
 )
 
+//EBS管理的卷须处于available状态，allowInUse时也可以已挂载
+//返回false时已发送应答；镜像不由EBS管理时返回nil
+func checkVolumeIdle(w http.ResponseWriter, pool string, name string, errcode int, allowInUse bool) (*Volume, bool) {
+	volume, err := findVolume(name, pool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", pool, name, err)
+		SendStatus(w, errcode, "")
+		return nil, false
+	}
+	if volume == nil || volume.state == repository.StateAvailable {
+		return volume, true
+	}
+	if volume.state == repository.StateInUse {
+		if allowInUse {
+			return volume, true
+		}
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is still attached\n", pool, name)
+		SendStatus(w, statusVolumeAttachedErr, "")
+		return nil, false
+	}
+	fmt.Fprintf(os.Stderr, "Volume %v/%v is %v\n", pool, name, volume.state)
+	SendStatus(w, statusInvalidStateErr, "")
+	return nil, false
+}
+
+func listSnapshots(pool string, volume string) ([]storage.SnapInfo, error) {
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	return image.ListSnapshots()
+}
+
+//以快照为父镜像的克隆，格式为pool/image
+func snapshotChildren(ioctx storage.Pool, volume string, snapshot string) ([]string, error) {
+	image, err := ioctx.OpenImage(volume, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	pools, images, err := image.ListChildren()
+	if err != nil {
+		return nil, err
+	}
+
+	children := make([]string, len(images))
+	for i := range images {
+		children[i] = pools[i] + "/" + images[i]
+	}
+	return children, nil
+}
+
 /*
 GET /?Action=CreateSnapshot&PoolName={PoolName}&VolumeName={volumeName}&Snapshot={name} HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
 HTTP /1.1 200 OK
 Server: dhcc.ebs
@@ -31,49 +94,46 @@ func CreateSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := rados.NewConn()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusCreateSnapshotErr, "")
+	if _, ok := checkVolumeIdle(w, pool, volume, statusCreateSnapshotErr, true); !ok {
 		return
 	}
-	defer conn.Shutdown()
 
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusCreateSnapshotErr, "")
+	release, ok := checkQuota(w, pool, TenantUsage{Snapshots: 1}, statusCreateSnapshotErr)
+	if !ok {
 		return
 	}
+	defer release()
 
-	if err := conn.Connect(); err != nil {
+	conn, err := connectCluster()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
 		SendStatus(w, statusCreateSnapshotErr, "")
 		return
 	}
+	defer conn.Shutdown()
 
-	ioctx, err := conn.OpenIOContext(pool)
+	ioctx, err := conn.OpenPool(pool)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", pool, err)
-		SendStatus(w, statusCreateSnapshotErr, err.Error())
+		sendStorageError(w, err, statusCreateSnapshotErr)
 		return
 	}
-	defer ioctx.Destroy()
+	defer ioctx.Close()
 
-	image := rbd.GetImage(ioctx, volume)
-	if err := image.Open(); err != nil {
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
-		SendStatus(w, statusCreateSnapshotErr, err.Error())
+		sendStorageError(w, err, statusCreateSnapshotErr)
 		return
 	}
 	defer image.Close()
 
-	snapshotInfo, err := image.CreateSnapshot(snapshot)
-	if err != nil {
+	if err := image.CreateSnapshot(snapshot); err != nil {
 		fmt.Fprintf(os.Stderr, "CreateSnapshot failed: %v\n", err)
-		SendStatus(w, statusCreateSnapshotErr, err.Error())
+		sendStorageError(w, err, statusCreateSnapshotErr)
 		return
 	}
-	fmt.Fprintf(os.Stderr, "CreateSnapshot : %v\n", *snapshotInfo)
+	fmt.Fprintf(os.Stderr, "CreateSnapshot : %v@%v\n", volume, snapshot)
 
 	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
 }
@@ -82,7 +142,7 @@ func CreateSnapshot(w http.ResponseWriter, r *http.Request) {
 GET /?Action=InfoSnapshot&PoolName={PoolName}&VolumeName={volumeName} HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
 HTTP /1.1 200 OK
 Server: dhcc.ebs
@@ -99,46 +159,34 @@ func InfoSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := rados.NewConn()
+	conn, err := connectCluster()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusInfoSnapshotErr, "")
-		return
-	}
-	defer conn.Shutdown()
-
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusInfoSnapshotErr, "")
-		return
-	}
-
-	if err := conn.Connect(); err != nil {
 		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
 		SendStatus(w, statusInfoSnapshotErr, "")
 		return
 	}
+	defer conn.Shutdown()
 
-	ioctx, err := conn.OpenIOContext(pool)
+	ioctx, err := conn.OpenPool(pool)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", pool, err)
-		SendStatus(w, statusInfoSnapshotErr, err.Error())
+		sendStorageError(w, err, statusInfoSnapshotErr)
 		return
 	}
-	defer ioctx.Destroy()
+	defer ioctx.Close()
 
-	image := rbd.GetImage(ioctx, volume)
-	if err := image.Open(); err != nil {
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
-		SendStatus(w, statusInfoSnapshotErr, err.Error())
+		sendStorageError(w, err, statusInfoSnapshotErr)
 		return
 	}
 	defer image.Close()
 
-	info, err := image.GetSnapshotNames()
+	info, err := image.ListSnapshots()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "GetSnapshotNames failed: %v\n", err)
-		SendStatus(w, statusInfoSnapshotErr, err.Error())
+		sendStorageError(w, err, statusInfoSnapshotErr)
 		return
 	}
 
@@ -157,7 +205,7 @@ func InfoSnapshot(w http.ResponseWriter, r *http.Request) {
 GET /?Action=DelSnapshot&PoolName={PoolName}&VolumeName={volumeName}&Snapshot={name} HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
 HTTP /1.1 200 OK
 Server: dhcc.ebs
@@ -175,48 +223,490 @@ func DelSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := rados.NewConn()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusDelSnapshotErr, "")
-		return
-	}
-	defer conn.Shutdown()
-
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusDelSnapshotErr, "")
+	if _, ok := checkVolumeIdle(w, pool, volume, statusDelSnapshotErr, true); !ok {
 		return
 	}
 
-	if err := conn.Connect(); err != nil {
+	conn, err := connectCluster()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
 		SendStatus(w, statusDelSnapshotErr, "")
 		return
 	}
+	defer conn.Shutdown()
 
-	ioctx, err := conn.OpenIOContext(pool)
+	ioctx, err := conn.OpenPool(pool)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", pool, err)
 		SendStatus(w, statusDelSnapshotErr, err.Error())
 		return
 	}
-	defer ioctx.Destroy()
+	defer ioctx.Close()
 
-	image := rbd.GetImage(ioctx, volume)
-	if err := image.Open(); err != nil {
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
 		SendStatus(w, statusDelSnapshotErr, err.Error())
 		return
 	}
 	defer image.Close()
 
-	snapshotCtx := image.GetSnapshot(snapshot)
-	if err := snapshotCtx.Remove(); err != nil {
+	//受保护的快照须先解除保护，有克隆时先拍平克隆
+	protected, err := image.IsSnapshotProtected(snapshot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get protection of %v@%v failed: %v\n", volume, snapshot, err)
+		sendStorageError(w, err, statusDelSnapshotErr)
+		return
+	}
+	if protected {
+		children, err := snapshotChildren(ioctx, volume, snapshot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "List children of %v@%v failed: %v\n", volume, snapshot, err)
+			SendStatus(w, statusDelSnapshotErr, "")
+			return
+		}
+		if len(children) > 0 {
+			fmt.Fprintf(os.Stderr, "Snapshot %v@%v has children: %v\n", volume, snapshot, children)
+			SendStatus(w, statusSnapHasChildrenErr, "Snapshot has children: " + strings.Join(children, ","))
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Snapshot %v@%v is protected\n", volume, snapshot)
+		SendStatus(w, statusSnapProtectedErr, "")
+		return
+	}
+
+	if err := image.RemoveSnapshot(snapshot); err != nil {
 		fmt.Fprintf(os.Stderr, "snapshot Remove failed: %v\n", err)
 		SendStatus(w, statusDelSnapshotErr, err.Error())
 		return
 	}
 
 	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
-}
\ No newline at end of file
+}
+//快照存在时返回nil
+func checkSnapshot(pool string, volume string, snapshot string) error {
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return err
+	}
+
+	image, err := ioctx.OpenImage(volume, snapshot)
+	if err != nil {
+		return err
+	}
+	return image.Close()
+}
+
+//回滚镜像并返回回滚后的大小
+func rollbackImage(pool string, volume string, snapshot string) (uint64, error) {
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return 0, err
+	}
+
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		return 0, err
+	}
+	defer image.Close()
+
+	if err := image.RollbackSnapshot(snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "Rollback %v/%v to %v failed: %v\n", pool, volume, snapshot, err)
+		return 0, err
+	}
+	return image.GetSize()
+}
+
+//回滚可能改变大小，需要刷新映射的设备；回滚中途失败时镜像内容不确定，置为error
+func (volume *Volume) rollback(snapshot string) error {
+	size, err := rollbackImage(volume.parentPool, volume.name, snapshot)
+	if err != nil {
+		volume.restoreState(repository.StateError)
+		return err
+	}
+
+	if size != volume.size {
+		volume.size = size
+		if err := volume.Refresh(); err != nil {
+			fmt.Fprintf(os.Stderr, "Refresh device error: %v\n", err)
+			volume.restoreState(repository.StateError)
+			return err
+		}
+		if err := volume.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Update db error: %v\n", err)
+			volume.restoreState(repository.StateError)
+			return err
+		}
+	}
+
+	volume.restoreState(repository.StateAvailable)
+	return nil
+}
+
+/*
+镜像的内容和大小回到快照时的状态，已挂载的卷不能回滚
+GET /?Action=RollbackSnapshot&PoolName={PoolName}&VolumeName={volumeName}&Snapshot={name} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 202 Accepted
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"JobId":"job-..."}
+*/
+func RollbackSnapshot(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	volume := r.FormValue("VolumeName")
+	snapshot := r.FormValue("Snapshot")
+	if pool == "" || volume == "" || snapshot == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	//上次回滚失败处于error状态的卷可以再次回滚
+	managed, err := findVolume(volume, pool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", pool, volume, err)
+		SendStatus(w, statusRollbackSnapErr, "")
+		return
+	}
+	if managed != nil && managed.state == repository.StateInUse {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is still attached\n", pool, volume)
+		SendStatus(w, statusVolumeAttachedErr, "")
+		return
+	}
+	if managed != nil && managed.state != repository.StateAvailable && managed.state != repository.StateError {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is %v\n", pool, volume, managed.state)
+		SendStatus(w, statusInvalidStateErr, "")
+		return
+	}
+
+	if err := checkSnapshot(pool, volume, snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "Open snapshot %v/%v@%v failed: %v\n", pool, volume, snapshot, err)
+		sendStorageError(w, err, statusRollbackSnapErr)
+		return
+	}
+
+	if managed == nil {
+		submitJob(w, "RollbackSnapshot", pool + "/" + volume, statusRollbackSnapErr, func(p *job.Progress) error {
+			_, err := rollbackImage(pool, volume, snapshot)
+			return err
+		})
+		return
+	}
+
+	//回滚期间置为restoring，禁止挂载
+	state := managed.state
+	if err := managed.SetState(repository.StateRestoring); err != nil {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v can not be rolled back: %v\n", pool, volume, err)
+		sendStateError(w, err, statusRollbackSnapErr)
+		return
+	}
+
+	err = submitJob(w, "RollbackSnapshot", managed.resource(), statusRollbackSnapErr, func(p *job.Progress) error {
+		return managed.rollback(snapshot)
+	})
+	if err != nil {
+		managed.restoreState(state)
+	}
+}
+
+/*
+受保护的快照才能克隆，已受保护时直接返回成功
+GET /?Action=ProtectSnapshot&PoolName={PoolName}&VolumeName={volumeName}&Snapshot={name} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
+func ProtectSnapshot(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	volume := r.FormValue("VolumeName")
+	snapshot := r.FormValue("Snapshot")
+	if pool == "" || volume == "" || snapshot == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		sendStorageError(w, err, statusProtectSnapErr)
+		return
+	}
+
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		sendStorageError(w, err, statusProtectSnapErr)
+		return
+	}
+	defer image.Close()
+
+	protected, err := image.IsSnapshotProtected(snapshot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get protection of %v@%v failed: %v\n", volume, snapshot, err)
+		sendStorageError(w, err, statusProtectSnapErr)
+		return
+	}
+
+	if !protected {
+		if err := image.ProtectSnapshot(snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "Protect %v@%v failed: %v\n", volume, snapshot, err)
+			SendStatus(w, statusProtectSnapErr, err.Error())
+			return
+		}
+	}
+
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+/*
+快照有克隆时不能解除保护，先拍平克隆；未受保护时直接返回成功
+GET /?Action=UnprotectSnapshot&PoolName={PoolName}&VolumeName={volumeName}&Snapshot={name} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
+func UnprotectSnapshot(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	volume := r.FormValue("VolumeName")
+	snapshot := r.FormValue("Snapshot")
+	if pool == "" || volume == "" || snapshot == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		sendStorageError(w, err, statusUnprotectSnapErr)
+		return
+	}
+
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		sendStorageError(w, err, statusUnprotectSnapErr)
+		return
+	}
+	defer image.Close()
+
+	protected, err := image.IsSnapshotProtected(snapshot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get protection of %v@%v failed: %v\n", volume, snapshot, err)
+		sendStorageError(w, err, statusUnprotectSnapErr)
+		return
+	}
+	if !protected {
+		SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+		return
+	}
+
+	children, err := snapshotChildren(ioctx, volume, snapshot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List children of %v@%v failed: %v\n", volume, snapshot, err)
+		SendStatus(w, statusUnprotectSnapErr, "")
+		return
+	}
+	if len(children) > 0 {
+		fmt.Fprintf(os.Stderr, "Snapshot %v@%v has children: %v\n", volume, snapshot, children)
+		SendStatus(w, statusSnapHasChildrenErr, "Snapshot has children: " + strings.Join(children, ","))
+		return
+	}
+
+	if err := image.UnprotectSnapshot(snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "Unprotect %v@%v failed: %v\n", volume, snapshot, err)
+		SendStatus(w, statusUnprotectSnapErr, err.Error())
+		return
+	}
+
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+/*
+从受保护的快照克隆出新卷，新卷与CreateDisk创建的卷一样映射并登记
+DestPoolName默认与PoolName相同
+GET /?Action=CloneFromSnapshot&PoolName={PoolName}&VolumeName={volumeName}&Snapshot={name}&DestVolumeName={destVolume}[&DestPoolName={destPool}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 202 Accepted
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"JobId":"job-..."}
+*/
+func CloneFromSnapshot(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	volume := r.FormValue("VolumeName")
+	snapshot := r.FormValue("Snapshot")
+	destPool := r.FormValue("DestPoolName")
+	destVolume := r.FormValue("DestVolumeName")
+	if pool == "" || volume == "" || snapshot == "" || destVolume == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if destPool == "" {
+		destPool = pool
+	}
+
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		sendStorageError(w, err, statusCloneVolumeErr)
+		return
+	}
+
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		sendStorageError(w, err, statusCloneVolumeErr)
+		return
+	}
+	protected, err := image.IsSnapshotProtected(snapshot)
+	image.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get protection of %v@%v failed: %v\n", volume, snapshot, err)
+		sendStorageError(w, err, statusCloneVolumeErr)
+		return
+	}
+	if !protected {
+		fmt.Fprintf(os.Stderr, "Snapshot %v@%v is not protected\n", volume, snapshot)
+		SendStatus(w, statusSnapNotProtectedErr, "")
+		return
+	}
+
+	size, err := imageSize(pool, volume, snapshot)
+	if err != nil {
+		sendStorageError(w, err, statusCloneVolumeErr)
+		return
+	}
+	release, ok := checkQuota(w, destPool, TenantUsage{Volumes: 1, Bytes: size}, statusCloneVolumeErr)
+	if !ok {
+		return
+	}
+
+	clone := NewVolume(destVolume, destPool, 0)
+	if err := clone.Register(); err != nil {
+		release()
+		fmt.Fprintf(os.Stderr, "Register volume %v error: %v\n", clone.resource(), err)
+		if err == repository.ErrExist {
+			SendStatus(w, statusVolumeExistErr, "")
+		} else {
+			SendStatus(w, statusCloneVolumeErr, "")
+		}
+		return
+	}
+
+	err = submitJob(w, "CloneFromSnapshot", clone.resource(), statusCloneVolumeErr, func(p *job.Progress) error {
+		defer release()
+		return createDisk(clone, func() error {
+			return clone.Clone(pool, volume, snapshot)
+		})
+	})
+	if err != nil {
+		release()
+		if err := clone.Unregister(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unregister volume %v error: %v\n", clone.resource(), err)
+		}
+	}
+}
+
+/*
+复制父快照的数据使克隆成为独立的卷，之后父快照可以解除保护；已挂载的卷也可以拍平
+GET /?Action=FlattenVolume&PoolName={PoolName}&VolumeName={volumeName} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 202 Accepted
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"JobId":"job-..."}
+*/
+func FlattenVolume(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	volume := r.FormValue("VolumeName")
+	if pool == "" || volume == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if _, ok := checkVolumeIdle(w, pool, volume, statusFlattenVolumeErr, true); !ok {
+		return
+	}
+
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		sendStorageError(w, err, statusFlattenVolumeErr)
+		return
+	}
+
+	image, err := ioctx.OpenImage(volume, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		sendStorageError(w, err, statusFlattenVolumeErr)
+		return
+	}
+	_, _, _, err = image.Parent()
+	image.Close()
+	if storage.IsNotFound(err) {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v has no parent\n", pool, volume)
+		SendStatus(w, statusInvalidStateErr, "Volume has no parent")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get parent of %v/%v failed: %v\n", pool, volume, err)
+		SendStatus(w, statusFlattenVolumeErr, "")
+		return
+	}
+
+	submitJob(w, "FlattenVolume", pool + "/" + volume, statusFlattenVolumeErr, func(p *job.Progress) error {
+		conn, ioctx, err := NewConnAndOpenPool(pool)
+		defer DisConnAndClosePool(conn, ioctx)
+		if err != nil {
+			return err
+		}
+
+		image, err := ioctx.OpenImage(volume, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+			return err
+		}
+		defer image.Close()
+
+		if err := image.Flatten(); err != nil {
+			fmt.Fprintf(os.Stderr, "Flatten %v/%v failed: %v\n", pool, volume, err)
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,199 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"job"
+	"repository"
+	"storage"
+)
+
+//通过CreateDisk创建EBS管理的卷
+func createTestDisk(t *testing.T, name string, size uint64) {
+	j := runHandlerJob(t, CreateDisk, url.Values{"Action": {"CreateDisk"}, "PoolName": {"rbd"},
+		"VolumeName": {name}, "Size": {strconv.FormatUint(size, 10)}})
+	if j.State != job.StateSucceeded {
+		t.Fatalf("create %v: %+v", name, j)
+	}
+}
+
+func writeImage(t *testing.T, pool storage.Pool, name string, data []byte, off int64) {
+	image, err := pool.OpenImage(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	if _, err := image.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readImage(t *testing.T, pool storage.Pool, name string, n int) []byte {
+	image, err := pool.OpenImage(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	data := make([]byte, n)
+	if _, err := image.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSnapshotHandlers(t *testing.T) {
+	cluster := setupDisk(t, "rbd/clone")
+	createTestDisk(t, "vol", 1<<20)
+	pool, err := cluster.OpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotted := bytes.Repeat([]byte("snap"), 1024)
+	writeImage(t, pool, "vol", snapshotted, 0)
+
+	query := func(action string, extra ...string) url.Values {
+		q := url.Values{"Action": {action}, "PoolName": {"rbd"}, "VolumeName": {"vol"}, "Snapshot": {"s1"}}
+		for i := 0; i+1 < len(extra); i += 2 {
+			q.Set(extra[i], extra[i+1])
+		}
+		return q
+	}
+	handlers := map[string]func(http.ResponseWriter, *http.Request){
+		"CreateSnapshot":    CreateSnapshot,
+		"ProtectSnapshot":   ProtectSnapshot,
+		"UnprotectSnapshot": UnprotectSnapshot,
+		"DelSnapshot":       DelSnapshot,
+		"CloneFromSnapshot": CloneFromSnapshot,
+		"FlattenVolume":     FlattenVolume,
+	}
+	steps := []struct {
+		name   string
+		query  url.Values
+		status int
+		//旧接口的状态码，同步接口成功时为200
+		code int
+	}{
+		{"create", query("CreateSnapshot"), http.StatusOK, http.StatusOK},
+		{"create again", query("CreateSnapshot"), http.StatusConflict, statusCreateSnapshotErr},
+		{"clone unprotected", query("CloneFromSnapshot", "DestVolumeName", "clone"), http.StatusConflict, statusSnapNotProtectedErr},
+		{"protect", query("ProtectSnapshot"), http.StatusOK, http.StatusOK},
+		{"protect again", query("ProtectSnapshot"), http.StatusOK, http.StatusOK},
+		{"delete protected", query("DelSnapshot"), http.StatusConflict, statusSnapProtectedErr},
+		{"clone", query("CloneFromSnapshot", "DestVolumeName", "clone"), http.StatusAccepted, http.StatusOK},
+		{"unprotect with clone", query("UnprotectSnapshot"), http.StatusConflict, statusSnapHasChildrenErr},
+		{"delete with clone", query("DelSnapshot"), http.StatusConflict, statusSnapHasChildrenErr},
+		{"flatten volume without parent", query("FlattenVolume"), http.StatusConflict, statusInvalidStateErr},
+		{"flatten clone", query("FlattenVolume", "VolumeName", "clone"), http.StatusAccepted, http.StatusOK},
+		{"unprotect", query("UnprotectSnapshot"), http.StatusOK, http.StatusOK},
+		{"unprotect again", query("UnprotectSnapshot"), http.StatusOK, http.StatusOK},
+		{"missing snapshot", query("ProtectSnapshot", "Snapshot", "missing"), http.StatusNotFound, statusNotFoundErr},
+	}
+	for _, step := range steps {
+		w := callHandler(handlers[step.query.Get("Action")], step.query)
+		jobs.Wait()
+		if w.Code != step.status {
+			t.Errorf("%v: status %v %v", step.name, w.Code, w.Body)
+		}
+		legacy := ""
+		if step.code != http.StatusOK {
+			legacy = strconv.Itoa(step.code)
+		}
+		if got := w.Header().Get(LegacyCodeHeader); got != legacy {
+			t.Errorf("%v: code %q, want %q", step.name, got, legacy)
+		}
+		if step.name == "unprotect with clone" && !strings.Contains(w.Body.String(), "rbd/clone") {
+			t.Errorf("%v: children not listed in %v", step.name, w.Body)
+		}
+	}
+
+	//克隆是EBS管理的卷，内容为快照时的数据，拍平后与父快照无关
+	clone, err := repo.Volumes().Get("rbd", "clone")
+	if err != nil || clone.State != repository.StateAvailable || clone.Size != 1<<20 || clone.DevPath != "/dev/rbd1" {
+		t.Errorf("clone record %+v, %v", clone, err)
+	}
+	if got := readImage(t, pool, "clone", len(snapshotted)); !bytes.Equal(got, snapshotted) {
+		t.Error("clone does not have the snapshot data")
+	}
+
+	w := callHandler(InfoSnapshot, query("InfoSnapshot"))
+	var snaps []storage.SnapInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &snaps); err != nil || len(snaps) != 1 || snaps[0].Name != "s1" {
+		t.Errorf("InfoSnapshot = %v, %v", w.Body, err)
+	}
+	w = callHandler(DelSnapshot, query("DelSnapshot"))
+	if w.Code != http.StatusOK {
+		t.Errorf("delete: status %v %v", w.Code, w.Body)
+	}
+}
+
+func TestRollbackSnapshot(t *testing.T) {
+	tests := []struct {
+		name  string
+		state repository.VolumeState
+		//回滚任务结束后卷的状态，为空时不提交任务
+		after  repository.VolumeState
+		status int
+	}{
+		{"available", repository.StateAvailable, repository.StateAvailable, http.StatusAccepted},
+		{"error", repository.StateError, repository.StateAvailable, http.StatusAccepted},
+		{"in use", repository.StateInUse, "", http.StatusConflict},
+		{"restoring", repository.StateRestoring, "", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := setupDisk(t)
+			createTestDisk(t, "vol", 1<<20)
+			pool, err := cluster.OpenPool("rbd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			original := bytes.Repeat([]byte{1}, 4096)
+			writeImage(t, pool, "vol", original, 0)
+			q := url.Values{"Action": {"CreateSnapshot"}, "PoolName": {"rbd"}, "VolumeName": {"vol"}, "Snapshot": {"s1"}}
+			if w := callHandler(CreateSnapshot, q); w.Code != http.StatusOK {
+				t.Fatalf("CreateSnapshot: %v %v", w.Code, w.Body)
+			}
+			writeImage(t, pool, "vol", bytes.Repeat([]byte{2}, 4096), 0)
+
+			//从available经过statePaths中available之后的状态到达tt.state
+			from := repository.StateAvailable
+			for _, to := range statePaths[tt.state] {
+				if to == from {
+					continue
+				}
+				if err := repo.Volumes().Transition("rbd", "vol", from, to); err != nil {
+					t.Fatal(err)
+				}
+				from = to
+			}
+
+			q.Set("Action", "RollbackSnapshot")
+			w := callHandler(RollbackSnapshot, q)
+			jobs.Wait()
+			if w.Code != tt.status {
+				t.Fatalf("RollbackSnapshot: status %v %v", w.Code, w.Body)
+			}
+			record, err := repo.Volumes().Get("rbd", "vol")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.after == "" {
+				if record.State != tt.state {
+					t.Errorf("state %v after a refused rollback", record.State)
+				}
+				return
+			}
+			if record.State != tt.after {
+				t.Errorf("state %v after rollback, want %v", record.State, tt.after)
+			}
+			if got := readImage(t, pool, "vol", len(original)); !bytes.Equal(got, original) {
+				t.Error("data not rolled back")
+			}
+		})
+	}
+}
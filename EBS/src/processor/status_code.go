@@ -6,6 +6,9 @@ import (
 	//"strconv"
 	"fmt"
 	"errors"
+	"strconv"
+	"strings"
+	"encoding/json"
 )
 
 const (
@@ -27,6 +30,53 @@ const (
 	statusCreateDiskErr       = 715
 	statusMapVolumeErr        = 716
 	statusUnmapVolumeErr      = 717
+	statusDelDiskErr          = 718
+	statusExtendDiskErr       = 719
+	statusAttachDiskErr       = 720
+	statusDetachDiskErr       = 721
+	statusVolumeAttachedErr   = 722
+	statusInfoClusterErr      = 723
+	statusDescribeJobErr      = 724
+	statusResourceBusyErr     = 725
+	statusCopyVolumeErr       = 726
+	statusInvalidStateErr     = 727
+	statusVolumeExistErr      = 728
+	statusDescribeAttachErr   = 729
+	statusChapConflictErr     = 730
+	statusTransportErr        = 731
+	statusBackupDiskErr       = 732
+	statusListBackupsErr      = 733
+	statusRestoreDiskErr      = 734
+	statusRollbackSnapErr     = 735
+	statusProtectSnapErr      = 736
+	statusUnprotectSnapErr    = 737
+	statusCloneVolumeErr      = 738
+	statusFlattenVolumeErr    = 739
+	statusSnapProtectedErr    = 740
+	statusSnapHasChildrenErr  = 741
+	statusSnapNotProtectedErr = 742
+	statusCreatePolicyErr     = 743
+	statusDelPolicyErr        = 744
+	statusListPoliciesErr     = 745
+	statusAttachPolicyErr     = 746
+	statusDetachPolicyErr     = 747
+	statusListSnapRunsErr     = 748
+	statusPolicyExistErr      = 749
+	statusUpdateFeaturesErr   = 750
+	statusModifyQoSErr        = 751
+	statusTagVolumeErr        = 752
+	statusUntagVolumeErr      = 753
+	statusListVolumesErr      = 754
+	statusTooManyTagsErr      = 755
+	statusQuotaExceededErr    = 756
+	statusCreateTenantErr     = 757
+	statusDelTenantErr        = 758
+	statusInfoTenantErr       = 759
+	statusModifyTenantErr     = 760
+	statusTenantExistErr      = 761
+	statusTenantInUseErr      = 762
+	statusInsufficientCapacityErr = 763
+	statusPoolQuotaErr        = 764
 )
 
 var codeDesc = map[int]string {
@@ -48,13 +98,217 @@ var codeDesc = map[int]string {
 	statusCreateDiskErr       : "Create Disk Failed",
 	statusMapVolumeErr        : "Map Volume Failed",
 	statusUnmapVolumeErr      : "Unmap Volume Failed",
+	statusDelDiskErr          : "Delete Disk Failed",
+	statusExtendDiskErr       : "Extend Disk Failed",
+	statusAttachDiskErr       : "Attach Disk Failed",
+	statusDetachDiskErr       : "Detach Disk Failed",
+	statusVolumeAttachedErr   : "Volume Is Attached",
+	statusInfoClusterErr      : "Info Cluster Failed",
+	statusDescribeJobErr      : "Describe Job Failed",
+	statusResourceBusyErr     : "Resource Busy",
+	statusCopyVolumeErr       : "Copy Volume Failed",
+	statusInvalidStateErr     : "Invalid Volume State",
+	statusVolumeExistErr      : "Volume Already Exist",
+	statusDescribeAttachErr   : "Describe Attachment Failed",
+	statusChapConflictErr     : "CHAP Setting Conflict",
+	statusTransportErr        : "Transport Conflict",
+	statusBackupDiskErr       : "Backup Disk Failed",
+	statusListBackupsErr      : "List Backups Failed",
+	statusRestoreDiskErr      : "Restore Disk Failed",
+	statusRollbackSnapErr     : "Rollback Snapshot Failed",
+	statusProtectSnapErr      : "Protect Snapshot Failed",
+	statusUnprotectSnapErr    : "Unprotect Snapshot Failed",
+	statusCloneVolumeErr      : "Clone Volume Failed",
+	statusFlattenVolumeErr    : "Flatten Volume Failed",
+	statusSnapProtectedErr    : "Snapshot Is Protected",
+	statusSnapHasChildrenErr  : "Snapshot Has Children",
+	statusSnapNotProtectedErr : "Snapshot Not Protected",
+	statusCreatePolicyErr     : "Create Snapshot Policy Failed",
+	statusDelPolicyErr        : "Delete Snapshot Policy Failed",
+	statusListPoliciesErr     : "List Snapshot Policies Failed",
+	statusAttachPolicyErr     : "Attach Snapshot Policy Failed",
+	statusDetachPolicyErr     : "Detach Snapshot Policy Failed",
+	statusListSnapRunsErr     : "List Snapshot Runs Failed",
+	statusPolicyExistErr      : "Snapshot Policy Already Exist",
+	statusUpdateFeaturesErr   : "Update Volume Features Failed",
+	statusModifyQoSErr        : "Modify Volume QoS Failed",
+	statusTagVolumeErr        : "Tag Volume Failed",
+	statusUntagVolumeErr      : "Untag Volume Failed",
+	statusListVolumesErr      : "List Volumes Failed",
+	statusTooManyTagsErr      : "Too Many Tags",
+	statusQuotaExceededErr    : "Quota Exceeded",
+	statusCreateTenantErr     : "Create Tenant Failed",
+	statusDelTenantErr        : "Delete Tenant Failed",
+	statusInfoTenantErr       : "Info Tenant Failed",
+	statusModifyTenantErr     : "Modify Tenant Quota Failed",
+	statusTenantExistErr      : "Tenant Already Exist",
+	statusTenantInUseErr      : "Tenant In Use",
+	statusInsufficientCapacityErr : "Insufficient Capacity",
+	statusPoolQuotaErr        : "Pool Quota Failed",
+}
+
+//错误应答中的请求ID和旧接口的状态码
+const (
+	RequestIDHeader  = "X-Request-Id"
+	LegacyCodeHeader = "X-Ebs-Code"
+)
+
+//错误对应的HTTP状态码、稳定的错误码和客户端能否重试
+type apiError struct {
+	status    int
+	code      string
+	retryable bool
+}
+
+var codeErrors = map[int]apiError {
+	http.StatusBadRequest          : {http.StatusBadRequest, "InvalidRequest", false},
+	http.StatusUnauthorized        : {http.StatusUnauthorized, "Unauthorized", false},
+	http.StatusForbidden           : {http.StatusForbidden, "Forbidden", false},
+	http.StatusNotFound            : {http.StatusNotFound, "NotFound", false},
+	http.StatusMethodNotAllowed    : {http.StatusMethodNotAllowed, "MethodNotAllowed", false},
+	http.StatusInternalServerError : {http.StatusInternalServerError, "InternalError", true},
+	statusTimeoutErr          : {http.StatusGatewayTimeout, "RequestTimeout", true},
+	statusCreateVolumeErr     : {http.StatusInternalServerError, "CreateVolumeFailed", true},
+	statusInfoVolumesErr      : {http.StatusInternalServerError, "InfoVolumesFailed", true},
+	statusDelVolumeErr        : {http.StatusInternalServerError, "DeleteVolumeFailed", true},
+	statusNotFoundErr         : {http.StatusNotFound, "NotFound", false},
+	statusCreatePoolErr       : {http.StatusInternalServerError, "CreatePoolFailed", true},
+	statusInfoPoolErr         : {http.StatusInternalServerError, "InfoPoolFailed", true},
+	statusInfoPoolIOErr       : {http.StatusInternalServerError, "InfoPoolIOFailed", true},
+	statusDelPoolErr          : {http.StatusInternalServerError, "DeletePoolFailed", true},
+	statusModPoolErr          : {http.StatusInternalServerError, "ModifyPoolFailed", true},
+	statusResizeVolumeErr     : {http.StatusInternalServerError, "ResizeVolumeFailed", true},
+	statusCreateSnapshotErr   : {http.StatusInternalServerError, "CreateSnapshotFailed", true},
+	statusInfoSnapshotErr     : {http.StatusInternalServerError, "InfoSnapshotFailed", true},
+	statusDelSnapshotErr      : {http.StatusInternalServerError, "DeleteSnapshotFailed", true},
+	statusExportVolumeErr     : {http.StatusInternalServerError, "ExportVolumeFailed", true},
+	statusCreateDiskErr       : {http.StatusInternalServerError, "CreateDiskFailed", true},
+	statusMapVolumeErr        : {http.StatusInternalServerError, "MapVolumeFailed", true},
+	statusUnmapVolumeErr      : {http.StatusInternalServerError, "UnmapVolumeFailed", true},
+	statusDelDiskErr          : {http.StatusInternalServerError, "DeleteDiskFailed", true},
+	statusExtendDiskErr       : {http.StatusInternalServerError, "ExtendDiskFailed", true},
+	statusAttachDiskErr       : {http.StatusInternalServerError, "AttachDiskFailed", true},
+	statusDetachDiskErr       : {http.StatusInternalServerError, "DetachDiskFailed", true},
+	statusVolumeAttachedErr   : {http.StatusConflict, "VolumeAttached", false},
+	statusInfoClusterErr      : {http.StatusInternalServerError, "InfoClusterFailed", true},
+	statusDescribeJobErr      : {http.StatusInternalServerError, "DescribeJobFailed", true},
+	statusResourceBusyErr     : {http.StatusConflict, "ResourceBusy", true},
+	statusCopyVolumeErr       : {http.StatusInternalServerError, "CopyVolumeFailed", true},
+	statusInvalidStateErr     : {http.StatusConflict, "InvalidVolumeState", false},
+	statusVolumeExistErr      : {http.StatusConflict, "VolumeAlreadyExists", false},
+	statusDescribeAttachErr   : {http.StatusInternalServerError, "DescribeAttachmentFailed", true},
+	statusChapConflictErr     : {http.StatusConflict, "ChapConflict", false},
+	statusTransportErr        : {http.StatusConflict, "TransportConflict", false},
+	statusBackupDiskErr       : {http.StatusInternalServerError, "BackupDiskFailed", true},
+	statusListBackupsErr      : {http.StatusInternalServerError, "ListBackupsFailed", true},
+	statusRestoreDiskErr      : {http.StatusInternalServerError, "RestoreDiskFailed", true},
+	statusRollbackSnapErr     : {http.StatusInternalServerError, "RollbackSnapshotFailed", true},
+	statusProtectSnapErr      : {http.StatusInternalServerError, "ProtectSnapshotFailed", true},
+	statusUnprotectSnapErr    : {http.StatusInternalServerError, "UnprotectSnapshotFailed", true},
+	statusCloneVolumeErr      : {http.StatusInternalServerError, "CloneVolumeFailed", true},
+	statusFlattenVolumeErr    : {http.StatusInternalServerError, "FlattenVolumeFailed", true},
+	statusSnapProtectedErr    : {http.StatusConflict, "SnapshotProtected", false},
+	statusSnapHasChildrenErr  : {http.StatusConflict, "SnapshotHasChildren", false},
+	statusSnapNotProtectedErr : {http.StatusConflict, "SnapshotNotProtected", false},
+	statusCreatePolicyErr     : {http.StatusInternalServerError, "CreateSnapshotPolicyFailed", true},
+	statusDelPolicyErr        : {http.StatusInternalServerError, "DeleteSnapshotPolicyFailed", true},
+	statusListPoliciesErr     : {http.StatusInternalServerError, "ListSnapshotPoliciesFailed", true},
+	statusAttachPolicyErr     : {http.StatusInternalServerError, "AttachSnapshotPolicyFailed", true},
+	statusDetachPolicyErr     : {http.StatusInternalServerError, "DetachSnapshotPolicyFailed", true},
+	statusListSnapRunsErr     : {http.StatusInternalServerError, "ListSnapshotRunsFailed", true},
+	statusPolicyExistErr      : {http.StatusConflict, "SnapshotPolicyAlreadyExists", false},
+	statusUpdateFeaturesErr   : {http.StatusInternalServerError, "UpdateVolumeFeaturesFailed", true},
+	statusModifyQoSErr        : {http.StatusInternalServerError, "ModifyVolumeQoSFailed", true},
+	statusTagVolumeErr        : {http.StatusInternalServerError, "TagVolumeFailed", true},
+	statusUntagVolumeErr      : {http.StatusInternalServerError, "UntagVolumeFailed", true},
+	statusListVolumesErr      : {http.StatusInternalServerError, "ListVolumesFailed", true},
+	statusTooManyTagsErr      : {http.StatusBadRequest, "TooManyTags", false},
+	statusQuotaExceededErr    : {http.StatusForbidden, "QuotaExceeded", false},
+	statusCreateTenantErr     : {http.StatusInternalServerError, "CreateTenantFailed", true},
+	statusDelTenantErr        : {http.StatusInternalServerError, "DeleteTenantFailed", true},
+	statusInfoTenantErr       : {http.StatusInternalServerError, "InfoTenantFailed", true},
+	statusModifyTenantErr     : {http.StatusInternalServerError, "ModifyTenantQuotaFailed", true},
+	statusTenantExistErr      : {http.StatusConflict, "TenantAlreadyExists", false},
+	statusTenantInUseErr      : {http.StatusConflict, "TenantInUse", false},
+	statusInsufficientCapacityErr : {http.StatusInsufficientStorage, "InsufficientCapacity", false},
+	statusPoolQuotaErr        : {http.StatusInternalServerError, "PoolQuotaFailed", true},
+}
+
+//未列出的标准状态码原样返回，自定义码为500
+func errorOf(code int) apiError {
+	if e, ok := codeErrors[code]; ok {
+		return e
+	}
+	if code < 600 {
+		return apiError{code, strings.Replace(http.StatusText(code), " ", "", -1), code >= 500}
+	}
+	return apiError{http.StatusInternalServerError, "InternalError", true}
+}
+
+type ErrorDetail struct {
+	Code      string
+	Message   string
+	RequestId string
+	Retryable bool
+}
+
+type ErrorReply struct {
+	Error ErrorDetail
+}
+
+/*
+错误应答：HTTP状态码为4xx/5xx，X-Ebs-Code为旧接口的状态码，例如
+HTTP/1.1 404 Not Found
+X-Ebs-Code: 704
+X-Request-Id: 5f0c6e1d2a9b4c37
+
+{"Error":{"Code":"VolumeNotFound","Message":"Image not found","RequestId":"5f0c6e1d2a9b4c37","Retryable":false}}
+*/
+func sendError(w http.ResponseWriter, errcode int, e apiError, message string) {
+	if message == "" {
+		message = codeDesc[errcode]
+	}
+	if message == "" {
+		message = http.StatusText(e.status)
+	}
+	payload, _ := json.Marshal(ErrorReply{Error: ErrorDetail{
+		Code: e.code,
+		Message: message,
+		RequestId: w.Header().Get(RequestIDHeader),
+		Retryable: e.retryable,
+	}})
+
+	w.Header().Set(LegacyCodeHeader, strconv.Itoa(errcode))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	fmt.Fprintln(w, string(payload))
+}
+
+//resource不存在，错误码为resource+NotFound，如VolumeNotFound
+func SendNotFound(w http.ResponseWriter, resource string) {
+	sendError(w, statusNotFoundErr, apiError{http.StatusNotFound, resource + "NotFound", false}, resource + " not found")
+}
+
+//Action为空或未知，错误码为InvalidAction
+func SendInvalidAction(w http.ResponseWriter, action string) {
+	message := "Missing Action"
+	if action != "" {
+		message = "Unknown Action " + action
+	}
+	sendError(w, http.StatusBadRequest, apiError{http.StatusBadRequest, "InvalidAction", false}, message)
 }
 
 func GetError(errcode int) error {
 	return errors.New(codeDesc[errcode])
 }
 
+//4xx、5xx和7xx以JSON错误应答返回
 func SendStatus(w http.ResponseWriter, code int, desc string) {
+	if code >= http.StatusBadRequest {
+		sendError(w, code, errorOf(code), desc)
+		return
+	}
 	if desc == "" {
 		http.Error(w, codeDesc[code], code)
 	} else {
@@ -0,0 +1,138 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"mon"
+	"repository"
+	"storage"
+)
+
+//每个旧接口的状态码都有稳定的错误码，错误码不会被两个状态码共用
+func TestCodeErrors(t *testing.T) {
+	owners := make(map[string]int)
+	for code := range codeDesc {
+		if code < 700 {
+			continue
+		}
+		e, ok := codeErrors[code]
+		if !ok {
+			t.Errorf("%v %q has no error code", code, codeDesc[code])
+			continue
+		}
+		if e.status < 400 || e.status >= 600 || e.code == "" {
+			t.Errorf("%v: %+v", code, e)
+		}
+		if e.status >= 500 && !e.retryable && e.status != http.StatusInsufficientStorage {
+			t.Errorf("%v: server error %v is not retryable", code, e.code)
+		}
+		//7xx的NotFound与404相同
+		if owner, ok := owners[e.code]; ok && e.code != "NotFound" {
+			t.Errorf("%v and %v share %v", owner, code, e.code)
+		}
+		owners[e.code] = code
+	}
+}
+
+func TestErrorOf(t *testing.T) {
+	tests := []struct {
+		code int
+		want apiError
+	}{
+		{http.StatusBadRequest, apiError{http.StatusBadRequest, "InvalidRequest", false}},
+		{http.StatusNotFound, apiError{http.StatusNotFound, "NotFound", false}},
+		{http.StatusInternalServerError, apiError{http.StatusInternalServerError, "InternalError", true}},
+		//未列出的标准状态码原样返回
+		{http.StatusConflict, apiError{http.StatusConflict, "Conflict", false}},
+		{http.StatusServiceUnavailable, apiError{http.StatusServiceUnavailable, "ServiceUnavailable", true}},
+		{statusNotFoundErr, apiError{http.StatusNotFound, "NotFound", false}},
+		{statusTimeoutErr, apiError{http.StatusGatewayTimeout, "RequestTimeout", true}},
+		{statusCreateDiskErr, apiError{http.StatusInternalServerError, "CreateDiskFailed", true}},
+		{statusVolumeExistErr, apiError{http.StatusConflict, "VolumeAlreadyExists", false}},
+		{statusResourceBusyErr, apiError{http.StatusConflict, "ResourceBusy", true}},
+		{statusTooManyTagsErr, apiError{http.StatusBadRequest, "TooManyTags", false}},
+		{statusQuotaExceededErr, apiError{http.StatusForbidden, "QuotaExceeded", false}},
+		{statusInsufficientCapacityErr, apiError{http.StatusInsufficientStorage, "InsufficientCapacity", false}},
+		//未知的自定义码
+		{799, apiError{http.StatusInternalServerError, "InternalError", true}},
+	}
+	for _, tt := range tests {
+		if got := errorOf(tt.code); got != tt.want {
+			t.Errorf("errorOf(%v) = %+v, want %+v", tt.code, got, tt.want)
+		}
+	}
+}
+
+//发送错误应答并解出状态码、X-Ebs-Code和错误内容
+func recordError(t *testing.T, send func(w http.ResponseWriter)) (int, string, ErrorDetail) {
+	w := httptest.NewRecorder()
+	w.Header().Set(RequestIDHeader, "req-1")
+	send(w)
+	var reply ErrorReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("reply %q: %v", w.Body, err)
+	}
+	if reply.Error.RequestId != "req-1" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("reply %q, headers %v", w.Body, w.Header())
+	}
+	return w.Code, w.Header().Get(LegacyCodeHeader), reply.Error
+}
+
+func TestSendError(t *testing.T) {
+	tests := []struct {
+		name   string
+		send   func(w http.ResponseWriter)
+		status int
+		legacy int
+		want   ErrorDetail
+	}{
+		{"bad request", func(w http.ResponseWriter) { SendStatus(w, http.StatusBadRequest, "") },
+			http.StatusBadRequest, http.StatusBadRequest, ErrorDetail{"InvalidRequest", "Bad Request", "req-1", false}},
+		{"legacy code", func(w http.ResponseWriter) { SendStatus(w, statusVolumeExistErr, "") },
+			http.StatusConflict, statusVolumeExistErr, ErrorDetail{"VolumeAlreadyExists", codeDesc[statusVolumeExistErr], "req-1", false}},
+		{"message", func(w http.ResponseWriter) { SendStatus(w, statusQuotaExceededErr, "Tenant acme exceeds its quota") },
+			http.StatusForbidden, statusQuotaExceededErr, ErrorDetail{"QuotaExceeded", "Tenant acme exceeds its quota", "req-1", false}},
+		{"not found", func(w http.ResponseWriter) { SendNotFound(w, "Job") },
+			http.StatusNotFound, statusNotFoundErr, ErrorDetail{"JobNotFound", "Job not found", "req-1", false}},
+		{"missing action", func(w http.ResponseWriter) { SendInvalidAction(w, "") },
+			http.StatusBadRequest, http.StatusBadRequest, ErrorDetail{"InvalidAction", "Missing Action", "req-1", false}},
+		{"unknown action", func(w http.ResponseWriter) { SendInvalidAction(w, "Bogus") },
+			http.StatusBadRequest, http.StatusBadRequest, ErrorDetail{"InvalidAction", "Unknown Action Bogus", "req-1", false}},
+		//不存在的统一为旧接口的704
+		{"image not found", func(w http.ResponseWriter) { sendStorageError(w, storage.ErrImageNotFound, statusCreateDiskErr) },
+			http.StatusNotFound, statusNotFoundErr, ErrorDetail{"VolumeNotFound", storage.ErrImageNotFound.Error(), "req-1", false}},
+		{"image exists", func(w http.ResponseWriter) { sendStorageError(w, storage.ErrExist, statusCreateDiskErr) },
+			http.StatusConflict, statusCreateDiskErr, ErrorDetail{"AlreadyExists", storage.ErrExist.Error(), "req-1", false}},
+		{"image busy", func(w http.ResponseWriter) { sendStorageError(w, storage.ErrBusy, statusDelDiskErr) },
+			http.StatusConflict, statusDelDiskErr, ErrorDetail{"ResourceBusy", storage.ErrBusy.Error(), "req-1", true}},
+		{"other storage error", func(w http.ResponseWriter) { sendStorageError(w, errors.New("EIO"), statusCreateDiskErr) },
+			http.StatusInternalServerError, statusCreateDiskErr, ErrorDetail{"CreateDiskFailed", codeDesc[statusCreateDiskErr], "req-1", true}},
+		{"mon pool not found", func(w http.ResponseWriter) {
+			sendMonError(w, &mon.CommandError{Prefix: "osd pool get", Status: "unrecognized pool 'x'", Err: storage.ErrNotFound}, statusInfoPoolErr)
+		}, http.StatusNotFound, statusNotFoundErr, ErrorDetail{"PoolNotFound", "osd pool get: " + storage.ErrNotFound.Error() + ": unrecognized pool 'x'", "req-1", false}},
+		{"mon error", func(w http.ResponseWriter) {
+			sendMonError(w, &mon.CommandError{Prefix: "osd pool set", Status: "denied", Err: errors.New("EACCES")}, statusModPoolErr)
+		}, http.StatusInternalServerError, statusModPoolErr, ErrorDetail{"ModifyPoolFailed", "osd pool set: EACCES: denied", "req-1", true}},
+		{"record not found", func(w http.ResponseWriter) { sendStateError(w, repository.ErrNotFound, statusDelDiskErr) },
+			http.StatusNotFound, statusNotFoundErr, ErrorDetail{"NotFound", codeDesc[statusNotFoundErr], "req-1", false}},
+		{"state changed", func(w http.ResponseWriter) { sendStateError(w, repository.ErrStateChanged, statusDelDiskErr) },
+			http.StatusConflict, statusInvalidStateErr, ErrorDetail{"InvalidVolumeState", repository.ErrStateChanged.Error(), "req-1", false}},
+	}
+	for _, tt := range tests {
+		status, legacy, got := recordError(t, tt.send)
+		if status != tt.status || legacy != strconv.Itoa(tt.legacy) || got != tt.want {
+			t.Errorf("%v: %v %v %+v, want %v %v %+v", tt.name, status, legacy, got, tt.status, tt.legacy, tt.want)
+		}
+	}
+
+	//成功的应答不是错误
+	w := httptest.NewRecorder()
+	SendStatus(w, http.StatusOK, "")
+	if w.Code != http.StatusOK || w.Header().Get(LegacyCodeHeader) != "" {
+		t.Errorf("SendStatus(200): %v %v", w.Code, w.Header())
+	}
+}
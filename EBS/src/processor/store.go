@@ -0,0 +1,35 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"repository"
+)
+
+var repo repository.Store
+
+//设置卷记录的存储，生产环境为MySQL，测试时可替换为内存实现
+func SetRepository(store repository.Store) {
+	repo = store
+}
+
+//操作失败后回到操作前的状态，失败时只记录日志
+func (volume *Volume)restoreState(state repository.VolumeState) {
+	if err := volume.SetState(state); err != nil {
+		fmt.Fprintf(os.Stderr, "Restore volume %v to %v failed: %v\n", volume.resource(), state, err)
+	}
+}
+
+//按仓库错误类型返回状态码，其他错误返回errcode
+func sendStateError(w http.ResponseWriter, err error, errcode int) {
+	if err == repository.ErrNotFound {
+		SendStatus(w, statusNotFoundErr, "")
+		return
+	}
+	if _, ok := err.(*repository.InvalidTransitionError); ok || err == repository.ErrStateChanged {
+		SendStatus(w, statusInvalidStateErr, err.Error())
+		return
+	}
+	SendStatus(w, errcode, "")
+}
@@ -0,0 +1,329 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"strings"
+	"encoding/json"
+	"repository"
+	"storage"
+)
+
+//标签同时写入镜像元数据，rbd image-meta list可以看到
+const tagMetadataPrefix = "ebs.tag."
+
+const (
+	maxVolumeTags  = 50
+	maxTagKeyLen   = 128
+	maxTagValueLen = 255
+)
+
+type VolumeInfo struct {
+	Pool       string
+	Name       string
+	Size       uint64
+	State      repository.VolumeState
+	DevPath    string
+	Tags       map[string]string
+	CreateTime string
+}
+
+//键只能含字母、数字和-_./，不能含分隔键值的冒号
+func validTagKey(key string) bool {
+	if key == "" || len(key) > maxTagKeyLen {
+		return false
+	}
+	return strings.IndexFunc(key, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./", r))
+	}) < 0
+}
+
+//Tag参数格式为key:value，value可以为空或含冒号；requireValue为false时可以只给出key
+func parseTags(values []string, requireValue bool) ([]*repository.VolumeTag, error) {
+	var tags []*repository.VolumeTag
+	for _, v := range values {
+		i := strings.Index(v, ":")
+		if i < 0 && requireValue {
+			return nil, fmt.Errorf("Tag %q is not key:value", v)
+		}
+		tag := &repository.VolumeTag{Key: v}
+		if i >= 0 {
+			tag.Key, tag.Value = v[:i], v[i+1:]
+		}
+		if !validTagKey(tag.Key) || len(tag.Value) > maxTagValueLen {
+			return nil, fmt.Errorf("Invalid tag %q", v)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func tagMap(tags []*repository.VolumeTag) map[string]string {
+	m := make(map[string]string)
+	for _, t := range tags {
+		m[t.Key] = t.Value
+	}
+	return m
+}
+
+//加载要打标签的卷，创建和删除过程中的卷不能修改
+func loadTaggableVolume(w http.ResponseWriter, pool string, name string, errcode int) (*Volume, bool) {
+	volume, err := LoadVolume(name, pool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", pool, name, err)
+		sendStateError(w, err, errcode)
+		return nil, false
+	}
+	if volume.state == repository.StateCreating || volume.state == repository.StateDeleting {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is %v\n", pool, name, volume.state)
+		SendStatus(w, statusInvalidStateErr, "")
+		return nil, false
+	}
+	return volume, true
+}
+
+//先修改镜像元数据再修改数据库；set为nil时删除keys
+func (volume *Volume) updateTags(set []*repository.VolumeTag, keys []string) error {
+	conn, ioctx, err := NewConnAndOpenPool(volume.parentPool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return err
+	}
+
+	image, err := ioctx.OpenImage(volume.name, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		return err
+	}
+	defer image.Close()
+
+	for _, t := range set {
+		if err := image.SetMetadata(tagMetadataPrefix + t.Key, t.Value); err != nil {
+			fmt.Fprintf(os.Stderr, "Set metadata %v of %v failed: %v\n", t.Key, volume.resource(), err)
+			return err
+		}
+		t.Pool, t.Volume = volume.parentPool, volume.name
+		if err := repo.Tags().Set(t); err != nil {
+			fmt.Fprintf(os.Stderr, "Save tag %v of %v failed: %v\n", t.Key, volume.resource(), err)
+			return err
+		}
+	}
+
+	for _, key := range keys {
+		err := image.RemoveMetadata(tagMetadataPrefix + key)
+		if err != nil && !storage.IsNotFound(err) {
+			fmt.Fprintf(os.Stderr, "Remove metadata %v of %v failed: %v\n", key, volume.resource(), err)
+			return err
+		}
+		err = repo.Tags().Remove(volume.parentPool, volume.name, key)
+		if err != nil && err != repository.ErrNotFound {
+			fmt.Fprintf(os.Stderr, "Remove tag %v of %v failed: %v\n", key, volume.resource(), err)
+			return err
+		}
+	}
+	return nil
+}
+
+func sendTags(w http.ResponseWriter, volume *Volume, errcode int) {
+	tags, err := repo.Tags().List(volume.parentPool, volume.name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List tags of %v failed: %v\n", volume.resource(), err)
+		SendStatus(w, errcode, "")
+		return
+	}
+
+	payload, err := json.Marshal(map[string]map[string]string{"Tags": tagMap(tags)})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, errcode, "")
+		return
+	}
+	SendResponse(w, http.StatusOK, string(payload))
+}
+
+/*
+给卷添加标签或修改标签的值，可以给出多个Tag；每个卷最多50个标签
+GET /?Action=TagVolume&PoolName={PoolName}&VolumeName={volumeName}&Tag={key}:{value}[&Tag={key}:{value}...] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"Tags":{"env":"prod","owner":"storage"}}
+*/
+func TagVolume(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	name := r.FormValue("VolumeName")
+	r.ParseForm()
+	tags, err := parseTags(r.Form["Tag"], true)
+	if pool == "" || name == "" || len(tags) == 0 || err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	volume, ok := loadTaggableVolume(w, pool, name, statusTagVolumeErr)
+	if !ok {
+		return
+	}
+
+	existing, err := repo.Tags().List(pool, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List tags of %v/%v failed: %v\n", pool, name, err)
+		SendStatus(w, statusTagVolumeErr, "")
+		return
+	}
+	keys := tagMap(existing)
+	for _, t := range tags {
+		keys[t.Key] = t.Value
+	}
+	if len(keys) > maxVolumeTags {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v would have %v tags\n", pool, name, len(keys))
+		SendStatus(w, statusTooManyTagsErr, "")
+		return
+	}
+
+	if err := volume.updateTags(tags, nil); err != nil {
+		sendStorageError(w, err, statusTagVolumeErr)
+		return
+	}
+	sendTags(w, volume, statusTagVolumeErr)
+}
+
+/*
+删除卷的标签，不存在的标签忽略
+GET /?Action=UntagVolume&PoolName={PoolName}&VolumeName={volumeName}&Key={key}[&Key={key}...] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"Tags":{"owner":"storage"}}
+*/
+func UntagVolume(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	name := r.FormValue("VolumeName")
+	r.ParseForm()
+	keys := r.Form["Key"]
+	valid := len(keys) > 0
+	for _, key := range keys {
+		valid = valid && validTagKey(key)
+	}
+	if pool == "" || name == "" || !valid {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	volume, ok := loadTaggableVolume(w, pool, name, statusUntagVolumeErr)
+	if !ok {
+		return
+	}
+
+	if err := volume.updateTags(nil, keys); err != nil {
+		sendStorageError(w, err, statusUntagVolumeErr)
+		return
+	}
+	sendTags(w, volume, statusUntagVolumeErr)
+}
+
+//删除卷后清除标签记录，镜像元数据随镜像删除
+func deleteTags(volume *Volume) error {
+	return repo.Tags().DeleteVolume(volume.parentPool, volume.name)
+}
+
+/*
+列出EBS管理的卷及其标签；Tag为key:value或key(匹配任意值)，给出多个时需全部匹配
+GET /?Action=ListVolumes[&PoolName={PoolName}][&Tag={key}:{value}...] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+[{"Pool":"rbd","Name":"vol1","Size":1073741824,"State":"available","DevPath":"/dev/rbd0","Tags":{"env":"prod"},"CreateTime":"..."}]
+*/
+func ListVolumes(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	r.ParseForm()
+	filters, err := parseTags(r.Form["Tag"], false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	//每个过滤条件通过标签索引查出匹配的卷，取交集
+	var matched map[string]bool
+	for _, f := range filters {
+		tags, err := repo.Tags().Find(f.Key, f.Value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Find tag %v failed: %v\n", f.Key, err)
+			SendStatus(w, statusListVolumesErr, "")
+			return
+		}
+		found := make(map[string]bool)
+		for _, t := range tags {
+			k := t.Pool + "/" + t.Volume
+			if matched == nil || matched[k] {
+				found[k] = true
+			}
+		}
+		matched = found
+	}
+
+	records, err := repo.Volumes().List(pool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List volumes failed: %v\n", err)
+		SendStatus(w, statusListVolumesErr, "")
+		return
+	}
+	tags, err := repo.Tags().List(pool, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List tags failed: %v\n", err)
+		SendStatus(w, statusListVolumesErr, "")
+		return
+	}
+	byVolume := make(map[string][]*repository.VolumeTag)
+	for _, t := range tags {
+		k := t.Pool + "/" + t.Volume
+		byVolume[k] = append(byVolume[k], t)
+	}
+
+	volumes := []*VolumeInfo{}
+	for _, v := range records {
+		k := v.Pool + "/" + v.Name
+		if matched != nil && !matched[k] {
+			continue
+		}
+		volumes = append(volumes, &VolumeInfo{
+			Pool: v.Pool,
+			Name: v.Name,
+			Size: v.Size,
+			State: v.State,
+			DevPath: v.DevPath,
+			Tags: tagMap(byVolume[k]),
+			CreateTime: v.CreateTime,
+		})
+	}
+
+	payload, err := json.Marshal(volumes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusListVolumesErr, "")
+		return
+	}
+	SendResponse(w, http.StatusOK, string(payload))
+}
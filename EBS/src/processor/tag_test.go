@@ -0,0 +1,164 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		values       []string
+		requireValue bool
+		//want为nil时应返回错误
+		want map[string]string
+	}{
+		{nil, true, map[string]string{}},
+		{[]string{"env:prod", "owner:storage"}, true, map[string]string{"env": "prod", "owner": "storage"}},
+		{[]string{"env:"}, true, map[string]string{"env": ""}},
+		{[]string{"url:http://a:80/b"}, true, map[string]string{"url": "http://a:80/b"}},
+		{[]string{"a-b_c.d/e:1"}, true, map[string]string{"a-b_c.d/e": "1"}},
+		{[]string{"env"}, true, nil},
+		{[]string{"env"}, false, map[string]string{"env": ""}},
+		{[]string{":prod"}, false, nil},
+		{[]string{"e nv:prod"}, true, nil},
+		{[]string{"环境:prod"}, true, nil},
+		{[]string{strings.Repeat("k", maxTagKeyLen) + ":v"}, true, map[string]string{strings.Repeat("k", maxTagKeyLen): "v"}},
+		{[]string{strings.Repeat("k", maxTagKeyLen+1) + ":v"}, true, nil},
+		{[]string{"k:" + strings.Repeat("v", maxTagValueLen+1)}, true, nil},
+	}
+	for _, tt := range tests {
+		tags, err := parseTags(tt.values, tt.requireValue)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q accepted", tt.values)
+			}
+			continue
+		}
+		if got := tagMap(tags); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: tags %v, %v", tt.values, got, err)
+		}
+	}
+}
+
+func TestTagVolume(t *testing.T) {
+	cluster := setupDisk(t, "rbd/db", "rbd/web")
+	for _, name := range []string{"db", "web"} {
+		createTestDisk(t, name, 1<<20)
+	}
+
+	tagged := func(name string, w interface{ Bytes() []byte }) map[string]string {
+		var reply map[string]map[string]string
+		if err := json.Unmarshal(w.Bytes(), &reply); err != nil {
+			t.Fatalf("%v: reply %s, %v", name, w.Bytes(), err)
+		}
+		return reply["Tags"]
+	}
+	query := func(action string, name string, param string, values ...string) url.Values {
+		return url.Values{"Action": {action}, "PoolName": {"rbd"}, "VolumeName": {name}, param: values}
+	}
+
+	w := callHandler(TagVolume, query("TagVolume", "db", "Tag", "env:prod", "owner:storage"))
+	if got := tagged("db", w.Body); w.Code != http.StatusOK || !reflect.DeepEqual(got, map[string]string{"env": "prod", "owner": "storage"}) {
+		t.Errorf("TagVolume db: %v %v", w.Code, got)
+	}
+	w = callHandler(TagVolume, query("TagVolume", "web", "Tag", "env:test"))
+	if w.Code != http.StatusOK {
+		t.Errorf("TagVolume web: %v %v", w.Code, w.Body)
+	}
+	//修改已有标签的值
+	w = callHandler(TagVolume, query("TagVolume", "web", "Tag", "env:prod", "tier:front"))
+	if got := tagged("web", w.Body); !reflect.DeepEqual(got, map[string]string{"env": "prod", "tier": "front"}) {
+		t.Errorf("retagged web: %v", got)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"without value", query("TagVolume", "db", "Tag", "env"), http.StatusBadRequest},
+		{"without tag", query("TagVolume", "db", "Tag"), http.StatusBadRequest},
+		{"missing volume", query("TagVolume", "missing", "Tag", "env:prod"), http.StatusNotFound},
+		{"untag invalid key", query("UntagVolume", "db", "Key", "e nv"), http.StatusBadRequest},
+		{"filter invalid key", url.Values{"Action": {"ListVolumes"}, "Tag": {"e nv"}}, http.StatusBadRequest},
+	} {
+		handler := map[string]http.HandlerFunc{"TagVolume": TagVolume, "UntagVolume": UntagVolume, "ListVolumes": ListVolumes}
+		if w := callHandler(handler[tt.query.Get("Action")], tt.query); w.Code != tt.status {
+			t.Errorf("%v: status %v %v", tt.name, w.Code, w.Body)
+		}
+	}
+
+	//每个卷最多maxVolumeTags个标签，超出时一个也不添加
+	var many []string
+	for i := 0; i < maxVolumeTags-1; i++ {
+		many = append(many, "k"+strconv.Itoa(i)+":v")
+	}
+	w = callHandler(TagVolume, query("TagVolume", "db", "Tag", many...))
+	if w.Code != http.StatusBadRequest || w.Header().Get(LegacyCodeHeader) != strconv.Itoa(statusTooManyTagsErr) {
+		t.Errorf("too many tags: %v %v", w.Code, w.Body)
+	}
+	if tags, _ := repo.Tags().List("rbd", "db"); len(tags) != 2 {
+		t.Errorf("%v tags after refused TagVolume", len(tags))
+	}
+	w = callHandler(TagVolume, query("TagVolume", "db", "Tag", many[:maxVolumeTags-2]...))
+	if w.Code != http.StatusOK || len(tagged("db", w.Body)) != maxVolumeTags {
+		t.Errorf("tagging up to the limit: %v", w.Code)
+	}
+	keys := []string{"owner"}
+	for _, tag := range many {
+		keys = append(keys, strings.TrimSuffix(tag, ":v"))
+	}
+	w = callHandler(UntagVolume, query("UntagVolume", "db", "Key", keys...))
+	if got := tagged("db", w.Body); w.Code != http.StatusOK || !reflect.DeepEqual(got, map[string]string{"env": "prod"}) {
+		t.Errorf("UntagVolume: %v %v", w.Code, got)
+	}
+
+	//标签写入镜像元数据
+	pool, err := cluster.OpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := pool.OpenImage("web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := image.ListMetadata()
+	image.Close()
+	if err != nil || metadata["ebs.tag.env"] != "prod" || metadata["ebs.tag.tier"] != "front" {
+		t.Errorf("metadata %v, %v", metadata, err)
+	}
+
+	for _, tt := range []struct {
+		filters []string
+		want    []string
+	}{
+		{nil, []string{"db", "web"}},
+		{[]string{"env:prod"}, []string{"db", "web"}},
+		{[]string{"env"}, []string{"db", "web"}},
+		{[]string{"tier"}, []string{"web"}},
+		{[]string{"env:prod", "tier:front"}, []string{"web"}},
+		{[]string{"env:test"}, []string{}},
+		{[]string{"owner"}, []string{}},
+	} {
+		w := callHandler(ListVolumes, url.Values{"Action": {"ListVolumes"}, "Tag": tt.filters})
+		var volumes []VolumeInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &volumes); err != nil {
+			t.Fatalf("ListVolumes %q: %v %v", tt.filters, w.Body, err)
+		}
+		names := []string{}
+		for _, v := range volumes {
+			names = append(names, v.Name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("ListVolumes %q = %v, want %v", tt.filters, names, tt.want)
+		}
+		if len(volumes) > 0 && volumes[len(volumes)-1].Name == "web" && volumes[len(volumes)-1].Tags["tier"] != "front" {
+			t.Errorf("ListVolumes %q: tags of web %v", tt.filters, volumes[len(volumes)-1].Tags)
+		}
+	}
+}
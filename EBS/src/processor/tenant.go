@@ -0,0 +1,633 @@
+package processor
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"repository"
+	"storage"
+	"mon"
+)
+
+//租户独占一个pool，cephx用户只有该pool的rbd权限
+//librbd的命名空间需要Nautilus，比内置的头文件新，所以不使用rados命名空间隔离
+const (
+	tenantUserPrefix    = "client.ebs."
+	tenantBackendPrefix = "tenant."
+	maxTenantNameLen    = 64
+	accessKeyLen        = 20
+	secretKeyBytes      = 30
+)
+
+const accessKeyChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+//租户pool到租户连接的映射，在启动和创建、删除租户时更新
+var tenantMu sync.RWMutex
+var tenantBackends = make(map[string]storage.Backend)
+
+type tenantContextKey struct{}
+
+type TenantUsage struct {
+	Volumes   int
+	Bytes     uint64
+	Snapshots int
+}
+
+type TenantInfo struct {
+	Name         string
+	AccessKey    string
+	SecretKey    string `json:",omitempty"`
+	Pool         string
+	CephUser     string
+	MaxVolumes   int
+	MaxGB        uint64
+	MaxSnapshots int
+	Usage        *TenantUsage `json:",omitempty"`
+	CreateTime   string
+}
+
+func tenantInfo(t *repository.Tenant) *TenantInfo {
+	return &TenantInfo{
+		Name: t.Name,
+		AccessKey: t.AccessKey,
+		Pool: t.Pool,
+		CephUser: t.CephUser,
+		MaxVolumes: t.MaxVolumes,
+		MaxGB: t.MaxGB,
+		MaxSnapshots: t.MaxSnapshots,
+		CreateTime: t.CreateTime,
+	}
+}
+
+func tenantBackend(pool string) storage.Backend {
+	tenantMu.RLock()
+	defer tenantMu.RUnlock()
+	return tenantBackends[pool]
+}
+
+//建立租户的连接；后端不支持其他用户时租户pool仍使用管理员连接
+func addTenantBackend(t *repository.Tenant) error {
+	users, ok := backend.(storage.UserBackend)
+	if !ok {
+		return nil
+	}
+	b, err := users.AddUser(tenantBackendPrefix + t.Name, t.CephUser, t.CephKey)
+	if b != nil {
+		tenantMu.Lock()
+		tenantBackends[t.Pool] = b
+		tenantMu.Unlock()
+	}
+	return err
+}
+
+func removeTenantBackend(t *repository.Tenant) {
+	tenantMu.Lock()
+	delete(tenantBackends, t.Pool)
+	tenantMu.Unlock()
+
+	if users, ok := backend.(storage.UserBackend); ok {
+		if err := users.RemoveUser(tenantBackendPrefix + t.Name); err != nil {
+			fmt.Fprintf(os.Stderr, "Remove connection of tenant %v failed: %v\n", t.Name, err)
+		}
+	}
+}
+
+//启动时为每个租户建立连接，连接失败的在后台重试
+func LoadTenants() error {
+	tenants, err := repo.Tenants().List()
+	if err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		if err := addTenantBackend(t); err != nil {
+			fmt.Fprintf(os.Stderr, "Connect as %v for tenant %v failed: %v\n", t.CephUser, t.Name, err)
+		}
+	}
+	return nil
+}
+
+func requestTenant(r *http.Request) *repository.Tenant {
+	t, _ := r.Context().Value(tenantContextKey{}).(*repository.Tenant)
+	return t
+}
+
+//管理员请求可以访问所有pool
+func tenantOwns(r *http.Request, pool string) bool {
+	t := requestTenant(r)
+	return t == nil || t.Pool == pool
+}
+
+/*
+租户请求已通过Authenticate校验签名；管理员请求不受限制。
+租户只能调用allowed的接口，PoolName默认为租户的pool，PoolName、DestPoolName和DataPool只能是租户的pool，
+TenantName只能是租户自己
+*/
+func AuthorizeTenant(w http.ResponseWriter, r *http.Request, allowed bool) bool {
+	t := requestTenant(r)
+	if t == nil {
+		return true
+	}
+
+	if !allowed {
+		fmt.Fprintf(os.Stderr, "Tenant %v is not allowed to %v\n", t.Name, r.RequestURI)
+		SendStatus(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return false
+	}
+
+	r.ParseForm()
+	if r.Form.Get("PoolName") == "" {
+		r.Form.Set("PoolName", t.Pool)
+	}
+	if r.Form.Get("TenantName") == "" {
+		r.Form.Set("TenantName", t.Name)
+	}
+	owned := map[string]string{"PoolName": t.Pool, "DestPoolName": t.Pool, "DataPool": t.Pool, "TenantName": t.Name}
+	for param, value := range owned {
+		if v := r.Form.Get(param); v != "" && v != value {
+			fmt.Fprintf(os.Stderr, "Tenant %v is not allowed to access %v %v\n", t.Name, param, v)
+			SendStatus(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+			return false
+		}
+	}
+	return true
+}
+
+type quotaError struct {
+	tenant string
+	what   string
+	limit  uint64
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("Tenant %v exceeds its quota of %v %v", e.tenant, e.limit, e.what)
+}
+
+//已通过检查但任务尚未结束的用量，检查时计入，避免并发请求一起超出配额
+var quotaMu sync.Mutex
+var quotaReserved = make(map[string]*TenantUsage)
+
+//pool中所有镜像的数量、大小和快照数，包括EBS未登记的镜像
+func poolUsage(pool string, countSnapshots bool) (*TenantUsage, error) {
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := ioctx.ListImages()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ListImages failed: %v\n", err)
+		return nil, err
+	}
+
+	usage := &TenantUsage{}
+	for _, name := range names {
+		image, err := ioctx.OpenImage(name, "")
+		if storage.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+			return nil, err
+		}
+		size, err := image.GetSize()
+		var snaps []storage.SnapInfo
+		if err == nil && countSnapshots {
+			snaps, err = image.ListSnapshots()
+		}
+		image.Close()
+		if err != nil {
+			return nil, err
+		}
+		usage.Volumes++
+		usage.Bytes += size
+		usage.Snapshots += len(snaps)
+	}
+	return usage, nil
+}
+
+/*
+pool属于租户时检查加上delta后是否超过租户的配额，超过时返回quotaError。
+通过检查的delta一直预留到调用返回的release，请求的任务结束后调用；
+任务运行期间新镜像与预留会重复计算，只会使检查偏严
+*/
+func reserveQuota(pool string, delta TenantUsage) (func(), error) {
+	t, err := repo.Tenants().GetByPool(pool)
+	if err == repository.ErrNotFound {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//没有相关的配额时不必统计用量
+	if !(delta.Volumes > 0 && t.MaxVolumes > 0 || delta.Bytes > 0 && t.MaxGB > 0 || delta.Snapshots > 0 && t.MaxSnapshots > 0) {
+		return func() {}, nil
+	}
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	usage, err := poolUsage(pool, t.MaxSnapshots > 0 && delta.Snapshots > 0)
+	if err != nil {
+		return nil, err
+	}
+	reserved := quotaReserved[pool]
+	if reserved == nil {
+		reserved = &TenantUsage{}
+	}
+
+	if delta.Volumes > 0 && t.MaxVolumes > 0 && usage.Volumes+reserved.Volumes+delta.Volumes > t.MaxVolumes {
+		return nil, &quotaError{tenant: t.Name, what: "volumes", limit: uint64(t.MaxVolumes)}
+	}
+	if delta.Bytes > 0 && t.MaxGB > 0 && usage.Bytes+reserved.Bytes+delta.Bytes > t.MaxGB<<30 {
+		return nil, &quotaError{tenant: t.Name, what: "GB", limit: t.MaxGB}
+	}
+	if delta.Snapshots > 0 && t.MaxSnapshots > 0 && usage.Snapshots+reserved.Snapshots+delta.Snapshots > t.MaxSnapshots {
+		return nil, &quotaError{tenant: t.Name, what: "snapshots", limit: uint64(t.MaxSnapshots)}
+	}
+
+	reserved.Volumes += delta.Volumes
+	reserved.Bytes += delta.Bytes
+	reserved.Snapshots += delta.Snapshots
+	quotaReserved[pool] = reserved
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			quotaMu.Lock()
+			defer quotaMu.Unlock()
+			reserved.Volumes -= delta.Volumes
+			reserved.Bytes -= delta.Bytes
+			reserved.Snapshots -= delta.Snapshots
+			if *reserved == (TenantUsage{}) && quotaReserved[pool] == reserved {
+				delete(quotaReserved, pool)
+			}
+		})
+	}, nil
+}
+
+//检查失败时发送错误，超出配额返回statusQuotaExceededErr和原因
+func checkQuota(w http.ResponseWriter, pool string, delta TenantUsage, errcode int) (func(), bool) {
+	release, err := reserveQuota(pool, delta)
+	if qerr, ok := err.(*quotaError); ok {
+		fmt.Fprintf(os.Stderr, "%v\n", qerr)
+		SendStatus(w, statusQuotaExceededErr, qerr.Error())
+		return nil, false
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Check quota of pool %v failed: %v\n", pool, err)
+		sendStorageError(w, err, errcode)
+		return nil, false
+	}
+	return release, true
+}
+
+//镜像或快照的大小，snapshot为空时为镜像本身
+func imageSize(pool string, name string, snapshot string) (uint64, error) {
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return 0, err
+	}
+
+	image, err := ioctx.OpenImage(name, snapshot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		return 0, err
+	}
+	defer image.Close()
+	return image.GetSize()
+}
+
+//租户名用于cephx用户名，只允许小写字母、数字和-_
+func validTenantName(name string) bool {
+	if name == "" || len(name) > maxTenantNameLen {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) < 0
+}
+
+func newAccessKeys() (string, string, error) {
+	b := make([]byte, accessKeyLen + secretKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	access := make([]byte, accessKeyLen)
+	for i := range access {
+		access[i] = accessKeyChars[int(b[i]) % len(accessKeyChars)]
+	}
+	return string(access), base64.RawURLEncoding.EncodeToString(b[accessKeyLen:]), nil
+}
+
+//未给出的参数沿用t中的值，0表示不限
+func parseTenantLimits(r *http.Request, t *repository.Tenant) error {
+	if value := r.FormValue("MaxVolumes"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return err
+		}
+		t.MaxVolumes = int(n)
+	}
+	if value := r.FormValue("MaxGB"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 34)
+		if err != nil {
+			return err
+		}
+		t.MaxGB = n
+	}
+	if value := r.FormValue("MaxSnapshots"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return err
+		}
+		t.MaxSnapshots = int(n)
+	}
+	return nil
+}
+
+type authEntity struct {
+	Entity string
+	Key    string
+}
+
+//auth get-or-create对已存在且权限相同的用户返回原有密钥，权限不同时失败
+func createCephUser(user string, pool string) (string, error) {
+	var entities []authEntity
+	cmd := mon.Command{
+		"prefix": "auth get-or-create",
+		"entity": user,
+		"caps": []string{"mon", "profile rbd", "osd", "profile rbd pool=" + pool},
+	}
+	if err := monCommand(cmd, &entities); err != nil {
+		return "", err
+	}
+	if len(entities) == 0 || entities[0].Key == "" {
+		return "", fmt.Errorf("No key of %v in auth get-or-create result", user)
+	}
+	return entities[0].Key, nil
+}
+
+func sendTenant(w http.ResponseWriter, info interface{}, errcode int) {
+	payload, err := json.Marshal(info)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, errcode, "")
+		return
+	}
+	SendResponse(w, http.StatusOK, string(payload))
+}
+
+/*
+创建租户：不存在的pool会被创建，创建cephx用户client.ebs.{TenantName}并只授予该pool的rbd权限。
+SecretKey只在创建时返回；租户用AccessKey和SecretKey签名请求，调用卷相关的接口。
+MaxVolumes、MaxGB和MaxSnapshots限制卷数、卷的总容量和快照数，0或不给出表示不限
+GET /?Action=CreateTenant&TenantName={name}&PoolName={PoolName}[&MaxVolumes={n}][&MaxGB={n}][&MaxSnapshots={n}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"Name":"acme","AccessKey":"...","SecretKey":"...","Pool":"acme","CephUser":"client.ebs.acme","MaxVolumes":10,"MaxGB":1024,"MaxSnapshots":100,"CreateTime":"..."}
+*/
+func CreateTenant(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("TenantName")
+	pool := r.FormValue("PoolName")
+	t := &repository.Tenant{Name: name, Pool: pool, CephUser: tenantUserPrefix + name}
+	err := parseTenantLimits(r, t)
+	if !validTenantName(name) || pool == "" || err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if _, err := repo.Tenants().Get(name); err != repository.ErrNotFound {
+		fmt.Fprintf(os.Stderr, "Load tenant %v: %v\n", name, err)
+		if err == nil {
+			SendStatus(w, statusTenantExistErr, "")
+		} else {
+			SendStatus(w, statusCreateTenantErr, "")
+		}
+		return
+	}
+	if owner, err := repo.Tenants().GetByPool(pool); err != repository.ErrNotFound {
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Pool %v is owned by tenant %v\n", pool, owner.Name)
+			SendStatus(w, statusTenantInUseErr, "")
+		} else {
+			fmt.Fprintf(os.Stderr, "Load tenant of pool %v failed: %v\n", pool, err)
+			SendStatus(w, statusCreateTenantErr, "")
+		}
+		return
+	}
+
+	conn, err := connectCluster()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
+		SendStatus(w, statusCreateTenantErr, "")
+		return
+	}
+	err = conn.LookupPool(pool)
+	if storage.IsNotFound(err) {
+		if err = conn.MakePool(pool); err == nil {
+			tagPool(mon.New(conn), pool)
+		}
+	}
+	conn.Shutdown()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Create pool %v failed: %v\n", pool, err)
+		SendStatus(w, statusCreateTenantErr, err.Error())
+		return
+	}
+
+	//失败时不删除cephx用户，再次请求时get-or-create返回同一个密钥
+	if t.CephKey, err = createCephUser(t.CephUser, pool); err != nil {
+		fmt.Fprintf(os.Stderr, "Create cephx user %v failed: %v\n", t.CephUser, err)
+		SendStatus(w, statusCreateTenantErr, err.Error())
+		return
+	}
+	if t.AccessKey, t.SecretKey, err = newAccessKeys(); err != nil {
+		fmt.Fprintf(os.Stderr, "Generate access key failed: %v\n", err)
+		SendStatus(w, statusCreateTenantErr, "")
+		return
+	}
+
+	if err := repo.Tenants().Create(t); err != nil {
+		fmt.Fprintf(os.Stderr, "Save tenant %v failed: %v\n", name, err)
+		if err == repository.ErrExist {
+			SendStatus(w, statusTenantExistErr, "")
+		} else {
+			SendStatus(w, statusCreateTenantErr, err.Error())
+		}
+		return
+	}
+
+	if err := addTenantBackend(t); err != nil {
+		fmt.Fprintf(os.Stderr, "Connect as %v for tenant %v failed: %v\n", t.CephUser, name, err)
+	}
+
+	info := tenantInfo(t)
+	info.SecretKey = t.SecretKey
+	sendTenant(w, info, statusCreateTenantErr)
+}
+
+/*
+删除租户和它的cephx用户，pool保留；租户还有EBS管理的卷时不能删除
+GET /?Action=DelTenant&TenantName={name} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+
+OK
+*/
+func DelTenant(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("TenantName")
+	if name == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	t, err := repo.Tenants().Get(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load tenant %v failed: %v\n", name, err)
+		sendStateError(w, err, statusDelTenantErr)
+		return
+	}
+
+	volumes, err := repo.Volumes().List(t.Pool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List volumes of %v failed: %v\n", t.Pool, err)
+		SendStatus(w, statusDelTenantErr, "")
+		return
+	}
+	if len(volumes) > 0 {
+		fmt.Fprintf(os.Stderr, "Tenant %v still has %v volumes\n", name, len(volumes))
+		SendStatus(w, statusTenantInUseErr, "")
+		return
+	}
+
+	//先删除记录，之后租户的凭据立即失效
+	if err := repo.Tenants().Delete(name); err != nil {
+		fmt.Fprintf(os.Stderr, "Delete tenant %v failed: %v\n", name, err)
+		sendStateError(w, err, statusDelTenantErr)
+		return
+	}
+	removeTenantBackend(t)
+
+	err = monCommand(mon.Command{"prefix": "auth del", "entity": t.CephUser}, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Delete cephx user %v failed: %v\n", t.CephUser, err)
+	}
+
+	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+/*
+查询租户的配额和当前用量；不给出TenantName时列出所有租户。租户只能查询自己
+GET /?Action=InfoTenant[&TenantName={name}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+[{"Name":"acme","AccessKey":"...","Pool":"acme","CephUser":"client.ebs.acme","MaxVolumes":10,"MaxGB":1024,"MaxSnapshots":100,
+"Usage":{"Volumes":2,"Bytes":21474836480,"Snapshots":3},"CreateTime":"..."}]
+*/
+func InfoTenant(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("TenantName")
+
+	var tenants []*repository.Tenant
+	if name == "" {
+		var err error
+		if tenants, err = repo.Tenants().List(); err != nil {
+			fmt.Fprintf(os.Stderr, "List tenants failed: %v\n", err)
+			SendStatus(w, statusInfoTenantErr, "")
+			return
+		}
+	} else {
+		t, err := repo.Tenants().Get(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Load tenant %v failed: %v\n", name, err)
+			sendStateError(w, err, statusInfoTenantErr)
+			return
+		}
+		tenants = append(tenants, t)
+	}
+
+	infos := []*TenantInfo{}
+	for _, t := range tenants {
+		info := tenantInfo(t)
+		usage, err := poolUsage(t.Pool, true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Get usage of tenant %v failed: %v\n", t.Name, err)
+			SendStatus(w, statusInfoTenantErr, "")
+			return
+		}
+		info.Usage = usage
+		infos = append(infos, info)
+	}
+	sendTenant(w, infos, statusInfoTenantErr)
+}
+
+/*
+修改租户的配额，未给出的参数保持不变，0表示不限；已超出新配额的用量不受影响，只限制之后的创建和扩容
+GET /?Action=ModifyTenantQuota&TenantName={name}[&MaxVolumes={n}][&MaxGB={n}][&MaxSnapshots={n}] HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"Name":"acme","AccessKey":"...","Pool":"acme","CephUser":"client.ebs.acme","MaxVolumes":20,"MaxGB":2048,"MaxSnapshots":100,"CreateTime":"..."}
+*/
+func ModifyTenantQuota(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("TenantName")
+	if name == "" {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	t, err := repo.Tenants().Get(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load tenant %v failed: %v\n", name, err)
+		sendStateError(w, err, statusModifyTenantErr)
+		return
+	}
+	if err := parseTenantLimits(r, t); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	if err := repo.Tenants().UpdateLimits(t); err != nil {
+		fmt.Fprintf(os.Stderr, "Save tenant %v failed: %v\n", name, err)
+		sendStateError(w, err, statusModifyTenantErr)
+		return
+	}
+	sendTenant(w, tenantInfo(t), statusModifyTenantErr)
+}
@@ -0,0 +1,176 @@
+package processor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"job"
+	"repository"
+)
+
+//pool rbd属于租户acme，结束时清除未释放的配额预留
+func setupTenant(t *testing.T, maxVolumes int, maxGB uint64, maxSnapshots int) *repository.Tenant {
+	t.Cleanup(func() {
+		quotaMu.Lock()
+		quotaReserved = make(map[string]*TenantUsage)
+		quotaMu.Unlock()
+	})
+	tenant := &repository.Tenant{Name: "acme", AccessKey: "ACMEKEY", SecretKey: "acme-secret", Pool: "rbd",
+		CephUser: tenantUserPrefix + "acme", MaxVolumes: maxVolumes, MaxGB: maxGB, MaxSnapshots: maxSnapshots}
+	if err := repo.Tenants().Create(tenant); err != nil {
+		t.Fatal(err)
+	}
+	return tenant
+}
+
+func TestReserveQuota(t *testing.T) {
+	cluster := setupDisk(t)
+	if err := cluster.MakePool("other"); err != nil {
+		t.Fatal(err)
+	}
+	setupTenant(t, 3, 1, 2)
+	pool, err := cluster.OpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//EBS未登记的镜像也计入用量
+	if err := pool.CreateImage("unmanaged", 256<<20, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var releases []func()
+	steps := []struct {
+		name  string
+		pool  string
+		delta TenantUsage
+		//超出的配额，为空时应通过
+		exceeds string
+	}{
+		{"volume", "rbd", TenantUsage{Volumes: 1, Bytes: 512 << 20}, ""},
+		{"reserved bytes counted", "rbd", TenantUsage{Volumes: 1, Bytes: 512 << 20}, "GB"},
+		{"up to the byte quota", "rbd", TenantUsage{Volumes: 1, Bytes: 256 << 20}, ""},
+		{"reserved volumes counted", "rbd", TenantUsage{Volumes: 1}, "volumes"},
+		{"snapshot", "rbd", TenantUsage{Snapshots: 2}, ""},
+		{"reserved snapshots counted", "rbd", TenantUsage{Snapshots: 1}, "snapshots"},
+		//不涉及的配额不检查
+		{"shrink", "rbd", TenantUsage{}, ""},
+		{"pool without tenant", "other", TenantUsage{Volumes: 100, Bytes: 1 << 50, Snapshots: 100}, ""},
+	}
+	for _, step := range steps {
+		release, err := reserveQuota(step.pool, step.delta)
+		if step.exceeds == "" {
+			if err != nil {
+				t.Errorf("%v: %v", step.name, err)
+			} else {
+				releases = append(releases, release)
+			}
+			continue
+		}
+		qerr, ok := err.(*quotaError)
+		if !ok || qerr.tenant != "acme" || qerr.what != step.exceeds {
+			t.Errorf("%v: %v, want exceeding %v", step.name, err, step.exceeds)
+		}
+	}
+
+	//释放后可以再次预留，重复释放不影响其他预留
+	releases[0]()
+	releases[0]()
+	if _, err := reserveQuota("rbd", TenantUsage{Volumes: 1, Bytes: 512 << 20}); err != nil {
+		t.Errorf("reserve after release: %v", err)
+	}
+	if _, err := reserveQuota("rbd", TenantUsage{Volumes: 1}); err == nil {
+		t.Error("second release freed another reservation")
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	setupDisk(t)
+	setupTenant(t, 1, 1, 1)
+	createTestDisk(t, "vol", 1<<20)
+
+	steps := []struct {
+		name    string
+		handler http.HandlerFunc
+		query   url.Values
+		message string
+	}{
+		{"volumes", CreateDisk, url.Values{"Action": {"CreateDisk"}, "VolumeName": {"vol2"}, "Size": {"1048576"}}, "quota of 1 volumes"},
+		{"extend", ExtendDisk, url.Values{"Action": {"ExtendDisk"}, "VolumeName": {"vol"}, "Size": {"2147483648"}}, "quota of 1 GB"},
+		{"snapshots", CreateSnapshot, url.Values{"Action": {"CreateSnapshot"}, "VolumeName": {"vol"}, "Snapshot": {"s2"}}, "quota of 1 snapshots"},
+	}
+	q := url.Values{"Action": {"CreateSnapshot"}, "PoolName": {"rbd"}, "VolumeName": {"vol"}, "Snapshot": {"s1"}}
+	if w := callHandler(CreateSnapshot, q); w.Code != http.StatusOK {
+		t.Fatalf("CreateSnapshot: %v %v", w.Code, w.Body)
+	}
+	for _, step := range steps {
+		step.query.Set("PoolName", "rbd")
+		w := callHandler(step.handler, step.query)
+		jobs.Wait()
+		if w.Code != http.StatusForbidden || w.Header().Get(LegacyCodeHeader) != strconv.Itoa(statusQuotaExceededErr) ||
+			!strings.Contains(w.Body.String(), step.message) {
+			t.Errorf("%v: status %v %v", step.name, w.Code, w.Body)
+		}
+	}
+	if volume, err := repo.Volumes().Get("rbd", "vol"); err != nil || volume.Size != 1<<20 {
+		t.Errorf("volume after refused extend %+v, %v", volume, err)
+	}
+
+	//放宽配额后不再拒绝
+	w := callHandler(ModifyTenantQuota, url.Values{"Action": {"ModifyTenantQuota"}, "TenantName": {"acme"}, "MaxGB": {"0"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("ModifyTenantQuota: %v %v", w.Code, w.Body)
+	}
+	if w := runHandlerJob(t, ExtendDisk, steps[1].query); w.State != job.StateSucceeded {
+		t.Errorf("extend after raising the quota: %+v", w)
+	}
+}
+
+func TestAuthorizeTenant(t *testing.T) {
+	tenant := &repository.Tenant{Name: "acme", Pool: "acme"}
+	tests := []struct {
+		name    string
+		tenant  *repository.Tenant
+		allowed bool
+		query   string
+		ok      bool
+		//通过时补全的参数
+		pool string
+	}{
+		{"admin", nil, false, "PoolName=other", true, "other"},
+		{"not allowed", tenant, false, "PoolName=acme", false, ""},
+		{"default pool", tenant, true, "VolumeName=vol", true, "acme"},
+		{"own pool", tenant, true, "PoolName=acme&DestPoolName=acme&DataPool=acme", true, "acme"},
+		{"other pool", tenant, true, "PoolName=other", false, ""},
+		{"other dest pool", tenant, true, "DestPoolName=other", false, ""},
+		{"other data pool", tenant, true, "DataPool=other", false, ""},
+		{"other tenant", tenant, true, "TenantName=evil", false, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		if tt.tenant != nil {
+			r = r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tt.tenant))
+		}
+		w := httptest.NewRecorder()
+		ok := AuthorizeTenant(w, r, tt.allowed)
+		if ok != tt.ok {
+			t.Errorf("%v: authorized %v", tt.name, ok)
+			continue
+		}
+		if !ok {
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%v: status %v", tt.name, w.Code)
+			}
+			continue
+		}
+		if got := r.FormValue("PoolName"); got != tt.pool {
+			t.Errorf("%v: PoolName %q", tt.name, got)
+		}
+		if tt.tenant != nil && r.FormValue("TenantName") != tt.tenant.Name {
+			t.Errorf("%v: TenantName %q", tt.name, r.FormValue("TenantName"))
+		}
+	}
+}
@@ -2,28 +2,34 @@ package processor
 
 import (
 	"net/http"
-	"librados/rados"
 	"fmt"
 	"os"
-	"librados/rbd"
+	"storage"
 	"strconv"
 	"encoding/json"
-	"os/exec"
 	"time"
-	"bytes"
-	"db"
-	"utils"
-	"image"
+	"repository"
+	"krbd"
+	"job"
 )
 
 const MaxProcessorNumber = 16
 
+//rbd map/unmap的超时时间
+var mapTimeout = 5 * time.Second
+
+func SetMapTimeout(timeout time.Duration) {
+	mapTimeout = timeout
+	devices.SetTimeout(timeout)
+}
+
 type Volume struct {
 	size       uint64
 	name       string
 	parentPool string
 	devPath    string
 	fullname   string
+	state      repository.VolumeState
 }
 
 func NewVolume(name string, pool string, size uint64) *Volume {
@@ -33,6 +39,7 @@ func NewVolume(name string, pool string, size uint64) *Volume {
 		parentPool: pool,
 		devPath: "",
 		fullname: "",
+		state: repository.StateCreating,
 	}
 }
 
@@ -40,25 +47,118 @@ func (volume *Volume) SetDevicePath(path string) {
 	volume.devPath = path
 }
 
+func (volume *Volume) resource() string {
+	return volume.parentPool + "/" + volume.name
+}
+
 func (volume *Volume) SetFullname(poolid int64, prefix string) {
-	volume.fullname = string(poolid) + "." + prefix
+	volume.fullname = strconv.FormatInt(poolid, 10) + "." + prefix
+}
+
+//从数据库加载已创建的卷
+func LoadVolume(name string, pool string) (*Volume, error) {
+	record, err := repo.Volumes().Get(pool, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Volume{
+		size: record.Size,
+		name: record.Name,
+		parentPool: record.Pool,
+		devPath: record.DevPath,
+		fullname: record.Fullname,
+		state: record.State,
+	}, nil
+}
+
+//上次退出时正在创建、删除、挂载、卸载或恢复的卷，操作已中断，标记为error
+//error状态的卷可以删除或重新恢复，必须在接收请求之前调用
+func RecoverVolumes() error {
+	volumes, err := repo.Volumes().List("")
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		if !v.State.Busy() {
+			continue
+		}
+		if err := repo.Volumes().Transition(v.Pool, v.Name, v.State, repository.StateError); err != nil {
+			return fmt.Errorf("volume %v/%v: %v", v.Pool, v.Name, err)
+		}
+		fmt.Fprintf(os.Stderr, "Volume %v/%v interrupted while %v, marked %v\n", v.Pool, v.Name, v.State, repository.StateError)
+	}
+	return nil
+}
+
+//镜像不由EBS管理、没有卷记录时返回nil
+func findVolume(name string, pool string) (*Volume, error) {
+	volume, err := LoadVolume(name, pool)
+	if err == repository.ErrNotFound {
+		return nil, nil
+	}
+	return volume, err
+}
+
+func (volume *Volume) record() *repository.Volume {
+	return &repository.Volume{
+		Pool: volume.parentPool,
+		Name: volume.name,
+		Size: volume.size,
+		DevPath: volume.devPath,
+		Fullname: volume.fullname,
+		State: volume.state,
+	}
+}
+
+//CreateDisk的镜像选项，未指定Features时只开启layering
+func parseImageOptions(r *http.Request) (*storage.ImageOptions, error) {
+	opts := &storage.ImageOptions{
+		Features: storage.FeatureLayering,
+		DataPool: r.FormValue("DataPool"),
+	}
+
+	var err error
+	if features := r.FormValue("Features"); features != "" {
+		if opts.Features, err = storage.ParseFeatures(features); err != nil {
+			return nil, err
+		}
+	}
+	if order := r.FormValue("Order"); order != "" {
+		if opts.Order, err = strconv.Atoi(order); err != nil {
+			return nil, err
+		}
+	}
+	if unit := r.FormValue("StripeUnit"); unit != "" {
+		if opts.StripeUnit, err = strconv.ParseUint(unit, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if count := r.FormValue("StripeCount"); count != "" {
+		if opts.StripeCount, err = strconv.ParseUint(count, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return opts, opts.Validate()
 }
 
-func (volume *Volume) Create() error {
+//opts为nil时只开启layering，对象大小等沿用默认值
+func (volume *Volume) Create(opts *storage.ImageOptions) error {
 	conn, ioctx, err := NewConnAndOpenPool(volume.parentPool)
 	defer DisConnAndClosePool(conn, ioctx)
 	if err != nil {
 		return GetError(statusCreateVolumeErr)
 	}
 
-	//TODO: 映象的feature设置
-	image, err := rbd.Create(ioctx, volume.name, volume.size,22, 1)
-	if err != nil {
+	if opts == nil {
+		opts = &storage.ImageOptions{Features: storage.FeatureLayering}
+	}
+	if err := ioctx.CreateImageWithOptions(volume.name, volume.size, opts); err != nil {
 		fmt.Fprintf(os.Stderr, "RBD create volume failed: %v\n", err)
 		return GetError(statusCreateVolumeErr)
 	}
 
-	if err := image.Open(); err != nil {
+	image, err := ioctx.OpenImage(volume.name, "")
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Open image failed: %v\n", err)
 		return GetError(statusCreateVolumeErr)
 	}
@@ -70,94 +170,204 @@ func (volume *Volume) Create() error {
 		return GetError(statusCreateVolumeErr)
 	}
 
-	volume.SetFullname(ioctx.GetPoolID(), info.Block_name_prefix)
+	volume.SetFullname(ioctx.ID(), info.Block_name_prefix)
+
+	return nil
+}
+
+//从受保护的快照克隆，大小与快照相同，feature沿用源镜像
+func (volume *Volume) Clone(srcPool string, srcName string, snapshot string) error {
+	conn, ioctx, err := NewConnAndOpenPool(srcPool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return GetError(statusCloneVolumeErr)
+	}
+
+	destIoctx, err := conn.OpenPool(volume.parentPool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", volume.parentPool, err)
+		return GetError(statusCloneVolumeErr)
+	}
+	defer destIoctx.Close()
+
+	src, err := ioctx.OpenImage(srcName, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Open image failed: %v\n", err)
+		return GetError(statusCloneVolumeErr)
+	}
+	defer src.Close()
+
+	features, err := src.GetFeatures()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get features failed: %v\n", err)
+		return GetError(statusCloneVolumeErr)
+	}
+
+	if err := src.Clone(snapshot, destIoctx, volume.name, features, 0); err != nil {
+		fmt.Fprintf(os.Stderr, "RBD clone %v/%v@%v failed: %v\n", srcPool, srcName, snapshot, err)
+		return GetError(statusCloneVolumeErr)
+	}
+
+	image, err := destIoctx.OpenImage(volume.name, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Open image failed: %v\n", err)
+		return GetError(statusCloneVolumeErr)
+	}
+	defer image.Close()
+
+	info, err := image.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Stat image failed:  %v\n", err)
+		return GetError(statusCloneVolumeErr)
+	}
 
+	volume.size = info.Size
+	volume.SetFullname(destIoctx.ID(), info.Block_name_prefix)
 	return nil
 }
 
-func (volume *Volume)Remove() error {
+func (volume *Volume)Remove(progress storage.ProgressFunc) error {
 	conn, ioctx, err := NewConnAndOpenPool(volume.parentPool)
 	defer DisConnAndClosePool(conn, ioctx)
 	if err != nil {
-		return GetError(statusCreateVolumeErr)
+		return GetError(statusDelVolumeErr)
 	}
 
-	img := rbd.GetImage(ioctx, volume.name)
-	return img.Remove()
+	return ioctx.RemoveImageWithProgress(volume.name, progress)
+}
+
+func (volume *Volume)Resize(size uint64, progress storage.ProgressFunc) error {
+	conn, ioctx, err := NewConnAndOpenPool(volume.parentPool)
+	defer DisConnAndClosePool(conn, ioctx)
+	if err != nil {
+		return GetError(statusResizeVolumeErr)
+	}
+
+	img, err := ioctx.OpenImage(volume.name, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Open image failed: %v\n", err)
+		return GetError(statusResizeVolumeErr)
+	}
+	defer img.Close()
+
+	if err := img.ResizeWithProgress(size, progress); err != nil {
+		fmt.Fprintf(os.Stderr, "RBD resize volume failed: %v\n", err)
+		return GetError(statusResizeVolumeErr)
+	}
+
+	volume.size = size
+	return nil
+}
+
+//通知内核重新读取已映射设备的大小
+func (volume *Volume)Refresh() error {
+	if volume.devPath == "" {
+		return nil
+	}
+
+	id, err := krbd.DeviceID(volume.devPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return GetError(statusMapVolumeErr)
+	}
+
+	if err := devices.Refresh(id); err != nil {
+		fmt.Fprintf(os.Stderr, "Refresh device %v failed: %v\n", volume.devPath, err)
+		return GetError(statusMapVolumeErr)
+	}
+	return nil
 }
 
-//rbd map iscsi -p rbd
-//TODO: 命令路径
+//通过/sys/bus/rbd映射到/dev/rbdN，已映射时直接返回原设备
 func (volume *Volume)Map() error {
-	cmd := exec.Command("/home/wu_chao/ceph-10.2.9/src/rbd", "map", volume.name, "-p", volume.parentPool)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-
-	c := make(chan bool, 1)
-	go func(ch chan bool, command *exec.Cmd) {
-		if err := command.Run(); err != nil {
-			fmt.Fprintf(os.Stderr, "Run volume map command failed: %v\n", err)
-			ch <- false
-		} else {
-			ch <- true
-		}
-	}(c, cmd)
-
-	select {
-		case result := <- c:
-			if result {
-				volume.SetDevicePath(string(stdout.Bytes()[:len(stdout.Bytes()) - 1]))
-				return nil
-			} else {
-				return GetError(statusUnmapVolumeErr)
-			}
-		case <-time.After(5 * time.Second):
-			fmt.Fprintf(os.Stderr, "Run volume map command timeout\n")
+	opts, err := mapOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get map options failed: %v\n", err)
+		return GetError(statusMapVolumeErr)
+	}
+
+	mapping, err := devices.Map(volume.parentPool, volume.name, "", opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Map volume %v failed: %v\n", volume.resource(), err)
+		if err == krbd.ErrTimeout {
 			return GetError(statusTimeoutErr)
+		}
+		return GetError(statusMapVolumeErr)
 	}
+
+	volume.SetDevicePath(mapping.Device)
+	return nil
 }
 
+//设备已不存在时视为解除成功
 func (volume *Volume)Unmap() error {
-	cmd := exec.Command("/home/wu_chao/ceph-10.2.9/src/rbd", "unmap", volume.name, "-p", volume.parentPool)
-	c := make(chan bool, 1)
-	go func (ch chan bool, command *exec.Cmd) {
-		if err := command.Run(); err != nil {
-			fmt.Fprintf(os.Stderr, "Run volume unmap command failed: %v\n", err)
-			ch <- false
-		} else {
-			ch <- true
-		}
-	}(c, cmd)
-
-	select {
-		case result := <- c:
-			if result {
-				return nil
-			} else {
-				return GetError(statusUnmapVolumeErr)
-			}
-		case <- time.After(5 * time.Second):
-			fmt.Fprintf(os.Stderr, "Run volume unmap command timeout\n")
+	err := devices.UnmapImage(volume.parentPool, volume.name, "", false)
+	if err != nil && err != krbd.ErrNotFound {
+		fmt.Fprintf(os.Stderr, "Unmap volume %v failed: %v\n", volume.resource(), err)
+		if err == krbd.ErrTimeout {
 			return GetError(statusTimeoutErr)
+		}
+		return GetError(statusUnmapVolumeErr)
 	}
+
+	volume.SetDevicePath("")
+	return nil
+}
+
+//创建前先登记为creating状态，占用卷名
+func (volume *Volume)Register() error {
+	volume.state = repository.StateCreating
+	return repo.Volumes().Create(volume.record())
+}
+
+func (volume *Volume)Unregister() error {
+	return repo.Volumes().Delete(volume.parentPool, volume.name)
 }
 
 func (volume *Volume)UpdateCreateResult() error {
-	t := utils.CurrentTime()
-	handle := db.GetDBHandler()
-	_, err := handle.Exec("INSERT INTO %s VALUES (%s, %s, %d, %s, %s, %s, %s)",
-			db.VolumesTab, volume.parentPool, volume.name, volume.size, volume.devPath, volume.fullname, t, t)
-	if err != nil {
+	if err := repo.Volumes().Update(volume.record()); err != nil {
 		return err
 	}
+	return volume.SetState(repository.StateAvailable)
+}
+
+//保存大小和设备路径
+func (volume *Volume)Save() error {
+	return repo.Volumes().Update(volume.record())
+}
+
+//状态转换由repository统一校验
+func (volume *Volume)SetState(state repository.VolumeState) error {
+	if err := repo.Volumes().Transition(volume.parentPool, volume.name, volume.state, state); err != nil {
+		return err
+	}
+	volume.state = state
 	return nil
 }
 
+func (volume *Volume)IsAttached() (bool, error) {
+	attachments, err := repo.Attachments().List(volume.parentPool, volume.name)
+	if err != nil {
+		return false, err
+	}
+	return len(attachments) > 0, nil
+}
+
+//export和allow只用于NBD
+func (volume *Volume)Attach(client string, transport string, export string, allow string) error {
+	return repo.Attachments().Add(&repository.Attachment{Pool: volume.parentPool, Volume: volume.name, Client: client,
+		Transport: transport, Export: export, Allow: allow})
+}
+
+func (volume *Volume)Detach(client string) error {
+	return repo.Attachments().Remove(volume.parentPool, volume.name, client)
+}
+
 /*
 GET /?Action=InfoVolume&PoolName={PoolName|*} HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
 HTTP /1.1 200 OK
 Server: dhcc.ebs
@@ -175,25 +385,13 @@ func InfoVolumes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := rados.NewConn()
+	conn, err := connectCluster()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusInfoVolumesErr, "")
-		return
-	}
-	defer conn.Shutdown()
-
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusInfoVolumesErr, "")
-		return
-	}
-
-	if err := conn.Connect(); err != nil {
 		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
 		SendStatus(w, statusInfoVolumesErr, "")
 		return
 	}
+	defer conn.Shutdown()
 
 	var pools []string
 	if pool == "*" {
@@ -205,33 +403,33 @@ func InfoVolumes(w http.ResponseWriter, r *http.Request) {
 	} else {
 		if err := conn.LookupPool(pool); err != nil {
 			fmt.Fprintf(os.Stderr, "LookupPool failed, pool name:%v, %v\n", pool, err)
-			SendStatus(w, statusNotFoundErr, "")
+			SendNotFound(w, "Pool")
 			return
 		}
 		pools = append(pools, pool)
 	}
 
-	imageInfo := make(map[string][]map[string]rbd.ImageInfo)
+	imageInfo := make(map[string][]map[string]storage.ImageInfo)
 	for i := 0; i < len(pools); i++ {
-		ioctx, err := conn.OpenIOContext(pools[i])
+		ioctx, err := conn.OpenPool(pools[i])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", pool, err)
 			SendStatus(w, statusInfoVolumesErr, "")
 			return
 		}
-		defer ioctx.Destroy()
+		defer ioctx.Close()
 
-		images, err := rbd.GetImageNames(ioctx)
+		images, err := ioctx.ListImages()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "GetImageNames failed: %v\n", err)
 			SendStatus(w, statusInfoVolumesErr, "")
 			return
 		}
 
-		var imageList []map[string]rbd.ImageInfo
+		var imageList []map[string]storage.ImageInfo
 		for j := 0; j < len(images); j++ {
-			image := rbd.GetImage(ioctx, images[j])
-			if err := image.Open(); err != nil {
+			image, err := ioctx.OpenImage(images[j], "")
+			if err != nil {
 				fmt.Fprintf(os.Stderr, "Open failed, image name:%v/%v, %v\n", pool, images[j], err)
 				SendStatus(w, statusInfoVolumesErr, "")
 				return
@@ -244,7 +442,7 @@ func InfoVolumes(w http.ResponseWriter, r *http.Request) {
 				SendStatus(w, statusInfoVolumesErr, "")
 				return
 			}
-			infoPair := make(map[string]rbd.ImageInfo);infoPair[images[j]] = *info
+			infoPair := make(map[string]storage.ImageInfo);infoPair[images[j]] = *info
 			imageList = append(imageList, infoPair)
 		}
 		imageInfo[pools[i]] = imageList
@@ -265,13 +463,14 @@ func InfoVolumes(w http.ResponseWriter, r *http.Request) {
 GET /?Action=DelVolume&PoolName={PoolName}&VolumeName={volumeName} HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
-HTTP /1.1 200 OK
+HTTP /1.1 202 Accepted
 Server: dhcc.ebs
 Date: GMT Date
+Content-Type: application/json
 
-OK
+{"JobId":"job-..."}
 */
 func DelVolume(w http.ResponseWriter, r *http.Request) {
 	pool := r.FormValue("PoolName")
@@ -282,55 +481,64 @@ func DelVolume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := rados.NewConn()
+	//EBS管理的卷须通过DelDisk删除，以便同时解除映射和删除记录
+	managed, err := findVolume(volume, pool)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusDelVolumeErr, "")
-		return
-	}
-	defer conn.Shutdown()
-
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", pool, volume, err)
 		SendStatus(w, statusDelVolumeErr, "")
 		return
 	}
-
-	if err := conn.Connect(); err != nil {
-		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
-		SendStatus(w, statusDelVolumeErr, "")
+	if managed != nil {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v is managed, state %v\n", pool, volume, managed.state)
+		if managed.state == repository.StateInUse {
+			SendStatus(w, statusVolumeAttachedErr, "")
+		} else {
+			SendStatus(w, statusInvalidStateErr, "Volume is managed by EBS, use DelDisk")
+		}
 		return
 	}
 
-	ioctx, err := conn.OpenIOContext(pool)
+	//有快照的镜像不能删除，先删除快照
+	snaps, err := listSnapshots(pool, volume)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", pool, err)
-		SendStatus(w, statusDelVolumeErr, "")
+		fmt.Fprintf(os.Stderr, "List snapshots of %v/%v failed: %v\n", pool, volume, err)
+		sendStorageError(w, err, statusDelVolumeErr)
 		return
 	}
-	defer ioctx.Destroy()
-
-	image := rbd.GetImage(ioctx, volume)
-	if err := image.Remove(); err != nil {
-		fmt.Fprintf(os.Stderr, "Remove failed %v\n", err)
-		SendStatus(w, statusDelVolumeErr, err.Error())
+	if len(snaps) > 0 {
+		fmt.Fprintf(os.Stderr, "Volume %v/%v has %v snapshots\n", pool, volume, len(snaps))
+		SendStatus(w, statusResourceBusyErr, "Volume has snapshots")
 		return
 	}
 
-	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+	submitJob(w, "DelVolume", pool + "/" + volume, statusDelVolumeErr, func(p *job.Progress) error {
+		conn, ioctx, err := NewConnAndOpenPool(pool)
+		defer DisConnAndClosePool(conn, ioctx)
+		if err != nil {
+			return err
+		}
+
+		if err := ioctx.RemoveImageWithProgress(volume, p.Update); err != nil {
+			fmt.Fprintf(os.Stderr, "Remove failed %v\n", err)
+			return err
+		}
+		return nil
+	})
 }
 
 /*
+已挂载的卷只能扩容，通过NBD挂载的卷不能改变大小，返回409 VolumeAttached
 GET /?Action=ResizeVolume&PoolName={PoolName}&VolumeName={volumeName}&Size={newSize} HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
-HTTP /1.1 200 OK
+HTTP /1.1 202 Accepted
 Server: dhcc.ebs
 Date: GMT Date
+Content-Type: application/json
 
-OK
+{"JobId":"job-..."}
 */
 func ResizeVolume(w http.ResponseWriter, r *http.Request) {
 	pool := r.FormValue("PoolName")
@@ -349,145 +557,248 @@ func ResizeVolume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := rados.NewConn()
+	//EBS管理的卷同时刷新映射的设备和记录，已挂载的卷不能缩容
+	managed, err := findVolume(volume, pool)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusResizeVolumeErr, "")
-		return
-	}
-	defer conn.Shutdown()
-
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Load volume %v/%v error: %v\n", pool, volume, err)
 		SendStatus(w, statusResizeVolumeErr, "")
 		return
 	}
+	if managed != nil {
+		if managed.state != repository.StateAvailable && managed.state != repository.StateInUse {
+			fmt.Fprintf(os.Stderr, "Volume %v/%v is %v\n", pool, volume, managed.state)
+			SendStatus(w, statusInvalidStateErr, "")
+			return
+		}
+		if managed.state == repository.StateInUse && newSize < managed.size {
+			fmt.Fprintf(os.Stderr, "Volume %v/%v is attached, can not shrink to %v\n", pool, volume, newSize)
+			SendStatus(w, statusVolumeAttachedErr, "")
+			return
+		}
+		if !checkNBDResize(w, managed, statusResizeVolumeErr) {
+			return
+		}
 
-	if err := conn.Connect(); err != nil {
-		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
-		SendStatus(w, statusResizeVolumeErr, "")
+		release, ok := checkResizeQuota(w, pool, managed.size, newSize)
+		if !ok {
+			return
+		}
+		err := submitJob(w, "ResizeVolume", managed.resource(), statusResizeVolumeErr, func(p *job.Progress) error {
+			defer release()
+			return resizeDisk(managed, newSize, p)
+		})
+		if err != nil {
+			release()
+		}
 		return
 	}
 
-	ioctx, err := conn.OpenIOContext(pool)
+	oldSize, err := imageSize(pool, volume, "")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", pool, err)
-		SendStatus(w, statusResizeVolumeErr, err.Error())
+		sendStorageError(w, err, statusResizeVolumeErr)
 		return
 	}
-	defer ioctx.Destroy()
-
-	image := rbd.GetImage(ioctx, volume)
-	if err := image.Open(); err != nil {
-		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
-		SendStatus(w, statusResizeVolumeErr, err.Error())
+	release, ok := checkResizeQuota(w, pool, oldSize, newSize)
+	if !ok {
 		return
 	}
-	defer image.Close()
+	err = submitJob(w, "ResizeVolume", pool + "/" + volume, statusResizeVolumeErr, func(p *job.Progress) error {
+		defer release()
+		conn, ioctx, err := NewConnAndOpenPool(pool)
+		defer DisConnAndClosePool(conn, ioctx)
+		if err != nil {
+			return err
+		}
 
-	if err := image.Resize(newSize); err != nil {
-		fmt.Fprintf(os.Stderr, "Resize failed: %v\n", err)
-		SendStatus(w, statusResizeVolumeErr, "")
-		return
+		image, err := ioctx.OpenImage(volume, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+			return err
+		}
+		defer image.Close()
+
+		if err := image.ResizeWithProgress(newSize, p.Update); err != nil {
+			fmt.Fprintf(os.Stderr, "Resize failed: %v\n", err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		release()
 	}
+}
 
-	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+//只有扩容需要检查配额
+func checkResizeQuota(w http.ResponseWriter, pool string, oldSize uint64, newSize uint64) (func(), bool) {
+	if newSize <= oldSize {
+		return func() {}, true
+	}
+	return checkQuota(w, pool, TenantUsage{Bytes: newSize - oldSize}, statusResizeVolumeErr)
 }
 
 /*
-GET /?Action=ExportVolume&PoolName={PoolName}&VolumeName={volumeName}&OSSBucket={bucket} HTTP/1.1
+GET /?Action=CopyVolume&PoolName={PoolName}&VolumeName={volumeName}&DestPoolName={destPool}&DestVolumeName={destVolume} HTTP/1.1
 Host: xxx.xxx.xxx.xxx
 Date: GMT Date
-Authorization: (optional)TODO
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
 --------------------------
-HTTP /1.1 200 OK
+HTTP /1.1 202 Accepted
 Server: dhcc.ebs
 Date: GMT Date
+Content-Type: application/json
 
-OK
+{"JobId":"job-..."}
 */
-func ExportVolume(w http.ResponseWriter, r *http.Request) {
-	/*
+func CopyVolume(w http.ResponseWriter, r *http.Request) {
 	pool := r.FormValue("PoolName")
 	volume := r.FormValue("VolumeName")
-	bucket := r.FormValue("OSSBucket")
-	if pool == "" || volume == "" || bucket == "" {
+	destPool := r.FormValue("DestPoolName")
+	destVolume := r.FormValue("DestVolumeName")
+	if pool == "" || volume == "" || destVolume == "" {
 		fmt.Fprintf(os.Stderr, "Invalid Request: %v\n", r.RequestURI)
 		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
 	}
+	if destPool == "" {
+		destPool = pool
+	}
 
-	//TODO bucket合法性检查
-
-	conn, err := rados.NewConn()
+	size, err := imageSize(pool, volume, "")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewConn failed: %v\n", err)
-		SendStatus(w, statusExportVolumeErr, "")
+		sendStorageError(w, err, statusCopyVolumeErr)
 		return
 	}
-	defer conn.Shutdown()
-
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(os.Stderr, "ReadDefaultConfigFile failed: %v\n", err)
-		SendStatus(w, statusExportVolumeErr, "")
+	release, ok := checkQuota(w, destPool, TenantUsage{Volumes: 1, Bytes: size}, statusCopyVolumeErr)
+	if !ok {
 		return
 	}
 
-	if err := conn.Connect(); err != nil {
-		fmt.Fprintf(os.Stderr, "Connect failed: %v\n", err)
-		SendStatus(w, statusExportVolumeErr, "")
-		return
-	}
+	err = submitJob(w, "CopyVolume", destPool + "/" + destVolume, statusCopyVolumeErr, func(p *job.Progress) error {
+		defer release()
+		conn, ioctx, err := NewConnAndOpenPool(pool)
+		defer DisConnAndClosePool(conn, ioctx)
+		if err != nil {
+			return err
+		}
 
-	ioctx, err := conn.OpenIOContext(pool)
+		destIoctx, err := conn.OpenPool(destPool)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", destPool, err)
+			return err
+		}
+		defer destIoctx.Close()
+
+		image, err := ioctx.OpenImage(volume, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+			return err
+		}
+		defer image.Close()
+
+		if err := image.Copy(destIoctx, destVolume, p.Update); err != nil {
+			fmt.Fprintf(os.Stderr, "Copy %v/%v to %v/%v failed: %v\n", pool, volume, destPool, destVolume, err)
+			return err
+		}
+		return nil
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "OpenIOContext failed, pool name:%v, %v\n", pool, err)
-		SendStatus(w, statusExportVolumeErr, err.Error())
+		release()
+	}
+}
+
+type VolumeFeatures struct {
+	Features []string
+}
+
+/*
+开启或关闭镜像的feature，只能修改exclusive-lock、object-map、fast-diff、journaling，deep-flatten只能关闭；
+object-map依赖exclusive-lock，fast-diff依赖object-map，journaling依赖exclusive-lock。
+已挂载的卷不能修改
+GET /?Action=UpdateVolumeFeatures&PoolName={PoolName}&VolumeName={volumeName}&Features={features}&Enabled={true|false} HTTP/1.1
+Host: xxx.xxx.xxx.xxx
+Date: GMT Date
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+--------------------------
+HTTP /1.1 200 OK
+Server: dhcc.ebs
+Date: GMT Date
+Content-Type: application/json
+
+{"Features":["exclusive-lock","layering","object-map"]}
+*/
+func UpdateVolumeFeatures(w http.ResponseWriter, r *http.Request) {
+	pool := r.FormValue("PoolName")
+	volume := r.FormValue("VolumeName")
+	features, err := storage.ParseFeatures(r.FormValue("Features"))
+	if err == nil && features == 0 {
+		err = fmt.Errorf("No feature given")
+	}
+	var enabled bool
+	if err == nil {
+		enabled, err = strconv.ParseBool(r.FormValue("Enabled"))
+	}
+	allowed := storage.FeaturesMutable
+	if !enabled {
+		allowed |= storage.FeaturesDisableOnly
+	}
+	if err == nil && features&^allowed != 0 {
+		err = fmt.Errorf("Features %v can not be changed", storage.FeatureList(features&^allowed))
+	}
+	if pool == "" || volume == "" || err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", r.RequestURI, err)
+		SendStatus(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
 	}
-	defer ioctx.Destroy()
 
-	image := rbd.GetImage(ioctx, volume)
-	if err := image.Open(); err != nil {
-		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
-		SendStatus(w, statusExportVolumeErr, err.Error())
+	if _, ok := checkVolumeIdle(w, pool, volume, statusUpdateFeaturesErr, false); !ok {
 		return
 	}
-	defer image.Close()
 
-	info, err := image.Stat()
+	conn, ioctx, err := NewConnAndOpenPool(pool)
+	defer DisConnAndClosePool(conn, ioctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "image Stat failed: %v\n", err)
-		SendStatus(w, statusExportVolumeErr, err.Error())
+		sendStorageError(w, err, statusUpdateFeaturesErr)
 		return
 	}
 
-	//TODO 暂时导出到文件系统中
-	fp, err := os.OpenFile(bucket, os.O_RDONLY | os.O_CREATE | os.O_EXCL, 0644)
+	image, err := ioctx.OpenImage(volume, "")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "OpenFile bucket %v failed: %v\n", bucket, err)
-		SendStatus(w, statusExportVolumeErr, err.Error())
+		fmt.Fprintf(os.Stderr, "image Open failed: %v\n", err)
+		sendStorageError(w, err, statusUpdateFeaturesErr)
 		return
 	}
+	defer image.Close()
 
-	period, err := image.GetStripePeriod()
+	current, err := image.GetFeatures()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "GetStripePeriod failed: %v\n", err)
-		SendStatus(w, statusExportVolumeErr, err.Error())
+		fmt.Fprintf(os.Stderr, "Get features of %v/%v failed: %v\n", pool, volume, err)
+		SendStatus(w, statusUpdateFeaturesErr, "")
+		return
+	}
+	updated := current | features
+	if !enabled {
+		updated = current &^ features
+	}
+	//依赖关系在librbd中返回EINVAL，先检查以给出原因
+	if err := storage.CheckFeatures(updated); err != nil {
+		fmt.Fprintf(os.Stderr, "Update features of %v/%v refused: %v\n", pool, volume, err)
+		SendStatus(w, statusUpdateFeaturesErr, err.Error())
 		return
 	}
 
-	fmt.Fprintf(os.Stderr, "GetStripePeriod: %v\n", period)
+	if updated != current {
+		if err := image.UpdateFeatures(features&(current^updated), enabled); err != nil {
+			fmt.Fprintf(os.Stderr, "Update features of %v/%v failed: %v\n", pool, volume, err)
+			SendStatus(w, statusUpdateFeaturesErr, "")
+			return
+		}
+	}
 
-	ch := make(chan int, MaxProcessorNumber)
-	wg := &sync.WaitGroup{}
-	for offset := uint64(0); offset < info.Size; offset += period {
-		length := uint64(math.Min(float64(period), float64(info.Size - offset)))
-		ch <- 1
-		wg.Add(1)
-		go doRead(fp, offset, length)
+	payload, err := json.Marshal(&VolumeFeatures{Features: storage.FeatureList(updated)})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encode payload failed: %v\n", err)
+		SendStatus(w, statusUpdateFeaturesErr, "")
+		return
 	}
-	wg.Wait()
-*/
-	SendResponse(w, http.StatusOK, http.StatusText(http.StatusOK))
+	SendResponse(w, http.StatusOK, string(payload))
 }
@@ -0,0 +1,64 @@
+package processor
+
+import (
+	"repository"
+	"testing"
+)
+
+//从creating经过path到达各状态
+var statePaths = map[repository.VolumeState][]repository.VolumeState{
+	repository.StateCreating:  nil,
+	repository.StateAvailable: {repository.StateAvailable},
+	repository.StateAttaching: {repository.StateAvailable, repository.StateAttaching},
+	repository.StateInUse:     {repository.StateAvailable, repository.StateAttaching, repository.StateInUse},
+	repository.StateDetaching: {repository.StateAvailable, repository.StateAttaching, repository.StateInUse, repository.StateDetaching},
+	repository.StateDeleting:  {repository.StateAvailable, repository.StateDeleting},
+	repository.StateRestoring: {repository.StateAvailable, repository.StateRestoring},
+	repository.StateError:     {repository.StateError},
+}
+
+func TestRecoverVolumes(t *testing.T) {
+	tests := []struct {
+		state repository.VolumeState
+		want  repository.VolumeState
+	}{
+		{repository.StateCreating, repository.StateError},
+		{repository.StateAvailable, repository.StateAvailable},
+		{repository.StateAttaching, repository.StateError},
+		{repository.StateInUse, repository.StateInUse},
+		{repository.StateDetaching, repository.StateError},
+		{repository.StateDeleting, repository.StateError},
+		{repository.StateRestoring, repository.StateError},
+		{repository.StateError, repository.StateError},
+	}
+
+	store := repository.NewMemoryStore()
+	SetRepository(store)
+	defer SetRepository(nil)
+	for _, tt := range tests {
+		name := string(tt.state)
+		if err := store.Volumes().Create(&repository.Volume{Pool: "rbd", Name: name, Size: 1 << 30, State: repository.StateCreating}); err != nil {
+			t.Fatalf("Create %v: %v", name, err)
+		}
+		from := repository.StateCreating
+		for _, to := range statePaths[tt.state] {
+			if err := store.Volumes().Transition("rbd", name, from, to); err != nil {
+				t.Fatalf("Transition %v: %v", name, err)
+			}
+			from = to
+		}
+	}
+
+	if err := RecoverVolumes(); err != nil {
+		t.Fatalf("RecoverVolumes: %v", err)
+	}
+	for _, tt := range tests {
+		v, err := store.Volumes().Get("rbd", string(tt.state))
+		if err != nil {
+			t.Fatalf("Get %v: %v", tt.state, err)
+		}
+		if v.State != tt.want {
+			t.Errorf("volume %v recovered to %v, want %v", tt.state, v.State, tt.want)
+		}
+	}
+}
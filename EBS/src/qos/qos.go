@@ -0,0 +1,164 @@
+// Package qos throttles the I/O that EBS serves itself, over NBD and in
+// export, backup and restore streams, with token buckets.
+package qos
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits are the I/O limits of a volume. A zero limit is unlimited. Burst
+// is how many seconds of each limit a volume can save up while idle and
+// spend at once; 0 is taken as 1.
+type Limits struct {
+	ReadIOPS  uint64
+	WriteIOPS uint64
+	ReadBps   uint64
+	WriteBps  uint64
+	Burst     uint64
+}
+
+// Unlimited reports whether no limit is set.
+func (l Limits) Unlimited() bool {
+	return l.ReadIOPS == 0 && l.WriteIOPS == 0 && l.ReadBps == 0 && l.WriteBps == 0
+}
+
+func (l Limits) burst() uint64 {
+	if l.Burst == 0 {
+		return 1
+	}
+	return l.Burst
+}
+
+// Capacity returns the size of the bucket of limit, the most that can be
+// spent at once after an idle period.
+func (l Limits) Capacity(limit uint64) uint64 {
+	return limit * l.burst()
+}
+
+// Bucket is a token bucket refilled at rate tokens a second up to
+// capacity. A reservation larger than the tokens left takes the bucket
+// below zero and the caller waits until the debt is refilled, so large
+// requests are delayed rather than refused. A zero rate is unlimited.
+type Bucket struct {
+	mu       sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+}
+
+func NewBucket(rate uint64, capacity uint64) *Bucket {
+	b := &Bucket{now: time.Now}
+	b.SetRate(rate, capacity)
+	return b
+}
+
+// SetRate changes the rate and capacity. The bucket starts full after
+// it was unlimited and keeps its tokens, up to the new capacity,
+// otherwise.
+func (b *Bucket) SetRate(rate uint64, capacity uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if capacity < rate {
+		capacity = rate
+	}
+	b.refill()
+	if b.rate == 0 {
+		b.tokens = float64(capacity)
+	}
+	b.rate, b.capacity = float64(rate), float64(capacity)
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+func (b *Bucket) refill() {
+	now := b.now()
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+	b.last = now
+}
+
+// Reserve takes n tokens and returns how long the caller must wait
+// before using them.
+func (b *Bucket) Reserve(n uint64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limiter throttles the reads and writes of one volume. It is shared by
+// everything serving that volume, so the limits hold for their sum.
+type Limiter struct {
+	mu        sync.Mutex
+	limits    Limits
+	readIOPS  *Bucket
+	writeIOPS *Bucket
+	readBps   *Bucket
+	writeBps  *Bucket
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{
+		readIOPS:  NewBucket(0, 0),
+		writeIOPS: NewBucket(0, 0),
+		readBps:   NewBucket(0, 0),
+		writeBps:  NewBucket(0, 0),
+	}
+	l.SetLimits(limits)
+	return l
+}
+
+// SetLimits changes the limits, taking effect with the next request.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits = limits
+	l.readIOPS.SetRate(limits.ReadIOPS, limits.Capacity(limits.ReadIOPS))
+	l.writeIOPS.SetRate(limits.WriteIOPS, limits.Capacity(limits.WriteIOPS))
+	l.readBps.SetRate(limits.ReadBps, limits.Capacity(limits.ReadBps))
+	l.writeBps.SetRate(limits.WriteBps, limits.Capacity(limits.WriteBps))
+}
+
+func (l *Limiter) Limits() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits
+}
+
+// Read waits until a read of n bytes is allowed.
+func (l *Limiter) Read(n uint64) {
+	wait(l.readIOPS.Reserve(1), l.readBps.Reserve(n))
+}
+
+// Write waits until a write of n bytes is allowed. Discards count as
+// writes of no bytes.
+func (l *Limiter) Write(n uint64) {
+	wait(l.writeIOPS.Reserve(1), l.writeBps.Reserve(n))
+}
+
+func wait(ops time.Duration, bytes time.Duration) {
+	if bytes > ops {
+		ops = bytes
+	}
+	if ops > 0 {
+		time.Sleep(ops)
+	}
+}
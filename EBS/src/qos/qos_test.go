@@ -0,0 +1,161 @@
+package qos
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a fake time source advanced by the tests.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestBucket(rate uint64, capacity uint64) (*Bucket, *clock) {
+	c := &clock{t: time.Unix(1500000000, 0)}
+	b := &Bucket{now: c.now}
+	b.SetRate(rate, capacity)
+	return b, c
+}
+
+func TestBucketRate(t *testing.T) {
+	b, c := newTestBucket(100, 200)
+
+	// A full bucket serves its capacity at once.
+	for i := 0; i < 200; i++ {
+		if d := b.Reserve(1); d != 0 {
+			t.Fatalf("reservation %v waits %v", i, d)
+		}
+	}
+	// Beyond it the wait is the debt divided by the rate.
+	if d := b.Reserve(1); d != 10*time.Millisecond {
+		t.Errorf("wait %v when empty", d)
+	}
+	if d := b.Reserve(49); d != 500*time.Millisecond {
+		t.Errorf("wait %v with a debt of 50", d)
+	}
+
+	// Half a second refills the debt.
+	c.advance(500 * time.Millisecond)
+	if d := b.Reserve(0); d != 0 {
+		t.Errorf("wait %v after the debt was refilled", d)
+	}
+	c.advance(time.Second)
+	if d := b.Reserve(100); d != 0 {
+		t.Errorf("wait %v for the tokens of a second", d)
+	}
+	if d := b.Reserve(1); d != 10*time.Millisecond {
+		t.Errorf("wait %v after spending the refill", d)
+	}
+
+	// An idle bucket fills up to its capacity only.
+	c.advance(time.Hour)
+	if d := b.Reserve(201); d != 10*time.Millisecond {
+		t.Errorf("wait %v for more than the capacity", d)
+	}
+
+	// Served over a long time a bucket gives its rate.
+	b, c = newTestBucket(1000, 1000)
+	b.Reserve(1000)
+	var waited time.Duration
+	for i := 0; i < 5000; i++ {
+		d := b.Reserve(1)
+		c.advance(d)
+		waited += d
+	}
+	if waited < 4999*time.Millisecond || waited > 5001*time.Millisecond {
+		t.Errorf("5000 tokens at 1000/s took %v", waited)
+	}
+}
+
+func TestBucketSetRate(t *testing.T) {
+	b, c := newTestBucket(0, 0)
+	if d := b.Reserve(1 << 40); d != 0 {
+		t.Errorf("unlimited bucket waits %v", d)
+	}
+
+	// Limiting an unlimited bucket starts full, the capacity is at least
+	// the rate.
+	b.SetRate(10, 5)
+	if d := b.Reserve(10); d != 0 {
+		t.Errorf("wait %v after limiting", d)
+	}
+	if d := b.Reserve(1); d != 100*time.Millisecond {
+		t.Errorf("wait %v when empty", d)
+	}
+
+	// Changing the rate keeps the tokens, up to the new capacity.
+	c.advance(time.Second)
+	b.SetRate(100, 100)
+	if d := b.Reserve(10); d != 10*time.Millisecond {
+		t.Errorf("wait %v after raising the rate", d)
+	}
+	c.advance(time.Second)
+	b.SetRate(10, 20)
+	if d := b.Reserve(21); d != 100*time.Millisecond {
+		t.Errorf("wait %v after lowering the capacity", d)
+	}
+
+	b.SetRate(0, 0)
+	if d := b.Reserve(1 << 40); d != 0 {
+		t.Errorf("wait %v after removing the limit", d)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		limits    Limits
+		unlimited bool
+		capacity  uint64
+	}{
+		{Limits{}, true, 0},
+		{Limits{Burst: 3}, true, 0},
+		{Limits{ReadIOPS: 100}, false, 100},
+		{Limits{ReadIOPS: 100, Burst: 1}, false, 100},
+		{Limits{ReadIOPS: 100, Burst: 3}, false, 300},
+		{Limits{WriteBps: 1}, false, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.limits.Unlimited(); got != tt.unlimited {
+			t.Errorf("%+v: Unlimited() = %v", tt.limits, got)
+		}
+		if got := tt.limits.Capacity(tt.limits.ReadIOPS); got != tt.capacity {
+			t.Errorf("%+v: Capacity = %v, want %v", tt.limits, got, tt.capacity)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(Limits{})
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		l.Read(1 << 20)
+		l.Write(1 << 20)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("unlimited I/O took %v", d)
+	}
+
+	// The write limit does not slow down reads, and the slower of the
+	// IOPS and bandwidth limits applies.
+	l.SetLimits(Limits{WriteIOPS: 1000, WriteBps: 20})
+	if got := l.Limits(); got.WriteIOPS != 1000 || got.WriteBps != 20 {
+		t.Errorf("limits %+v", got)
+	}
+	for i := 0; i < 1000; i++ {
+		l.Read(1 << 20)
+	}
+	l.Write(20)
+	start = time.Now()
+	l.Write(2)
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("write over the bandwidth limit waited %v", d)
+	}
+}
@@ -0,0 +1,847 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"utils"
+)
+
+// MemoryStore keeps the repositories in process memory. Records are copied
+// in and out, so callers never share them.
+type MemoryStore struct {
+	mu            sync.Mutex
+	volumes       map[string]Volume
+	attachments   map[string]Attachment
+	targets       map[string]Target
+	backups       map[string]Backup
+	restores      map[string]Restore
+	qos           map[string]VolumeQoS
+	tags          map[string]VolumeTag
+	tenants       map[string]Tenant
+	policies      map[string]SnapshotPolicy
+	policyTargets map[string]PolicyTarget
+	runs          map[string]SnapshotRun
+	leases        map[string]memoryLease
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		volumes:       make(map[string]Volume),
+		attachments:   make(map[string]Attachment),
+		targets:       make(map[string]Target),
+		backups:       make(map[string]Backup),
+		restores:      make(map[string]Restore),
+		qos:           make(map[string]VolumeQoS),
+		tags:          make(map[string]VolumeTag),
+		tenants:       make(map[string]Tenant),
+		policies:      make(map[string]SnapshotPolicy),
+		policyTargets: make(map[string]PolicyTarget),
+		runs:          make(map[string]SnapshotRun),
+		leases:        make(map[string]memoryLease),
+	}
+}
+
+func (s *MemoryStore) Volumes() VolumeRepository {
+	return &memoryVolumes{s}
+}
+
+func (s *MemoryStore) Attachments() AttachmentRepository {
+	return &memoryAttachments{s}
+}
+
+func (s *MemoryStore) Targets() TargetRepository {
+	return &memoryTargets{s}
+}
+
+func (s *MemoryStore) Backups() BackupRepository {
+	return &memoryBackups{s}
+}
+
+func (s *MemoryStore) Restores() RestoreRepository {
+	return &memoryRestores{s}
+}
+
+func (s *MemoryStore) QoS() QoSRepository {
+	return &memoryQoS{s}
+}
+
+func (s *MemoryStore) Tags() TagRepository {
+	return &memoryTags{s}
+}
+
+func (s *MemoryStore) Tenants() TenantRepository {
+	return &memoryTenants{s}
+}
+
+func (s *MemoryStore) Policies() PolicyRepository {
+	return &memoryPolicies{s}
+}
+
+func (s *MemoryStore) SnapshotRuns() SnapshotRunRepository {
+	return &memorySnapshotRuns{s}
+}
+
+func (s *MemoryStore) Leases() LeaseRepository {
+	return &memoryLeases{s}
+}
+
+func key(parts ...string) string {
+	k := ""
+	for _, p := range parts {
+		k += p + "\x00"
+	}
+	return k
+}
+
+type memoryVolumes struct {
+	*MemoryStore
+}
+
+func (r *memoryVolumes) Create(v *Volume) error {
+	if v.State != StateCreating {
+		return &InvalidTransitionError{From: "", To: v.State}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(v.Pool, v.Name)
+	if _, ok := r.volumes[k]; ok {
+		return ErrExist
+	}
+	t := utils.CurrentTime()
+	v.CreateTime, v.UpdateTime = t, t
+	r.volumes[k] = *v
+	return nil
+}
+
+func (r *memoryVolumes) Get(pool string, name string) (*Volume, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.volumes[key(pool, name)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &v, nil
+}
+
+func (r *memoryVolumes) List(pool string) ([]*Volume, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var volumes []*Volume
+	for _, v := range r.volumes {
+		if pool == "" || v.Pool == pool {
+			v := v
+			volumes = append(volumes, &v)
+		}
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		if volumes[i].Pool != volumes[j].Pool {
+			return volumes[i].Pool < volumes[j].Pool
+		}
+		return volumes[i].Name < volumes[j].Name
+	})
+	return volumes, nil
+}
+
+func (r *memoryVolumes) Update(v *Volume) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(v.Pool, v.Name)
+	old, ok := r.volumes[k]
+	if !ok {
+		return ErrNotFound
+	}
+	old.Size = v.Size
+	old.DevPath = v.DevPath
+	old.Fullname = v.Fullname
+	old.UpdateTime = utils.CurrentTime()
+	r.volumes[k] = old
+	v.UpdateTime = old.UpdateTime
+	return nil
+}
+
+func (r *memoryVolumes) Transition(pool string, name string, from VolumeState, to VolumeState) error {
+	if err := CheckTransition(from, to); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(pool, name)
+	v, ok := r.volumes[k]
+	if !ok {
+		return ErrNotFound
+	}
+	if v.State != from {
+		return ErrStateChanged
+	}
+	v.State = to
+	v.UpdateTime = utils.CurrentTime()
+	r.volumes[k] = v
+	return nil
+}
+
+func (r *memoryVolumes) Delete(pool string, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(pool, name)
+	if _, ok := r.volumes[k]; !ok {
+		return ErrNotFound
+	}
+	delete(r.volumes, k)
+	return nil
+}
+
+type memoryAttachments struct {
+	*MemoryStore
+}
+
+func (r *memoryAttachments) Add(a *Attachment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(a.Pool, a.Volume, a.Client)
+	if _, ok := r.attachments[k]; ok {
+		return ErrExist
+	}
+	if a.Transport == "" {
+		a.Transport = TransportISCSI
+	}
+	a.CreateTime = utils.CurrentTime()
+	r.attachments[k] = *a
+	return nil
+}
+
+func (r *memoryAttachments) Remove(pool string, volume string, client string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(pool, volume, client)
+	if _, ok := r.attachments[k]; !ok {
+		return ErrNotFound
+	}
+	delete(r.attachments, k)
+	return nil
+}
+
+func (r *memoryAttachments) List(pool string, volume string) ([]*Attachment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var attachments []*Attachment
+	for _, a := range r.attachments {
+		if a.Pool == pool && a.Volume == volume {
+			a := a
+			attachments = append(attachments, &a)
+		}
+	}
+	sort.Slice(attachments, func(i, j int) bool {
+		return attachments[i].Client < attachments[j].Client
+	})
+	return attachments, nil
+}
+
+type memoryTargets struct {
+	*MemoryStore
+}
+
+func (r *memoryTargets) Add(t *Target) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(t.Pool, t.Volume, t.Initiator)
+	if _, ok := r.targets[k]; ok {
+		return ErrExist
+	}
+	t.CreateTime = utils.CurrentTime()
+	r.targets[k] = *t
+	return nil
+}
+
+func (r *memoryTargets) Get(pool string, volume string, initiator string) (*Target, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.targets[key(pool, volume, initiator)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &t, nil
+}
+
+func (r *memoryTargets) Remove(pool string, volume string, initiator string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(pool, volume, initiator)
+	if _, ok := r.targets[k]; !ok {
+		return ErrNotFound
+	}
+	delete(r.targets, k)
+	return nil
+}
+
+func (r *memoryTargets) List(pool string, volume string) ([]*Target, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var targets []*Target
+	for _, t := range r.targets {
+		if t.Pool == pool && t.Volume == volume {
+			t := t
+			targets = append(targets, &t)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Initiator < targets[j].Initiator
+	})
+	return targets, nil
+}
+
+type memoryBackups struct {
+	*MemoryStore
+}
+
+func (r *memoryBackups) Add(b *Backup) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.backups[b.Id]; ok {
+		return ErrExist
+	}
+	var seq int64
+	for _, other := range r.backups {
+		if other.Pool == b.Pool && other.Volume == b.Volume && other.Seq > seq {
+			seq = other.Seq
+		}
+	}
+	b.Seq = seq + 1
+	b.CreateTime = utils.CurrentTime()
+	b.UpdateTime = b.CreateTime
+	r.backups[b.Id] = *b
+	return nil
+}
+
+func (r *memoryBackups) Get(id string) (*Backup, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.backups[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &b, nil
+}
+
+func (r *memoryBackups) List(pool string, volume string) ([]*Backup, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var backups []*Backup
+	for _, b := range r.backups {
+		if (pool == "" || b.Pool == pool) && (volume == "" || b.Volume == volume) {
+			b := b
+			backups = append(backups, &b)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Pool != backups[j].Pool {
+			return backups[i].Pool < backups[j].Pool
+		}
+		if backups[i].Volume != backups[j].Volume {
+			return backups[i].Volume < backups[j].Volume
+		}
+		return backups[i].Seq < backups[j].Seq
+	})
+	return backups, nil
+}
+
+func (r *memoryBackups) Update(b *Backup) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old, ok := r.backups[b.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	old.State = b.State
+	old.DataSize = b.DataSize
+	old.UpdateTime = utils.CurrentTime()
+	r.backups[b.Id] = old
+	b.UpdateTime = old.UpdateTime
+	return nil
+}
+
+func (r *memoryBackups) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.backups[id]; !ok {
+		return ErrNotFound
+	}
+	for _, b := range r.backups {
+		if b.Parent == id {
+			return ErrBackupInUse
+		}
+	}
+	delete(r.backups, id)
+	return nil
+}
+
+type memoryRestores struct {
+	*MemoryStore
+}
+
+func (r *memoryRestores) Save(restore *Restore) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(restore.Pool, restore.Volume)
+	t := utils.CurrentTime()
+	if old, ok := r.restores[k]; ok {
+		restore.CreateTime = old.CreateTime
+	} else {
+		restore.CreateTime = t
+	}
+	restore.UpdateTime = t
+	r.restores[k] = *restore
+	return nil
+}
+
+func (r *memoryRestores) Get(pool string, volume string) (*Restore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	restore, ok := r.restores[key(pool, volume)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &restore, nil
+}
+
+func (r *memoryRestores) List() ([]*Restore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var restores []*Restore
+	for _, restore := range r.restores {
+		restore := restore
+		restores = append(restores, &restore)
+	}
+	sort.Slice(restores, func(i, j int) bool {
+		if restores[i].Pool != restores[j].Pool {
+			return restores[i].Pool < restores[j].Pool
+		}
+		return restores[i].Volume < restores[j].Volume
+	})
+	return restores, nil
+}
+
+func (r *memoryRestores) Delete(pool string, volume string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(pool, volume)
+	if _, ok := r.restores[k]; !ok {
+		return ErrNotFound
+	}
+	delete(r.restores, k)
+	return nil
+}
+
+type memoryQoS struct {
+	*MemoryStore
+}
+
+func (r *memoryQoS) Save(q *VolumeQoS) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(q.Pool, q.Volume)
+	t := utils.CurrentTime()
+	if old, ok := r.qos[k]; ok {
+		q.CreateTime = old.CreateTime
+	} else {
+		q.CreateTime = t
+	}
+	q.UpdateTime = t
+	r.qos[k] = *q
+	return nil
+}
+
+func (r *memoryQoS) Get(pool string, volume string) (*VolumeQoS, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q, ok := r.qos[key(pool, volume)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &q, nil
+}
+
+func (r *memoryQoS) Delete(pool string, volume string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(pool, volume)
+	if _, ok := r.qos[k]; !ok {
+		return ErrNotFound
+	}
+	delete(r.qos, k)
+	return nil
+}
+
+type memoryTags struct {
+	*MemoryStore
+}
+
+func (r *memoryTags) Set(t *VolumeTag) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(t.Pool, t.Volume, t.Key)
+	if old, ok := r.tags[k]; ok {
+		t.CreateTime = old.CreateTime
+	} else {
+		t.CreateTime = utils.CurrentTime()
+	}
+	r.tags[k] = *t
+	return nil
+}
+
+func (r *memoryTags) Remove(pool string, volume string, tagKey string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(pool, volume, tagKey)
+	if _, ok := r.tags[k]; !ok {
+		return ErrNotFound
+	}
+	delete(r.tags, k)
+	return nil
+}
+
+func (r *memoryTags) filter(match func(t *VolumeTag) bool) []*VolumeTag {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var tags []*VolumeTag
+	for _, t := range r.tags {
+		t := t
+		if match(&t) {
+			tags = append(tags, &t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return key(tags[i].Pool, tags[i].Volume, tags[i].Key) < key(tags[j].Pool, tags[j].Volume, tags[j].Key)
+	})
+	return tags
+}
+
+func (r *memoryTags) List(pool string, volume string) ([]*VolumeTag, error) {
+	return r.filter(func(t *VolumeTag) bool {
+		return (pool == "" || t.Pool == pool) && (volume == "" || t.Volume == volume)
+	}), nil
+}
+
+func (r *memoryTags) Find(tagKey string, value string) ([]*VolumeTag, error) {
+	return r.filter(func(t *VolumeTag) bool {
+		return t.Key == tagKey && (value == "" || t.Value == value)
+	}), nil
+}
+
+func (r *memoryTags) DeleteVolume(pool string, volume string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, t := range r.tags {
+		if t.Pool == pool && t.Volume == volume {
+			delete(r.tags, k)
+		}
+	}
+	return nil
+}
+
+type memoryTenants struct {
+	*MemoryStore
+}
+
+func (r *memoryTenants) Create(t *Tenant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, old := range r.tenants {
+		if old.Name == t.Name || old.AccessKey == t.AccessKey || old.Pool == t.Pool {
+			return ErrExist
+		}
+	}
+	now := utils.CurrentTime()
+	t.CreateTime, t.UpdateTime = now, now
+	r.tenants[t.Name] = *t
+	return nil
+}
+
+func (r *memoryTenants) Get(name string) (*Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tenants[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &t, nil
+}
+
+func (r *memoryTenants) GetByAccessKey(accessKey string) (*Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, t := range r.tenants {
+		if t.AccessKey == accessKey {
+			return &t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryTenants) GetByPool(pool string) (*Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, t := range r.tenants {
+		if t.Pool == pool {
+			return &t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryTenants) List() ([]*Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var tenants []*Tenant
+	for _, t := range r.tenants {
+		t := t
+		tenants = append(tenants, &t)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].Name < tenants[j].Name
+	})
+	return tenants, nil
+}
+
+func (r *memoryTenants) UpdateLimits(t *Tenant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old, ok := r.tenants[t.Name]
+	if !ok {
+		return ErrNotFound
+	}
+	old.MaxVolumes, old.MaxGB, old.MaxSnapshots = t.MaxVolumes, t.MaxGB, t.MaxSnapshots
+	old.UpdateTime = utils.CurrentTime()
+	r.tenants[t.Name] = old
+	t.UpdateTime = old.UpdateTime
+	return nil
+}
+
+func (r *memoryTenants) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.tenants[name]; !ok {
+		return ErrNotFound
+	}
+	delete(r.tenants, name)
+	return nil
+}
+
+type memoryPolicies struct {
+	*MemoryStore
+}
+
+func (r *memoryPolicies) Create(p *SnapshotPolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.policies[p.Name]; ok {
+		return ErrExist
+	}
+	t := utils.CurrentTime()
+	p.CreateTime, p.UpdateTime = t, t
+	r.policies[p.Name] = *p
+	return nil
+}
+
+func (r *memoryPolicies) Get(name string) (*SnapshotPolicy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.policies[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+func (r *memoryPolicies) List() ([]*SnapshotPolicy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var policies []*SnapshotPolicy
+	for _, p := range r.policies {
+		p := p
+		policies = append(policies, &p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies, nil
+}
+
+func (r *memoryPolicies) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.policies[name]; !ok {
+		return ErrNotFound
+	}
+	delete(r.policies, name)
+	for k, t := range r.policyTargets {
+		if t.Policy == name {
+			delete(r.policyTargets, k)
+		}
+	}
+	return nil
+}
+
+func (r *memoryPolicies) Attach(t *PolicyTarget) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(t.Policy, t.Pool, t.Volume)
+	if _, ok := r.policyTargets[k]; ok {
+		return ErrExist
+	}
+	t.CreateTime = utils.CurrentTime()
+	r.policyTargets[k] = *t
+	return nil
+}
+
+func (r *memoryPolicies) Detach(policy string, pool string, volume string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(policy, pool, volume)
+	if _, ok := r.policyTargets[k]; !ok {
+		return ErrNotFound
+	}
+	delete(r.policyTargets, k)
+	return nil
+}
+
+func (r *memoryPolicies) Targets(policy string) ([]*PolicyTarget, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var targets []*PolicyTarget
+	for _, t := range r.policyTargets {
+		if policy == "" || t.Policy == policy {
+			t := t
+			targets = append(targets, &t)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return key(targets[i].Policy, targets[i].Pool, targets[i].Volume) < key(targets[j].Policy, targets[j].Pool, targets[j].Volume)
+	})
+	return targets, nil
+}
+
+type memorySnapshotRuns struct {
+	*MemoryStore
+}
+
+func (r *memorySnapshotRuns) Save(run *SnapshotRun) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key(run.Policy, run.Pool, run.Volume, run.ScheduledTime)
+	t := utils.CurrentTime()
+	if old, ok := r.runs[k]; ok {
+		run.CreateTime = old.CreateTime
+	} else {
+		run.CreateTime = t
+	}
+	run.UpdateTime = t
+	r.runs[k] = *run
+	return nil
+}
+
+func (r *memorySnapshotRuns) Get(policy string, pool string, volume string, scheduledTime string) (*SnapshotRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	run, ok := r.runs[key(policy, pool, volume, scheduledTime)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &run, nil
+}
+
+func (r *memorySnapshotRuns) List(policy string, pool string, volume string, state string) ([]*SnapshotRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var runs []*SnapshotRun
+	for _, run := range r.runs {
+		if (policy == "" || run.Policy == policy) && (pool == "" || run.Pool == pool) &&
+			(volume == "" || run.Volume == volume) && (state == "" || run.State == state) {
+			run := run
+			runs = append(runs, &run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return key(runs[i].ScheduledTime, runs[i].Policy, runs[i].Pool, runs[i].Volume) <
+			key(runs[j].ScheduledTime, runs[j].Policy, runs[j].Pool, runs[j].Volume)
+	})
+	return runs, nil
+}
+
+type memoryLease struct {
+	holder string
+	expire time.Time
+}
+
+type memoryLeases struct {
+	*MemoryStore
+}
+
+func (r *memoryLeases) Acquire(name string, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lease, ok := r.leases[name]
+	if ok && lease.holder != holder && !lease.expire.Before(now) {
+		return false, nil
+	}
+	r.leases[name] = memoryLease{holder: holder, expire: now.Add(ttl)}
+	return true, nil
+}
+
+func (r *memoryLeases) Release(name string, holder string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if lease, ok := r.leases[name]; ok && lease.holder == holder {
+		delete(r.leases, name)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"db"
+	"utils"
+)
+
+type Dialect int
+
+// MySQL is the only dialect whose driver is registered, in package db.
+const (
+	MySQL Dialect = iota
+)
+
+// DialectOf returns the dialect for a database/sql driver name.
+func DialectOf(driver string) (Dialect, error) {
+	switch driver {
+	case "mysql":
+		return MySQL, nil
+	}
+	return 0, fmt.Errorf("Unsupported database driver %v", driver)
+}
+
+const migrationsTab = "schema_migrations"
+
+// tableOptions marks where CREATE TABLE takes dialect specific options.
+const tableOptions = "{table_options}"
+
+// migration is one versioned schema change, written in portable SQL so that
+// another dialect only needs its table options in expand.
+type migration struct {
+	version     int
+	description string
+	stmts       []string
+}
+
+// Migrations are applied in order and never edited once released; change
+// the schema by appending a new version.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "volumes, client_volumes and target_volumes",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS ` + db.VolumesTab + ` (
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL,
+				size BIGINT UNSIGNED NOT NULL,
+				dev_path VARCHAR(255) NOT NULL DEFAULT '',
+				fullname VARCHAR(255) NOT NULL DEFAULT '',
+				create_time DATETIME NOT NULL,
+				update_time DATETIME NOT NULL,
+				PRIMARY KEY (pool_name, volume_name)
+			)` + tableOptions,
+			`CREATE TABLE IF NOT EXISTS ` + db.ClientVolumesTab + ` (
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL,
+				client VARCHAR(255) NOT NULL,
+				create_time DATETIME NOT NULL,
+				PRIMARY KEY (pool_name, volume_name, client)
+			)` + tableOptions,
+			`CREATE TABLE IF NOT EXISTS ` + db.TargetVolumesTab + ` (
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL,
+				target VARCHAR(255) NOT NULL,
+				lun INT NOT NULL DEFAULT 0,
+				create_time DATETIME NOT NULL,
+				PRIMARY KEY (pool_name, volume_name, target)
+			)` + tableOptions,
+		},
+	},
+	{
+		version:     2,
+		description: "volume state",
+		stmts: []string{
+			`ALTER TABLE ` + db.VolumesTab + ` ADD COLUMN state VARCHAR(16) NOT NULL DEFAULT 'available'`,
+			`UPDATE ` + db.VolumesTab + ` SET state = 'in-use' WHERE EXISTS (SELECT 1 FROM ` + db.ClientVolumesTab + ` c
+				WHERE c.pool_name = ` + db.VolumesTab + `.pool_name AND c.volume_name = ` + db.VolumesTab + `.volume_name)`,
+		},
+	},
+	{
+		version:     3,
+		description: "jobs",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS ` + db.JobsTab + ` (
+				id VARCHAR(64) NOT NULL PRIMARY KEY,
+				action VARCHAR(64) NOT NULL,
+				resource VARCHAR(255) NOT NULL,
+				state VARCHAR(16) NOT NULL,
+				progress INT NOT NULL DEFAULT 0,
+				error TEXT,
+				create_time DATETIME NOT NULL,
+				update_time DATETIME NOT NULL
+			)` + tableOptions,
+		},
+	},
+	{
+		//每个initiator一行，保存加密后的CHAP密码；主键改变，重建表
+		version:     4,
+		description: "per-initiator target_volumes with CHAP credentials",
+		stmts: []string{
+			`CREATE TABLE ` + db.TargetVolumesTab + `_v4 (
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL,
+				target VARCHAR(255) NOT NULL,
+				lun INT NOT NULL DEFAULT 0,
+				initiator VARCHAR(223) NOT NULL DEFAULT '',
+				chap_user VARCHAR(255) NOT NULL DEFAULT '',
+				chap_secret TEXT,
+				mutual_chap_user VARCHAR(255) NOT NULL DEFAULT '',
+				mutual_chap_secret TEXT,
+				create_time DATETIME NOT NULL,
+				PRIMARY KEY (pool_name, volume_name, initiator)
+			)` + tableOptions,
+			`INSERT INTO ` + db.TargetVolumesTab + `_v4 (pool_name, volume_name, target, lun, initiator, create_time)
+				SELECT t.pool_name, t.volume_name, t.target, t.lun, COALESCE(c.client, ''), t.create_time
+				FROM ` + db.TargetVolumesTab + ` t LEFT JOIN ` + db.ClientVolumesTab + ` c
+				ON c.pool_name = t.pool_name AND c.volume_name = t.volume_name`,
+			`DROP TABLE ` + db.TargetVolumesTab,
+			`ALTER TABLE ` + db.TargetVolumesTab + `_v4 RENAME TO ` + db.TargetVolumesTab,
+		},
+	},
+	{
+		version:     5,
+		description: "attachment transport",
+		stmts: []string{
+			`ALTER TABLE ` + db.ClientVolumesTab + ` ADD COLUMN transport VARCHAR(16) NOT NULL DEFAULT 'iscsi'`,
+		},
+	},
+	{
+		version:     6,
+		description: "backup catalog",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS ` + db.BackupsTab + ` (
+				id VARCHAR(64) NOT NULL PRIMARY KEY,
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL,
+				seq BIGINT NOT NULL,
+				type VARCHAR(16) NOT NULL,
+				chain_id VARCHAR(64) NOT NULL,
+				parent_id VARCHAR(64) NOT NULL DEFAULT '',
+				snapshot VARCHAR(128) NOT NULL,
+				bucket VARCHAR(255) NOT NULL,
+				prefix VARCHAR(1024) NOT NULL,
+				size BIGINT UNSIGNED NOT NULL,
+				data_size BIGINT UNSIGNED NOT NULL DEFAULT 0,
+				state VARCHAR(16) NOT NULL,
+				create_time DATETIME NOT NULL,
+				update_time DATETIME NOT NULL
+			)` + tableOptions,
+			`CREATE UNIQUE INDEX ` + db.BackupsTab + `_volume_seq ON ` + db.BackupsTab + ` (pool_name, volume_name, seq)`,
+		},
+	},
+	{
+		version:     7,
+		description: "restore checkpoints",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS ` + db.RestoresTab + ` (
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL,
+				backup_id VARCHAR(64) NOT NULL,
+				in_place INT NOT NULL DEFAULT 0,
+				prepared INT NOT NULL DEFAULT 0,
+				step INT NOT NULL DEFAULT 0,
+				extent INT NOT NULL DEFAULT 0,
+				create_time DATETIME NOT NULL,
+				update_time DATETIME NOT NULL,
+				PRIMARY KEY (pool_name, volume_name)
+			)` + tableOptions,
+		},
+	},
+	{
+		//volume_name为空表示作用于整个pool
+		version:     8,
+		description: "snapshot policies, runs and leases",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS ` + db.SnapshotPoliciesTab + ` (
+				name VARCHAR(128) NOT NULL PRIMARY KEY,
+				schedule VARCHAR(16) NOT NULL,
+				minute INT NOT NULL DEFAULT 0,
+				hour INT NOT NULL DEFAULT 0,
+				weekday INT NOT NULL DEFAULT 0,
+				retention INT NOT NULL DEFAULT 0,
+				name_template VARCHAR(255) NOT NULL,
+				create_time DATETIME NOT NULL,
+				update_time DATETIME NOT NULL
+			)` + tableOptions,
+			`CREATE TABLE IF NOT EXISTS ` + db.SnapshotPolicyTargetsTab + ` (
+				policy_name VARCHAR(128) NOT NULL,
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL DEFAULT '',
+				create_time DATETIME NOT NULL,
+				PRIMARY KEY (policy_name, pool_name, volume_name)
+			)` + tableOptions,
+			`CREATE TABLE IF NOT EXISTS ` + db.SnapshotRunsTab + ` (
+				policy_name VARCHAR(128) NOT NULL,
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL,
+				scheduled_time DATETIME NOT NULL,
+				snapshot VARCHAR(255) NOT NULL,
+				state VARCHAR(16) NOT NULL,
+				error TEXT,
+				create_time DATETIME NOT NULL,
+				update_time DATETIME NOT NULL,
+				PRIMARY KEY (policy_name, pool_name, volume_name, scheduled_time)
+			)` + tableOptions,
+			`CREATE TABLE IF NOT EXISTS ` + db.LeasesTab + ` (
+				name VARCHAR(128) NOT NULL PRIMARY KEY,
+				holder VARCHAR(255) NOT NULL,
+				expire_time DATETIME NOT NULL
+			)` + tableOptions,
+		},
+	},
+	{
+		version:     9,
+		description: "volume qos",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS ` + db.VolumeQoSTab + ` (
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL,
+				read_iops BIGINT UNSIGNED NOT NULL DEFAULT 0,
+				write_iops BIGINT UNSIGNED NOT NULL DEFAULT 0,
+				read_bps BIGINT UNSIGNED NOT NULL DEFAULT 0,
+				write_bps BIGINT UNSIGNED NOT NULL DEFAULT 0,
+				burst BIGINT UNSIGNED NOT NULL DEFAULT 0,
+				create_time DATETIME NOT NULL,
+				update_time DATETIME NOT NULL,
+				PRIMARY KEY (pool_name, volume_name)
+			)` + tableOptions,
+		},
+	},
+	{
+		version:     10,
+		description: "volume tags",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS ` + db.VolumeTagsTab + ` (
+				pool_name VARCHAR(128) NOT NULL,
+				volume_name VARCHAR(128) NOT NULL,
+				tag_key VARCHAR(128) NOT NULL,
+				tag_value VARCHAR(255) NOT NULL DEFAULT '',
+				create_time DATETIME NOT NULL,
+				PRIMARY KEY (pool_name, volume_name, tag_key)
+			)` + tableOptions,
+			`CREATE INDEX ` + db.VolumeTagsTab + `_key_value ON ` + db.VolumeTagsTab + ` (tag_key, tag_value)`,
+		},
+	},
+	{
+		version:     11,
+		description: "tenants",
+		stmts: []string{
+			`CREATE TABLE IF NOT EXISTS ` + db.TenantsTab + ` (
+				name VARCHAR(64) NOT NULL PRIMARY KEY,
+				access_key VARCHAR(64) NOT NULL,
+				secret_key VARCHAR(255) NOT NULL,
+				pool_name VARCHAR(128) NOT NULL,
+				ceph_user VARCHAR(128) NOT NULL,
+				ceph_key VARCHAR(255) NOT NULL,
+				max_volumes INT NOT NULL DEFAULT 0,
+				max_gb BIGINT UNSIGNED NOT NULL DEFAULT 0,
+				max_snapshots INT NOT NULL DEFAULT 0,
+				create_time DATETIME NOT NULL,
+				update_time DATETIME NOT NULL
+			)` + tableOptions,
+			`CREATE UNIQUE INDEX ` + db.TenantsTab + `_access_key ON ` + db.TenantsTab + ` (access_key)`,
+			`CREATE UNIQUE INDEX ` + db.TenantsTab + `_pool ON ` + db.TenantsTab + ` (pool_name)`,
+		},
+	},
+	{
+		version:     12,
+		description: "nbd export per attachment",
+		stmts: []string{
+			`ALTER TABLE ` + db.ClientVolumesTab + ` ADD COLUMN nbd_export VARCHAR(255) NOT NULL DEFAULT ''`,
+			`ALTER TABLE ` + db.ClientVolumesTab + ` ADD COLUMN nbd_allow VARCHAR(1024) NOT NULL DEFAULT ''`,
+		},
+	},
+}
+
+// expand fills in the dialect specific table options of CREATE TABLE.
+func (d Dialect) expand(stmt string) string {
+	options := ""
+	if d == MySQL {
+		options = " ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	}
+	return strings.Replace(stmt, tableOptions, options, -1)
+}
+
+// Migrate brings the schema up to the latest version. Each migration is
+// recorded in schema_migrations once all its statements have succeeded.
+func Migrate(handle *sql.DB, dialect Dialect) error {
+	_, err := handle.Exec(dialect.expand(`CREATE TABLE IF NOT EXISTS ` + migrationsTab + ` (
+		version INT NOT NULL PRIMARY KEY,
+		description VARCHAR(255) NOT NULL,
+		applied_time DATETIME NOT NULL
+	)` + tableOptions))
+	if err != nil {
+		return err
+	}
+
+	var current sql.NullInt64
+	if err := handle.QueryRow("SELECT MAX(version) FROM " + migrationsTab).Scan(&current); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if int64(m.version) <= current.Int64 {
+			continue
+		}
+
+		for _, stmt := range m.stmts {
+			if _, err := handle.Exec(dialect.expand(stmt)); err != nil {
+				return fmt.Errorf("migration %v (%v): %v", m.version, m.description, err)
+			}
+		}
+
+		_, err := handle.Exec("INSERT INTO "+migrationsTab+" (version, description, applied_time) VALUES (?, ?, ?)",
+			m.version, m.description, utils.CurrentTime())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Applied schema migration %v: %v\n", m.version, m.description)
+	}
+	return nil
+}
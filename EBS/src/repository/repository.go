@@ -0,0 +1,354 @@
+// Package repository persists volumes, their client attachments, their
+// iSCSI target exports, their QoS limits and tags, the tenants owning
+// pools, the backup catalog, restore checkpoints, snapshot policies with
+// the snapshots they created, and leader leases. Two implementations are provided: SQLStore, for MySQL
+// through database/sql, and MemoryStore.
+package repository
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("Record not found")
+var ErrExist = errors.New("Record already exist")
+
+// ErrStateChanged is returned by Transition when the volume is no longer in
+// the expected state, usually because of a concurrent request.
+var ErrStateChanged = errors.New("Volume state changed")
+
+// ErrNoSecretKey is returned when CHAP secrets or tenant keys have to be
+// stored but the store was given no key to encrypt them with.
+var ErrNoSecretKey = errors.New("No secret key configured")
+
+// ErrBackupInUse is returned when deleting a backup that a newer
+// incremental backup depends on.
+var ErrBackupInUse = errors.New("Backup has dependent incremental backups")
+
+// Volume is a row of the volumes table.
+type Volume struct {
+	Pool       string
+	Name       string
+	Size       uint64
+	DevPath    string
+	Fullname   string
+	State      VolumeState
+	CreateTime string
+	UpdateTime string
+}
+
+// Transports a volume can be attached through.
+const (
+	TransportISCSI = "iscsi"
+	TransportNBD   = "nbd"
+)
+
+// Attachment is a row of the client_volumes table. An empty Transport is
+// stored as TransportISCSI. Export and Allow are the NBD export name of the
+// attachment and the comma separated networks it admits, empty for iSCSI.
+type Attachment struct {
+	Pool       string
+	Volume     string
+	Client     string
+	Transport  string
+	Export     string
+	Allow      string
+	CreateTime string
+}
+
+// Target is a row of the target_volumes table: a volume exported as a LUN
+// of an iSCSI target to one initiator. The CHAP secrets are plain text here
+// and encrypted by the store.
+type Target struct {
+	Pool             string
+	Volume           string
+	Target           string
+	Lun              int
+	Initiator        string
+	ChapUser         string
+	ChapSecret       string
+	MutualChapUser   string
+	MutualChapSecret string
+	CreateTime       string
+}
+
+// Backup types.
+const (
+	BackupFull        = "full"
+	BackupIncremental = "incremental"
+)
+
+// Backup states.
+const (
+	BackupCreating  = "creating"
+	BackupAvailable = "available"
+	BackupError     = "error"
+)
+
+// Backup is a row of the backups table. A chain starts with a full backup,
+// Chain is its id; each incremental backup holds only the extents changed
+// since Parent, so a backup cannot be deleted while another has it as
+// parent. Seq orders the backups of one volume.
+type Backup struct {
+	Id         string
+	Pool       string
+	Volume     string
+	Seq        int64
+	Type       string
+	Chain      string
+	Parent     string
+	Snapshot   string
+	Bucket     string
+	Prefix     string
+	Size       uint64
+	DataSize   uint64
+	State      string
+	CreateTime string
+	UpdateTime string
+}
+
+// Restore is a row of the restores table, the checkpoint of a restore of
+// backup BackupId into a volume: the chain from the full backup is applied
+// in order, and Step and Extent are the first backup of the chain and the
+// first extent of its manifest not yet written. Prepared is set once the
+// image has been created, or cleared for an in-place restore.
+type Restore struct {
+	Pool       string
+	Volume     string
+	BackupId   string
+	InPlace    bool
+	Prepared   bool
+	Step       int
+	Extent     int
+	CreateTime string
+	UpdateTime string
+}
+
+// Snapshot policy schedules.
+const (
+	ScheduleHourly = "hourly"
+	ScheduleDaily  = "daily"
+	ScheduleWeekly = "weekly"
+)
+
+// SnapshotPolicy is a row of the snapshot_policies table. A policy takes a
+// snapshot every hour at Minute, every day at Hour:Minute, or every week on
+// Weekday (0 is Sunday) at Hour:Minute, and keeps the newest Retention of
+// the snapshots it took, or all of them when Retention is 0. NameTemplate
+// names the snapshots.
+type SnapshotPolicy struct {
+	Name         string
+	Schedule     string
+	Minute       int
+	Hour         int
+	Weekday      int
+	Retention    int
+	NameTemplate string
+	CreateTime   string
+	UpdateTime   string
+}
+
+// PolicyTarget is a row of the snapshot_policy_targets table: a policy
+// applied to one volume, or to every volume of Pool when Volume is empty.
+type PolicyTarget struct {
+	Policy     string
+	Pool       string
+	Volume     string
+	CreateTime string
+}
+
+// Snapshot run states.
+const (
+	RunCreated = "created"
+	RunFailed  = "failed"
+	RunDeleted = "deleted"
+)
+
+// SnapshotRun is a row of the snapshot_runs table, the result of taking
+// the snapshot of one schedule slot. A failed run is retried until the
+// next slot; a created snapshot is marked deleted once retention removes
+// it.
+type SnapshotRun struct {
+	Policy        string
+	Pool          string
+	Volume        string
+	ScheduledTime string
+	Snapshot      string
+	State         string
+	Error         string
+	CreateTime    string
+	UpdateTime    string
+}
+
+// VolumeQoS is a row of the volume_qos table, the I/O limits of a volume
+// as in qos.Limits. A zero limit is unlimited.
+type VolumeQoS struct {
+	Pool       string
+	Volume     string
+	ReadIOPS   uint64
+	WriteIOPS  uint64
+	ReadBps    uint64
+	WriteBps   uint64
+	Burst      uint64
+	CreateTime string
+	UpdateTime string
+}
+
+// VolumeTag is a row of the volume_tags table, a label of a volume.
+type VolumeTag struct {
+	Pool       string
+	Volume     string
+	Key        string
+	Value      string
+	CreateTime string
+}
+
+// Tenant is a row of the tenants table. A tenant owns Pool, which EBS
+// opens as the cephx user CephUser, and calls the API with AccessKey and
+// SecretKey. SecretKey and CephKey are plain text here and encrypted by the
+// store. MaxGB is in GiB; a zero limit is unlimited.
+type Tenant struct {
+	Name         string
+	AccessKey    string
+	SecretKey    string
+	Pool         string
+	CephUser     string
+	CephKey      string
+	MaxVolumes   int
+	MaxGB        uint64
+	MaxSnapshots int
+	CreateTime   string
+	UpdateTime   string
+}
+
+type VolumeRepository interface {
+	// Create inserts v, which must be in StateCreating.
+	Create(v *Volume) error
+	Get(pool string, name string) (*Volume, error)
+	// List returns the volumes of pool, or of every pool when pool is empty.
+	List(pool string) ([]*Volume, error)
+	// Update saves size, device path and full name.
+	Update(v *Volume) error
+	// Transition moves the volume from one state to another after checking
+	// that the transition is allowed.
+	Transition(pool string, name string, from VolumeState, to VolumeState) error
+	Delete(pool string, name string) error
+}
+
+type AttachmentRepository interface {
+	Add(a *Attachment) error
+	Remove(pool string, volume string, client string) error
+	List(pool string, volume string) ([]*Attachment, error)
+}
+
+type TargetRepository interface {
+	Add(t *Target) error
+	Get(pool string, volume string, initiator string) (*Target, error)
+	Remove(pool string, volume string, initiator string) error
+	List(pool string, volume string) ([]*Target, error)
+}
+
+type BackupRepository interface {
+	// Add inserts b as the newest backup of its volume and sets its Seq.
+	Add(b *Backup) error
+	Get(id string) (*Backup, error)
+	// List returns backups oldest first: those of volume, of every volume
+	// of pool when volume is empty, or all when pool is empty too.
+	List(pool string, volume string) ([]*Backup, error)
+	// Update saves state and data size.
+	Update(b *Backup) error
+	// Delete removes a backup, failing with ErrBackupInUse while another
+	// backup has it as parent.
+	Delete(id string) error
+}
+
+type RestoreRepository interface {
+	// Save inserts or updates the checkpoint of r's volume.
+	Save(r *Restore) error
+	Get(pool string, volume string) (*Restore, error)
+	// List returns the checkpoints of every unfinished restore.
+	List() ([]*Restore, error)
+	Delete(pool string, volume string) error
+}
+
+type QoSRepository interface {
+	// Save inserts or updates the limits of q's volume.
+	Save(q *VolumeQoS) error
+	Get(pool string, volume string) (*VolumeQoS, error)
+	Delete(pool string, volume string) error
+}
+
+type TagRepository interface {
+	// Set adds the tag or changes its value.
+	Set(t *VolumeTag) error
+	Remove(pool string, volume string, key string) error
+	// List returns tags sorted by volume and key: those of volume, of
+	// every volume of pool when volume is empty, or all when pool is
+	// empty too.
+	List(pool string, volume string) ([]*VolumeTag, error)
+	// Find returns the tags named key with value, or with any value when
+	// value is empty, sorted by volume.
+	Find(key string, value string) ([]*VolumeTag, error)
+	// DeleteVolume removes every tag of volume.
+	DeleteVolume(pool string, volume string) error
+}
+
+type TenantRepository interface {
+	// Create fails with ErrExist when the name, access key or pool is
+	// already taken.
+	Create(t *Tenant) error
+	Get(name string) (*Tenant, error)
+	GetByAccessKey(accessKey string) (*Tenant, error)
+	GetByPool(pool string) (*Tenant, error)
+	// List returns the tenants sorted by name.
+	List() ([]*Tenant, error)
+	// UpdateLimits saves MaxVolumes, MaxGB and MaxSnapshots.
+	UpdateLimits(t *Tenant) error
+	Delete(name string) error
+}
+
+type PolicyRepository interface {
+	Create(p *SnapshotPolicy) error
+	Get(name string) (*SnapshotPolicy, error)
+	List() ([]*SnapshotPolicy, error)
+	// Delete removes the policy and its targets.
+	Delete(name string) error
+	Attach(t *PolicyTarget) error
+	Detach(policy string, pool string, volume string) error
+	// Targets returns the targets of policy, or of every policy when
+	// policy is empty.
+	Targets(policy string) ([]*PolicyTarget, error)
+}
+
+type SnapshotRunRepository interface {
+	// Save inserts or updates the run of r's policy, volume and slot.
+	Save(r *SnapshotRun) error
+	Get(policy string, pool string, volume string, scheduledTime string) (*SnapshotRun, error)
+	// List returns runs oldest first, filtered by every argument that is
+	// not empty.
+	List(policy string, pool string, volume string, state string) ([]*SnapshotRun, error)
+}
+
+type LeaseRepository interface {
+	// Acquire takes or renews the lease name for holder until now+ttl. It
+	// reports whether holder owns the lease, which it does when the lease
+	// was free, expired or already its own.
+	Acquire(name string, holder string, now time.Time, ttl time.Duration) (bool, error)
+	// Release gives the lease up if holder owns it.
+	Release(name string, holder string) error
+}
+
+// Store groups the repositories of one database.
+type Store interface {
+	Volumes() VolumeRepository
+	Attachments() AttachmentRepository
+	Targets() TargetRepository
+	Backups() BackupRepository
+	Restores() RestoreRepository
+	QoS() QoSRepository
+	Tags() TagRepository
+	Tenants() TenantRepository
+	Policies() PolicyRepository
+	SnapshotRuns() SnapshotRunRepository
+	Leases() LeaseRepository
+}
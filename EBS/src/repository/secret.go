@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+)
+
+var ErrInvalidSecret = errors.New("Invalid encrypted secret")
+
+// secretVersion prefixes every encrypted value so the format can change
+// without guessing what is stored.
+const secretVersion = "v1:"
+
+// secretBox encrypts secrets at rest with AES-GCM.
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+// newSecretBox takes a 16, 24 or 32 byte AES key.
+func newSecretBox(key []byte) (*secretBox, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead: aead}, nil
+}
+
+//密文格式：v1:base64(nonce|ciphertext)，空串不加密；没有密钥时b为nil
+func (b *secretBox) seal(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	if b == nil {
+		return "", ErrNoSecretKey
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return secretVersion + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (b *secretBox) open(sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+	if b == nil {
+		return "", ErrNoSecretKey
+	}
+	if !strings.HasPrefix(sealed, secretVersion) {
+		return "", ErrInvalidSecret
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, secretVersion))
+	if err != nil || len(data) < b.aead.NonceSize() {
+		return "", ErrInvalidSecret
+	}
+	nonce, data := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	plain, err := b.aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return "", ErrInvalidSecret
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,1044 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"db"
+	"utils"
+)
+
+// SQLStore keeps the repositories in a MySQL database. All values
+// are passed as query parameters.
+type SQLStore struct {
+	handle  *sql.DB
+	dialect Dialect
+	secrets *secretBox
+}
+
+func NewSQLStore(handle *sql.DB, dialect Dialect) *SQLStore {
+	return &SQLStore{handle: handle, dialect: dialect}
+}
+
+// SetSecretKey sets the AES key, 16, 24 or 32 bytes, that CHAP secrets and
+// tenant keys are encrypted with. Without a key, targets with CHAP secrets
+// and tenants cannot be added.
+func (s *SQLStore) SetSecretKey(key []byte) error {
+	box, err := newSecretBox(key)
+	if err != nil {
+		return err
+	}
+	s.secrets = box
+	return nil
+}
+
+// Migrate brings the store's schema up to date.
+func (s *SQLStore) Migrate() error {
+	return Migrate(s.handle, s.dialect)
+}
+
+func (s *SQLStore) Volumes() VolumeRepository {
+	return &sqlVolumes{handle: s.handle}
+}
+
+func (s *SQLStore) Attachments() AttachmentRepository {
+	return &sqlAttachments{handle: s.handle}
+}
+
+func (s *SQLStore) Targets() TargetRepository {
+	return &sqlTargets{handle: s.handle, secrets: s.secrets}
+}
+
+func (s *SQLStore) Backups() BackupRepository {
+	return &sqlBackups{handle: s.handle}
+}
+
+func (s *SQLStore) Restores() RestoreRepository {
+	return &sqlRestores{handle: s.handle}
+}
+
+func (s *SQLStore) QoS() QoSRepository {
+	return &sqlQoS{handle: s.handle}
+}
+
+func (s *SQLStore) Tags() TagRepository {
+	return &sqlTags{handle: s.handle}
+}
+
+func (s *SQLStore) Tenants() TenantRepository {
+	return &sqlTenants{handle: s.handle, secrets: s.secrets}
+}
+
+func (s *SQLStore) Policies() PolicyRepository {
+	return &sqlPolicies{handle: s.handle}
+}
+
+func (s *SQLStore) SnapshotRuns() SnapshotRunRepository {
+	return &sqlSnapshotRuns{handle: s.handle}
+}
+
+func (s *SQLStore) Leases() LeaseRepository {
+	return &sqlLeases{handle: s.handle}
+}
+
+//主键冲突，MySQL为Error 1062
+func isDuplicate(err error) bool {
+	return strings.Contains(err.Error(), "Error 1062")
+}
+
+func checkAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const volumeColumns = "pool_name, volume_name, size, dev_path, fullname, state, create_time, update_time"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanVolume(row scanner) (*Volume, error) {
+	v := &Volume{}
+	var state string
+	if err := row.Scan(&v.Pool, &v.Name, &v.Size, &v.DevPath, &v.Fullname, &state, &v.CreateTime, &v.UpdateTime); err != nil {
+		return nil, err
+	}
+	v.State = VolumeState(state)
+	return v, nil
+}
+
+type sqlVolumes struct {
+	handle *sql.DB
+}
+
+func (r *sqlVolumes) Create(v *Volume) error {
+	if v.State != StateCreating {
+		return &InvalidTransitionError{From: "", To: v.State}
+	}
+
+	t := utils.CurrentTime()
+	_, err := r.handle.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", db.VolumesTab, volumeColumns),
+		v.Pool, v.Name, v.Size, v.DevPath, v.Fullname, string(v.State), t, t)
+	if err != nil {
+		if isDuplicate(err) {
+			return ErrExist
+		}
+		return err
+	}
+	v.CreateTime, v.UpdateTime = t, t
+	return nil
+}
+
+func (r *sqlVolumes) Get(pool string, name string) (*Volume, error) {
+	row := r.handle.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE pool_name = ? AND volume_name = ?",
+		volumeColumns, db.VolumesTab), pool, name)
+	v, err := scanVolume(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return v, err
+}
+
+func (r *sqlVolumes) List(pool string) ([]*Volume, error) {
+	var rows *sql.Rows
+	var err error
+	if pool == "" {
+		rows, err = r.handle.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY pool_name, volume_name",
+			volumeColumns, db.VolumesTab))
+	} else {
+		rows, err = r.handle.Query(fmt.Sprintf("SELECT %s FROM %s WHERE pool_name = ? ORDER BY volume_name",
+			volumeColumns, db.VolumesTab), pool)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var volumes []*Volume
+	for rows.Next() {
+		v, err := scanVolume(rows)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes, rows.Err()
+}
+
+func (r *sqlVolumes) Update(v *Volume) error {
+	t := utils.CurrentTime()
+	result, err := r.handle.Exec(fmt.Sprintf("UPDATE %s SET size = ?, dev_path = ?, fullname = ?, update_time = ? WHERE pool_name = ? AND volume_name = ?",
+		db.VolumesTab), v.Size, v.DevPath, v.Fullname, t, v.Pool, v.Name)
+	if err != nil {
+		return err
+	}
+	//MySQL对未改变的行返回0，需要再确认记录是否存在
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		if _, err := r.Get(v.Pool, v.Name); err != nil {
+			return err
+		}
+	}
+	v.UpdateTime = t
+	return nil
+}
+
+func (r *sqlVolumes) Transition(pool string, name string, from VolumeState, to VolumeState) error {
+	if err := CheckTransition(from, to); err != nil {
+		return err
+	}
+
+	result, err := r.handle.Exec(fmt.Sprintf("UPDATE %s SET state = ?, update_time = ? WHERE pool_name = ? AND volume_name = ? AND state = ?",
+		db.VolumesTab), string(to), utils.CurrentTime(), pool, name, string(from))
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(result); err == ErrNotFound {
+		if _, err := r.Get(pool, name); err != nil {
+			return err
+		}
+		return ErrStateChanged
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *sqlVolumes) Delete(pool string, name string) error {
+	result, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE pool_name = ? AND volume_name = ?",
+		db.VolumesTab), pool, name)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+type sqlAttachments struct {
+	handle *sql.DB
+}
+
+func (r *sqlAttachments) Add(a *Attachment) error {
+	if a.Transport == "" {
+		a.Transport = TransportISCSI
+	}
+	t := utils.CurrentTime()
+	_, err := r.handle.Exec(fmt.Sprintf("INSERT INTO %s (pool_name, volume_name, client, transport, nbd_export, nbd_allow, create_time) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		db.ClientVolumesTab), a.Pool, a.Volume, a.Client, a.Transport, a.Export, a.Allow, t)
+	if err != nil {
+		if isDuplicate(err) {
+			return ErrExist
+		}
+		return err
+	}
+	a.CreateTime = t
+	return nil
+}
+
+func (r *sqlAttachments) Remove(pool string, volume string, client string) error {
+	result, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE pool_name = ? AND volume_name = ? AND client = ?",
+		db.ClientVolumesTab), pool, volume, client)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+func (r *sqlAttachments) List(pool string, volume string) ([]*Attachment, error) {
+	rows, err := r.handle.Query(fmt.Sprintf("SELECT pool_name, volume_name, client, transport, nbd_export, nbd_allow, create_time FROM %s WHERE pool_name = ? AND volume_name = ? ORDER BY client",
+		db.ClientVolumesTab), pool, volume)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*Attachment
+	for rows.Next() {
+		a := &Attachment{}
+		if err := rows.Scan(&a.Pool, &a.Volume, &a.Client, &a.Transport, &a.Export, &a.Allow, &a.CreateTime); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+type sqlTargets struct {
+	handle  *sql.DB
+	secrets *secretBox
+}
+
+const targetColumns = "pool_name, volume_name, target, lun, initiator, chap_user, chap_secret, mutual_chap_user, mutual_chap_secret, create_time"
+
+func (r *sqlTargets) scan(row scanner) (*Target, error) {
+	t := &Target{}
+	var secret, mutualSecret sql.NullString
+	if err := row.Scan(&t.Pool, &t.Volume, &t.Target, &t.Lun, &t.Initiator, &t.ChapUser, &secret,
+		&t.MutualChapUser, &mutualSecret, &t.CreateTime); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if t.ChapSecret, err = r.secrets.open(secret.String); err != nil {
+		return nil, err
+	}
+	if t.MutualChapSecret, err = r.secrets.open(mutualSecret.String); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *sqlTargets) Add(t *Target) error {
+	secret, err := r.secrets.seal(t.ChapSecret)
+	if err != nil {
+		return err
+	}
+	mutualSecret, err := r.secrets.seal(t.MutualChapSecret)
+	if err != nil {
+		return err
+	}
+
+	now := utils.CurrentTime()
+	_, err = r.handle.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", db.TargetVolumesTab, targetColumns),
+		t.Pool, t.Volume, t.Target, t.Lun, t.Initiator, t.ChapUser, secret, t.MutualChapUser, mutualSecret, now)
+	if err != nil {
+		if isDuplicate(err) {
+			return ErrExist
+		}
+		return err
+	}
+	t.CreateTime = now
+	return nil
+}
+
+func (r *sqlTargets) Get(pool string, volume string, initiator string) (*Target, error) {
+	row := r.handle.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE pool_name = ? AND volume_name = ? AND initiator = ?",
+		targetColumns, db.TargetVolumesTab), pool, volume, initiator)
+	t, err := r.scan(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return t, err
+}
+
+func (r *sqlTargets) Remove(pool string, volume string, initiator string) error {
+	result, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE pool_name = ? AND volume_name = ? AND initiator = ?",
+		db.TargetVolumesTab), pool, volume, initiator)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+func (r *sqlTargets) List(pool string, volume string) ([]*Target, error) {
+	rows, err := r.handle.Query(fmt.Sprintf("SELECT %s FROM %s WHERE pool_name = ? AND volume_name = ? ORDER BY initiator",
+		targetColumns, db.TargetVolumesTab), pool, volume)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []*Target
+	for rows.Next() {
+		t, err := r.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+type sqlBackups struct {
+	handle *sql.DB
+}
+
+const backupColumns = "id, pool_name, volume_name, seq, type, chain_id, parent_id, snapshot, bucket, prefix, size, data_size, state, create_time, update_time"
+
+func scanBackup(row scanner) (*Backup, error) {
+	b := &Backup{}
+	if err := row.Scan(&b.Id, &b.Pool, &b.Volume, &b.Seq, &b.Type, &b.Chain, &b.Parent, &b.Snapshot, &b.Bucket,
+		&b.Prefix, &b.Size, &b.DataSize, &b.State, &b.CreateTime, &b.UpdateTime); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (r *sqlBackups) Add(b *Backup) error {
+	//同一个卷的备份由后台任务串行执行，seq不会并发分配
+	var seq sql.NullInt64
+	if err := r.handle.QueryRow(fmt.Sprintf("SELECT MAX(seq) FROM %s WHERE pool_name = ? AND volume_name = ?",
+		db.BackupsTab), b.Pool, b.Volume).Scan(&seq); err != nil {
+		return err
+	}
+
+	t := utils.CurrentTime()
+	_, err := r.handle.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", db.BackupsTab, backupColumns),
+		b.Id, b.Pool, b.Volume, seq.Int64+1, b.Type, b.Chain, b.Parent, b.Snapshot, b.Bucket, b.Prefix, b.Size, b.DataSize, b.State, t, t)
+	if err != nil {
+		if isDuplicate(err) {
+			return ErrExist
+		}
+		return err
+	}
+	b.Seq = seq.Int64 + 1
+	b.CreateTime, b.UpdateTime = t, t
+	return nil
+}
+
+func (r *sqlBackups) Get(id string) (*Backup, error) {
+	row := r.handle.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", backupColumns, db.BackupsTab), id)
+	b, err := scanBackup(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (r *sqlBackups) List(pool string, volume string) ([]*Backup, error) {
+	var rows *sql.Rows
+	var err error
+	switch {
+	case pool == "":
+		rows, err = r.handle.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY pool_name, volume_name, seq",
+			backupColumns, db.BackupsTab))
+	case volume == "":
+		rows, err = r.handle.Query(fmt.Sprintf("SELECT %s FROM %s WHERE pool_name = ? ORDER BY volume_name, seq",
+			backupColumns, db.BackupsTab), pool)
+	default:
+		rows, err = r.handle.Query(fmt.Sprintf("SELECT %s FROM %s WHERE pool_name = ? AND volume_name = ? ORDER BY seq",
+			backupColumns, db.BackupsTab), pool, volume)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var backups []*Backup
+	for rows.Next() {
+		b, err := scanBackup(rows)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+	return backups, rows.Err()
+}
+
+func (r *sqlBackups) Update(b *Backup) error {
+	t := utils.CurrentTime()
+	result, err := r.handle.Exec(fmt.Sprintf("UPDATE %s SET state = ?, data_size = ?, update_time = ? WHERE id = ?",
+		db.BackupsTab), b.State, b.DataSize, t, b.Id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		if _, err := r.Get(b.Id); err != nil {
+			return err
+		}
+	}
+	b.UpdateTime = t
+	return nil
+}
+
+func (r *sqlBackups) Delete(id string) error {
+	var children int
+	if err := r.handle.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE parent_id = ?",
+		db.BackupsTab), id).Scan(&children); err != nil {
+		return err
+	}
+	if children > 0 {
+		return ErrBackupInUse
+	}
+
+	result, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", db.BackupsTab), id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+type sqlRestores struct {
+	handle *sql.DB
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+//先更新，记录不存在时再插入
+func (r *sqlRestores) Save(restore *Restore) error {
+	t := utils.CurrentTime()
+	result, err := r.handle.Exec(fmt.Sprintf("UPDATE %s SET backup_id = ?, in_place = ?, prepared = ?, step = ?, extent = ?, update_time = ? WHERE pool_name = ? AND volume_name = ?",
+		db.RestoresTab), restore.BackupId, boolToInt(restore.InPlace), boolToInt(restore.Prepared), restore.Step, restore.Extent, t,
+		restore.Pool, restore.Volume)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		restore.UpdateTime = t
+		return err
+	}
+
+	_, err = r.handle.Exec(fmt.Sprintf("INSERT INTO %s (pool_name, volume_name, backup_id, in_place, prepared, step, extent, create_time, update_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		db.RestoresTab), restore.Pool, restore.Volume, restore.BackupId, boolToInt(restore.InPlace), boolToInt(restore.Prepared),
+		restore.Step, restore.Extent, t, t)
+	//MySQL对未改变的行返回0，记录其实已存在
+	if err != nil && !isDuplicate(err) {
+		return err
+	}
+	restore.UpdateTime = t
+	if restore.CreateTime == "" {
+		restore.CreateTime = t
+	}
+	return nil
+}
+
+func (r *sqlRestores) Get(pool string, volume string) (*Restore, error) {
+	restore := &Restore{}
+	var inPlace, prepared int
+	err := r.handle.QueryRow(fmt.Sprintf("SELECT pool_name, volume_name, backup_id, in_place, prepared, step, extent, create_time, update_time FROM %s WHERE pool_name = ? AND volume_name = ?",
+		db.RestoresTab), pool, volume).Scan(&restore.Pool, &restore.Volume, &restore.BackupId, &inPlace, &prepared,
+		&restore.Step, &restore.Extent, &restore.CreateTime, &restore.UpdateTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	restore.InPlace, restore.Prepared = inPlace != 0, prepared != 0
+	return restore, nil
+}
+
+func (r *sqlRestores) List() ([]*Restore, error) {
+	rows, err := r.handle.Query(fmt.Sprintf("SELECT pool_name, volume_name, backup_id, in_place, prepared, step, extent, create_time, update_time FROM %s ORDER BY pool_name, volume_name",
+		db.RestoresTab))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var restores []*Restore
+	for rows.Next() {
+		restore := &Restore{}
+		var inPlace, prepared int
+		if err := rows.Scan(&restore.Pool, &restore.Volume, &restore.BackupId, &inPlace, &prepared,
+			&restore.Step, &restore.Extent, &restore.CreateTime, &restore.UpdateTime); err != nil {
+			return nil, err
+		}
+		restore.InPlace, restore.Prepared = inPlace != 0, prepared != 0
+		restores = append(restores, restore)
+	}
+	return restores, rows.Err()
+}
+
+func (r *sqlRestores) Delete(pool string, volume string) error {
+	result, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE pool_name = ? AND volume_name = ?",
+		db.RestoresTab), pool, volume)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+type sqlQoS struct {
+	handle *sql.DB
+}
+
+func (r *sqlQoS) Save(q *VolumeQoS) error {
+	t := utils.CurrentTime()
+	result, err := r.handle.Exec(fmt.Sprintf("UPDATE %s SET read_iops = ?, write_iops = ?, read_bps = ?, write_bps = ?, burst = ?, update_time = ? WHERE pool_name = ? AND volume_name = ?",
+		db.VolumeQoSTab), q.ReadIOPS, q.WriteIOPS, q.ReadBps, q.WriteBps, q.Burst, t, q.Pool, q.Volume)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		q.UpdateTime = t
+		return err
+	}
+
+	_, err = r.handle.Exec(fmt.Sprintf("INSERT INTO %s (pool_name, volume_name, read_iops, write_iops, read_bps, write_bps, burst, create_time, update_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		db.VolumeQoSTab), q.Pool, q.Volume, q.ReadIOPS, q.WriteIOPS, q.ReadBps, q.WriteBps, q.Burst, t, t)
+	if err != nil && !isDuplicate(err) {
+		return err
+	}
+	q.UpdateTime = t
+	if q.CreateTime == "" {
+		q.CreateTime = t
+	}
+	return nil
+}
+
+func (r *sqlQoS) Get(pool string, volume string) (*VolumeQoS, error) {
+	q := &VolumeQoS{}
+	err := r.handle.QueryRow(fmt.Sprintf("SELECT pool_name, volume_name, read_iops, write_iops, read_bps, write_bps, burst, create_time, update_time FROM %s WHERE pool_name = ? AND volume_name = ?",
+		db.VolumeQoSTab), pool, volume).Scan(&q.Pool, &q.Volume, &q.ReadIOPS, &q.WriteIOPS, &q.ReadBps, &q.WriteBps,
+		&q.Burst, &q.CreateTime, &q.UpdateTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (r *sqlQoS) Delete(pool string, volume string) error {
+	result, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE pool_name = ? AND volume_name = ?",
+		db.VolumeQoSTab), pool, volume)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+type sqlTags struct {
+	handle *sql.DB
+}
+
+const tagColumns = "pool_name, volume_name, tag_key, tag_value, create_time"
+
+func (r *sqlTags) Set(t *VolumeTag) error {
+	result, err := r.handle.Exec(fmt.Sprintf("UPDATE %s SET tag_value = ? WHERE pool_name = ? AND volume_name = ? AND tag_key = ?",
+		db.VolumeTagsTab), t.Value, t.Pool, t.Volume, t.Key)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	t.CreateTime = utils.CurrentTime()
+	_, err = r.handle.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?)", db.VolumeTagsTab, tagColumns),
+		t.Pool, t.Volume, t.Key, t.Value, t.CreateTime)
+	if err != nil && !isDuplicate(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *sqlTags) Remove(pool string, volume string, key string) error {
+	result, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE pool_name = ? AND volume_name = ? AND tag_key = ?",
+		db.VolumeTagsTab), pool, volume, key)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+func (r *sqlTags) query(where string, args ...interface{}) ([]*VolumeTag, error) {
+	rows, err := r.handle.Query(fmt.Sprintf("SELECT %s FROM %s%s ORDER BY pool_name, volume_name, tag_key",
+		tagColumns, db.VolumeTagsTab, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []*VolumeTag
+	for rows.Next() {
+		t := &VolumeTag{}
+		if err := rows.Scan(&t.Pool, &t.Volume, &t.Key, &t.Value, &t.CreateTime); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+func (r *sqlTags) List(pool string, volume string) ([]*VolumeTag, error) {
+	switch {
+	case pool == "":
+		return r.query("")
+	case volume == "":
+		return r.query(" WHERE pool_name = ?", pool)
+	}
+	return r.query(" WHERE pool_name = ? AND volume_name = ?", pool, volume)
+}
+
+func (r *sqlTags) Find(key string, value string) ([]*VolumeTag, error) {
+	if value == "" {
+		return r.query(" WHERE tag_key = ?", key)
+	}
+	return r.query(" WHERE tag_key = ? AND tag_value = ?", key, value)
+}
+
+func (r *sqlTags) DeleteVolume(pool string, volume string) error {
+	_, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE pool_name = ? AND volume_name = ?",
+		db.VolumeTagsTab), pool, volume)
+	return err
+}
+
+type sqlTenants struct {
+	handle  *sql.DB
+	secrets *secretBox
+}
+
+const tenantColumns = "name, access_key, secret_key, pool_name, ceph_user, ceph_key, max_volumes, max_gb, max_snapshots, create_time, update_time"
+
+func (r *sqlTenants) scan(row scanner) (*Tenant, error) {
+	t := &Tenant{}
+	var secret, cephKey string
+	if err := row.Scan(&t.Name, &t.AccessKey, &secret, &t.Pool, &t.CephUser, &cephKey, &t.MaxVolumes, &t.MaxGB,
+		&t.MaxSnapshots, &t.CreateTime, &t.UpdateTime); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if t.SecretKey, err = r.secrets.open(secret); err != nil {
+		return nil, err
+	}
+	if t.CephKey, err = r.secrets.open(cephKey); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *sqlTenants) Create(t *Tenant) error {
+	secret, err := r.secrets.seal(t.SecretKey)
+	if err != nil {
+		return err
+	}
+	cephKey, err := r.secrets.seal(t.CephKey)
+	if err != nil {
+		return err
+	}
+
+	now := utils.CurrentTime()
+	_, err = r.handle.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", db.TenantsTab, tenantColumns),
+		t.Name, t.AccessKey, secret, t.Pool, t.CephUser, cephKey, t.MaxVolumes, t.MaxGB, t.MaxSnapshots, now, now)
+	if err != nil {
+		if isDuplicate(err) {
+			return ErrExist
+		}
+		return err
+	}
+	t.CreateTime, t.UpdateTime = now, now
+	return nil
+}
+
+func (r *sqlTenants) get(column string, value string) (*Tenant, error) {
+	row := r.handle.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", tenantColumns, db.TenantsTab, column), value)
+	t, err := r.scan(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return t, err
+}
+
+func (r *sqlTenants) Get(name string) (*Tenant, error) {
+	return r.get("name", name)
+}
+
+func (r *sqlTenants) GetByAccessKey(accessKey string) (*Tenant, error) {
+	return r.get("access_key", accessKey)
+}
+
+func (r *sqlTenants) GetByPool(pool string) (*Tenant, error) {
+	return r.get("pool_name", pool)
+}
+
+func (r *sqlTenants) List() ([]*Tenant, error) {
+	rows, err := r.handle.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY name", tenantColumns, db.TenantsTab))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []*Tenant
+	for rows.Next() {
+		t, err := r.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+func (r *sqlTenants) UpdateLimits(t *Tenant) error {
+	now := utils.CurrentTime()
+	result, err := r.handle.Exec(fmt.Sprintf("UPDATE %s SET max_volumes = ?, max_gb = ?, max_snapshots = ?, update_time = ? WHERE name = ?",
+		db.TenantsTab), t.MaxVolumes, t.MaxGB, t.MaxSnapshots, now, t.Name)
+	if err != nil {
+		return err
+	}
+	//MySQL对未改变的行返回0，需要再确认记录是否存在
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		if _, err := r.Get(t.Name); err != nil {
+			return err
+		}
+	}
+	t.UpdateTime = now
+	return nil
+}
+
+func (r *sqlTenants) Delete(name string) error {
+	result, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE name = ?", db.TenantsTab), name)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+type sqlPolicies struct {
+	handle *sql.DB
+}
+
+const policyColumns = "name, schedule, minute, hour, weekday, retention, name_template, create_time, update_time"
+
+func scanPolicy(row scanner) (*SnapshotPolicy, error) {
+	p := &SnapshotPolicy{}
+	if err := row.Scan(&p.Name, &p.Schedule, &p.Minute, &p.Hour, &p.Weekday, &p.Retention, &p.NameTemplate,
+		&p.CreateTime, &p.UpdateTime); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (r *sqlPolicies) Create(p *SnapshotPolicy) error {
+	t := utils.CurrentTime()
+	_, err := r.handle.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", db.SnapshotPoliciesTab, policyColumns),
+		p.Name, p.Schedule, p.Minute, p.Hour, p.Weekday, p.Retention, p.NameTemplate, t, t)
+	if err != nil {
+		if isDuplicate(err) {
+			return ErrExist
+		}
+		return err
+	}
+	p.CreateTime, p.UpdateTime = t, t
+	return nil
+}
+
+func (r *sqlPolicies) Get(name string) (*SnapshotPolicy, error) {
+	row := r.handle.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE name = ?", policyColumns, db.SnapshotPoliciesTab), name)
+	p, err := scanPolicy(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return p, err
+}
+
+func (r *sqlPolicies) List() ([]*SnapshotPolicy, error) {
+	rows, err := r.handle.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY name", policyColumns, db.SnapshotPoliciesTab))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []*SnapshotPolicy
+	for rows.Next() {
+		p, err := scanPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+func (r *sqlPolicies) Delete(name string) error {
+	tx, err := r.handle.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE policy_name = ?", db.SnapshotPolicyTargetsTab), name); err != nil {
+		return err
+	}
+	result, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE name = ?", db.SnapshotPoliciesTab), name)
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(result); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *sqlPolicies) Attach(t *PolicyTarget) error {
+	now := utils.CurrentTime()
+	_, err := r.handle.Exec(fmt.Sprintf("INSERT INTO %s (policy_name, pool_name, volume_name, create_time) VALUES (?, ?, ?, ?)",
+		db.SnapshotPolicyTargetsTab), t.Policy, t.Pool, t.Volume, now)
+	if err != nil {
+		if isDuplicate(err) {
+			return ErrExist
+		}
+		return err
+	}
+	t.CreateTime = now
+	return nil
+}
+
+func (r *sqlPolicies) Detach(policy string, pool string, volume string) error {
+	result, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE policy_name = ? AND pool_name = ? AND volume_name = ?",
+		db.SnapshotPolicyTargetsTab), policy, pool, volume)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+func (r *sqlPolicies) Targets(policy string) ([]*PolicyTarget, error) {
+	var rows *sql.Rows
+	var err error
+	if policy == "" {
+		rows, err = r.handle.Query(fmt.Sprintf("SELECT policy_name, pool_name, volume_name, create_time FROM %s ORDER BY policy_name, pool_name, volume_name",
+			db.SnapshotPolicyTargetsTab))
+	} else {
+		rows, err = r.handle.Query(fmt.Sprintf("SELECT policy_name, pool_name, volume_name, create_time FROM %s WHERE policy_name = ? ORDER BY pool_name, volume_name",
+			db.SnapshotPolicyTargetsTab), policy)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []*PolicyTarget
+	for rows.Next() {
+		t := &PolicyTarget{}
+		if err := rows.Scan(&t.Policy, &t.Pool, &t.Volume, &t.CreateTime); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+type sqlSnapshotRuns struct {
+	handle *sql.DB
+}
+
+const runColumns = "policy_name, pool_name, volume_name, scheduled_time, snapshot, state, error, create_time, update_time"
+
+func scanRun(row scanner) (*SnapshotRun, error) {
+	run := &SnapshotRun{}
+	var reason sql.NullString
+	if err := row.Scan(&run.Policy, &run.Pool, &run.Volume, &run.ScheduledTime, &run.Snapshot, &run.State, &reason,
+		&run.CreateTime, &run.UpdateTime); err != nil {
+		return nil, err
+	}
+	run.Error = reason.String
+	return run, nil
+}
+
+//先更新，记录不存在时再插入
+func (r *sqlSnapshotRuns) Save(run *SnapshotRun) error {
+	t := utils.CurrentTime()
+	result, err := r.handle.Exec(fmt.Sprintf("UPDATE %s SET snapshot = ?, state = ?, error = ?, update_time = ? WHERE policy_name = ? AND pool_name = ? AND volume_name = ? AND scheduled_time = ?",
+		db.SnapshotRunsTab), run.Snapshot, run.State, run.Error, t, run.Policy, run.Pool, run.Volume, run.ScheduledTime)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		run.UpdateTime = t
+		return err
+	}
+
+	_, err = r.handle.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", db.SnapshotRunsTab, runColumns),
+		run.Policy, run.Pool, run.Volume, run.ScheduledTime, run.Snapshot, run.State, run.Error, t, t)
+	//MySQL对未改变的行返回0，记录其实已存在
+	if err != nil && !isDuplicate(err) {
+		return err
+	}
+	run.UpdateTime = t
+	if run.CreateTime == "" {
+		run.CreateTime = t
+	}
+	return nil
+}
+
+func (r *sqlSnapshotRuns) Get(policy string, pool string, volume string, scheduledTime string) (*SnapshotRun, error) {
+	row := r.handle.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE policy_name = ? AND pool_name = ? AND volume_name = ? AND scheduled_time = ?",
+		runColumns, db.SnapshotRunsTab), policy, pool, volume, scheduledTime)
+	run, err := scanRun(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return run, err
+}
+
+func (r *sqlSnapshotRuns) List(policy string, pool string, volume string, state string) ([]*SnapshotRun, error) {
+	var conds []string
+	var args []interface{}
+	for _, f := range []struct {
+		column string
+		value  string
+	}{{"policy_name", policy}, {"pool_name", pool}, {"volume_name", volume}, {"state", state}} {
+		if f.value != "" {
+			conds = append(conds, f.column+" = ?")
+			args = append(args, f.value)
+		}
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	rows, err := r.handle.Query(fmt.Sprintf("SELECT %s FROM %s%s ORDER BY scheduled_time, policy_name, pool_name, volume_name",
+		runColumns, db.SnapshotRunsTab, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*SnapshotRun
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+type sqlLeases struct {
+	handle *sql.DB
+}
+
+//租约时间使用UTC，各实例时区不同也能比较
+const leaseTimeLayout = "2006-01-02 15:04:05"
+
+//MySQL对未改变的行返回0，所以更新后重新读取持有者
+func (r *sqlLeases) Acquire(name string, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	current := now.UTC().Format(leaseTimeLayout)
+	expire := now.Add(ttl).UTC().Format(leaseTimeLayout)
+	_, err := r.handle.Exec(fmt.Sprintf("UPDATE %s SET holder = ?, expire_time = ? WHERE name = ? AND (holder = ? OR expire_time < ?)",
+		db.LeasesTab), holder, expire, name, holder, current)
+	if err != nil {
+		return false, err
+	}
+
+	var owner string
+	err = r.handle.QueryRow(fmt.Sprintf("SELECT holder FROM %s WHERE name = ?", db.LeasesTab), name).Scan(&owner)
+	if err == sql.ErrNoRows {
+		_, err = r.handle.Exec(fmt.Sprintf("INSERT INTO %s (name, holder, expire_time) VALUES (?, ?, ?)", db.LeasesTab),
+			name, holder, expire)
+		if err == nil {
+			return true, nil
+		}
+		if !isDuplicate(err) {
+			return false, err
+		}
+		err = r.handle.QueryRow(fmt.Sprintf("SELECT holder FROM %s WHERE name = ?", db.LeasesTab), name).Scan(&owner)
+	}
+	if err != nil {
+		return false, err
+	}
+	return owner == holder, nil
+}
+
+func (r *sqlLeases) Release(name string, holder string) error {
+	_, err := r.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE name = ? AND holder = ?", db.LeasesTab), name, holder)
+	return err
+}
@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"fmt"
+)
+
+type VolumeState string
+
+const (
+	StateCreating  VolumeState = "creating"
+	StateAvailable VolumeState = "available"
+	StateAttaching VolumeState = "attaching"
+	StateInUse     VolumeState = "in-use"
+	StateDetaching VolumeState = "detaching"
+	StateDeleting  VolumeState = "deleting"
+	StateRestoring VolumeState = "restoring"
+	StateError     VolumeState = "error"
+)
+
+// transitions lists, for each state, the states it may move to. A failed
+// operation returns to the state it started from, or to error when the
+// rollback itself fails. An in-use volume may be attached to further
+// initiators. A restore that failed leaves the volume in error and may be
+// resumed from there.
+var transitions = map[VolumeState][]VolumeState{
+	StateCreating:  {StateAvailable, StateRestoring, StateError},
+	StateAvailable: {StateAttaching, StateDeleting, StateRestoring, StateError},
+	StateAttaching: {StateInUse, StateAvailable, StateError},
+	StateInUse:     {StateAttaching, StateDetaching, StateError},
+	StateDetaching: {StateAvailable, StateInUse, StateError},
+	StateDeleting:  {StateAvailable, StateError},
+	StateRestoring: {StateAvailable, StateError},
+	StateError:     {StateDeleting, StateAvailable, StateRestoring},
+}
+
+// InvalidTransitionError reports a transition the state machine forbids.
+type InvalidTransitionError struct {
+	From VolumeState
+	To   VolumeState
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("Invalid volume state transition from %v to %v", e.From, e.To)
+}
+
+func (s VolumeState) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// Busy reports whether an operation is in progress on a volume in state s.
+func (s VolumeState) Busy() bool {
+	switch s {
+	case StateCreating, StateAttaching, StateDetaching, StateDeleting, StateRestoring:
+		return true
+	}
+	return false
+}
+
+// CheckTransition is the single place where volume state changes are
+// validated; every repository calls it before writing a new state.
+func CheckTransition(from VolumeState, to VolumeState) error {
+	for _, s := range transitions[from] {
+		if s == to {
+			return nil
+		}
+	}
+	return &InvalidTransitionError{From: from, To: to}
+}
@@ -0,0 +1,198 @@
+package repository
+
+import (
+	"sync"
+	"testing"
+)
+
+var allStates = []VolumeState{
+	StateCreating, StateAvailable, StateAttaching, StateInUse,
+	StateDetaching, StateDeleting, StateRestoring, StateError,
+}
+
+func TestCheckTransition(t *testing.T) {
+	allowed := map[VolumeState][]VolumeState{
+		StateCreating:  {StateAvailable, StateRestoring, StateError},
+		StateAvailable: {StateAttaching, StateDeleting, StateRestoring, StateError},
+		StateAttaching: {StateInUse, StateAvailable, StateError},
+		StateInUse:     {StateAttaching, StateDetaching, StateError},
+		StateDetaching: {StateAvailable, StateInUse, StateError},
+		StateDeleting:  {StateAvailable, StateError},
+		StateRestoring: {StateAvailable, StateError},
+		StateError:     {StateDeleting, StateAvailable, StateRestoring},
+	}
+	for _, from := range allStates {
+		for _, to := range allStates {
+			want := false
+			for _, s := range allowed[from] {
+				want = want || s == to
+			}
+			err := CheckTransition(from, to)
+			if (err == nil) != want {
+				t.Errorf("CheckTransition(%v, %v) = %v, want allowed %v", from, to, err, want)
+			}
+			if e, ok := err.(*InvalidTransitionError); err != nil && (!ok || e.From != from || e.To != to) {
+				t.Errorf("CheckTransition(%v, %v) = %#v", from, to, err)
+			}
+		}
+	}
+	if err := CheckTransition("bogus", StateAvailable); err == nil {
+		t.Error("transition from an unknown state allowed")
+	}
+}
+
+func TestStates(t *testing.T) {
+	busy := map[VolumeState]bool{
+		StateCreating: true, StateAttaching: true, StateDetaching: true,
+		StateDeleting: true, StateRestoring: true,
+	}
+	for _, s := range allStates {
+		if !s.Valid() {
+			t.Errorf("%v not valid", s)
+		}
+		if s.Busy() != busy[s] {
+			t.Errorf("%v busy %v, want %v", s, s.Busy(), busy[s])
+		}
+		// An interrupted operation can always be marked failed.
+		if s.Busy() && CheckTransition(s, StateError) != nil {
+			t.Errorf("busy state %v can not move to error", s)
+		}
+	}
+	if VolumeState("bogus").Valid() {
+		t.Error("unknown state valid")
+	}
+}
+
+func TestMemoryTransition(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to VolumeState
+		volume   string
+		err      error
+		state    VolumeState
+	}{
+		{"allowed", StateCreating, StateAvailable, "vol", nil, StateAvailable},
+		{"stale from", StateAvailable, StateAttaching, "vol", ErrStateChanged, StateCreating},
+		{"forbidden", StateCreating, StateInUse, "vol", &InvalidTransitionError{StateCreating, StateInUse}, StateCreating},
+		{"missing volume", StateCreating, StateAvailable, "missing", ErrNotFound, StateCreating},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			if err := store.Volumes().Create(&Volume{Pool: "rbd", Name: "vol", State: StateCreating}); err != nil {
+				t.Fatal(err)
+			}
+			err := store.Volumes().Transition("rbd", tt.volume, tt.from, tt.to)
+			if e, ok := tt.err.(*InvalidTransitionError); ok {
+				if got, ok := err.(*InvalidTransitionError); !ok || *got != *e {
+					t.Errorf("Transition = %v, want %v", err, tt.err)
+				}
+			} else if err != tt.err {
+				t.Errorf("Transition = %v, want %v", err, tt.err)
+			}
+			v, err := store.Volumes().Get("rbd", "vol")
+			if err != nil || v.State != tt.state {
+				t.Errorf("state %v, %v, want %v", v.State, err, tt.state)
+			}
+		})
+	}
+}
+
+func TestMemoryCreate(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.Volumes().Create(&Volume{Pool: "rbd", Name: "vol", State: StateAvailable}); err == nil {
+		t.Error("volume created in state available")
+	}
+	if err := store.Volumes().Create(&Volume{Pool: "rbd", Name: "vol", State: StateCreating}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Volumes().Create(&Volume{Pool: "rbd", Name: "vol", State: StateCreating}); err != ErrExist {
+		t.Errorf("second Create = %v", err)
+	}
+
+	// Update leaves the state to Transition.
+	if err := store.Volumes().Update(&Volume{Pool: "rbd", Name: "vol", Size: 1 << 30, DevPath: "/dev/rbd0",
+		State: StateInUse}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := store.Volumes().Get("rbd", "vol")
+	if err != nil || v.State != StateCreating || v.Size != 1<<30 || v.DevPath != "/dev/rbd0" {
+		t.Errorf("volume after Update %+v, %v", v, err)
+	}
+}
+
+// Of concurrent operations starting from the same state only one wins.
+func TestMemoryTransitionRace(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.Volumes().Create(&Volume{Pool: "rbd", Name: "vol", State: StateCreating}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Volumes().Transition("rbd", "vol", StateCreating, StateAvailable); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []VolumeState{StateAttaching, StateDeleting, StateRestoring, StateAttaching, StateDeleting}
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, to := range targets {
+		wg.Add(1)
+		go func(i int, to VolumeState) {
+			defer wg.Done()
+			errs[i] = store.Volumes().Transition("rbd", "vol", StateAvailable, to)
+		}(i, to)
+	}
+	wg.Wait()
+
+	won := 0
+	for i, err := range errs {
+		switch err {
+		case nil:
+			won++
+			if v, _ := store.Volumes().Get("rbd", "vol"); v.State != targets[i] {
+				t.Errorf("state %v, winner moved to %v", v.State, targets[i])
+			}
+		case ErrStateChanged:
+		default:
+			t.Errorf("Transition to %v = %v", targets[i], err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%v transitions won, want 1", won)
+	}
+}
+
+func TestMemoryAttachments(t *testing.T) {
+	store := NewMemoryStore()
+	attachments := []*Attachment{
+		{Pool: "rbd", Volume: "vol", Client: "iqn.1994-05.com.redhat:b"},
+		{Pool: "rbd", Volume: "vol", Client: "a", Transport: TransportNBD, Export: "rbd/vol/1f", Allow: "10.0.0.1/32"},
+		{Pool: "rbd", Volume: "other", Client: "a", Transport: TransportNBD},
+	}
+	for _, a := range attachments {
+		if err := store.Attachments().Add(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Attachments().Add(&Attachment{Pool: "rbd", Volume: "vol", Client: "a"}); err != ErrExist {
+		t.Errorf("duplicate Add = %v", err)
+	}
+
+	list, err := store.Attachments().List("rbd", "vol")
+	if err != nil || len(list) != 2 {
+		t.Fatalf("List = %+v, %v", list, err)
+	}
+	nbd, iscsi := list[0], list[1]
+	if nbd.Client != "a" || nbd.Export != "rbd/vol/1f" || nbd.Allow != "10.0.0.1/32" || nbd.Transport != TransportNBD {
+		t.Errorf("NBD attachment %+v", nbd)
+	}
+	if iscsi.Transport != TransportISCSI || iscsi.Export != "" {
+		t.Errorf("iSCSI attachment %+v", iscsi)
+	}
+
+	if err := store.Attachments().Remove("rbd", "vol", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Attachments().Remove("rbd", "vol", "a"); err != ErrNotFound {
+		t.Errorf("second Remove = %v", err)
+	}
+}
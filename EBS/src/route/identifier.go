@@ -6,12 +6,47 @@ const (
 	createPoolAction      = "CreatePool"
 	infoPoolAction        = "InfoPool"
 	infoPoolIOAction      = "InfoPoolIO"
+	poolIOHistoryAction   = "InfoPoolIOHistory"
 	delPoolAction         = "DelPool"
 	modPoolRepSizeAction  = "ModPoolRepSize"
+	setPoolQuotaAction    = "SetPoolQuota"
+	infoPoolQuotaAction   = "InfoPoolQuota"
 	createDiskAction      = "CreateDisk"
 	delDiskAction         = "DelDisk"
 	extendDiskAction      = "ExtendDisk"
 	attachDiskAction      = "AttachDisk"
 	detachDiskAction      = "DetachDisk"
 	backupDiskAction      = "BackupDisk"
+	infoClusterAction     = "InfoCluster"
+	describeJobAction     = "DescribeJob"
+	copyVolumeAction      = "CopyVolume"
+	describeAttachAction  = "DescribeAttachment"
+	listBackupsAction     = "ListBackups"
+	restoreDiskAction     = "RestoreDisk"
+	infoVolumeAction      = "InfoVolume"
+	delVolumeAction       = "DelVolume"
+	resizeVolumeAction    = "ResizeVolume"
+	createSnapAction      = "CreateSnapshot"
+	infoSnapAction        = "InfoSnapshot"
+	delSnapAction         = "DelSnapshot"
+	rollbackSnapAction    = "RollbackSnapshot"
+	protectSnapAction     = "ProtectSnapshot"
+	unprotectSnapAction   = "UnprotectSnapshot"
+	cloneSnapAction       = "CloneFromSnapshot"
+	flattenVolumeAction   = "FlattenVolume"
+	createPolicyAction    = "CreateSnapshotPolicy"
+	delPolicyAction       = "DelSnapshotPolicy"
+	listPoliciesAction    = "ListSnapshotPolicies"
+	attachPolicyAction    = "AttachSnapshotPolicy"
+	detachPolicyAction    = "DetachSnapshotPolicy"
+	listSnapRunsAction    = "ListSnapshotRuns"
+	updateFeaturesAction  = "UpdateVolumeFeatures"
+	modifyQoSAction       = "ModifyVolumeQoS"
+	tagVolumeAction       = "TagVolume"
+	untagVolumeAction     = "UntagVolume"
+	listVolumesAction     = "ListVolumes"
+	createTenantAction    = "CreateTenant"
+	delTenantAction       = "DelTenant"
+	infoTenantAction      = "InfoTenant"
+	modifyTenantAction    = "ModifyTenantQuota"
 )
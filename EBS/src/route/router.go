@@ -4,11 +4,72 @@ import (
 	"net/http"
 	"fmt"
 	"os"
+	"strings"
+	"crypto/rand"
+	"encoding/hex"
 	"processor"
+	"github.com/gin-gonic/gin"
 )
 
 func Init() {
-	http.HandleFunc("/", httpRoute)
+	http.Handle("/", newEngine())
+}
+
+//GET /?Action=的旧接口和/v1的REST接口共用一个gin引擎
+func newEngine() *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(gin.Recovery(), requestID)
+	engine.HandleMethodNotAllowed = true
+
+	initV1(engine.Group(v1Prefix))
+	engine.NoMethod(v1NoRoute)
+
+	//其余路径都交给旧接口，与原来的http.HandleFunc("/")一致
+	legacy := gin.WrapF(authenticate(httpRoute))
+	engine.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, v1Prefix + "/") {
+			v1NoRoute(c)
+			return
+		}
+		legacy(c)
+	})
+	return engine
+}
+
+//每个应答都带X-Request-Id，客户端传入的合法ID原样使用，否则生成一个
+func requestID(c *gin.Context) {
+	id := c.GetHeader(processor.RequestIDHeader)
+	if !isValidRequestID(id) {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	c.Header(processor.RequestIDHeader, id)
+	c.Next()
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, ch := range id {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '_' || ch == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+//校验签名后再分发请求
+func authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, ok := processor.Authenticate(w, r)
+		if !ok {
+			return
+		}
+		next(w, r)
+	}
 }
 
 func httpRoute(w http.ResponseWriter, r *http.Request) {
@@ -21,6 +82,15 @@ func httpRoute(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	action := r.FormValue("Action")
 
+	//租户签名的请求只能调用卷相关的接口，只能访问租户自己的pool
+	if !processor.AuthorizeTenant(w, r, isTenantAction(action)) {
+		return
+	}
+	dispatch(w, r, action)
+}
+
+//按Action调用processor的接口，/v1接口也通过这里调用
+func dispatch(w http.ResponseWriter, r *http.Request, action string) {
 	switch {
 	case isExportVolume(action):
 		processor.ExportVolume(w, r)
@@ -30,10 +100,16 @@ func httpRoute(w http.ResponseWriter, r *http.Request) {
 		processor.InfoPools(w, r)
 	case isInfoPoolIO(action):
 		processor.InfoPoolsIO(w, r)
+	case isInfoPoolIOHistory(action):
+		processor.InfoPoolIOHistory(w, r)
 	case isDelPool(action):
 		processor.DelPool(w, r)
 	case isModPoolReplicaSize(action):
 		processor.ModPoolRepSize(w,r )
+	case isSetPoolQuota(action):
+		processor.SetPoolQuota(w, r)
+	case isInfoPoolQuota(action):
+		processor.InfoPoolQuota(w, r)
 	case isCreateDisk(action):
 		processor.CreateDisk(w, r)
 	case isDelDisk(action):
@@ -46,10 +122,75 @@ func httpRoute(w http.ResponseWriter, r *http.Request) {
 		processor.DetachDisk(w, r)
 	case isBackupDisk(action):
 		processor.BackupDisk(w, r)
+	case isInfoCluster(action):
+		processor.InfoCluster(w, r)
+	case isDescribeJob(action):
+		processor.DescribeJob(w, r)
+	case isCopyVolume(action):
+		processor.CopyVolume(w, r)
+	case isDescribeAttachment(action):
+		processor.DescribeAttachment(w, r)
+	case isListBackups(action):
+		processor.ListBackups(w, r)
+	case isRestoreDisk(action):
+		processor.RestoreDisk(w, r)
+	case isInfoVolume(action):
+		processor.InfoVolumes(w, r)
+	case isDelVolume(action):
+		processor.DelVolume(w, r)
+	case isResizeVolume(action):
+		processor.ResizeVolume(w, r)
+	case isCreateSnapshot(action):
+		processor.CreateSnapshot(w, r)
+	case isInfoSnapshot(action):
+		processor.InfoSnapshot(w, r)
+	case isDelSnapshot(action):
+		processor.DelSnapshot(w, r)
+	case isRollbackSnapshot(action):
+		processor.RollbackSnapshot(w, r)
+	case isProtectSnapshot(action):
+		processor.ProtectSnapshot(w, r)
+	case isUnprotectSnapshot(action):
+		processor.UnprotectSnapshot(w, r)
+	case isCloneFromSnapshot(action):
+		processor.CloneFromSnapshot(w, r)
+	case isFlattenVolume(action):
+		processor.FlattenVolume(w, r)
+	case isCreateSnapshotPolicy(action):
+		processor.CreateSnapshotPolicy(w, r)
+	case isDelSnapshotPolicy(action):
+		processor.DelSnapshotPolicy(w, r)
+	case isListSnapshotPolicies(action):
+		processor.ListSnapshotPolicies(w, r)
+	case isAttachSnapshotPolicy(action):
+		processor.AttachSnapshotPolicy(w, r)
+	case isDetachSnapshotPolicy(action):
+		processor.DetachSnapshotPolicy(w, r)
+	case isListSnapshotRuns(action):
+		processor.ListSnapshotRuns(w, r)
+	case isUpdateVolumeFeatures(action):
+		processor.UpdateVolumeFeatures(w, r)
+	case isModifyVolumeQoS(action):
+		processor.ModifyVolumeQoS(w, r)
+	case isTagVolume(action):
+		processor.TagVolume(w, r)
+	case isUntagVolume(action):
+		processor.UntagVolume(w, r)
+	case isListVolumes(action):
+		processor.ListVolumes(w, r)
+	case isCreateTenant(action):
+		processor.CreateTenant(w, r)
+	case isDelTenant(action):
+		processor.DelTenant(w, r)
+	case isInfoTenant(action):
+		processor.InfoTenant(w, r)
+	case isModifyTenantQuota(action):
+		processor.ModifyTenantQuota(w, r)
 	case isTest(action):
 		processor.Test(w, r)
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown request: %v\n", r.RequestURI)
+		processor.SendInvalidAction(w, action)
 	}
 }
 
@@ -77,6 +218,10 @@ func isInfoPoolIO(action string) bool {
 	return action == infoPoolIOAction
 }
 
+func isInfoPoolIOHistory(action string) bool {
+	return action == poolIOHistoryAction
+}
+
 func isDelPool(action string) bool {
 	return action == delPoolAction
 }
@@ -85,6 +230,14 @@ func isModPoolReplicaSize(action string) bool {
 	return action == modPoolRepSizeAction
 }
 
+func isSetPoolQuota(action string) bool {
+	return action == setPoolQuotaAction
+}
+
+func isInfoPoolQuota(action string) bool {
+	return action == infoPoolQuotaAction
+}
+
 func isCreateDisk(action string) bool {
 	return action == createDiskAction
 }
@@ -107,4 +260,147 @@ func isDetachDisk(action string) bool {
 
 func isBackupDisk(action string) bool {
 	return action == backupDiskAction
-}
\ No newline at end of file
+}
+
+func isInfoCluster(action string) bool {
+	return action == infoClusterAction
+}
+
+func isDescribeJob(action string) bool {
+	return action == describeJobAction
+}
+
+func isCopyVolume(action string) bool {
+	return action == copyVolumeAction
+}
+
+func isDescribeAttachment(action string) bool {
+	return action == describeAttachAction
+}
+
+func isListBackups(action string) bool {
+	return action == listBackupsAction
+}
+
+func isRestoreDisk(action string) bool {
+	return action == restoreDiskAction
+}
+
+func isInfoVolume(action string) bool {
+	return action == infoVolumeAction
+}
+
+func isDelVolume(action string) bool {
+	return action == delVolumeAction
+}
+
+func isResizeVolume(action string) bool {
+	return action == resizeVolumeAction
+}
+
+func isCreateSnapshot(action string) bool {
+	return action == createSnapAction
+}
+
+func isInfoSnapshot(action string) bool {
+	return action == infoSnapAction
+}
+
+func isDelSnapshot(action string) bool {
+	return action == delSnapAction
+}
+
+func isRollbackSnapshot(action string) bool {
+	return action == rollbackSnapAction
+}
+
+func isProtectSnapshot(action string) bool {
+	return action == protectSnapAction
+}
+
+func isUnprotectSnapshot(action string) bool {
+	return action == unprotectSnapAction
+}
+
+func isCloneFromSnapshot(action string) bool {
+	return action == cloneSnapAction
+}
+
+func isFlattenVolume(action string) bool {
+	return action == flattenVolumeAction
+}
+
+func isCreateSnapshotPolicy(action string) bool {
+	return action == createPolicyAction
+}
+
+func isDelSnapshotPolicy(action string) bool {
+	return action == delPolicyAction
+}
+
+func isListSnapshotPolicies(action string) bool {
+	return action == listPoliciesAction
+}
+
+func isAttachSnapshotPolicy(action string) bool {
+	return action == attachPolicyAction
+}
+
+func isDetachSnapshotPolicy(action string) bool {
+	return action == detachPolicyAction
+}
+
+func isListSnapshotRuns(action string) bool {
+	return action == listSnapRunsAction
+}
+
+func isUpdateVolumeFeatures(action string) bool {
+	return action == updateFeaturesAction
+}
+
+func isModifyVolumeQoS(action string) bool {
+	return action == modifyQoSAction
+}
+
+func isTagVolume(action string) bool {
+	return action == tagVolumeAction
+}
+
+func isUntagVolume(action string) bool {
+	return action == untagVolumeAction
+}
+
+func isListVolumes(action string) bool {
+	return action == listVolumesAction
+}
+
+func isCreateTenant(action string) bool {
+	return action == createTenantAction
+}
+
+func isDelTenant(action string) bool {
+	return action == delTenantAction
+}
+
+func isInfoTenant(action string) bool {
+	return action == infoTenantAction
+}
+
+func isModifyTenantQuota(action string) bool {
+	return action == modifyTenantAction
+}
+
+//租户可以调用的接口，管理pool、集群、快照策略、QoS和租户的接口只有管理员可以调用
+func isTenantAction(action string) bool {
+	switch action {
+	case exportVolumeAction, infoPoolAction, infoPoolIOAction, poolIOHistoryAction,
+		createDiskAction, delDiskAction, extendDiskAction, attachDiskAction, detachDiskAction,
+		backupDiskAction, describeJobAction, copyVolumeAction, describeAttachAction,
+		listBackupsAction, restoreDiskAction, infoVolumeAction, delVolumeAction, resizeVolumeAction,
+		createSnapAction, infoSnapAction, delSnapAction, rollbackSnapAction, protectSnapAction,
+		unprotectSnapAction, cloneSnapAction, flattenVolumeAction, updateFeaturesAction,
+		tagVolumeAction, untagVolumeAction, listVolumesAction, infoTenantAction:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,471 @@
+package route
+
+import (
+	"net/http"
+	"net/url"
+	"fmt"
+	"os"
+	"io"
+	"bytes"
+	"sort"
+	"strconv"
+	"encoding/json"
+	"processor"
+	"auth"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+/v1 REST接口：资源路径中的参数和JSON请求体中的字段转换为旧接口的参数后按Action调用processor，
+请求体字段名与旧接口的参数名相同，数组表示参数重复多次，例如
+POST /v1/pools/rbd/volumes HTTP/1.1
+Content-Type: application/json
+Authorization: EBS-HMAC-SHA256 AccessKeyId={AccessKeyId}, Timestamp={Timestamp}, Nonce={Nonce}, Signature={Signature}
+
+{"VolumeName":"vol1","Size":1073741824}
+
+应答：
+1.成功且有结果时返回200和JSON结果；没有结果时返回204
+2.后台任务返回202，{"JobId":"..."}，Location为/v1/jobs/{JobId}
+3.列表用?offset=&limit=分页，返回{"Items":[...],"TotalCount":n,"Offset":0,"Limit":100[,"NextOffset":100]}；
+  旧接口不分页，每页都先取得全部结果再截取，分页只减小应答，不减少查询的开销
+4.失败时与旧接口相同，返回4xx/5xx和{"Error":{"Code":"VolumeNotFound",...}}，见processor.SendStatus
+*/
+const (
+	v1Prefix        = "/v1"
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+//路径参数对应的旧接口参数
+var v1PathParams = map[string]string{
+	"pool":   "PoolName",
+	"vol":    "VolumeName",
+	"snap":   "Snapshot",
+	"client": "Client",
+	"backup": "BackupId",
+	"policy": "PolicyName",
+	"job":    "JobId",
+	"tenant": "TenantName",
+}
+
+//单个资源不存在时的错误码前缀，如VolumeNotFound
+var v1Resources = map[string]string{
+	"pool":   "Pool",
+	"vol":    "Volume",
+	"snap":   "Snapshot",
+	"policy": "SnapshotPolicy",
+	"tenant": "Tenant",
+}
+
+//从旧接口的JSON结果中取出列表项
+type itemsFunc func(payload []byte) ([]json.RawMessage, error)
+
+type v1Route struct {
+	method string
+	path   string
+	action string
+	//固定的旧接口参数
+	fixed  map[string]string
+	//非空时结果是分页的列表
+	items  itemsFunc
+	//非空时只返回列表中Name等于该路径参数的一项
+	item   string
+}
+
+var v1Routes = []v1Route{
+	{method: "GET", path: "/cluster", action: infoClusterAction},
+
+	{method: "GET", path: "/pools", action: infoPoolAction, fixed: map[string]string{"PoolName": "*"}, items: namedItems},
+	{method: "POST", path: "/pools", action: createPoolAction},
+	{method: "GET", path: "/pools/:pool", action: infoPoolAction, items: namedItems, item: "pool"},
+	{method: "PATCH", path: "/pools/:pool", action: modPoolRepSizeAction},
+	{method: "DELETE", path: "/pools/:pool", action: delPoolAction},
+	{method: "GET", path: "/pools/:pool/io", action: infoPoolIOAction, items: namedItems, item: "pool"},
+	{method: "GET", path: "/pools/:pool/io/history", action: poolIOHistoryAction, items: arrayItems},
+	{method: "GET", path: "/pools/:pool/quota", action: infoPoolQuotaAction},
+	{method: "PUT", path: "/pools/:pool/quota", action: setPoolQuotaAction},
+
+	{method: "GET", path: "/volumes", action: listVolumesAction, items: arrayItems},
+	//按容量选择pool，PoolName可以是pool类别
+	{method: "POST", path: "/volumes", action: createDiskAction},
+	{method: "GET", path: "/pools/:pool/volumes", action: listVolumesAction, items: arrayItems},
+	{method: "POST", path: "/pools/:pool/volumes", action: createDiskAction},
+	{method: "GET", path: "/pools/:pool/volumes/:vol", action: listVolumesAction, items: arrayItems, item: "vol"},
+	{method: "PATCH", path: "/pools/:pool/volumes/:vol", action: extendDiskAction},
+	{method: "DELETE", path: "/pools/:pool/volumes/:vol", action: delDiskAction},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/copy", action: copyVolumeAction},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/flatten", action: flattenVolumeAction},
+	{method: "PUT", path: "/pools/:pool/volumes/:vol/features", action: updateFeaturesAction},
+	{method: "PUT", path: "/pools/:pool/volumes/:vol/qos", action: modifyQoSAction},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/tags", action: tagVolumeAction},
+	{method: "DELETE", path: "/pools/:pool/volumes/:vol/tags", action: untagVolumeAction},
+	{method: "GET", path: "/pools/:pool/volumes/:vol/attachments", action: describeAttachAction, items: arrayItems},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/attachments", action: attachDiskAction},
+	{method: "DELETE", path: "/pools/:pool/volumes/:vol/attachments/:client", action: detachDiskAction},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/exports", action: exportVolumeAction},
+	{method: "GET", path: "/pools/:pool/volumes/:vol/backups", action: listBackupsAction, items: arrayItems},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/backups", action: backupDiskAction},
+
+	{method: "GET", path: "/pools/:pool/volumes/:vol/snapshots", action: infoSnapAction, items: arrayItems},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/snapshots", action: createSnapAction},
+	{method: "GET", path: "/pools/:pool/volumes/:vol/snapshots/:snap", action: infoSnapAction, items: arrayItems, item: "snap"},
+	{method: "DELETE", path: "/pools/:pool/volumes/:vol/snapshots/:snap", action: delSnapAction},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/snapshots/:snap/rollback", action: rollbackSnapAction},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/snapshots/:snap/protect", action: protectSnapAction},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/snapshots/:snap/unprotect", action: unprotectSnapAction},
+	{method: "POST", path: "/pools/:pool/volumes/:vol/snapshots/:snap/clone", action: cloneSnapAction},
+
+	//不由EBS管理的rbd镜像
+	{method: "GET", path: "/pools/:pool/images", action: infoVolumeAction, items: imageItems},
+	{method: "PATCH", path: "/pools/:pool/images/:vol", action: resizeVolumeAction},
+	{method: "DELETE", path: "/pools/:pool/images/:vol", action: delVolumeAction},
+
+	{method: "GET", path: "/backups", action: listBackupsAction, items: arrayItems},
+	{method: "POST", path: "/backups/:backup/restore", action: restoreDiskAction},
+
+	{method: "GET", path: "/jobs/:job", action: describeJobAction},
+
+	{method: "GET", path: "/snapshot-policies", action: listPoliciesAction, items: arrayItems},
+	{method: "POST", path: "/snapshot-policies", action: createPolicyAction},
+	{method: "GET", path: "/snapshot-policies/:policy", action: listPoliciesAction, items: arrayItems, item: "policy"},
+	{method: "DELETE", path: "/snapshot-policies/:policy", action: delPolicyAction},
+	{method: "POST", path: "/snapshot-policies/:policy/targets", action: attachPolicyAction},
+	{method: "DELETE", path: "/snapshot-policies/:policy/targets", action: detachPolicyAction},
+	{method: "GET", path: "/snapshot-runs", action: listSnapRunsAction, items: arrayItems},
+
+	{method: "GET", path: "/tenants", action: infoTenantAction, items: arrayItems},
+	{method: "POST", path: "/tenants", action: createTenantAction},
+	{method: "GET", path: "/tenants/:tenant", action: infoTenantAction, items: arrayItems, item: "tenant"},
+	{method: "PATCH", path: "/tenants/:tenant", action: modifyTenantAction},
+	{method: "DELETE", path: "/tenants/:tenant", action: delTenantAction},
+}
+
+func initV1(group *gin.RouterGroup) {
+	group.Use(v1Authenticate)
+	for i := range v1Routes {
+		rt := &v1Routes[i]
+		group.Handle(rt.method, rt.path, rt.handle)
+	}
+}
+
+type v1Page struct {
+	Items      []json.RawMessage
+	TotalCount int
+	Offset     int
+	Limit      int
+	NextOffset *int `json:",omitempty"`
+}
+
+func sendV1Error(c *gin.Context, code int, message string) {
+	processor.SendStatus(c.Writer, code, message)
+	c.Abort()
+}
+
+func v1NoRoute(c *gin.Context) {
+	if c.Writer.Status() == http.StatusMethodNotAllowed {
+		sendV1Error(c, http.StatusMethodNotAllowed, "")
+		return
+	}
+	sendV1Error(c, http.StatusNotFound, "")
+}
+
+//processor的接口直接写应答，先记录下来再转换为/v1的格式
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+//错误应答中要带上请求ID
+func newResponseRecorder(c *gin.Context) *responseRecorder {
+	rec := &responseRecorder{header: make(http.Header)}
+	rec.header.Set(processor.RequestIDHeader, c.Writer.Header().Get(processor.RequestIDHeader))
+	return rec
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+func (rec *responseRecorder) status() int {
+	if rec.code == 0 {
+		return http.StatusOK
+	}
+	return rec.code
+}
+
+//原样写出记录的应答，processor的错误应答已经是JSON
+func (rec *responseRecorder) writeTo(c *gin.Context) {
+	for name, values := range rec.header {
+		c.Writer.Header()[name] = values
+	}
+	c.Writer.WriteHeader(rec.status())
+	c.Writer.Write(rec.body.Bytes())
+	c.Abort()
+}
+
+//签名错误等也以JSON返回
+func v1Authenticate(c *gin.Context) {
+	rec := newResponseRecorder(c)
+	r, ok := processor.Authenticate(rec, c.Request)
+	if !ok {
+		rec.writeTo(c)
+		return
+	}
+	c.Request = r
+	c.Next()
+}
+
+//JSON值转换为旧接口的参数值，数组为多个值
+func formValues(name string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return nil, fmt.Errorf("nested array in %v", name)
+			}
+			itemValues, err := formValues(name, item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported value of %v", name)
+}
+
+//旧接口的参数：查询参数、请求体、固定参数，最后是路径参数
+func (rt *v1Route) form(c *gin.Context) (url.Values, error) {
+	form := url.Values{}
+	for name, values := range c.Request.URL.Query() {
+		if name != "offset" && name != "limit" {
+			form[name] = values
+		}
+	}
+
+	if c.Request.Body != nil {
+		decoder := json.NewDecoder(io.LimitReader(c.Request.Body, auth.MaxBodyBytes))
+		decoder.UseNumber()
+		var body map[string]interface{}
+		if err := decoder.Decode(&body); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid JSON body: %v", err)
+		}
+		for name, value := range body {
+			values, err := formValues(name, value)
+			if err != nil {
+				return nil, err
+			}
+			form.Del(name)
+			for _, v := range values {
+				form.Add(name, v)
+			}
+		}
+	}
+
+	for name, value := range rt.fixed {
+		form.Set(name, value)
+	}
+	for _, param := range c.Params {
+		form.Set(v1PathParams[param.Key], param.Value)
+	}
+	form.Set("Action", rt.action)
+	return form, nil
+}
+
+func (rt *v1Route) handle(c *gin.Context) {
+	form, err := rt.form(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", c.Request.RequestURI, err)
+		sendV1Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, limit, err := pageParams(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Request: %v %v\n", c.Request.RequestURI, err)
+		sendV1Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//按旧接口的GET请求调用，context中保留签名校验得到的租户
+	r := new(http.Request)
+	*r = *c.Request
+	u := *c.Request.URL
+	u.RawQuery = form.Encode()
+	r.URL = &u
+	r.Method = http.MethodGet
+	r.Form = form
+	r.PostForm = url.Values{}
+
+	rec := newResponseRecorder(c)
+	if processor.AuthorizeTenant(rec, r, isTenantAction(rt.action)) {
+		dispatch(rec, r, rt.action)
+	}
+	rt.reply(c, rec, offset, limit)
+}
+
+func pageParams(c *gin.Context) (int, int, error) {
+	offset, limit := 0, defaultPageSize
+	if value := c.Query("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %v", value)
+		}
+		offset = n
+	}
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxPageSize {
+			return 0, 0, fmt.Errorf("invalid limit %v", value)
+		}
+		limit = n
+	}
+	return offset, limit, nil
+}
+
+func (rt *v1Route) reply(c *gin.Context, rec *responseRecorder, offset int, limit int) {
+	code := rec.status()
+	payload := bytes.TrimSpace(rec.body.Bytes())
+	if code >= http.StatusBadRequest {
+		rec.writeTo(c)
+		return
+	}
+	//不少接口成功时只返回文本OK
+	if !json.Valid(payload) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	if code == http.StatusAccepted {
+		var reply processor.JobReply
+		if json.Unmarshal(payload, &reply) == nil && reply.JobId != "" {
+			c.Header("Location", v1Prefix + "/jobs/" + reply.JobId)
+		}
+		c.Data(code, "application/json; charset=utf-8", payload)
+		return
+	}
+	if rt.items == nil {
+		c.Data(code, "application/json; charset=utf-8", payload)
+		return
+	}
+
+	items, err := rt.items(payload)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Decode %v result failed: %v\n", rt.action, err)
+		sendV1Error(c, http.StatusInternalServerError, "")
+		return
+	}
+
+	if rt.item != "" {
+		name := c.Param(rt.item)
+		for _, item := range items {
+			var named struct{ Name string }
+			if json.Unmarshal(item, &named) == nil && named.Name == name {
+				c.Data(http.StatusOK, "application/json; charset=utf-8", item)
+				return
+			}
+		}
+		processor.SendNotFound(c.Writer, v1Resources[rt.item])
+		c.Abort()
+		return
+	}
+
+	page := v1Page{Items: []json.RawMessage{}, TotalCount: len(items), Offset: offset, Limit: limit}
+	if offset < len(items) {
+		end := offset + limit
+		if end < len(items) {
+			page.NextOffset = &end
+		} else {
+			end = len(items)
+		}
+		page.Items = items[offset:end]
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+func arrayItems(payload []byte) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	err := json.Unmarshal(payload, &items)
+	return items, err
+}
+
+//{"name":{...}}转换为按名字排序的[{"Name":"name",...}]
+func namedItems(payload []byte) ([]json.RawMessage, error) {
+	var named map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &named); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := make([]json.RawMessage, 0, len(names))
+	for _, name := range names {
+		item, err := withName(name, named[name])
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+//InfoVolume的结果为{"pool":[{"image":{...}}]}
+func imageItems(payload []byte) ([]json.RawMessage, error) {
+	var pools map[string][]map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &pools); err != nil {
+		return nil, err
+	}
+	var items []json.RawMessage
+	for _, images := range pools {
+		for _, image := range images {
+			for name, value := range image {
+				item, err := withName(name, value)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return bytes.Compare(items[i], items[j]) < 0
+	})
+	return items, nil
+}
+
+//在JSON对象的开头加上Name字段
+func withName(name string, object json.RawMessage) (json.RawMessage, error) {
+	object = bytes.TrimSpace(object)
+	if len(object) < 2 || object[0] != '{' {
+		return nil, fmt.Errorf("%v is not an object", name)
+	}
+	key, _ := json.Marshal(name)
+	item := append([]byte(`{"Name":`), key...)
+	if rest := bytes.TrimSpace(object[1:]); len(rest) > 0 && rest[0] != '}' {
+		item = append(item, ',')
+	}
+	return append(item, object[1:]...), nil
+}
@@ -0,0 +1,300 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"job"
+	"processor"
+	"repository"
+	"storage/memory"
+	"github.com/gin-gonic/gin"
+)
+
+//路径和方法对应的Action，路径参数和查询参数转换为旧接口的参数
+func TestV1Routes(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	group := engine.Group(v1Prefix)
+	var action string
+	var form url.Values
+	for i := range v1Routes {
+		rt := &v1Routes[i]
+		group.Handle(rt.method, rt.path, func(c *gin.Context) {
+			action = rt.action
+			form, _ = rt.form(c)
+		})
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		action string
+		params string
+	}{
+		{"GET", "/cluster", infoClusterAction, ""},
+		{"GET", "/pools", infoPoolAction, "PoolName=*"},
+		{"POST", "/pools", createPoolAction, ""},
+		{"GET", "/pools/rbd", infoPoolAction, "PoolName=rbd"},
+		{"PATCH", "/pools/rbd", modPoolRepSizeAction, "PoolName=rbd"},
+		{"DELETE", "/pools/rbd", delPoolAction, "PoolName=rbd"},
+		{"GET", "/pools/rbd/io?Window=5m", infoPoolIOAction, "PoolName=rbd&Window=5m"},
+		{"GET", "/pools/rbd/io/history", poolIOHistoryAction, "PoolName=rbd"},
+		{"GET", "/pools/rbd/quota", infoPoolQuotaAction, "PoolName=rbd"},
+		{"PUT", "/pools/rbd/quota", setPoolQuotaAction, "PoolName=rbd"},
+		{"GET", "/volumes?Tag=env:prod&Tag=tier", listVolumesAction, "Tag=env:prod&Tag=tier"},
+		{"POST", "/volumes", createDiskAction, ""},
+		{"GET", "/pools/rbd/volumes", listVolumesAction, "PoolName=rbd"},
+		{"POST", "/pools/rbd/volumes", createDiskAction, "PoolName=rbd"},
+		{"GET", "/pools/rbd/volumes/vol", listVolumesAction, "PoolName=rbd&VolumeName=vol"},
+		{"PATCH", "/pools/rbd/volumes/vol", extendDiskAction, "PoolName=rbd&VolumeName=vol"},
+		{"DELETE", "/pools/rbd/volumes/vol", delDiskAction, "PoolName=rbd&VolumeName=vol"},
+		{"POST", "/pools/rbd/volumes/vol/copy", copyVolumeAction, "PoolName=rbd&VolumeName=vol"},
+		{"POST", "/pools/rbd/volumes/vol/flatten", flattenVolumeAction, "PoolName=rbd&VolumeName=vol"},
+		{"PUT", "/pools/rbd/volumes/vol/features", updateFeaturesAction, "PoolName=rbd&VolumeName=vol"},
+		{"PUT", "/pools/rbd/volumes/vol/qos", modifyQoSAction, "PoolName=rbd&VolumeName=vol"},
+		{"POST", "/pools/rbd/volumes/vol/tags", tagVolumeAction, "PoolName=rbd&VolumeName=vol"},
+		{"DELETE", "/pools/rbd/volumes/vol/tags?Key=env", untagVolumeAction, "PoolName=rbd&VolumeName=vol&Key=env"},
+		{"GET", "/pools/rbd/volumes/vol/attachments", describeAttachAction, "PoolName=rbd&VolumeName=vol"},
+		{"POST", "/pools/rbd/volumes/vol/attachments", attachDiskAction, "PoolName=rbd&VolumeName=vol"},
+		{"DELETE", "/pools/rbd/volumes/vol/attachments/host1", detachDiskAction, "PoolName=rbd&VolumeName=vol&Client=host1"},
+		{"POST", "/pools/rbd/volumes/vol/exports", exportVolumeAction, "PoolName=rbd&VolumeName=vol"},
+		{"GET", "/pools/rbd/volumes/vol/backups", listBackupsAction, "PoolName=rbd&VolumeName=vol"},
+		{"POST", "/pools/rbd/volumes/vol/backups", backupDiskAction, "PoolName=rbd&VolumeName=vol"},
+		{"GET", "/pools/rbd/volumes/vol/snapshots", infoSnapAction, "PoolName=rbd&VolumeName=vol"},
+		{"POST", "/pools/rbd/volumes/vol/snapshots", createSnapAction, "PoolName=rbd&VolumeName=vol"},
+		{"GET", "/pools/rbd/volumes/vol/snapshots/s1", infoSnapAction, "PoolName=rbd&VolumeName=vol&Snapshot=s1"},
+		{"DELETE", "/pools/rbd/volumes/vol/snapshots/s1", delSnapAction, "PoolName=rbd&VolumeName=vol&Snapshot=s1"},
+		{"POST", "/pools/rbd/volumes/vol/snapshots/s1/rollback", rollbackSnapAction, "PoolName=rbd&VolumeName=vol&Snapshot=s1"},
+		{"POST", "/pools/rbd/volumes/vol/snapshots/s1/protect", protectSnapAction, "PoolName=rbd&VolumeName=vol&Snapshot=s1"},
+		{"POST", "/pools/rbd/volumes/vol/snapshots/s1/unprotect", unprotectSnapAction, "PoolName=rbd&VolumeName=vol&Snapshot=s1"},
+		{"POST", "/pools/rbd/volumes/vol/snapshots/s1/clone", cloneSnapAction, "PoolName=rbd&VolumeName=vol&Snapshot=s1"},
+		{"GET", "/pools/rbd/images", infoVolumeAction, "PoolName=rbd"},
+		{"PATCH", "/pools/rbd/images/img", resizeVolumeAction, "PoolName=rbd&VolumeName=img"},
+		{"DELETE", "/pools/rbd/images/img", delVolumeAction, "PoolName=rbd&VolumeName=img"},
+		{"GET", "/backups", listBackupsAction, ""},
+		{"POST", "/backups/b1/restore", restoreDiskAction, "BackupId=b1"},
+		{"GET", "/jobs/job-1", describeJobAction, "JobId=job-1"},
+		{"GET", "/snapshot-policies", listPoliciesAction, ""},
+		{"POST", "/snapshot-policies", createPolicyAction, ""},
+		{"GET", "/snapshot-policies/daily", listPoliciesAction, "PolicyName=daily"},
+		{"DELETE", "/snapshot-policies/daily", delPolicyAction, "PolicyName=daily"},
+		{"POST", "/snapshot-policies/daily/targets", attachPolicyAction, "PolicyName=daily"},
+		{"DELETE", "/snapshot-policies/daily/targets", detachPolicyAction, "PolicyName=daily"},
+		{"GET", "/snapshot-runs", listSnapRunsAction, ""},
+		{"GET", "/tenants", infoTenantAction, ""},
+		{"POST", "/tenants", createTenantAction, ""},
+		{"GET", "/tenants/acme", infoTenantAction, "TenantName=acme"},
+		{"PATCH", "/tenants/acme", modifyTenantAction, "TenantName=acme"},
+		{"DELETE", "/tenants/acme", delTenantAction, "TenantName=acme"},
+		//路径参数优先于查询参数，分页参数不传给旧接口
+		{"GET", "/pools/rbd/volumes/vol?PoolName=other&offset=1&limit=2", listVolumesAction, "PoolName=rbd&VolumeName=vol"},
+		{"GET", "/pools/rbd/volumes/vol%20one", listVolumesAction, "PoolName=rbd&VolumeName=vol+one"},
+	}
+	if len(tests) < len(v1Routes) {
+		t.Errorf("%v routes, %v tested", len(v1Routes), len(tests))
+	}
+	for _, tt := range tests {
+		action, form = "", nil
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(tt.method, v1Prefix+tt.path, nil))
+		want, _ := url.ParseQuery(tt.params)
+		want.Set("Action", tt.action)
+		if action != tt.action || form.Encode() != want.Encode() {
+			t.Errorf("%v %v: %v %v, want %v", tt.method, tt.path, action, form, want)
+		}
+	}
+}
+
+//内存集群中有pool rbd和EBS管理的卷vol0...vol4，不签名的请求按管理员处理
+func setupV1(t *testing.T) (*gin.Engine, *memory.Cluster, *job.Manager) {
+	cluster := memory.NewCluster()
+	if err := cluster.MakePool("rbd"); err != nil {
+		t.Fatal(err)
+	}
+	store := repository.NewMemoryStore()
+	processor.SetBackend(cluster)
+	processor.SetRepository(store)
+	jobs := job.NewManager(job.NewMemoryStore(), 1)
+	processor.SetJobManager(jobs)
+	processor.SetAuthConfig("", "", 0, true)
+	t.Cleanup(func() {
+		jobs.Wait()
+		processor.SetAuthConfig("", "", 0, false)
+		processor.SetJobManager(nil)
+		processor.SetRepository(nil)
+		processor.SetBackend(nil)
+	})
+
+	pool, err := cluster.OpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		name := "vol" + strconv.Itoa(i)
+		if err := pool.CreateImage(name, 1<<20, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Volumes().Create(&repository.Volume{Pool: "rbd", Name: name, Size: 1 << 20, State: repository.StateCreating}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Volumes().Transition("rbd", name, repository.StateCreating, repository.StateAvailable); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newEngine(), cluster, jobs
+}
+
+func serveV1(engine *gin.Engine, method string, target string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set(processor.RequestIDHeader, "req-1")
+	engine.ServeHTTP(w, r)
+	return w
+}
+
+//错误应答为JSON，带请求ID
+func expectV1Error(t *testing.T, name string, w *httptest.ResponseRecorder, status int, code string) {
+	var reply processor.ErrorReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || w.Code != status || reply.Error.Code != code ||
+		reply.Error.RequestId != "req-1" {
+		t.Errorf("%v: %v %v, want %v %v", name, w.Code, w.Body, status, code)
+	}
+}
+
+func TestV1Errors(t *testing.T) {
+	engine, _, _ := setupV1(t)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{"unknown path", "GET", "/v1/nothing", "", http.StatusNotFound, "NotFound"},
+		{"unknown subresource", "GET", "/v1/pools/rbd/volumes/vol0/nothing", "", http.StatusNotFound, "NotFound"},
+		{"method not allowed", "PATCH", "/v1/cluster", "", http.StatusMethodNotAllowed, "MethodNotAllowed"},
+		{"method not allowed on a volume", "POST", "/v1/pools/rbd/volumes/vol0", "", http.StatusMethodNotAllowed, "MethodNotAllowed"},
+		{"missing volume", "GET", "/v1/pools/rbd/volumes/missing", "", http.StatusNotFound, "VolumeNotFound"},
+		{"missing pool", "GET", "/v1/pools/missing", "", http.StatusNotFound, "PoolNotFound"},
+		{"truncated body", "POST", "/v1/pools/rbd/volumes", `{"VolumeName":`, http.StatusBadRequest, "InvalidRequest"},
+		{"body not an object", "POST", "/v1/pools/rbd/volumes", `["vol"]`, http.StatusBadRequest, "InvalidRequest"},
+		{"nested array", "POST", "/v1/pools/rbd/volumes/vol0/tags", `{"Tag":[["env:prod"]]}`, http.StatusBadRequest, "InvalidRequest"},
+		{"object value", "POST", "/v1/pools/rbd/volumes/vol0/tags", `{"Tag":{"env":"prod"}}`, http.StatusBadRequest, "InvalidRequest"},
+		//旧接口的错误原样返回
+		{"invalid parameter", "POST", "/v1/pools/rbd/volumes/vol0/tags", `{"Tag":"env"}`, http.StatusBadRequest, "InvalidRequest"},
+		{"legacy path", "GET", "/?Action=Bogus", "", http.StatusBadRequest, "InvalidAction"},
+	}
+	for _, tt := range tests {
+		expectV1Error(t, tt.name, serveV1(engine, tt.method, tt.target, tt.body), tt.status, tt.code)
+	}
+
+	processor.SetAuthConfig("", "", 0, false)
+	w := serveV1(engine, "GET", "/v1/volumes", "")
+	expectV1Error(t, "unsigned", w, http.StatusUnauthorized, "Unauthorized")
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("unsigned: headers %v", w.Header())
+	}
+}
+
+//JSON请求体中的数组为重复的参数，没有结果的应答为204
+func TestV1Body(t *testing.T) {
+	engine, cluster, jobs := setupV1(t)
+
+	w := serveV1(engine, "POST", "/v1/pools/rbd/volumes/vol0/tags", `{"Tag":["env:prod","owner:storage"]}`)
+	var tags map[string]map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &tags); err != nil || w.Code != http.StatusOK || len(tags["Tags"]) != 2 {
+		t.Errorf("tag: %v %v", w.Code, w.Body)
+	}
+	w = serveV1(engine, "PUT", "/v1/pools/rbd/volumes/vol0/qos", `{"ReadIOPS":1000,"Burst":2}`)
+	var limits processor.VolumeQoS
+	if err := json.Unmarshal(w.Body.Bytes(), &limits); err != nil || limits.ReadIOPS != 1000 || limits.Burst != 2 {
+		t.Errorf("qos: %v %v", w.Code, w.Body)
+	}
+	w = serveV1(engine, "PUT", "/v1/pools/rbd/quota", `{"MaxBytes":1073741824}`)
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("quota: %v %v", w.Code, w.Body)
+	}
+
+	w = serveV1(engine, "GET", "/v1/pools/rbd/volumes/vol0", "")
+	var volume processor.VolumeInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &volume); err != nil || volume.Name != "vol0" || volume.Tags["owner"] != "storage" {
+		t.Errorf("volume: %v %v", w.Code, w.Body)
+	}
+
+	//后台任务返回202和任务的位置
+	w = serveV1(engine, "POST", "/v1/pools/rbd/volumes/vol0/copy", `{"DestPoolName":"rbd","DestVolumeName":"copy"}`)
+	var reply processor.JobReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || w.Code != http.StatusAccepted ||
+		w.Header().Get("Location") != "/v1/jobs/"+reply.JobId {
+		t.Fatalf("copy: %v %v %v", w.Code, w.Header(), w.Body)
+	}
+	jobs.Wait()
+	w = serveV1(engine, "GET", w.Header().Get("Location"), "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), reply.JobId) {
+		t.Errorf("job: %v %v", w.Code, w.Body)
+	}
+	pool, _ := cluster.OpenPool("rbd")
+	if images, _ := pool.ListImages(); len(images) != 6 {
+		t.Errorf("images after copy %v", images)
+	}
+}
+
+func TestV1Pages(t *testing.T) {
+	engine, _, _ := setupV1(t)
+
+	tests := []struct {
+		query string
+		names []string
+		//offset、limit和NextOffset，NextOffset为-1时没有下一页
+		offset, limit, next int
+	}{
+		{"", []string{"vol0", "vol1", "vol2", "vol3", "vol4"}, 0, defaultPageSize, -1},
+		{"?limit=2", []string{"vol0", "vol1"}, 0, 2, 2},
+		{"?offset=2&limit=2", []string{"vol2", "vol3"}, 2, 2, 4},
+		//最后一页不满
+		{"?offset=4&limit=2", []string{"vol4"}, 4, 2, -1},
+		{"?offset=3&limit=2", []string{"vol3", "vol4"}, 3, 2, -1},
+		{"?offset=5", []string{}, 5, defaultPageSize, -1},
+		{"?offset=100&limit=10", []string{}, 100, 10, -1},
+		{"?limit=1000", []string{"vol0", "vol1", "vol2", "vol3", "vol4"}, 0, maxPageSize, -1},
+		{"?limit=5", []string{"vol0", "vol1", "vol2", "vol3", "vol4"}, 0, 5, -1},
+		{"?offset=0&limit=4", []string{"vol0", "vol1", "vol2", "vol3"}, 0, 4, 4},
+	}
+	for _, tt := range tests {
+		w := serveV1(engine, "GET", "/v1/volumes"+tt.query, "")
+		var page struct {
+			Items      []processor.VolumeInfo
+			TotalCount int
+			Offset     int
+			Limit      int
+			NextOffset *int
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+			t.Errorf("%q: %v %v", tt.query, w.Code, w.Body)
+			continue
+		}
+		names := []string{}
+		for _, v := range page.Items {
+			names = append(names, v.Name)
+		}
+		next := -1
+		if page.NextOffset != nil {
+			next = *page.NextOffset
+		}
+		if strings.Join(names, ",") != strings.Join(tt.names, ",") || page.TotalCount != 5 ||
+			page.Offset != tt.offset || page.Limit != tt.limit || next != tt.next {
+			t.Errorf("%q: %v", tt.query, w.Body)
+		}
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=-1", "?limit=1001", "?limit=x", "?offset=-1", "?offset=1.5"} {
+		expectV1Error(t, query, serveV1(engine, "GET", "/v1/volumes"+query, ""), http.StatusBadRequest, "InvalidRequest")
+	}
+}
@@ -0,0 +1,345 @@
+// Package s3 is a small client for the subset of the S3 API that EBS
+// needs to move volume data in and out of OSS: single objects and
+// multipart uploads, signed with AWS Signature Version 4 and addressed
+// path-style, http(s)://endpoint/bucket/key.
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultRegion = "us-east-1"
+
+// MinPartSize is the smallest part S3 accepts, except for the last one.
+const MinPartSize = 5 << 20
+
+// MaxParts is the largest number of parts of one multipart upload.
+const MaxParts = 10000
+
+type Config struct {
+	// Endpoint is host[:port] of the gateway.
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	// Region is only used for signing, DefaultRegion when empty.
+	Region   string
+	UseHTTPS bool
+	Timeout  time.Duration
+}
+
+type Client struct {
+	cfg  Config
+	http *http.Client
+}
+
+func New(cfg Config) *Client {
+	if cfg.Region == "" {
+		cfg.Region = DefaultRegion
+	}
+	return &Client{cfg: cfg, http: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// Error is an error response of the gateway.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("S3 error %v %v: %v", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound reports whether err means the bucket or object does not exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey" || e.Code == "NoSuchBucket")
+}
+
+// escapePath URI-encodes every segment of a path the way SigV4 expects.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (c *Client) url(bucket string, key string, query url.Values) *url.URL {
+	scheme := "http"
+	if c.cfg.UseHTTPS {
+		scheme = "https"
+	}
+	path := "/" + bucket
+	if key != "" {
+		path += "/" + key
+	}
+	return &url.URL{Scheme: scheme, Host: c.cfg.Endpoint, Path: path, RawPath: escapePath(path), RawQuery: canonicalQuery(query)}
+}
+
+// canonicalQuery sorts and encodes the query as SigV4 requires.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, escapeQuery(k)+"="+escapeQuery(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escapeQuery(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds the SigV4 headers to req, whose body hashes to payloadHash.
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "content-md5" || lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretKey), date)
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// do sends a signed request. A response other than 2xx is turned into an
+// *Error; the caller closes the body of a successful response.
+func (c *Client) do(method string, bucket string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(bucket, key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, hashHex(body), time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+	return resp, nil
+}
+
+func readError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if len(data) == 0 || xml.Unmarshal(data, e) != nil {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+// HeadBucket checks that bucket exists and is accessible.
+func (c *Client) HeadBucket(bucket string) error {
+	resp, err := c.do("HEAD", bucket, "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) PutObject(bucket string, key string, data []byte, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := c.do("PUT", bucket, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetObject returns the whole object. The caller closes it.
+func (c *Client) GetObject(bucket string, key string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetObjectRange returns length bytes of the object starting at offset.
+func (c *Client) GetObjectRange(bucket string, key string, offset uint64, length uint64) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := c.do("GET", bucket, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *Client) DeleteObject(bucket string, key string) error {
+	resp, err := c.do("DELETE", bucket, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Part is an uploaded part of a multipart upload.
+type Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// CreateMultipartUpload starts a multipart upload and returns its id.
+func (c *Client) CreateMultipartUpload(bucket string, key string) (string, error) {
+	resp, err := c.do("POST", bucket, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadId string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.UploadId == "" {
+		return "", fmt.Errorf("S3 returned no upload id for %v/%v", bucket, key)
+	}
+	return result.UploadId, nil
+}
+
+// UploadPart uploads part number, counted from 1, and returns its ETag.
+func (c *Client) UploadPart(bucket string, key string, uploadID string, number int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, err := c.do("PUT", bucket, key, query, nil, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []Part   `xml:"Part"`
+}
+
+// CompleteMultipartUpload assembles the parts, which must be sorted by
+// part number, into the object.
+func (c *Client) CompleteMultipartUpload(bucket string, key string, uploadID string, parts []Part) error {
+	body, err := xml.Marshal(&completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do("POST", bucket, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	//完成请求可能返回200但正文是错误
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return e
+	}
+	return nil
+}
+
+func (c *Client) AbortMultipartUpload(bucket string, key string, uploadID string) error {
+	resp, err := c.do("DELETE", bucket, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,362 @@
+// Package scheduler takes and prunes the snapshots of snapshot policies.
+// Several EBS instances may run a Scheduler against the same database;
+// only the holder of the scheduler lease acts on a tick, so every slot is
+// taken once.
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"repository"
+)
+
+// ErrProtected is returned by Snapshotter.RemoveSnapshot for a protected
+// snapshot, which retention leaves in place.
+var ErrProtected = errors.New("Snapshot is protected")
+
+// ErrLeaseLost is returned by Tick when the lease could not be renewed
+// before the next volume, so another instance may be acting on the tick.
+var ErrLeaseLost = errors.New("Scheduler lease lost")
+
+// LeaseName is the lease the instances compete for.
+const LeaseName = "snapshot-scheduler"
+
+// DefaultInterval is the time between two ticks.
+const DefaultInterval = time.Minute
+
+// DefaultNameTemplate names the snapshots of a policy without a template.
+const DefaultNameTemplate = "auto-{policy}-{time}"
+
+// timeLayout formats {time} in snapshot names, scheduledLayout the slot of
+// a run.
+const (
+	timeLayout      = "20060102-1504"
+	scheduledLayout = "2006-01-02 15:04:05"
+)
+
+// Clock is the scheduler's source of time, replaced in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
+
+// Snapshotter takes and removes the snapshots of a volume.
+type Snapshotter interface {
+	// CreateSnapshot succeeds when the snapshot already exists, as after
+	// a run whose result could not be recorded.
+	CreateSnapshot(pool string, volume string, name string) error
+	// RemoveSnapshot succeeds when the snapshot no longer exists and
+	// returns ErrProtected when it is protected.
+	RemoveSnapshot(pool string, volume string, name string) error
+}
+
+type Config struct {
+	// Holder identifies this instance in the lease.
+	Holder string
+	// Interval is the time between ticks, DefaultInterval when 0.
+	Interval time.Duration
+	// LeaseTTL is how long the lease outlives its last renewal, three
+	// intervals when 0.
+	LeaseTTL time.Duration
+	// Clock is SystemClock when nil.
+	Clock Clock
+}
+
+type Scheduler struct {
+	store     repository.Store
+	snapshots Snapshotter
+	cfg       Config
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func New(store repository.Store, snapshots Snapshotter, cfg Config) *Scheduler {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.LeaseTTL <= 0 {
+		cfg.LeaseTTL = 3 * cfg.Interval
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = SystemClock
+	}
+	return &Scheduler{
+		store:     store,
+		snapshots: snapshots,
+		cfg:       cfg,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Validate checks the schedule fields and name template of p.
+func Validate(p *repository.SnapshotPolicy) error {
+	switch p.Schedule {
+	case repository.ScheduleHourly, repository.ScheduleDaily, repository.ScheduleWeekly:
+	default:
+		return fmt.Errorf("Unknown schedule %q", p.Schedule)
+	}
+	if p.Minute < 0 || p.Minute > 59 || p.Hour < 0 || p.Hour > 23 || p.Weekday < 0 || p.Weekday > 6 {
+		return fmt.Errorf("Invalid schedule time")
+	}
+	if p.Retention < 0 {
+		return fmt.Errorf("Invalid retention %v", p.Retention)
+	}
+	//{time}保证每个时段的快照名不同
+	if !strings.Contains(p.NameTemplate, "{time}") {
+		return fmt.Errorf("Name template must contain {time}")
+	}
+	if strings.ContainsAny(p.NameTemplate, "@/ ") {
+		return fmt.Errorf("Invalid name template %q", p.NameTemplate)
+	}
+	return nil
+}
+
+// LastSlot returns the latest time at or before now at which p takes a
+// snapshot, in now's location.
+func LastSlot(p *repository.SnapshotPolicy, now time.Time) time.Time {
+	y, m, d := now.Date()
+	switch p.Schedule {
+	case repository.ScheduleHourly:
+		slot := time.Date(y, m, d, now.Hour(), p.Minute, 0, 0, now.Location())
+		if slot.After(now) {
+			slot = slot.Add(-time.Hour)
+		}
+		return slot
+	case repository.ScheduleWeekly:
+		slot := time.Date(y, m, d, p.Hour, p.Minute, 0, 0, now.Location())
+		slot = slot.AddDate(0, 0, -((int(slot.Weekday()) - p.Weekday + 7) % 7))
+		if slot.After(now) {
+			slot = slot.AddDate(0, 0, -7)
+		}
+		return slot
+	default:
+		slot := time.Date(y, m, d, p.Hour, p.Minute, 0, 0, now.Location())
+		if slot.After(now) {
+			slot = slot.AddDate(0, 0, -1)
+		}
+		return slot
+	}
+}
+
+// SnapshotName expands the name template of p for the snapshot of volume
+// taken at slot.
+func SnapshotName(p *repository.SnapshotPolicy, pool string, volume string, slot time.Time) string {
+	return strings.NewReplacer(
+		"{policy}", p.Name,
+		"{schedule}", p.Schedule,
+		"{pool}", pool,
+		"{volume}", volume,
+		"{time}", slot.Format(timeLayout),
+	).Replace(p.NameTemplate)
+}
+
+// Start ticks in the background until Stop. It must be called once.
+func (s *Scheduler) Start() {
+	s.done = make(chan struct{})
+	go s.loop()
+}
+
+// Stop waits for the current tick and gives the lease up, so another
+// instance can take over without waiting for it to expire.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		if s.done != nil {
+			<-s.done
+		}
+		if err := s.store.Leases().Release(LeaseName, s.cfg.Holder); err != nil {
+			fmt.Fprintf(os.Stderr, "Release scheduler lease failed: %v\n", err)
+		}
+	})
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.done)
+	for {
+		if _, err := s.Tick(); err != nil {
+			fmt.Fprintf(os.Stderr, "Snapshot scheduler: %v\n", err)
+		}
+		select {
+		case <-s.cfg.Clock.After(s.cfg.Interval):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+type volumeRef struct {
+	pool string
+	name string
+}
+
+// Tick renews the lease and, if this instance holds it, takes the
+// snapshots that are due and prunes those beyond retention. The lease is
+// renewed again before each volume, and the tick stops with ErrLeaseLost
+// as soon as that fails. It reports whether this instance was the leader.
+func (s *Scheduler) Tick() (bool, error) {
+	now := s.cfg.Clock.Now()
+	leader, err := s.renew()
+	if err != nil || !leader {
+		return false, err
+	}
+
+	policies, err := s.store.Policies().List()
+	if err != nil {
+		return true, err
+	}
+	targets, err := s.store.Policies().Targets("")
+	if err != nil {
+		return true, err
+	}
+
+	byPolicy := make(map[string][]*repository.PolicyTarget)
+	for _, t := range targets {
+		byPolicy[t.Policy] = append(byPolicy[t.Policy], t)
+	}
+
+	for _, p := range policies {
+		slot := LastSlot(p, now)
+		for _, v := range s.volumes(byPolicy[p.Name]) {
+			leader, err := s.renew()
+			if err == nil && !leader {
+				err = ErrLeaseLost
+			}
+			if err != nil {
+				return true, err
+			}
+			if s.take(p, v, slot) {
+				s.prune(p, v)
+			}
+		}
+	}
+	return true, nil
+}
+
+// renew acquires or extends the lease from the current time.
+func (s *Scheduler) renew() (bool, error) {
+	return s.store.Leases().Acquire(LeaseName, s.cfg.Holder, s.cfg.Clock.Now(), s.cfg.LeaseTTL)
+}
+
+// volumes expands targets into the volumes that can be snapshotted now,
+// each once. Volumes in the middle of another operation are skipped and
+// picked up by a later tick.
+func (s *Scheduler) volumes(targets []*repository.PolicyTarget) []volumeRef {
+	var records []*repository.Volume
+	for _, t := range targets {
+		if t.Volume == "" {
+			volumes, err := s.store.Volumes().List(t.Pool)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "List volumes of %v failed: %v\n", t.Pool, err)
+				continue
+			}
+			records = append(records, volumes...)
+			continue
+		}
+		v, err := s.store.Volumes().Get(t.Pool, t.Volume)
+		if err != nil {
+			if err != repository.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Load volume %v/%v failed: %v\n", t.Pool, t.Volume, err)
+			}
+			continue
+		}
+		records = append(records, v)
+	}
+
+	seen := make(map[volumeRef]bool)
+	var refs []volumeRef
+	for _, v := range records {
+		ref := volumeRef{pool: v.Pool, name: v.Name}
+		if seen[ref] || v.State.Busy() || v.State == repository.StateError {
+			continue
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// take snapshots v for slot unless an earlier tick already did, and
+// reports whether a new snapshot was taken.
+func (s *Scheduler) take(p *repository.SnapshotPolicy, v volumeRef, slot time.Time) bool {
+	scheduled := slot.Format(scheduledLayout)
+	run, err := s.store.SnapshotRuns().Get(p.Name, v.pool, v.name, scheduled)
+	if err == nil && run.State != repository.RunFailed {
+		return false
+	}
+	if err != nil && err != repository.ErrNotFound {
+		fmt.Fprintf(os.Stderr, "Load snapshot run of %v on %v/%v failed: %v\n", p.Name, v.pool, v.name, err)
+		return false
+	}
+
+	run = &repository.SnapshotRun{
+		Policy:        p.Name,
+		Pool:          v.pool,
+		Volume:        v.name,
+		ScheduledTime: scheduled,
+		Snapshot:      SnapshotName(p, v.pool, v.name, slot),
+		State:         repository.RunCreated,
+	}
+	if err := s.snapshots.CreateSnapshot(v.pool, v.name, run.Snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "Policy %v snapshot %v/%v@%v failed: %v\n", p.Name, v.pool, v.name, run.Snapshot, err)
+		run.State = repository.RunFailed
+		run.Error = err.Error()
+	}
+	if err := s.store.SnapshotRuns().Save(run); err != nil {
+		fmt.Fprintf(os.Stderr, "Save snapshot run %v/%v@%v failed: %v\n", v.pool, v.name, run.Snapshot, err)
+	}
+	return run.State == repository.RunCreated
+}
+
+// prune removes the snapshots of p on v older than the newest Retention.
+// Protected snapshots are left in place and retried on the next prune.
+func (s *Scheduler) prune(p *repository.SnapshotPolicy, v volumeRef) {
+	if p.Retention == 0 {
+		return
+	}
+	runs, err := s.store.SnapshotRuns().List(p.Name, v.pool, v.name, repository.RunCreated)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "List snapshot runs of %v on %v/%v failed: %v\n", p.Name, v.pool, v.name, err)
+		return
+	}
+
+	kept := 0
+	for i := len(runs) - 1; i >= 0; i-- {
+		run := runs[i]
+		if kept < p.Retention {
+			kept++
+			continue
+		}
+		err := s.snapshots.RemoveSnapshot(v.pool, v.name, run.Snapshot)
+		if err == ErrProtected {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Prune snapshot %v/%v@%v failed: %v\n", v.pool, v.name, run.Snapshot, err)
+			continue
+		}
+		run.State = repository.RunDeleted
+		if err := s.store.SnapshotRuns().Save(run); err != nil {
+			fmt.Fprintf(os.Stderr, "Save snapshot run %v/%v@%v failed: %v\n", v.pool, v.name, run.Snapshot, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package scheduler
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"repository"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return nil
+}
+
+// fakeSnapshotter keeps the snapshots of each volume in memory. onCreate,
+// when set, runs before every snapshot is taken.
+type fakeSnapshotter struct {
+	snapshots map[string]map[string]bool
+	protected map[string]bool
+	onCreate  func()
+}
+
+func newFakeSnapshotter() *fakeSnapshotter {
+	return &fakeSnapshotter{snapshots: make(map[string]map[string]bool), protected: make(map[string]bool)}
+}
+
+func (f *fakeSnapshotter) CreateSnapshot(pool string, volume string, name string) error {
+	if f.onCreate != nil {
+		f.onCreate()
+	}
+	key := pool + "/" + volume
+	if f.snapshots[key] == nil {
+		f.snapshots[key] = make(map[string]bool)
+	}
+	f.snapshots[key][name] = true
+	return nil
+}
+
+func (f *fakeSnapshotter) RemoveSnapshot(pool string, volume string, name string) error {
+	if f.protected[name] {
+		return ErrProtected
+	}
+	delete(f.snapshots[pool+"/"+volume], name)
+	return nil
+}
+
+func (f *fakeSnapshotter) list(pool string, volume string) []string {
+	var names []string
+	for name := range f.snapshots[pool+"/"+volume] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLastSlot(t *testing.T) {
+	loc := time.UTC
+	// 2024-05-15 is a Wednesday.
+	now := time.Date(2024, 5, 15, 10, 30, 0, 0, loc)
+	tests := []struct {
+		name   string
+		policy repository.SnapshotPolicy
+		want   time.Time
+	}{
+		{"hourly past minute", repository.SnapshotPolicy{Schedule: repository.ScheduleHourly, Minute: 15},
+			time.Date(2024, 5, 15, 10, 15, 0, 0, loc)},
+		{"hourly at minute", repository.SnapshotPolicy{Schedule: repository.ScheduleHourly, Minute: 30},
+			time.Date(2024, 5, 15, 10, 30, 0, 0, loc)},
+		{"hourly before minute", repository.SnapshotPolicy{Schedule: repository.ScheduleHourly, Minute: 45},
+			time.Date(2024, 5, 15, 9, 45, 0, 0, loc)},
+		{"daily past time", repository.SnapshotPolicy{Schedule: repository.ScheduleDaily, Hour: 2},
+			time.Date(2024, 5, 15, 2, 0, 0, 0, loc)},
+		{"daily before time", repository.SnapshotPolicy{Schedule: repository.ScheduleDaily, Hour: 23, Minute: 5},
+			time.Date(2024, 5, 14, 23, 5, 0, 0, loc)},
+		{"weekly same day past time", repository.SnapshotPolicy{Schedule: repository.ScheduleWeekly, Weekday: 3, Hour: 1},
+			time.Date(2024, 5, 15, 1, 0, 0, 0, loc)},
+		{"weekly same day before time", repository.SnapshotPolicy{Schedule: repository.ScheduleWeekly, Weekday: 3, Hour: 11},
+			time.Date(2024, 5, 8, 11, 0, 0, 0, loc)},
+		{"weekly earlier day", repository.SnapshotPolicy{Schedule: repository.ScheduleWeekly, Weekday: 0, Hour: 4},
+			time.Date(2024, 5, 12, 4, 0, 0, 0, loc)},
+		{"weekly later day", repository.SnapshotPolicy{Schedule: repository.ScheduleWeekly, Weekday: 6},
+			time.Date(2024, 5, 11, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LastSlot(&tt.policy, now); !got.Equal(tt.want) {
+				t.Errorf("LastSlot = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestScheduler returns a scheduler over a memory store with the
+// volumes rbd/a and rbd/b and an hourly policy on pool rbd.
+func newTestScheduler(t *testing.T, retention int) (*Scheduler, *repository.MemoryStore, *fakeSnapshotter, *fakeClock) {
+	store := repository.NewMemoryStore()
+	for _, name := range []string{"a", "b"} {
+		if err := store.Volumes().Create(&repository.Volume{Pool: "rbd", Name: name, State: repository.StateCreating}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Volumes().Transition("rbd", name, repository.StateCreating, repository.StateAvailable); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := &repository.SnapshotPolicy{Name: "hourly", Schedule: repository.ScheduleHourly, Retention: retention,
+		NameTemplate: DefaultNameTemplate}
+	if err := store.Policies().Create(policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Policies().Attach(&repository.PolicyTarget{Policy: "hourly", Pool: "rbd"}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &fakeClock{now: time.Date(2024, 5, 15, 10, 30, 0, 0, time.UTC)}
+	snapshots := newFakeSnapshotter()
+	s := New(store, snapshots, Config{Holder: "me", Interval: time.Minute, Clock: clock})
+	return s, store, snapshots, clock
+}
+
+func TestTick(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention int
+		// ticks are the offsets from the start at which Tick runs.
+		ticks []time.Duration
+		want  []string
+	}{
+		{"one snapshot per slot", 0, []time.Duration{0, time.Minute, 29 * time.Minute},
+			[]string{"auto-hourly-20240515-1000"}},
+		{"next slot", 0, []time.Duration{0, time.Hour},
+			[]string{"auto-hourly-20240515-1000", "auto-hourly-20240515-1100"}},
+		{"missed slots are not caught up", 0, []time.Duration{0, 3 * time.Hour},
+			[]string{"auto-hourly-20240515-1000", "auto-hourly-20240515-1300"}},
+		{"retention", 2, []time.Duration{0, time.Hour, 2 * time.Hour, 3 * time.Hour},
+			[]string{"auto-hourly-20240515-1200", "auto-hourly-20240515-1300"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, snapshots, clock := newTestScheduler(t, tt.retention)
+			start := clock.now
+			for _, offset := range tt.ticks {
+				clock.now = start.Add(offset)
+				leader, err := s.Tick()
+				if err != nil || !leader {
+					t.Fatalf("Tick at %v = %v, %v", offset, leader, err)
+				}
+			}
+			for _, volume := range []string{"a", "b"} {
+				if got := snapshots.list("rbd", volume); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("snapshots of %v = %v, want %v", volume, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTickProtected(t *testing.T) {
+	s, store, snapshots, clock := newTestScheduler(t, 1)
+	snapshots.protected["auto-hourly-20240515-1000"] = true
+	start := clock.now
+	for _, offset := range []time.Duration{0, time.Hour} {
+		clock.now = start.Add(offset)
+		if _, err := s.Tick(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"auto-hourly-20240515-1000", "auto-hourly-20240515-1100"}
+	if got := snapshots.list("rbd", "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshots = %v, want %v", got, want)
+	}
+	runs, err := store.SnapshotRuns().List("hourly", "rbd", "a", repository.RunCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Errorf("%v created runs, want 2", len(runs))
+	}
+}
+
+func TestTickBusyVolume(t *testing.T) {
+	s, store, snapshots, _ := newTestScheduler(t, 0)
+	if err := store.Volumes().Transition("rbd", "b", repository.StateAvailable, repository.StateRestoring); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Tick(); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshots.list("rbd", "b"); len(got) != 0 {
+		t.Errorf("busy volume snapshotted: %v", got)
+	}
+	if got := snapshots.list("rbd", "a"); len(got) != 1 {
+		t.Errorf("snapshots of a = %v, want one", got)
+	}
+}
+
+func TestTickNotLeader(t *testing.T) {
+	s, store, snapshots, clock := newTestScheduler(t, 0)
+	if ok, err := store.Leases().Acquire(LeaseName, "other", clock.now, time.Minute); err != nil || !ok {
+		t.Fatalf("Acquire = %v, %v", ok, err)
+	}
+	leader, err := s.Tick()
+	if err != nil || leader {
+		t.Fatalf("Tick = %v, %v, want not leader", leader, err)
+	}
+	if len(snapshots.snapshots) != 0 {
+		t.Errorf("follower took snapshots: %v", snapshots.snapshots)
+	}
+
+	// The lease expires without renewal.
+	clock.now = clock.now.Add(2 * time.Minute)
+	if leader, err := s.Tick(); err != nil || !leader {
+		t.Fatalf("Tick after expiry = %v, %v", leader, err)
+	}
+}
+
+func TestTickLeaseLost(t *testing.T) {
+	s, store, snapshots, clock := newTestScheduler(t, 0)
+	// The first snapshot outlasts the lease, and another instance takes
+	// it over meanwhile.
+	snapshots.onCreate = func() {
+		snapshots.onCreate = nil
+		clock.now = clock.now.Add(s.cfg.LeaseTTL + time.Second)
+		if ok, err := store.Leases().Acquire(LeaseName, "other", clock.now, s.cfg.LeaseTTL); err != nil || !ok {
+			t.Fatalf("Acquire = %v, %v", ok, err)
+		}
+	}
+	leader, err := s.Tick()
+	if err != ErrLeaseLost || !leader {
+		t.Fatalf("Tick = %v, %v, want %v", leader, err, ErrLeaseLost)
+	}
+	if a, b := snapshots.list("rbd", "a"), snapshots.list("rbd", "b"); len(a)+len(b) != 1 {
+		t.Errorf("snapshots after losing the lease: a %v, b %v", a, b)
+	}
+}
@@ -0,0 +1,123 @@
+package signer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c := &Credential{AccessKeyID: "AKID", Timestamp: 1500000000, Nonce: "0123456789abcdef", Signature: "c2ln+/=="}
+	got, err := Parse(c.String())
+	if err != nil || *got != *c {
+		t.Errorf("Parse(%q) = %+v, %v", c.String(), got, err)
+	}
+
+	malformed := []string{
+		"",
+		"AWS4-HMAC-SHA256 AccessKeyId=AKID, Timestamp=1500000000, Nonce=0123456789abcdef, Signature=sig",
+		"EBS-HMAC-SHA256",
+		"EBS-HMAC-SHA256 AccessKeyId=AKID, Timestamp=soon, Nonce=0123456789abcdef, Signature=sig",
+		"EBS-HMAC-SHA256 AccessKeyId=AKID, Timestamp=1500000000, Nonce=short, Signature=sig",
+		"EBS-HMAC-SHA256 AccessKeyId=AKID, Timestamp=1500000000, Nonce=" + strings.Repeat("n", MaxNonceLen+1) + ", Signature=sig",
+		"EBS-HMAC-SHA256 Timestamp=1500000000, Nonce=0123456789abcdef, Signature=sig",
+		"EBS-HMAC-SHA256 AccessKeyId=AKID, Nonce=0123456789abcdef, Signature=sig",
+		"EBS-HMAC-SHA256 AccessKeyId=AKID, Timestamp=1500000000, Nonce=0123456789abcdef",
+		"EBS-HMAC-SHA256 AccessKeyId=AKID, Timestamp=1500000000, Nonce=0123456789abcdef, Signature=sig, Region=x",
+		"EBS-HMAC-SHA256 AccessKeyId=AKID Timestamp=1500000000",
+	}
+	for _, header := range malformed {
+		if c, err := Parse(header); err != ErrMalformed {
+			t.Errorf("Parse(%q) = %+v, %v", header, c, err)
+		}
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	tests := []struct {
+		query url.Values
+		want  string
+	}{
+		{url.Values{}, ""},
+		{url.Values{"b": {"2"}, "a": {"1"}}, "a=1&b=2"},
+		// Values of a key are sorted too.
+		{url.Values{"Tag": {"z:1", "a:2"}}, "Tag=a%3A2&Tag=z%3A1"},
+		{url.Values{"Name": {"a b+c/d"}}, "Name=a%20b%2Bc%2Fd"},
+		{url.Values{"k": {""}}, "k="},
+		{url.Values{"卷": {"值"}}, "%E5%8D%B7=%E5%80%BC"},
+	}
+	for _, tt := range tests {
+		if got := CanonicalQuery(tt.query); got != tt.want {
+			t.Errorf("CanonicalQuery(%v) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestStringToSign(t *testing.T) {
+	c := &Credential{AccessKeyID: "AKID", Timestamp: 1500000000, Nonce: "0123456789abcdef"}
+	want := strings.Join([]string{
+		Algorithm,
+		"POST",
+		"/",
+		"Action=CreateDisk&Size=1024",
+		HashBody(nil),
+		"1500000000",
+		"0123456789abcdef",
+		"AKID",
+	}, "\n")
+	if got := StringToSign("POST", "", url.Values{"Size": {"1024"}, "Action": {"CreateDisk"}}, HashBody(nil), c); got != want {
+		t.Errorf("StringToSign = %q, want %q", got, want)
+	}
+	if HashBody(nil) != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("hash of an empty body %v", HashBody(nil))
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	s := &Signer{AccessKeyID: "AKID", SecretKey: "secret", Now: func() time.Time { return now }}
+	req, err := http.NewRequest(http.MethodPost, "http://ebs:6666/v1/volumes?pool=rbd", strings.NewReader(`{"Name":"vol"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sign(req); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Parse(req.Header.Get("Authorization"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AccessKeyID != "AKID" || c.Timestamp != now.Unix() {
+		t.Errorf("credential %+v", c)
+	}
+	expected := Sign("secret", StringToSign(http.MethodPost, "/v1/volumes", url.Values{"pool": {"rbd"}}, HashBody([]byte(`{"Name":"vol"}`)), c))
+	if c.Signature != expected {
+		t.Errorf("signature %v, want %v", c.Signature, expected)
+	}
+	// The body can still be sent, and sent again on a redirect.
+	for _, read := range []func() ([]byte, error){
+		func() ([]byte, error) { return ioutil.ReadAll(req.Body) },
+		func() ([]byte, error) {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(body)
+		},
+	} {
+		if body, err := read(); err != nil || string(body) != `{"Name":"vol"}` {
+			t.Errorf("body after signing %q, %v", body, err)
+		}
+	}
+
+	// Every signature has its own nonce.
+	first, _ := s.Authorization(http.MethodGet, "/", nil, nil)
+	second, _ := s.Authorization(http.MethodGet, "/", nil, nil)
+	if first == second {
+		t.Errorf("two signatures with one nonce: %v", first)
+	}
+}
@@ -0,0 +1,415 @@
+package ceph
+
+import (
+	"bytes"
+	"syscall"
+	"librados/rados"
+	"librados/rbd"
+	"storage"
+)
+
+// Backend connects to the cluster described by the default ceph.conf.
+type Backend struct{}
+
+func NewBackend() *Backend {
+	return &Backend{}
+}
+
+func (b *Backend) Connect() (storage.Cluster, error) {
+	conn, err := rados.NewConn()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.ReadDefaultConfigFile(); err != nil {
+		conn.Shutdown()
+		return nil, err
+	}
+
+	if err := conn.Connect(); err != nil {
+		conn.Shutdown()
+		return nil, err
+	}
+
+	return &cluster{conn: conn}, nil
+}
+
+// 将librados/librbd错误转换为storage错误
+func getError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case rados.ConnErrorNotFound, rados.RadosErrorNotFound:
+		return storage.ErrNotFound
+	case rbd.RbdErrorNotFound:
+		return storage.ErrImageNotFound
+	case rados.ConnErrorAlreadyExist, rbd.RbdErrorAlreadyExist:
+		return storage.ErrExist
+	case rbd.RbdErrorProtected:
+		return storage.ErrBusy
+	case rbd.RbdErrorImageNotOpen:
+		return storage.ErrImageNotOpen
+	case rbd.RBDError(-int(syscall.EINVAL)), rados.RadosError(-int(syscall.EINVAL)):
+		return storage.ErrInvalidArgument
+	case rbd.RBDError(-int(syscall.EROFS)):
+		return storage.ErrReadOnly
+	}
+	return err
+}
+
+// pool级的操作找不到对象时就是pool不存在
+func getPoolError(err error) error {
+	if err = getError(err); err == storage.ErrNotFound {
+		return storage.ErrPoolNotFound
+	}
+	return err
+}
+
+type cluster struct {
+	conn *rados.Conn
+}
+
+func (c *cluster) Shutdown() {
+	c.conn.Shutdown()
+}
+
+func (c *cluster) MakePool(name string) error {
+	return getError(c.conn.MakePool(name))
+}
+
+func (c *cluster) MakePoolWithCrushRule(name string, rule uint8) error {
+	return getError(c.conn.MakePoolWithCrushRule(name, rule))
+}
+
+func (c *cluster) DeletePool(name string) error {
+	return getPoolError(c.conn.DeletePool(name))
+}
+
+func (c *cluster) ListPools() ([]string, error) {
+	names, err := c.conn.ListPools()
+	return names, getError(err)
+}
+
+func (c *cluster) LookupPool(name string) error {
+	return getPoolError(c.conn.LookupPool(name))
+}
+
+func (c *cluster) OpenPool(name string) (storage.Pool, error) {
+	ioctx, err := c.conn.OpenIOContext(name)
+	if err != nil {
+		return nil, getPoolError(err)
+	}
+	return &pool{name: name, ioctx: ioctx}, nil
+}
+
+func (c *cluster) GetClusterStats() (storage.ClusterStat, error) {
+	stat, err := c.conn.GetClusterStats()
+	if err != nil {
+		return storage.ClusterStat{}, getError(err)
+	}
+	return storage.ClusterStat{
+		Kb:          stat.Kb,
+		Kb_used:     stat.Kb_used,
+		Kb_avail:    stat.Kb_avail,
+		Num_objects: stat.Num_objects,
+	}, nil
+}
+
+func (c *cluster) MonCommand(args []byte) ([]byte, string, error) {
+	buf, info, err := c.conn.MonCommand(args)
+	return buf, info, getError(err)
+}
+
+type pool struct {
+	name  string
+	ioctx *rados.IOContext
+}
+
+func (p *pool) Name() string {
+	return p.name
+}
+
+func (p *pool) ID() int64 {
+	return p.ioctx.GetPoolID()
+}
+
+func (p *pool) GetPoolStats() (storage.PoolStat, error) {
+	stat, err := p.ioctx.GetPoolStats()
+	if err != nil {
+		return storage.PoolStat{}, getError(err)
+	}
+	return storage.PoolStat{
+		Num_bytes:                      stat.Num_bytes,
+		Num_kb:                         stat.Num_kb,
+		Num_objects:                    stat.Num_objects,
+		Num_object_clones:              stat.Num_object_clones,
+		Num_object_copies:              stat.Num_object_copies,
+		Num_objects_missing_on_primary: stat.Num_objects_missing_on_primary,
+		Num_objects_unfound:            stat.Num_objects_unfound,
+		Num_objects_degraded:           stat.Num_objects_degraded,
+		Num_rd:                         stat.Num_rd,
+		Num_rd_kb:                      stat.Num_rd_kb,
+		Num_wr:                         stat.Num_wr,
+		Num_wr_kb:                      stat.Num_wr_kb,
+	}, nil
+}
+
+func (p *pool) ListImages() ([]string, error) {
+	names, err := rbd.GetImageNames(p.ioctx)
+	return names, getError(err)
+}
+
+func (p *pool) CreateImage(name string, size uint64, order int, features uint64) error {
+	_, err := rbd.Create(p.ioctx, name, size, order, features)
+	return getError(err)
+}
+
+func (p *pool) CreateImageWithOptions(name string, size uint64, opts *storage.ImageOptions) error {
+	options := rbd.NewRbdImageOptions()
+	defer options.Destroy()
+
+	//只设置指定的选项，其余沿用集群配置
+	if err := options.SetUint64(rbd.RbdImageOptionFeatures, opts.Features); err != nil {
+		return err
+	}
+	if opts.Order != 0 {
+		if err := options.SetUint64(rbd.RbdImageOptionOrder, uint64(opts.Order)); err != nil {
+			return err
+		}
+	}
+	if opts.StripeUnit != 0 {
+		if err := options.SetUint64(rbd.RbdImageOptionStripeUnit, opts.StripeUnit); err != nil {
+			return err
+		}
+		if err := options.SetUint64(rbd.RbdImageOptionStripeCount, opts.StripeCount); err != nil {
+			return err
+		}
+	}
+	if opts.DataPool != "" {
+		if err := options.SetString(rbd.RbdImageOptionDataPool, opts.DataPool); err != nil {
+			return err
+		}
+	}
+
+	_, err := rbd.Create4(p.ioctx, name, size, options)
+	return getError(err)
+}
+
+func (p *pool) RemoveImage(name string) error {
+	return getError(rbd.GetImage(p.ioctx, name).Remove())
+}
+
+func (p *pool) RemoveImageWithProgress(name string, progress storage.ProgressFunc) error {
+	return getError(rbd.GetImage(p.ioctx, name).RemoveWithProgress(rbd.ProgressFunc(progress)))
+}
+
+func (p *pool) OpenImage(name string, snapshot string) (storage.Image, error) {
+	img := rbd.GetImage(p.ioctx, name)
+	var err error
+	if snapshot == "" {
+		err = img.Open()
+	} else {
+		err = img.Open(snapshot, true)
+	}
+	if err != nil {
+		return nil, getError(err)
+	}
+	return &image{name: name, image: img}, nil
+}
+
+func (p *pool) Close() {
+	p.ioctx.Destroy()
+}
+
+func ioctxOf(p storage.Pool) *rados.IOContext {
+	switch t := p.(type) {
+	case *pool:
+		return t.ioctx
+	case *sharedPool:
+		return t.ioctx
+	}
+	return nil
+}
+
+type image struct {
+	name  string
+	image *rbd.Image
+}
+
+func (i *image) Name() string {
+	return i.name
+}
+
+func (i *image) ReadAt(data []byte, off int64) (int, error) {
+	n, err := i.image.ReadAt(data, off)
+	return n, getError(err)
+}
+
+func (i *image) WriteAt(data []byte, off int64) (int, error) {
+	n, err := i.image.WriteAt(data, off)
+	return n, getError(err)
+}
+
+func (i *image) Stat() (*storage.ImageInfo, error) {
+	info, err := i.image.Stat()
+	if err != nil {
+		return nil, getError(err)
+	}
+	return &storage.ImageInfo{
+		Size:              info.Size,
+		Obj_size:          info.Obj_size,
+		Num_objs:          info.Num_objs,
+		Order:             info.Order,
+		Block_name_prefix: info.Block_name_prefix,
+		Parent_pool:       info.Parent_pool,
+		Parent_name:       info.Parent_name,
+	}, nil
+}
+
+func (i *image) GetSize() (uint64, error) {
+	size, err := i.image.GetSize()
+	return size, getError(err)
+}
+
+func (i *image) GetFeatures() (uint64, error) {
+	features, err := i.image.GetFeatures()
+	return features, getError(err)
+}
+
+func (i *image) UpdateFeatures(features uint64, enabled bool) error {
+	return getError(i.image.UpdateFeatures(features, enabled))
+}
+
+func (i *image) GetMetadata(key string) (string, error) {
+	value, err := i.image.GetMetadata(key)
+	return value, getError(err)
+}
+
+func (i *image) SetMetadata(key string, value string) error {
+	return getError(i.image.SetMetadata(key, value))
+}
+
+func (i *image) RemoveMetadata(key string) error {
+	return getError(i.image.RemoveMetadata(key))
+}
+
+func (i *image) ListMetadata() (map[string]string, error) {
+	metadata, err := i.image.ListMetadata()
+	return metadata, getError(err)
+}
+
+func (i *image) GetStripePeriod() (uint64, error) {
+	period, err := i.image.GetStripePeriod()
+	return period, getError(err)
+}
+
+func (i *image) Resize(size uint64) error {
+	return getError(i.image.Resize(size))
+}
+
+func (i *image) ResizeWithProgress(size uint64, progress storage.ProgressFunc) error {
+	return getError(i.image.ResizeWithProgress(size, rbd.ProgressFunc(progress)))
+}
+
+func (i *image) Flush() error {
+	return getError(i.image.Flush())
+}
+
+func (i *image) Discard(ofs uint64, length uint64) error {
+	return getError(i.image.Discard(ofs, length))
+}
+
+func (i *image) DiffIterate(fromSnapshot string, ofs uint64, length uint64, fn storage.DiffFunc) error {
+	return getError(i.image.DiffIterate2(fromSnapshot, ofs, length, true, false, rbd.DiffFunc(fn)))
+}
+
+func (i *image) CreateSnapshot(name string) error {
+	_, err := i.image.CreateSnapshot(name)
+	return getError(err)
+}
+
+func (i *image) ListSnapshots() ([]storage.SnapInfo, error) {
+	snaps, err := i.image.GetSnapshotNames()
+	if err != nil {
+		return nil, getError(err)
+	}
+
+	infos := make([]storage.SnapInfo, len(snaps))
+	for j, s := range snaps {
+		infos[j] = storage.SnapInfo{Id: s.Id, Size: s.Size, Name: s.Name}
+	}
+	return infos, nil
+}
+
+func (i *image) RemoveSnapshot(name string) error {
+	return getError(i.image.GetSnapshot(name).Remove())
+}
+
+func (i *image) RollbackSnapshot(name string) error {
+	return getError(i.image.GetSnapshot(name).Rollback())
+}
+
+func (i *image) ProtectSnapshot(name string) error {
+	return getError(i.image.GetSnapshot(name).Protect())
+}
+
+func (i *image) UnprotectSnapshot(name string) error {
+	return getError(i.image.GetSnapshot(name).Unprotect())
+}
+
+func (i *image) IsSnapshotProtected(name string) (bool, error) {
+	protected, err := i.image.GetSnapshot(name).IsProtected()
+	return protected, getError(err)
+}
+
+func (i *image) Clone(snapshot string, dest storage.Pool, name string, features uint64, order int) error {
+	ioctx := ioctxOf(dest)
+	if ioctx == nil {
+		return storage.ErrInvalidArgument
+	}
+	_, err := i.image.Clone(snapshot, ioctx, name, features, order)
+	return getError(err)
+}
+
+func (i *image) Flatten() error {
+	return getError(i.image.Flatten())
+}
+
+//名称超过缓冲区时librbd返回ERANGE
+func (i *image) Parent() (string, string, string, error) {
+	pool := make([]byte, 256)
+	name := make([]byte, 4096)
+	snap := make([]byte, 4096)
+	err := i.image.GetParentInfo(pool, name, snap)
+	if err == rbd.RBDError(-int(syscall.ENOENT)) {
+		return "", "", "", storage.ErrNotFound
+	}
+	if err != nil {
+		return "", "", "", getError(err)
+	}
+	return cString(pool), cString(name), cString(snap), nil
+}
+
+func cString(buf []byte) string {
+	if n := bytes.IndexByte(buf, 0); n >= 0 {
+		buf = buf[:n]
+	}
+	return string(buf)
+}
+
+func (i *image) Copy(dest storage.Pool, name string, progress storage.ProgressFunc) error {
+	ioctx := ioctxOf(dest)
+	if ioctx == nil {
+		return storage.ErrInvalidArgument
+	}
+	return getError(i.image.CopyWithProgress(ioctx, name, rbd.ProgressFunc(progress)))
+}
+
+func (i *image) ListChildren() ([]string, []string, error) {
+	pools, images, err := i.image.ListChildren()
+	return pools, images, getError(err)
+}
+
+func (i *image) Close() error {
+	return getError(i.image.Close())
+}
@@ -0,0 +1,520 @@
+package ceph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"librados/rados"
+	"storage"
+)
+
+var ErrUnknownCluster = errors.New("Unknown cluster")
+var ErrNotConnected = errors.New("Cluster not connected")
+
+const (
+	defaultCluster       = "ceph"
+	defaultUser          = "client.admin"
+	defaultProbeInterval = 10 * time.Second
+	defaultMinBackoff    = 1 * time.Second
+	defaultMaxBackoff    = 60 * time.Second
+)
+
+// ClusterConfig describes one named cluster connection.
+type ClusterConfig struct {
+	// Name is the registry key, e.g. "default".
+	Name string
+	// Cluster is the ceph cluster name, "ceph" when empty.
+	Cluster string
+	// User is the full entity name, "client.admin" when empty.
+	User string
+	// ConfigFile is the ceph.conf path, the default search path when empty.
+	ConfigFile string
+	// Keyring overrides the keyring option from ceph.conf when not empty.
+	Keyring string
+	// Key is the base64 cephx key of User, used instead of a keyring when
+	// not empty.
+	Key string
+}
+
+// Registry holds long-lived cluster connections, shared by all requests.
+// Each connection is probed periodically and re-established with
+// exponential backoff when the cluster drops it.
+type Registry struct {
+	mu            sync.Mutex
+	entries       map[string]*entry
+	defaultName   string
+	probeInterval time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	stop          chan struct{}
+	wg            sync.WaitGroup
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		entries:       make(map[string]*entry),
+		probeInterval: defaultProbeInterval,
+		minBackoff:    defaultMinBackoff,
+		maxBackoff:    defaultMaxBackoff,
+		stop:          make(chan struct{}),
+	}
+}
+
+// SetBackoff changes the probe interval and reconnect backoff bounds.
+// It must be called before Add.
+func (r *Registry) SetBackoff(probe, min, max time.Duration) {
+	r.probeInterval = probe
+	r.minBackoff = min
+	r.maxBackoff = max
+}
+
+// Add connects to the cluster and registers it under cfg.Name. The first
+// cluster added becomes the default.
+func (r *Registry) Add(cfg ClusterConfig) error {
+	if cfg.Cluster == "" {
+		cfg.Cluster = defaultCluster
+	}
+	if cfg.User == "" {
+		cfg.User = defaultUser
+	}
+
+	r.mu.Lock()
+	if _, ok := r.entries[cfg.Name]; ok {
+		r.mu.Unlock()
+		return storage.ErrExist
+	}
+	e := &entry{config: cfg, done: make(chan struct{})}
+	r.entries[cfg.Name] = e
+	if r.defaultName == "" {
+		r.defaultName = cfg.Name
+	}
+	r.mu.Unlock()
+
+	err := e.connect()
+
+	r.wg.Add(1)
+	go r.monitor(e)
+
+	return err
+}
+
+// Remove closes and forgets the named connection.
+func (r *Registry) Remove(name string) error {
+	r.mu.Lock()
+	e, ok := r.entries[name]
+	if ok {
+		delete(r.entries, name)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return ErrUnknownCluster
+	}
+	e.close()
+	return nil
+}
+
+// Close stops all monitors and releases every connection.
+func (r *Registry) Close() {
+	close(r.stop)
+	r.wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, e := range r.entries {
+		e.close()
+		delete(r.entries, name)
+	}
+}
+
+// Backend returns a storage backend bound to the named connection.
+func (r *Registry) Backend(name string) storage.Backend {
+	return &registryBackend{registry: r, name: name}
+}
+
+// Default returns a storage backend bound to the default connection.
+func (r *Registry) Default() storage.Backend {
+	return &registryBackend{registry: r}
+}
+
+// Health reports all connections, sorted by registration name.
+func (r *Registry) Health() []storage.ConnHealth {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.entries))
+	entries := make(map[string]*entry, len(r.entries))
+	for name, e := range r.entries {
+		names = append(names, name)
+		entries[name] = e
+	}
+	r.mu.Unlock()
+
+	sort.Strings(names)
+	health := make([]storage.ConnHealth, 0, len(names))
+	for _, name := range names {
+		health = append(health, entries[name].health())
+	}
+	return health
+}
+
+func (r *Registry) lookup(name string) (*entry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if name == "" {
+		name = r.defaultName
+	}
+	e, ok := r.entries[name]
+	if !ok {
+		return nil, ErrUnknownCluster
+	}
+	return e, nil
+}
+
+func (r *Registry) monitor(e *entry) {
+	defer r.wg.Done()
+
+	backoff := r.minBackoff
+	wait := r.probeInterval
+	if !e.isConnected() {
+		wait = backoff
+	}
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-e.done:
+			return
+		case <-time.After(wait):
+		}
+
+		if e.isConnected() {
+			if err := e.probe(); err == nil {
+				wait = r.probeInterval
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Cluster %v lost: %v\n", e.config.Name, e.lastError())
+			backoff = r.minBackoff
+		}
+
+		if err := e.connect(); err != nil {
+			fmt.Fprintf(os.Stderr, "Reconnect cluster %v failed, retry in %v: %v\n", e.config.Name, backoff, err)
+			wait = backoff
+			if backoff *= 2; backoff > r.maxBackoff {
+				backoff = r.maxBackoff
+			}
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Cluster %v reconnected\n", e.config.Name)
+		backoff = r.minBackoff
+		wait = r.probeInterval
+	}
+}
+
+type registryBackend struct {
+	registry *Registry
+	name     string
+}
+
+func (b *registryBackend) Connect() (storage.Cluster, error) {
+	e, err := b.registry.lookup(b.name)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := e.acquire()
+	if err != nil {
+		return nil, err
+	}
+	return &sharedCluster{cluster: cluster{conn: c.conn}, conn: c, entry: e}, nil
+}
+
+func (b *registryBackend) Health() []storage.ConnHealth {
+	return b.registry.Health()
+}
+
+// AddUser registers a connection to b's cluster, with its ceph.conf, as
+// another user.
+func (b *registryBackend) AddUser(name string, user string, key string) (storage.Backend, error) {
+	e, err := b.registry.lookup(b.name)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := ClusterConfig{
+		Name:       name,
+		Cluster:    e.config.Cluster,
+		User:       user,
+		ConfigFile: e.config.ConfigFile,
+		Key:        key,
+	}
+	if err := b.registry.Add(cfg); err != nil {
+		if err == storage.ErrExist {
+			return nil, err
+		}
+		return b.registry.Backend(name), err
+	}
+	return b.registry.Backend(name), nil
+}
+
+func (b *registryBackend) RemoveUser(name string) error {
+	return b.registry.Remove(name)
+}
+
+// connection is one generation of a rados connection. It is retired when
+// the cluster drops and shut down once the last request releases it.
+type connection struct {
+	conn    *rados.Conn
+	ioctxs  map[string]*rados.IOContext
+	refs    int
+	retired bool
+}
+
+func (c *connection) shutdown() {
+	for _, ioctx := range c.ioctxs {
+		ioctx.Destroy()
+	}
+	c.ioctxs = nil
+	c.conn.Shutdown()
+}
+
+type entry struct {
+	config ClusterConfig
+
+	mu          sync.Mutex
+	current     *connection
+	lastErr     error
+	lastConnect time.Time
+	failures    int
+	done        chan struct{}
+	closed      bool
+}
+
+func (e *entry) dial() (*rados.Conn, error) {
+	var conn *rados.Conn
+	var err error
+	if e.config.Cluster == defaultCluster {
+		// rados_create takes the id without the "client." prefix.
+		conn, err = rados.NewConnWithUser(strings.TrimPrefix(e.config.User, "client."))
+	} else {
+		conn, err = rados.NewConnWithClusterAndUser(e.config.Cluster, e.config.User)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if e.config.ConfigFile != "" {
+		err = conn.ReadConfigFile(e.config.ConfigFile)
+	} else {
+		err = conn.ReadDefaultConfigFile()
+	}
+	if err == nil && e.config.Keyring != "" {
+		err = conn.SetConfigOption("keyring", e.config.Keyring)
+	}
+	if err == nil && e.config.Key != "" {
+		err = conn.SetConfigOption("key", e.config.Key)
+	}
+	if err == nil {
+		err = conn.Connect()
+	}
+	if err != nil {
+		conn.Shutdown()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (e *entry) connect() error {
+	conn, err := e.dial()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err != nil {
+		e.lastErr = err
+		e.failures++
+		return err
+	}
+	if e.closed {
+		conn.Shutdown()
+		return ErrNotConnected
+	}
+
+	e.retire()
+	e.current = &connection{conn: conn, ioctxs: make(map[string]*rados.IOContext)}
+	e.lastErr = nil
+	e.lastConnect = time.Now()
+	e.failures = 0
+	return nil
+}
+
+// retire must be called with e.mu held.
+func (e *entry) retire() {
+	if e.current == nil {
+		return
+	}
+	e.current.retired = true
+	if e.current.refs == 0 {
+		e.current.shutdown()
+	}
+	e.current = nil
+}
+
+func (e *entry) probe() error {
+	c, err := e.acquire()
+	if err != nil {
+		return err
+	}
+	defer e.release(c)
+
+	if _, err := c.conn.GetClusterStats(); err != nil {
+		e.mu.Lock()
+		e.lastErr = err
+		e.failures++
+		if e.current == c {
+			e.retire()
+		}
+		e.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (e *entry) acquire() (*connection, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.current == nil {
+		if e.lastErr != nil {
+			return nil, e.lastErr
+		}
+		return nil, ErrNotConnected
+	}
+	e.current.refs++
+	return e.current, nil
+}
+
+func (e *entry) release(c *connection) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c.refs--
+	if c.refs == 0 && c.retired {
+		c.shutdown()
+	}
+}
+
+func (e *entry) isConnected() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.current != nil
+}
+
+func (e *entry) lastError() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastErr
+}
+
+func (e *entry) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return
+	}
+	e.closed = true
+	close(e.done)
+	e.retire()
+}
+
+func (e *entry) health() storage.ConnHealth {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	h := storage.ConnHealth{
+		Name:        e.config.Name,
+		Cluster:     e.config.Cluster,
+		User:        e.config.User,
+		Connected:   e.current != nil,
+		LastConnect: e.lastConnect,
+		Failures:    e.failures,
+	}
+	if e.lastErr != nil {
+		h.LastError = e.lastErr.Error()
+	}
+	if e.current != nil {
+		h.OpenPools = len(e.current.ioctxs)
+	}
+	return h
+}
+
+// ioctx returns the cached IOContext for pool, opening it on first use.
+func (e *entry) ioctx(c *connection, pool string) (*rados.IOContext, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ioctx, ok := c.ioctxs[pool]; ok {
+		return ioctx, nil
+	}
+	ioctx, err := c.conn.OpenIOContext(pool)
+	if err != nil {
+		return nil, err
+	}
+	c.ioctxs[pool] = ioctx
+	return ioctx, nil
+}
+
+func (e *entry) forget(c *connection, pool string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ioctx, ok := c.ioctxs[pool]; ok {
+		ioctx.Destroy()
+		delete(c.ioctxs, pool)
+	}
+}
+
+// sharedCluster is a request's view of a registry connection. Shutdown only
+// releases the reference; the connection itself stays up.
+type sharedCluster struct {
+	cluster
+	conn     *connection
+	entry    *entry
+	released bool
+}
+
+func (c *sharedCluster) Shutdown() {
+	if c.released {
+		return
+	}
+	c.released = true
+	c.entry.release(c.conn)
+}
+
+func (c *sharedCluster) DeletePool(name string) error {
+	c.entry.forget(c.conn, name)
+	return c.cluster.DeletePool(name)
+}
+
+func (c *sharedCluster) OpenPool(name string) (storage.Pool, error) {
+	ioctx, err := c.entry.ioctx(c.conn, name)
+	if err != nil {
+		return nil, getError(err)
+	}
+	return &sharedPool{pool{name: name, ioctx: ioctx}}, nil
+}
+
+// sharedPool wraps a cached IOContext; Close leaves it open for reuse.
+type sharedPool struct {
+	pool
+}
+
+func (p *sharedPool) Close() {
+}
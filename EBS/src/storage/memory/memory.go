@@ -0,0 +1,1251 @@
+// Package memory is a pure Go, in-process stand-in for a Ceph cluster.
+// Images are sparse: only objects that have been written hold memory, and
+// snapshots share unmodified objects with the image head.
+package memory
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"storage"
+)
+
+// Defaults of new pools and of the cluster.
+const (
+	DefaultReplicas = 3
+	DefaultPGNum    = 8
+	DefaultOSDs     = 3
+)
+
+// Cluster is an in-memory cluster. It is its own Backend; connections share
+// state and Shutdown does nothing.
+type Cluster struct {
+	mu         sync.Mutex
+	pools      map[string]*poolData
+	nextPoolID int64
+	capacity   uint64
+	osds       int
+	crushRules []string
+	ecProfiles map[string]map[string]string
+}
+
+func NewCluster() *Cluster {
+	return &Cluster{
+		pools:      make(map[string]*poolData),
+		nextPoolID: 1,
+		capacity:   1 << 40,
+		osds:       DefaultOSDs,
+		crushRules: []string{"replicated_rule"},
+		ecProfiles: map[string]map[string]string{
+			"default": {"k": "2", "m": "1", "plugin": "jerasure", "technique": "reed_sol_van"},
+		},
+	}
+}
+
+// SetOSDs sets the number of OSDs reported by the status command.
+func (c *Cluster) SetOSDs(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.osds = n
+}
+
+// AddCrushRule adds a replicated CRUSH rule and returns its ID.
+func (c *Cluster) AddCrushRule(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crushRules = append(c.crushRules, name)
+	return len(c.crushRules) - 1
+}
+
+// SetCapacity sets the raw capacity reported by GetClusterStats.
+func (c *Cluster) SetCapacity(bytes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = bytes
+}
+
+func (c *Cluster) Connect() (storage.Cluster, error) {
+	return c, nil
+}
+
+func (c *Cluster) Shutdown() {
+}
+
+func (c *Cluster) MakePool(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.pools[name]; ok {
+		return storage.ErrExist
+	}
+	c.addPool(name)
+	return nil
+}
+
+func (c *Cluster) MakePoolWithCrushRule(name string, rule uint8) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.pools[name]; ok {
+		return storage.ErrExist
+	}
+	if int(rule) >= len(c.crushRules) {
+		return storage.ErrInvalidArgument
+	}
+	c.addPool(name).crushRule = int(rule)
+	return nil
+}
+
+// addPool must be called with the cluster lock held.
+func (c *Cluster) addPool(name string) *poolData {
+	p := &poolData{
+		id:       c.nextPoolID,
+		name:     name,
+		replicas: DefaultReplicas,
+		minSize:  DefaultReplicas - DefaultReplicas/2,
+		pgNum:    DefaultPGNum,
+		apps:     make(map[string]bool),
+		images:   make(map[string]*imageData),
+	}
+	c.pools[name] = p
+	c.nextPoolID++
+	return p
+}
+
+func (c *Cluster) DeletePool(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.pools[name]; !ok {
+		return storage.ErrPoolNotFound
+	}
+	delete(c.pools, name)
+	return nil
+}
+
+func (c *Cluster) ListPools() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.pools))
+	for name := range c.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c *Cluster) LookupPool(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.pools[name]; !ok {
+		return storage.ErrPoolNotFound
+	}
+	return nil
+}
+
+func (c *Cluster) OpenPool(name string) (storage.Pool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pools[name]
+	if !ok {
+		return nil, storage.ErrPoolNotFound
+	}
+	return &pool{cluster: c, data: p}, nil
+}
+
+func (c *Cluster) GetClusterStats() (storage.ClusterStat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var used, objects uint64
+	for _, p := range c.pools {
+		stat := p.stat()
+		used += p.rawBytes(stat.Num_bytes)
+		objects += stat.Num_objects
+	}
+	avail := uint64(0)
+	if c.capacity > used {
+		avail = c.capacity - used
+	}
+	return storage.ClusterStat{
+		Kb:          c.capacity / 1024,
+		Kb_used:     used / 1024,
+		Kb_avail:    avail / 1024,
+		Num_objects: objects,
+	}, nil
+}
+
+// AddUser returns the cluster itself: users are not authenticated and
+// every connection sees every pool.
+func (c *Cluster) AddUser(name string, user string, key string) (storage.Backend, error) {
+	return c, nil
+}
+
+func (c *Cluster) RemoveUser(name string) error {
+	return nil
+}
+
+type poolData struct {
+	id       int64
+	name     string
+	replicas uint64
+	images   map[string]*imageData
+	nextID   uint64
+	rd       uint64
+	rdBytes  uint64
+	wr       uint64
+	wrBytes  uint64
+
+	// Settings changed by monitor commands. crushRule indexes
+	// Cluster.crushRules. An erasure coded pool has the profile ecProfile,
+	// replicas k+m of the profile and ecK its k.
+	minSize           uint64
+	pgNum             uint64
+	crushRule         int
+	ecProfile         string
+	ecK               uint64
+	allowECOverwrites bool
+	apps              map[string]bool
+	quotaMaxBytes     uint64
+	quotaMaxObjects   uint64
+}
+
+// rawBytes returns the raw capacity that bytes of data take in p.
+func (p *poolData) rawBytes(bytes uint64) uint64 {
+	if p.ecK > 0 {
+		return bytes * p.replicas / p.ecK
+	}
+	return bytes * p.replicas
+}
+
+// stat must be called with the cluster lock held.
+func (p *poolData) stat() storage.PoolStat {
+	var bytes, objects, clones uint64
+	for _, img := range p.images {
+		seen := make(map[*[]byte]bool)
+		for _, obj := range img.objects {
+			seen[obj] = true
+			bytes += uint64(len(*obj))
+			objects++
+		}
+		for _, snap := range img.snaps {
+			for _, obj := range snap.objects {
+				if !seen[obj] {
+					seen[obj] = true
+					bytes += uint64(len(*obj))
+					clones++
+				}
+			}
+		}
+	}
+	return storage.PoolStat{
+		Num_bytes:         bytes,
+		Num_kb:            bytes / 1024,
+		Num_objects:       objects,
+		Num_object_clones: clones,
+		Num_object_copies: objects * p.replicas,
+		Num_rd:            p.rd,
+		Num_rd_kb:         p.rdBytes / 1024,
+		Num_wr:            p.wr,
+		Num_wr_kb:         p.wrBytes / 1024,
+	}
+}
+
+type snapData struct {
+	id        uint64
+	name      string
+	size      uint64
+	objects   map[uint64]*[]byte
+	protected bool
+}
+
+type parentRef struct {
+	pool    *poolData
+	image   *imageData
+	snap    *snapData
+	overlap uint64
+}
+
+type imageData struct {
+	id          uint64
+	name        string
+	size        uint64
+	order       int
+	features    uint64
+	stripeUnit  uint64
+	stripeCount uint64
+	dataPool    string
+	metadata    map[string]string
+	objects     map[uint64]*[]byte
+	snaps       []*snapData
+	nextSnap    uint64
+	parent      *parentRef
+	removed     bool
+}
+
+func (img *imageData) objectSize() uint64 {
+	return uint64(1) << uint(img.order)
+}
+
+func (img *imageData) findSnap(name string) *snapData {
+	for _, s := range img.snaps {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// readObject copies the bytes of object objNo at [start, start+len(dst)) from
+// the given object map, falling through to the parent for unwritten objects.
+// Unallocated ranges read as zeros.
+func (img *imageData) readObject(objects map[uint64]*[]byte, objNo uint64, start uint64, dst []byte) {
+	if obj, ok := objects[objNo]; ok {
+		n := 0
+		if start < uint64(len(*obj)) {
+			n = copy(dst, (*obj)[start:])
+		}
+		for i := n; i < len(dst); i++ {
+			dst[i] = 0
+		}
+		return
+	}
+
+	if img.parent != nil {
+		off := objNo*img.objectSize() + start
+		if off < img.parent.overlap {
+			n := uint64(len(dst))
+			if off+n > img.parent.overlap {
+				n = img.parent.overlap - off
+			}
+			img.parent.image.readRange(img.parent.snap.objects, img.parent.snap.size, off, dst[:n])
+			for i := n; i < uint64(len(dst)); i++ {
+				dst[i] = 0
+			}
+			return
+		}
+	}
+
+	for i := range dst {
+		dst[i] = 0
+	}
+}
+
+func (img *imageData) readRange(objects map[uint64]*[]byte, size uint64, off uint64, dst []byte) {
+	objSize := img.objectSize()
+	for len(dst) > 0 {
+		if off >= size {
+			for i := range dst {
+				dst[i] = 0
+			}
+			return
+		}
+		objNo := off / objSize
+		start := off % objSize
+		n := objSize - start
+		if n > uint64(len(dst)) {
+			n = uint64(len(dst))
+		}
+		img.readObject(objects, objNo, start, dst[:n])
+		dst = dst[n:]
+		off += n
+	}
+}
+
+// writableObject returns a private copy of object objNo that may be
+// modified in place without affecting snapshots that share it.
+func (img *imageData) writableObject(objNo uint64) []byte {
+	objSize := img.objectSize()
+	length := objSize
+	if end := (objNo + 1) * objSize; end > img.size {
+		length = img.size - objNo*objSize
+	}
+
+	obj, ok := img.objects[objNo]
+	if ok && uint64(len(*obj)) == length {
+		shared := false
+		for _, s := range img.snaps {
+			if s.objects[objNo] == obj {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			return *obj
+		}
+	}
+
+	buf := make([]byte, length)
+	img.readObject(img.objects, objNo, 0, buf)
+	img.objects[objNo] = &buf
+	return buf
+}
+
+func (img *imageData) truncate(size uint64) {
+	objSize := img.objectSize()
+	for objNo, obj := range img.objects {
+		start := objNo * objSize
+		if start >= size {
+			delete(img.objects, objNo)
+			continue
+		}
+		if start+uint64(len(*obj)) > size {
+			buf := make([]byte, size-start)
+			copy(buf, *obj)
+			img.objects[objNo] = &buf
+		}
+	}
+	if img.parent != nil && img.parent.overlap > size {
+		img.parent.overlap = size
+	}
+	img.size = size
+}
+
+func copyObjects(objects map[uint64]*[]byte) map[uint64]*[]byte {
+	dup := make(map[uint64]*[]byte, len(objects))
+	for k, v := range objects {
+		dup[k] = v
+	}
+	return dup
+}
+
+type pool struct {
+	cluster *Cluster
+	data    *poolData
+}
+
+func (p *pool) Name() string {
+	return p.data.name
+}
+
+func (p *pool) ID() int64 {
+	return p.data.id
+}
+
+func (p *pool) GetPoolStats() (storage.PoolStat, error) {
+	p.cluster.mu.Lock()
+	defer p.cluster.mu.Unlock()
+	return p.data.stat(), nil
+}
+
+func (p *pool) ListImages() ([]string, error) {
+	p.cluster.mu.Lock()
+	defer p.cluster.mu.Unlock()
+
+	names := make([]string, 0, len(p.data.images))
+	for name := range p.data.images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (p *pool) CreateImage(name string, size uint64, order int, features uint64) error {
+	if order == 0 {
+		order = storage.DefaultOrder
+	}
+	if order < 12 || order > 25 {
+		return storage.ErrInvalidArgument
+	}
+
+	p.cluster.mu.Lock()
+	defer p.cluster.mu.Unlock()
+
+	if _, ok := p.data.images[name]; ok {
+		return storage.ErrExist
+	}
+	p.data.nextID++
+	p.data.images[name] = &imageData{
+		id:       p.data.nextID,
+		name:     name,
+		size:     size,
+		order:    order,
+		features: features,
+		objects:  make(map[uint64]*[]byte),
+	}
+	return nil
+}
+
+// CreateImageWithOptions records the stripe settings and data pool
+// without changing how the data is laid out.
+func (p *pool) CreateImageWithOptions(name string, size uint64, opts *storage.ImageOptions) error {
+	order := opts.Order
+	if order == 0 {
+		order = storage.DefaultOrder
+	}
+	if order < storage.MinOrder || order > storage.MaxOrder {
+		return storage.ErrInvalidArgument
+	}
+	if storage.CheckFeatures(opts.Features) != nil {
+		return storage.ErrInvalidArgument
+	}
+
+	p.cluster.mu.Lock()
+	defer p.cluster.mu.Unlock()
+
+	if opts.DataPool != "" {
+		if _, ok := p.cluster.pools[opts.DataPool]; !ok {
+			return storage.ErrPoolNotFound
+		}
+	}
+	if _, ok := p.data.images[name]; ok {
+		return storage.ErrExist
+	}
+	p.data.nextID++
+	p.data.images[name] = &imageData{
+		id:          p.data.nextID,
+		name:        name,
+		size:        size,
+		order:       order,
+		features:    opts.Features,
+		stripeUnit:  opts.StripeUnit,
+		stripeCount: opts.StripeCount,
+		dataPool:    opts.DataPool,
+		objects:     make(map[uint64]*[]byte),
+	}
+	return nil
+}
+
+func (p *pool) RemoveImage(name string) error {
+	p.cluster.mu.Lock()
+	defer p.cluster.mu.Unlock()
+
+	img, ok := p.data.images[name]
+	if !ok {
+		return storage.ErrImageNotFound
+	}
+	if len(img.snaps) > 0 {
+		return storage.ErrBusy
+	}
+	img.removed = true
+	delete(p.data.images, name)
+	return nil
+}
+
+func (p *pool) RemoveImageWithProgress(name string, progress storage.ProgressFunc) error {
+	if err := p.RemoveImage(name); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(1, 1)
+	}
+	return nil
+}
+
+func (p *pool) OpenImage(name string, snapshot string) (storage.Image, error) {
+	p.cluster.mu.Lock()
+	defer p.cluster.mu.Unlock()
+
+	img, ok := p.data.images[name]
+	if !ok {
+		return nil, storage.ErrImageNotFound
+	}
+
+	h := &image{pool: p, data: img, open: true}
+	if snapshot != "" {
+		if h.snap = img.findSnap(snapshot); h.snap == nil {
+			return nil, storage.ErrImageNotFound
+		}
+	}
+	return h, nil
+}
+
+func (p *pool) Close() {
+}
+
+type image struct {
+	pool *pool
+	data *imageData
+	snap *snapData
+	open bool
+}
+
+func (i *image) lock() error {
+	i.pool.cluster.mu.Lock()
+	if !i.open {
+		i.pool.cluster.mu.Unlock()
+		return storage.ErrImageNotOpen
+	}
+	if i.data.removed {
+		i.pool.cluster.mu.Unlock()
+		return storage.ErrImageNotFound
+	}
+	return nil
+}
+
+func (i *image) unlock() {
+	i.pool.cluster.mu.Unlock()
+}
+
+func (i *image) writable() error {
+	if i.snap != nil {
+		return storage.ErrReadOnly
+	}
+	return nil
+}
+
+func (i *image) Name() string {
+	return i.data.name
+}
+
+func (i *image) ReadAt(data []byte, off int64) (int, error) {
+	if err := i.lock(); err != nil {
+		return 0, err
+	}
+	defer i.unlock()
+
+	size, objects := i.data.size, i.data.objects
+	if i.snap != nil {
+		size, objects = i.snap.size, i.snap.objects
+	}
+	if off < 0 {
+		return 0, storage.ErrInvalidArgument
+	}
+	if uint64(off) >= size {
+		return 0, io.EOF
+	}
+
+	n := uint64(len(data))
+	if uint64(off)+n > size {
+		n = size - uint64(off)
+	}
+	i.data.readRange(objects, size, uint64(off), data[:n])
+
+	i.pool.data.rd++
+	i.pool.data.rdBytes += n
+	if n < uint64(len(data)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+func (i *image) WriteAt(data []byte, off int64) (int, error) {
+	if err := i.lock(); err != nil {
+		return 0, err
+	}
+	defer i.unlock()
+
+	if err := i.writable(); err != nil {
+		return 0, err
+	}
+	if off < 0 || uint64(off)+uint64(len(data)) > i.data.size {
+		return 0, storage.ErrInvalidArgument
+	}
+
+	objSize := i.data.objectSize()
+	pos, src := uint64(off), data
+	for len(src) > 0 {
+		objNo := pos / objSize
+		start := pos % objSize
+		buf := i.data.writableObject(objNo)
+		n := copy(buf[start:], src)
+		src = src[n:]
+		pos += uint64(n)
+	}
+
+	i.pool.data.wr++
+	i.pool.data.wrBytes += uint64(len(data))
+	return len(data), nil
+}
+
+func (i *image) Stat() (*storage.ImageInfo, error) {
+	if err := i.lock(); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	size := i.data.size
+	if i.snap != nil {
+		size = i.snap.size
+	}
+	objSize := i.data.objectSize()
+	info := &storage.ImageInfo{
+		Size:              size,
+		Obj_size:          objSize,
+		Num_objs:          (size + objSize - 1) / objSize,
+		Order:             i.data.order,
+		Block_name_prefix: fmt.Sprintf("rbd_data.%x%x", i.pool.data.id, i.data.id),
+		Parent_pool:       -1,
+	}
+	if i.data.parent != nil {
+		info.Parent_pool = i.data.parent.pool.id
+		info.Parent_name = i.data.parent.image.name
+	}
+	return info, nil
+}
+
+func (i *image) GetSize() (uint64, error) {
+	if err := i.lock(); err != nil {
+		return 0, err
+	}
+	defer i.unlock()
+
+	if i.snap != nil {
+		return i.snap.size, nil
+	}
+	return i.data.size, nil
+}
+
+func (i *image) GetFeatures() (uint64, error) {
+	if err := i.lock(); err != nil {
+		return 0, err
+	}
+	defer i.unlock()
+	return i.data.features, nil
+}
+
+func (i *image) UpdateFeatures(features uint64, enabled bool) error {
+	allowed := storage.FeaturesMutable
+	if !enabled {
+		allowed |= storage.FeaturesDisableOnly
+	}
+	if features == 0 || features&^allowed != 0 {
+		return storage.ErrInvalidArgument
+	}
+
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := i.writable(); err != nil {
+		return err
+	}
+	updated := i.data.features | features
+	if !enabled {
+		updated = i.data.features &^ features
+	}
+	if storage.CheckFeatures(updated) != nil {
+		return storage.ErrInvalidArgument
+	}
+	i.data.features = updated
+	return nil
+}
+
+func (i *image) GetMetadata(key string) (string, error) {
+	if err := i.lock(); err != nil {
+		return "", err
+	}
+	defer i.unlock()
+
+	value, ok := i.data.metadata[key]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return value, nil
+}
+
+func (i *image) SetMetadata(key string, value string) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := i.writable(); err != nil {
+		return err
+	}
+	if i.data.metadata == nil {
+		i.data.metadata = make(map[string]string)
+	}
+	i.data.metadata[key] = value
+	return nil
+}
+
+func (i *image) RemoveMetadata(key string) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := i.writable(); err != nil {
+		return err
+	}
+	if _, ok := i.data.metadata[key]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(i.data.metadata, key)
+	return nil
+}
+
+func (i *image) ListMetadata() (map[string]string, error) {
+	if err := i.lock(); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	metadata := make(map[string]string, len(i.data.metadata))
+	for k, v := range i.data.metadata {
+		metadata[k] = v
+	}
+	return metadata, nil
+}
+
+func (i *image) GetStripePeriod() (uint64, error) {
+	if err := i.lock(); err != nil {
+		return 0, err
+	}
+	defer i.unlock()
+	if i.data.stripeCount > 0 {
+		return i.data.stripeCount * i.data.objectSize(), nil
+	}
+	return i.data.objectSize(), nil
+}
+
+func (i *image) Resize(size uint64) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := i.writable(); err != nil {
+		return err
+	}
+	i.data.truncate(size)
+	return nil
+}
+
+func (i *image) ResizeWithProgress(size uint64, progress storage.ProgressFunc) error {
+	if err := i.Resize(size); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(1, 1)
+	}
+	return nil
+}
+
+func (i *image) Flush() error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	i.unlock()
+	return nil
+}
+
+func (i *image) Discard(ofs uint64, length uint64) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := i.writable(); err != nil {
+		return err
+	}
+	if ofs >= i.data.size {
+		return nil
+	}
+	if ofs+length > i.data.size {
+		length = i.data.size - ofs
+	}
+
+	objSize := i.data.objectSize()
+	for pos, end := ofs, ofs+length; pos < end; {
+		objNo := pos / objSize
+		start := pos % objSize
+		n := objSize - start
+		if pos+n > end {
+			n = end - pos
+		}
+		if start == 0 && n == objSize && i.data.parent == nil {
+			delete(i.data.objects, objNo)
+		} else {
+			buf := i.data.writableObject(objNo)
+			stop := start + n
+			if stop > uint64(len(buf)) {
+				stop = uint64(len(buf))
+			}
+			for j := start; j < stop; j++ {
+				buf[j] = 0
+			}
+		}
+		pos += n
+	}
+	return nil
+}
+
+type diffExtent struct {
+	offset uint64
+	length uint64
+	exists bool
+}
+
+// diff compares the object maps of two points in time at object
+// granularity: snapshots share unmodified objects with the head, so an
+// object differs when its buffer does. A nil from reports every allocated
+// object, including the range inherited from the parent.
+func (img *imageData) diff(from map[uint64]*[]byte, objects map[uint64]*[]byte, size uint64, ofs uint64, end uint64) []diffExtent {
+	if end > size {
+		end = size
+	}
+
+	var extents []diffExtent
+	objSize := img.objectSize()
+	for pos := ofs; pos < end; {
+		objNo := pos / objSize
+		next := (objNo + 1) * objSize
+		if next > end {
+			next = end
+		}
+
+		obj, allocated := objects[objNo]
+		changed, exists := false, true
+		if from == nil {
+			changed = allocated || (img.parent != nil && pos < img.parent.overlap)
+		} else if old, ok := from[objNo]; allocated {
+			changed = !ok || old != obj
+		} else if ok {
+			changed, exists = true, false
+		}
+
+		if changed {
+			if n := len(extents); n > 0 && extents[n-1].offset+extents[n-1].length == pos && extents[n-1].exists == exists {
+				extents[n-1].length += next - pos
+			} else {
+				extents = append(extents, diffExtent{offset: pos, length: next - pos, exists: exists})
+			}
+		}
+		pos = next
+	}
+	return extents
+}
+
+func (i *image) DiffIterate(fromSnapshot string, ofs uint64, length uint64, fn storage.DiffFunc) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+
+	size, objects := i.data.size, i.data.objects
+	if i.snap != nil {
+		size, objects = i.snap.size, i.snap.objects
+	}
+	var from map[uint64]*[]byte
+	if fromSnapshot != "" {
+		snap := i.data.findSnap(fromSnapshot)
+		if snap == nil {
+			i.unlock()
+			return storage.ErrNotFound
+		}
+		if i.snap != nil && snap.id >= i.snap.id {
+			i.unlock()
+			return storage.ErrInvalidArgument
+		}
+		from = snap.objects
+	}
+	extents := i.data.diff(from, objects, size, ofs, ofs+length)
+	i.unlock()
+
+	// fn may read the image, so it is called without the lock.
+	for _, e := range extents {
+		if err := fn(e.offset, e.length, e.exists); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *image) CreateSnapshot(name string) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := i.writable(); err != nil {
+		return err
+	}
+	if i.data.findSnap(name) != nil {
+		return storage.ErrExist
+	}
+	i.data.nextSnap++
+	i.data.snaps = append(i.data.snaps, &snapData{
+		id:      i.data.nextSnap,
+		name:    name,
+		size:    i.data.size,
+		objects: copyObjects(i.data.objects),
+	})
+	return nil
+}
+
+func (i *image) ListSnapshots() ([]storage.SnapInfo, error) {
+	if err := i.lock(); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	snaps := make([]storage.SnapInfo, len(i.data.snaps))
+	for j, s := range i.data.snaps {
+		snaps[j] = storage.SnapInfo{Id: s.id, Size: s.size, Name: s.name}
+	}
+	return snaps, nil
+}
+
+// hasChildren must be called with the cluster lock held.
+func (i *image) hasChildren(snap *snapData) bool {
+	for _, p := range i.pool.cluster.pools {
+		for _, img := range p.images {
+			if img.parent != nil && img.parent.snap == snap {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (i *image) RemoveSnapshot(name string) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	for j, s := range i.data.snaps {
+		if s.name == name {
+			if s.protected {
+				return storage.ErrBusy
+			}
+			i.data.snaps = append(i.data.snaps[:j], i.data.snaps[j+1:]...)
+			return nil
+		}
+	}
+	return storage.ErrNotFound
+}
+
+func (i *image) RollbackSnapshot(name string) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := i.writable(); err != nil {
+		return err
+	}
+	s := i.data.findSnap(name)
+	if s == nil {
+		return storage.ErrNotFound
+	}
+	i.data.objects = copyObjects(s.objects)
+	i.data.size = s.size
+	return nil
+}
+
+func (i *image) ProtectSnapshot(name string) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	s := i.data.findSnap(name)
+	if s == nil {
+		return storage.ErrNotFound
+	}
+	if s.protected {
+		return storage.ErrBusy
+	}
+	s.protected = true
+	return nil
+}
+
+func (i *image) UnprotectSnapshot(name string) error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	s := i.data.findSnap(name)
+	if s == nil {
+		return storage.ErrNotFound
+	}
+	if !s.protected {
+		return storage.ErrInvalidArgument
+	}
+	if i.hasChildren(s) {
+		return storage.ErrBusy
+	}
+	s.protected = false
+	return nil
+}
+
+func (i *image) IsSnapshotProtected(name string) (bool, error) {
+	if err := i.lock(); err != nil {
+		return false, err
+	}
+	defer i.unlock()
+
+	s := i.data.findSnap(name)
+	if s == nil {
+		return false, storage.ErrNotFound
+	}
+	return s.protected, nil
+}
+
+func (i *image) Clone(snapshot string, dest storage.Pool, name string, features uint64, order int) error {
+	d, ok := dest.(*pool)
+	if !ok || d.cluster != i.pool.cluster {
+		return storage.ErrInvalidArgument
+	}
+	if features&storage.FeatureLayering == 0 {
+		return storage.ErrInvalidArgument
+	}
+	if order == 0 {
+		order = i.data.order
+	}
+
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	s := i.data.findSnap(snapshot)
+	if s == nil {
+		return storage.ErrNotFound
+	}
+	if !s.protected {
+		return storage.ErrInvalidArgument
+	}
+	if _, ok := d.data.images[name]; ok {
+		return storage.ErrExist
+	}
+
+	d.data.nextID++
+	d.data.images[name] = &imageData{
+		id:       d.data.nextID,
+		name:     name,
+		size:     s.size,
+		order:    order,
+		features: features,
+		objects:  make(map[uint64]*[]byte),
+		parent: &parentRef{
+			pool:    i.pool.data,
+			image:   i.data,
+			snap:    s,
+			overlap: s.size,
+		},
+	}
+	return nil
+}
+
+func (i *image) Flatten() error {
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := i.writable(); err != nil {
+		return err
+	}
+	if i.data.parent == nil {
+		return storage.ErrInvalidArgument
+	}
+
+	objSize := i.data.objectSize()
+	for objNo := uint64(0); objNo*objSize < i.data.parent.overlap; objNo++ {
+		if _, ok := i.data.objects[objNo]; !ok {
+			i.data.writableObject(objNo)
+		}
+	}
+	i.data.parent = nil
+	return nil
+}
+
+func (i *image) Parent() (string, string, string, error) {
+	if err := i.lock(); err != nil {
+		return "", "", "", err
+	}
+	defer i.unlock()
+
+	parent := i.data.parent
+	if parent == nil {
+		return "", "", "", storage.ErrNotFound
+	}
+	return parent.pool.name, parent.image.name, parent.snap.name, nil
+}
+
+// Copy materializes every allocated or inherited object into a new image,
+// reporting progress per object.
+func (i *image) Copy(dest storage.Pool, name string, progress storage.ProgressFunc) error {
+	d, ok := dest.(*pool)
+	if !ok || d.cluster != i.pool.cluster {
+		return storage.ErrInvalidArgument
+	}
+
+	if err := i.lock(); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if _, ok := d.data.images[name]; ok {
+		return storage.ErrExist
+	}
+
+	size, objects := i.data.size, i.data.objects
+	if i.snap != nil {
+		size, objects = i.snap.size, i.snap.objects
+	}
+	dup := &imageData{
+		name:     name,
+		size:     size,
+		order:    i.data.order,
+		features: i.data.features,
+		objects:  make(map[uint64]*[]byte),
+	}
+
+	objSize := i.data.objectSize()
+	total := (size + objSize - 1) / objSize
+	for objNo := uint64(0); objNo < total; objNo++ {
+		_, allocated := objects[objNo]
+		inherited := i.data.parent != nil && objNo*objSize < i.data.parent.overlap
+		if allocated || inherited {
+			length := objSize
+			if end := (objNo + 1) * objSize; end > size {
+				length = size - objNo*objSize
+			}
+			buf := make([]byte, length)
+			i.data.readObject(objects, objNo, 0, buf)
+			dup.objects[objNo] = &buf
+		}
+		if progress != nil {
+			progress(objNo+1, total)
+		}
+	}
+
+	d.data.nextID++
+	dup.id = d.data.nextID
+	d.data.images[name] = dup
+	return nil
+}
+
+func (i *image) ListChildren() ([]string, []string, error) {
+	if err := i.lock(); err != nil {
+		return nil, nil, err
+	}
+	defer i.unlock()
+
+	if i.snap == nil {
+		return nil, nil, storage.ErrInvalidArgument
+	}
+
+	var pools, images []string
+	for _, p := range i.pool.cluster.pools {
+		for _, img := range p.images {
+			if img.parent != nil && img.parent.snap == i.snap {
+				pools = append(pools, p.name)
+				images = append(images, img.name)
+			}
+		}
+	}
+	return pools, images, nil
+}
+
+func (i *image) Close() error {
+	i.pool.cluster.mu.Lock()
+	defer i.pool.cluster.mu.Unlock()
+
+	if !i.open {
+		return storage.ErrImageNotOpen
+	}
+	i.open = false
+	return nil
+}
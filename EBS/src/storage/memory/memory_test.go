@@ -0,0 +1,367 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"storage"
+)
+
+// Images of the tests have 4 KiB objects.
+const (
+	testOrder   = 12
+	testObjSize = 1 << testOrder
+)
+
+func newTestPool(t *testing.T) (*Cluster, storage.Pool) {
+	c := NewCluster()
+	if err := c.MakePool("rbd"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.OpenPool("rbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, p
+}
+
+func newTestImage(t *testing.T, p storage.Pool, name string, size uint64) storage.Image {
+	if err := p.CreateImage(name, size, testOrder, storage.FeatureLayering); err != nil {
+		t.Fatal(err)
+	}
+	img, err := p.OpenImage(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { img.Close() })
+	return img
+}
+
+func fill(n int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func readAll(t *testing.T, img storage.Image, off int64, n int) []byte {
+	buf := make([]byte, n)
+	if _, err := img.ReadAt(buf, off); err != nil {
+		t.Fatalf("ReadAt(%v, %v): %v", off, n, err)
+	}
+	return buf
+}
+
+func TestSparseReadWrite(t *testing.T) {
+	_, p := newTestPool(t)
+	// The last object is partial.
+	size := uint64(4*testObjSize + 100)
+	img := newTestImage(t, p, "vol", size)
+
+	// Spans the end of object 0 and the start of object 1.
+	if _, err := img.WriteAt(fill(200, 1), testObjSize-100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(fill(50, 2), int64(size-50)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		off  int64
+		want []byte
+	}{
+		{"before write", 0, make([]byte, testObjSize-100)},
+		{"across objects", testObjSize - 100, fill(200, 1)},
+		{"unallocated object", 2 * testObjSize, make([]byte, testObjSize)},
+		{"partial last object", int64(size - 100), append(make([]byte, 50), fill(50, 2)...)},
+	}
+	for _, tt := range tests {
+		if got := readAll(t, img, tt.off, len(tt.want)); !bytes.Equal(got, tt.want) {
+			t.Errorf("%v: read %v", tt.name, got)
+		}
+	}
+
+	// Only the written objects take space.
+	stat, err := p.GetPoolStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Num_objects != 3 || stat.Num_bytes != 2*testObjSize+100 || stat.Num_object_copies != 3*DefaultReplicas {
+		t.Errorf("pool stats %+v", stat)
+	}
+	if stat.Num_wr != 2 || stat.Num_rd != uint64(len(tests)) {
+		t.Errorf("%v reads, %v writes", stat.Num_rd, stat.Num_wr)
+	}
+
+	buf := make([]byte, 100)
+	if n, err := img.ReadAt(buf, int64(size-10)); n != 10 || err != io.EOF {
+		t.Errorf("read past the end = %v, %v", n, err)
+	}
+	if _, err := img.ReadAt(buf, int64(size)); err != io.EOF {
+		t.Errorf("read at the end = %v", err)
+	}
+	if _, err := img.WriteAt(buf, int64(size-10)); err != storage.ErrInvalidArgument {
+		t.Errorf("write past the end = %v", err)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	_, p := newTestPool(t)
+	img := newTestImage(t, p, "vol", 2*testObjSize)
+	if _, err := img.WriteAt(fill(2*testObjSize, 1), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A whole object is released, part of one is zeroed.
+	if err := img.Discard(testObjSize-10, testObjSize+10); err != nil {
+		t.Fatal(err)
+	}
+	want := append(fill(testObjSize-10, 1), make([]byte, testObjSize+10)...)
+	if got := readAll(t, img, 0, 2*testObjSize); !bytes.Equal(got, want) {
+		t.Error("discarded range not zero")
+	}
+	if stat, _ := p.GetPoolStats(); stat.Num_objects != 1 {
+		t.Errorf("%v objects after discard", stat.Num_objects)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	_, p := newTestPool(t)
+	img := newTestImage(t, p, "vol", 2*testObjSize)
+	if _, err := img.WriteAt(fill(2*testObjSize, 1), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.CreateSnapshot("snap"); err != storage.ErrExist {
+		t.Errorf("second CreateSnapshot = %v", err)
+	}
+	if _, err := img.WriteAt(fill(10, 2), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := p.OpenImage("vol", "snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	if got := readAll(t, snap, 0, 10); !bytes.Equal(got, fill(10, 1)) {
+		t.Errorf("snapshot sees the write after it: %v", got)
+	}
+	if _, err := snap.WriteAt(fill(10, 3), 0); err != storage.ErrReadOnly {
+		t.Errorf("write to snapshot = %v", err)
+	}
+
+	// The overwritten object is kept for the snapshot, the other shared.
+	stat, _ := p.GetPoolStats()
+	if stat.Num_objects != 2 || stat.Num_object_clones != 1 || stat.Num_bytes != 3*testObjSize {
+		t.Errorf("pool stats %+v", stat)
+	}
+
+	var changed []uint64
+	err = img.DiffIterate("snap", 0, 2*testObjSize, func(off uint64, length uint64, exists bool) error {
+		changed = append(changed, off, length)
+		return nil
+	})
+	if err != nil || len(changed) != 2 || changed[0] != 0 || changed[1] != testObjSize {
+		t.Errorf("diff since snap %v, %v", changed, err)
+	}
+
+	if err := img.ProtectSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.RemoveSnapshot("snap"); err != storage.ErrBusy {
+		t.Errorf("remove protected snapshot = %v", err)
+	}
+	if err := p.RemoveImage("vol"); err != storage.ErrBusy {
+		t.Errorf("remove image with snapshots = %v", err)
+	}
+
+	if err := img.RollbackSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, img, 0, 10); !bytes.Equal(got, fill(10, 1)) {
+		t.Errorf("data after rollback %v", got)
+	}
+	if err := img.UnprotectSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.RemoveSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.OpenImage("vol", "snap"); err != storage.ErrImageNotFound {
+		t.Errorf("open removed snapshot = %v", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	c, p := newTestPool(t)
+	if err := c.MakePool("ssd"); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := c.OpenPool("ssd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := newTestImage(t, p, "parent", 2*testObjSize)
+	if _, err := parent.WriteAt(fill(2*testObjSize, 1), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.CreateSnapshot("base"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parent.Clone("base", dest, "child", storage.FeatureLayering, 0); err != storage.ErrInvalidArgument {
+		t.Errorf("clone of unprotected snapshot = %v", err)
+	}
+	if err := parent.ProtectSnapshot("base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Clone("base", dest, "child", 0, 0); err != storage.ErrInvalidArgument {
+		t.Errorf("clone without layering = %v", err)
+	}
+	if err := parent.Clone("base", dest, "child", storage.FeatureLayering, 0); err != nil {
+		t.Fatal(err)
+	}
+	child, err := dest.OpenImage("child", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+
+	if pool, name, snap, err := child.Parent(); err != nil || pool != "rbd" || name != "parent" || snap != "base" {
+		t.Errorf("Parent = %v/%v@%v, %v", pool, name, snap, err)
+	}
+	if _, err := child.WriteAt(fill(10, 2), testObjSize); err != nil {
+		t.Fatal(err)
+	}
+	// Unwritten ranges and the rest of a written object come from the parent.
+	want := append(fill(testObjSize, 1), fill(10, 2)...)
+	if got := readAll(t, child, 0, testObjSize+10); !bytes.Equal(got, want) {
+		t.Error("child does not read through to the parent")
+	}
+	if got := readAll(t, child, testObjSize+10, 10); !bytes.Equal(got, fill(10, 1)) {
+		t.Errorf("rest of copied object %v", got)
+	}
+	if got := readAll(t, parent, testObjSize, 10); !bytes.Equal(got, fill(10, 1)) {
+		t.Errorf("write to child changed the parent: %v", got)
+	}
+
+	if err := parent.UnprotectSnapshot("base"); err != storage.ErrBusy {
+		t.Errorf("unprotect with children = %v", err)
+	}
+	snap, err := p.OpenImage("parent", "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	if pools, images, err := snap.ListChildren(); err != nil || len(images) != 1 || pools[0] != "ssd" || images[0] != "child" {
+		t.Errorf("ListChildren = %v %v, %v", pools, images, err)
+	}
+
+	if err := child.Flatten(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := child.Parent(); err != storage.ErrNotFound {
+		t.Errorf("Parent after flatten = %v", err)
+	}
+	if got := readAll(t, child, 0, testObjSize); !bytes.Equal(got, fill(testObjSize, 1)) {
+		t.Error("flatten lost the parent data")
+	}
+	if err := parent.UnprotectSnapshot("base"); err != nil {
+		t.Errorf("unprotect after flatten = %v", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	_, p := newTestPool(t)
+	img := newTestImage(t, p, "vol", 3*testObjSize)
+	if _, err := img.WriteAt(fill(3*testObjSize, 1), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.Resize(testObjSize + 10); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := img.GetSize(); err != nil || size != testObjSize+10 {
+		t.Errorf("size after shrink %v, %v", size, err)
+	}
+	if stat, _ := p.GetPoolStats(); stat.Num_objects != 2 || stat.Num_bytes != testObjSize+10 {
+		t.Errorf("pool stats after shrink %+v", stat)
+	}
+
+	// Growing does not bring back the truncated data.
+	if err := img.Resize(3 * testObjSize); err != nil {
+		t.Fatal(err)
+	}
+	want := append(fill(10, 1), make([]byte, 2*testObjSize-10)...)
+	if got := readAll(t, img, testObjSize, 2*testObjSize); !bytes.Equal(got, want) {
+		t.Error("grown range not zero")
+	}
+}
+
+func TestClusterStats(t *testing.T) {
+	c, p := newTestPool(t)
+	c.SetCapacity(1 << 30)
+	img := newTestImage(t, p, "vol", 1<<20)
+	if _, err := img.WriteAt(fill(testObjSize, 1), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := c.GetClusterStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each byte is stored on DefaultReplicas OSDs.
+	used := uint64(testObjSize * DefaultReplicas)
+	if stat.Kb != 1<<20 || stat.Kb_used != used/1024 || stat.Kb_avail != (1<<30-used)/1024 || stat.Num_objects != 1 {
+		t.Errorf("cluster stats %+v", stat)
+	}
+}
+
+func TestMonCommand(t *testing.T) {
+	c, _ := newTestPool(t)
+	command := func(args map[string]interface{}, result interface{}) error {
+		data, _ := json.Marshal(args)
+		out, _, err := c.MonCommand(data)
+		if err == nil && result != nil {
+			err = json.Unmarshal(out, result)
+		}
+		return err
+	}
+
+	tests := []struct {
+		name string
+		args map[string]interface{}
+		err  error
+	}{
+		{"set size", map[string]interface{}{"prefix": "osd pool set", "pool": "rbd", "var": "size", "val": "2"}, nil},
+		{"size too large", map[string]interface{}{"prefix": "osd pool set", "pool": "rbd", "var": "size", "val": "11"},
+			storage.ErrInvalidArgument},
+		{"min_size above size", map[string]interface{}{"prefix": "osd pool set", "pool": "rbd", "var": "min_size", "val": 3},
+			storage.ErrInvalidArgument},
+		{"missing pool", map[string]interface{}{"prefix": "osd pool get", "pool": "missing", "var": "size"}, storage.ErrNotFound},
+		{"erasure pool", map[string]interface{}{"prefix": "osd pool create", "pool": "ec", "pg_num": 16,
+			"pool_type": "erasure"}, nil},
+		{"unknown command", map[string]interface{}{"prefix": "osd pool rm", "pool": "rbd"}, storage.ErrNotSupported},
+	}
+	for _, tt := range tests {
+		if err := command(tt.args, nil); err != tt.err {
+			t.Errorf("%v: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	var size struct{ Size uint64 }
+	if err := command(map[string]interface{}{"prefix": "osd pool get", "pool": "rbd", "var": "size"}, &size); err != nil || size.Size != 2 {
+		t.Errorf("size %v, %v", size.Size, err)
+	}
+	// The default profile is k=2 m=1.
+	if err := command(map[string]interface{}{"prefix": "osd pool get", "pool": "ec", "var": "size"}, &size); err != nil || size.Size != 3 {
+		t.Errorf("erasure pool size %v, %v", size.Size, err)
+	}
+	var rule struct{ Crush_rule string }
+	if err := command(map[string]interface{}{"prefix": "osd pool get", "pool": "ec", "var": "crush_rule"}, &rule); err != nil || rule.Crush_rule != "ec" {
+		t.Errorf("erasure pool rule %q, %v", rule.Crush_rule, err)
+	}
+}
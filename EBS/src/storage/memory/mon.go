@@ -0,0 +1,426 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"storage"
+)
+
+// monArgs are the arguments of a monitor command. Numbers may be given as
+// JSON numbers or strings, as the monitors accept both.
+type monArgs map[string]interface{}
+
+func (a monArgs) str(key string) string {
+	switch v := a[key].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func (a monArgs) number(key string) (uint64, error) {
+	n, err := strconv.ParseUint(a.str(key), 10, 64)
+	if err != nil {
+		return 0, storage.ErrInvalidArgument
+	}
+	return n, nil
+}
+
+// MonCommand implements the monitor commands EBS sends about pools, erasure
+// code profiles, CRUSH rules and the cluster state. Other commands fail
+// with ErrNotSupported.
+func (c *Cluster) MonCommand(args []byte) ([]byte, string, error) {
+	var a monArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, "", storage.ErrInvalidArgument
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var result interface{}
+	var err error
+	switch prefix := a.str("prefix"); prefix {
+	case "osd pool create":
+		err = c.monPoolCreate(a)
+	case "osd pool get":
+		result, err = c.monPoolGet(a)
+	case "osd pool set":
+		err = c.monPoolSet(a)
+	case "osd pool get-quota":
+		result, err = c.monPoolGetQuota(a)
+	case "osd pool set-quota":
+		err = c.monPoolSetQuota(a)
+	case "osd pool application enable":
+		var p *poolData
+		if p, err = c.monPool(a); err == nil {
+			p.apps[a.str("app")] = true
+		}
+	case "osd erasure-code-profile set":
+		err = c.monProfileSet(a)
+	case "osd erasure-code-profile get":
+		profile, ok := c.ecProfiles[a.str("name")]
+		if !ok {
+			return nil, "unknown erasure code profile", storage.ErrNotFound
+		}
+		result = profile
+	case "osd erasure-code-profile ls":
+		names := []string{}
+		for name := range c.ecProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		result = names
+	case "osd crush rule dump":
+		result, err = c.monCrushRule(a.str("name"))
+	case "health":
+		result = c.monHealth()
+	case "df":
+		result = c.monDF()
+	case "status":
+		result = c.monStatus()
+	default:
+		return nil, "unsupported command " + prefix, storage.ErrNotSupported
+	}
+	if err != nil {
+		return nil, err.Error(), err
+	}
+	if result == nil {
+		return nil, "", nil
+	}
+	out, err := json.Marshal(result)
+	return out, "", err
+}
+
+// monPool must be called with the cluster lock held, as all functions
+// below.
+func (c *Cluster) monPool(a monArgs) (*poolData, error) {
+	p, ok := c.pools[a.str("pool")]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return p, nil
+}
+
+func (c *Cluster) crushRuleID(name string) (int, error) {
+	for id, rule := range c.crushRules {
+		if rule == name {
+			return id, nil
+		}
+	}
+	return 0, storage.ErrNotFound
+}
+
+func (c *Cluster) monPoolCreate(a monArgs) error {
+	name := a.str("pool")
+	if _, ok := c.pools[name]; ok {
+		return storage.ErrExist
+	}
+	pgNum, err := a.number("pg_num")
+	if err != nil || pgNum == 0 {
+		return storage.ErrInvalidArgument
+	}
+	rule := 0
+	if ruleName := a.str("rule"); ruleName != "" {
+		if rule, err = c.crushRuleID(ruleName); err != nil {
+			return err
+		}
+	}
+
+	var profile string
+	var k, m uint64
+	switch a.str("pool_type") {
+	case "", "replicated":
+	case "erasure":
+		if profile = a.str("erasure_code_profile"); profile == "" {
+			profile = "default"
+		}
+		values, ok := c.ecProfiles[profile]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		k, _ = strconv.ParseUint(values["k"], 10, 64)
+		m, _ = strconv.ParseUint(values["m"], 10, 64)
+	default:
+		return storage.ErrInvalidArgument
+	}
+
+	// Like the monitors, generate a rule named after an erasure coded pool
+	// when none is given.
+	if profile != "" && a.str("rule") == "" {
+		c.crushRules = append(c.crushRules, name)
+		rule = len(c.crushRules) - 1
+	}
+	p := c.addPool(name)
+	p.pgNum = pgNum
+	p.crushRule = rule
+	if profile != "" {
+		p.ecProfile = profile
+		p.ecK = k
+		p.replicas = k + m
+		p.minSize = k + 1
+	}
+	return nil
+}
+
+func (c *Cluster) monPoolGet(a monArgs) (interface{}, error) {
+	p, err := c.monPool(a)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{"pool": p.name, "pool_id": p.id}
+	switch variable := a.str("var"); variable {
+	case "size":
+		result[variable] = p.replicas
+	case "min_size":
+		result[variable] = p.minSize
+	case "pg_num", "pgp_num":
+		result[variable] = p.pgNum
+	case "crush_rule":
+		result[variable] = c.crushRules[p.crushRule]
+	case "erasure_code_profile":
+		if p.ecProfile == "" {
+			return nil, storage.ErrInvalidArgument
+		}
+		result[variable] = p.ecProfile
+	case "allow_ec_overwrites":
+		result[variable] = p.allowECOverwrites
+	default:
+		return nil, storage.ErrInvalidArgument
+	}
+	return result, nil
+}
+
+func (c *Cluster) monPoolSet(a monArgs) error {
+	p, err := c.monPool(a)
+	if err != nil {
+		return err
+	}
+	switch a.str("var") {
+	case "size":
+		n, err := a.number("val")
+		if err != nil || n < 1 || n > 10 || p.ecProfile != "" {
+			return storage.ErrInvalidArgument
+		}
+		p.replicas = n
+		if p.minSize > n {
+			p.minSize = n
+		}
+	case "min_size":
+		n, err := a.number("val")
+		if err != nil || n < 1 || n > p.replicas || n < p.ecK {
+			return storage.ErrInvalidArgument
+		}
+		p.minSize = n
+	case "pg_num", "pgp_num":
+		n, err := a.number("val")
+		if err != nil || n == 0 {
+			return storage.ErrInvalidArgument
+		}
+		p.pgNum = n
+	case "crush_rule":
+		rule, err := c.crushRuleID(a.str("val"))
+		if err != nil {
+			return err
+		}
+		p.crushRule = rule
+	case "allow_ec_overwrites":
+		if p.ecProfile == "" {
+			return storage.ErrInvalidArgument
+		}
+		p.allowECOverwrites = a.str("val") == "true"
+	default:
+		return storage.ErrInvalidArgument
+	}
+	return nil
+}
+
+func (c *Cluster) monPoolGetQuota(a monArgs) (interface{}, error) {
+	p, err := c.monPool(a)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"pool_name":         p.name,
+		"pool_id":           p.id,
+		"quota_max_objects": p.quotaMaxObjects,
+		"quota_max_bytes":   p.quotaMaxBytes,
+	}, nil
+}
+
+func (c *Cluster) monPoolSetQuota(a monArgs) error {
+	p, err := c.monPool(a)
+	if err != nil {
+		return err
+	}
+	n, err := a.number("val")
+	if err != nil {
+		return err
+	}
+	switch a.str("field") {
+	case "max_bytes":
+		p.quotaMaxBytes = n
+	case "max_objects":
+		p.quotaMaxObjects = n
+	default:
+		return storage.ErrInvalidArgument
+	}
+	return nil
+}
+
+func (c *Cluster) monProfileSet(a monArgs) error {
+	name := a.str("name")
+	items, _ := a["profile"].([]interface{})
+	profile := map[string]string{"plugin": "jerasure", "technique": "reed_sol_van"}
+	for _, item := range items {
+		kv := strings.SplitN(fmt.Sprint(item), "=", 2)
+		if len(kv) != 2 {
+			return storage.ErrInvalidArgument
+		}
+		profile[kv[0]] = kv[1]
+	}
+	k, errK := strconv.ParseUint(profile["k"], 10, 64)
+	m, errM := strconv.ParseUint(profile["m"], 10, 64)
+	if name == "" || errK != nil || errM != nil || k == 0 || m == 0 {
+		return storage.ErrInvalidArgument
+	}
+
+	if old, ok := c.ecProfiles[name]; ok && a.str("force") != "true" {
+		if fmt.Sprint(old) != fmt.Sprint(profile) {
+			return storage.ErrExist
+		}
+	}
+	c.ecProfiles[name] = profile
+	return nil
+}
+
+func (c *Cluster) monCrushRule(name string) (interface{}, error) {
+	id, err := c.crushRuleID(name)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"rule_id": id, "rule_name": name, "ruleset": id, "type": 1}, nil
+}
+
+func (c *Cluster) monHealth() interface{} {
+	checks := map[string]interface{}{}
+	status := "HEALTH_OK"
+	if c.osds == 0 {
+		status = "HEALTH_ERR"
+		checks["OSD_DOWN"] = map[string]interface{}{
+			"severity": status,
+			"summary":  map[string]string{"message": "no osds"},
+		}
+	}
+	return map[string]interface{}{"checks": checks, "status": status}
+}
+
+// monUsage returns the raw capacity used by the pools, in bytes.
+func (c *Cluster) monUsage() uint64 {
+	var used uint64
+	for _, p := range c.pools {
+		used += p.rawBytes(p.stat().Num_bytes)
+	}
+	return used
+}
+
+func (c *Cluster) poolNames() []string {
+	names := make([]string, 0, len(c.pools))
+	for name := range c.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Cluster) monDF() interface{} {
+	used := c.monUsage()
+	avail := uint64(0)
+	if c.capacity > used {
+		avail = c.capacity - used
+	}
+
+	pools := []interface{}{}
+	for _, name := range c.poolNames() {
+		p := c.pools[name]
+		stat := p.stat()
+		var percent float64
+		if c.capacity > 0 {
+			percent = float64(p.rawBytes(stat.Num_bytes)) * 100 / float64(c.capacity)
+		}
+		pools = append(pools, map[string]interface{}{
+			"name": p.name,
+			"id":   p.id,
+			"stats": map[string]interface{}{
+				"kb_used":      stat.Num_kb,
+				"bytes_used":   stat.Num_bytes,
+				"percent_used": percent,
+				"max_avail":    p.usableBytes(avail),
+				"objects":      stat.Num_objects,
+			},
+		})
+	}
+	return map[string]interface{}{
+		"stats": map[string]uint64{
+			"total_bytes":       c.capacity,
+			"total_used_bytes":  used,
+			"total_avail_bytes": avail,
+		},
+		"pools": pools,
+	}
+}
+
+// usableBytes returns how much data fits in raw bytes of capacity in p.
+func (p *poolData) usableBytes(raw uint64) uint64 {
+	if p.ecK > 0 {
+		return raw / p.replicas * p.ecK
+	}
+	return raw / p.replicas
+}
+
+func (c *Cluster) monStatus() interface{} {
+	used := c.monUsage()
+	avail := uint64(0)
+	if c.capacity > used {
+		avail = c.capacity - used
+	}
+	var pgs, objects, data uint64
+	for _, p := range c.pools {
+		stat := p.stat()
+		pgs += p.pgNum
+		objects += stat.Num_objects
+		data += stat.Num_bytes
+	}
+	return map[string]interface{}{
+		"fsid":   "00000000-0000-0000-0000-000000000000",
+		"health": c.monHealth(),
+		"monmap": map[string]interface{}{
+			"epoch": 1,
+			"mons":  []interface{}{map[string]interface{}{"rank": 0, "name": "a", "addr": "127.0.0.1:6789/0"}},
+		},
+		"osdmap": map[string]interface{}{
+			"epoch":       1,
+			"num_osds":    c.osds,
+			"num_up_osds": c.osds,
+			"num_in_osds": c.osds,
+		},
+		"pgmap": map[string]interface{}{
+			"pgs_by_state": []interface{}{map[string]interface{}{"state_name": "active+clean", "count": pgs}},
+			"num_pgs":      pgs,
+			"num_pools":    len(c.pools),
+			"num_objects":  objects,
+			"data_bytes":   data,
+			"bytes_used":   used,
+			"bytes_avail":  avail,
+			"bytes_total":  c.capacity,
+		},
+	}
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("Not found")
+var ErrPoolNotFound = errors.New("Pool not found")
+var ErrImageNotFound = errors.New("Image not found")
+var ErrExist = errors.New("Already exist")
+var ErrBusy = errors.New("Device or resource busy")
+var ErrImageNotOpen = errors.New("Image not open")
+var ErrReadOnly = errors.New("Read-only image")
+var ErrInvalidArgument = errors.New("Invalid argument")
+var ErrNotSupported = errors.New("Operation not supported")
+
+// IsNotFound reports whether err means that a pool, image or other object
+// does not exist. Backends return ErrPoolNotFound and ErrImageNotFound when
+// they know which one is missing and ErrNotFound otherwise.
+func IsNotFound(err error) bool {
+	return err == ErrNotFound || err == ErrPoolNotFound || err == ErrImageNotFound
+}
+
+// Rbd feature bits, identical to librbd's.
+const (
+	FeatureLayering      = uint64(1 << 0)
+	FeatureStripingV2    = uint64(1 << 1)
+	FeatureExclusiveLock = uint64(1 << 2)
+	FeatureObjectMap     = uint64(1 << 3)
+	FeatureFastDiff      = uint64(1 << 4)
+	FeatureDeepFlatten   = uint64(1 << 5)
+	FeatureJournaling    = uint64(1 << 6)
+	FeatureDataPool      = uint64(1 << 7)
+)
+
+// FeatureNames maps the names the rbd tool uses for features to their bits.
+var FeatureNames = map[string]uint64{
+	"layering":       FeatureLayering,
+	"striping":       FeatureStripingV2,
+	"exclusive-lock": FeatureExclusiveLock,
+	"object-map":     FeatureObjectMap,
+	"fast-diff":      FeatureFastDiff,
+	"deep-flatten":   FeatureDeepFlatten,
+	"journaling":     FeatureJournaling,
+	"data-pool":      FeatureDataPool,
+}
+
+// Features that UpdateFeatures can enable on an existing image. Deep
+// flatten can only be disabled, the others only be set at creation.
+const (
+	FeaturesMutable     = FeatureExclusiveLock | FeatureObjectMap | FeatureFastDiff | FeatureJournaling
+	FeaturesDisableOnly = FeatureDeepFlatten
+)
+
+// ParseFeatures converts a comma separated list of feature names.
+func ParseFeatures(names string) (uint64, error) {
+	var features uint64
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		bit, ok := FeatureNames[name]
+		if !ok {
+			return 0, fmt.Errorf("Unknown feature %q", name)
+		}
+		features |= bit
+	}
+	return features, nil
+}
+
+// FeatureList returns the sorted names of the bits set in features.
+func FeatureList(features uint64) []string {
+	names := []string{}
+	for name, bit := range FeatureNames {
+		if features&bit != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckFeatures reports a feature enabled without the feature it depends
+// on, which librbd refuses.
+func CheckFeatures(features uint64) error {
+	switch {
+	case features&FeatureObjectMap != 0 && features&FeatureExclusiveLock == 0:
+		return fmt.Errorf("object-map requires exclusive-lock")
+	case features&FeatureFastDiff != 0 && features&FeatureObjectMap == 0:
+		return fmt.Errorf("fast-diff requires object-map")
+	case features&FeatureJournaling != 0 && features&FeatureExclusiveLock == 0:
+		return fmt.Errorf("journaling requires exclusive-lock")
+	}
+	return nil
+}
+
+// DefaultOrder is the default object size order, 4MB objects.
+const DefaultOrder = 22
+
+// MinOrder and MaxOrder bound the object size order, 4KB to 32MB objects.
+const (
+	MinOrder = 12
+	MaxOrder = 25
+)
+
+// ImageOptions are the settings of a new image. Zero fields are left to
+// the cluster defaults. StripeUnit and StripeCount go together; the
+// striping feature is added when they differ from one stripe per object,
+// and the data-pool feature when DataPool is set, as librbd does.
+type ImageOptions struct {
+	Features    uint64
+	Order       int
+	StripeUnit  uint64
+	StripeCount uint64
+	// DataPool keeps the image data in another pool, typically an
+	// erasure-coded one with overwrites enabled, while the metadata stays
+	// in the image's pool.
+	DataPool string
+}
+
+// Validate checks the options and adds the features they imply.
+func (o *ImageOptions) Validate() error {
+	order := o.Order
+	if order == 0 {
+		order = DefaultOrder
+	}
+	if order < MinOrder || order > MaxOrder {
+		return fmt.Errorf("Invalid order %v", o.Order)
+	}
+	if (o.StripeUnit == 0) != (o.StripeCount == 0) {
+		return fmt.Errorf("Stripe unit and count must be set together")
+	}
+	if o.StripeUnit != 0 {
+		objectSize := uint64(1) << uint(order)
+		if o.StripeUnit > objectSize || objectSize%o.StripeUnit != 0 {
+			return fmt.Errorf("Stripe unit %v must divide the object size %v", o.StripeUnit, objectSize)
+		}
+		if o.StripeUnit != objectSize || o.StripeCount != 1 {
+			o.Features |= FeatureStripingV2
+		}
+	}
+	if o.DataPool != "" {
+		o.Features |= FeatureDataPool
+	}
+	return CheckFeatures(o.Features)
+}
+
+// ClusterStat represents cluster statistics.
+type ClusterStat struct {
+	Kb          uint64
+	Kb_used     uint64
+	Kb_avail    uint64
+	Num_objects uint64
+}
+
+// PoolStat represents pool statistics, with the same fields as rados.PoolStat.
+type PoolStat struct {
+	Num_bytes                      uint64
+	Num_kb                         uint64
+	Num_objects                    uint64
+	Num_object_clones              uint64
+	Num_object_copies              uint64
+	Num_objects_missing_on_primary uint64
+	Num_objects_unfound            uint64
+	Num_objects_degraded           uint64
+	Num_rd                         uint64
+	Num_rd_kb                      uint64
+	Num_wr                         uint64
+	Num_wr_kb                      uint64
+}
+
+// ImageInfo represents image information, with the same fields as rbd.ImageInfo.
+type ImageInfo struct {
+	Size              uint64
+	Obj_size          uint64
+	Num_objs          uint64
+	Order             int
+	Block_name_prefix string
+	Parent_pool       int64
+	Parent_name       string
+}
+
+// SnapInfo represents a snapshot of an image.
+type SnapInfo struct {
+	Id   uint64
+	Size uint64
+	Name string
+}
+
+// ProgressFunc receives the progress of a long-running operation as done
+// out of total units. It may be called from another goroutine and must not
+// block.
+type ProgressFunc func(done uint64, total uint64)
+
+// DiffFunc receives one extent reported by Image.DiffIterate. exists is
+// false when the extent has become a hole. Returning an error stops the
+// iteration.
+type DiffFunc func(offset uint64, length uint64, exists bool) error
+
+// Backend hands out cluster connections.
+type Backend interface {
+	Connect() (Cluster, error)
+}
+
+// ConnHealth reports the state of one named cluster connection.
+type ConnHealth struct {
+	Name        string
+	Cluster     string
+	User        string
+	Connected   bool
+	LastError   string
+	LastConnect time.Time
+	Failures    int
+	OpenPools   int
+}
+
+// HealthChecker is implemented by backends that keep long-lived
+// connections and can report on them.
+type HealthChecker interface {
+	Health() []ConnHealth
+}
+
+// UserBackend is implemented by backends that can connect to the same
+// cluster as other cephx users.
+type UserBackend interface {
+	// AddUser registers a connection named name as user, the full entity
+	// name, authenticated with the base64 key, and returns a backend
+	// bound to it. A connection that fails is retried in the background;
+	// the error is still returned.
+	AddUser(name string, user string, key string) (Backend, error)
+	RemoveUser(name string) error
+}
+
+// Cluster is a connection to a storage cluster.
+type Cluster interface {
+	// Shutdown releases the connection.
+	Shutdown()
+	MakePool(name string) error
+	// MakePoolWithCrushRule creates a replicated pool placed by the CRUSH
+	// rule with ID rule.
+	MakePoolWithCrushRule(name string, rule uint8) error
+	DeletePool(name string) error
+	ListPools() ([]string, error)
+	LookupPool(name string) error
+	OpenPool(name string) (Pool, error)
+	GetClusterStats() (ClusterStat, error)
+	MonCommand(args []byte) ([]byte, string, error)
+}
+
+// Pool is an open pool, the equivalent of a rados IOContext.
+type Pool interface {
+	Name() string
+	ID() int64
+	GetPoolStats() (PoolStat, error)
+	ListImages() ([]string, error)
+	CreateImage(name string, size uint64, order int, features uint64) error
+	// CreateImageWithOptions creates an image with opts, which must have
+	// been validated.
+	CreateImageWithOptions(name string, size uint64, opts *ImageOptions) error
+	RemoveImage(name string) error
+	RemoveImageWithProgress(name string, progress ProgressFunc) error
+	// OpenImage opens the image head, or the named snapshot read-only
+	// when snapshot is not empty.
+	OpenImage(name string, snapshot string) (Image, error)
+	Close()
+}
+
+// Image is an open rbd image.
+type Image interface {
+	io.ReaderAt
+	io.WriterAt
+	Name() string
+	Stat() (*ImageInfo, error)
+	GetSize() (uint64, error)
+	GetFeatures() (uint64, error)
+	// UpdateFeatures enables or disables features, which must be within
+	// FeaturesMutable, or FeaturesDisableOnly when disabling.
+	UpdateFeatures(features uint64, enabled bool) error
+	GetStripePeriod() (uint64, error)
+	Resize(size uint64) error
+	ResizeWithProgress(size uint64, progress ProgressFunc) error
+	Flush() error
+	Discard(ofs uint64, length uint64) error
+	// DiffIterate reports the extents in [ofs, ofs+length) that changed
+	// between fromSnapshot and the opened snapshot or head. An empty
+	// fromSnapshot reports every allocated extent, including those
+	// inherited from a parent.
+	DiffIterate(fromSnapshot string, ofs uint64, length uint64, fn DiffFunc) error
+	CreateSnapshot(name string) error
+	ListSnapshots() ([]SnapInfo, error)
+	RemoveSnapshot(name string) error
+	RollbackSnapshot(name string) error
+	ProtectSnapshot(name string) error
+	UnprotectSnapshot(name string) error
+	IsSnapshotProtected(name string) (bool, error)
+	// Clone creates a copy-on-write child of the protected snapshot in dest.
+	Clone(snapshot string, dest Pool, name string, features uint64, order int) error
+	Flatten() error
+	// Parent returns the pool, image and snapshot the image was cloned
+	// from, or ErrNotFound when it has no parent.
+	Parent() (pool string, image string, snapshot string, err error)
+	// GetMetadata returns the value of key in the image metadata, or
+	// ErrNotFound.
+	GetMetadata(key string) (string, error)
+	SetMetadata(key string, value string) error
+	// RemoveMetadata returns ErrNotFound when key is not set.
+	RemoveMetadata(key string) error
+	ListMetadata() (map[string]string, error)
+	// Copy copies the image data, without snapshots, to a new image in dest.
+	Copy(dest Pool, name string, progress ProgressFunc) error
+	ListChildren() (pools []string, images []string, err error)
+	Close() error
+}
@@ -1,14 +0,0 @@
-from rtslib_fb import (
-    BlockStorageObject, FabricModule, Target, TPG,
-    NetworkPortal, NodeACL, LUN, MappedLUN, RTSRoot)
-import argparse
-
-def argparser():
-    parser = argparse.ArgumentParser()
-    parser.add_argument()
-
-def main():
-    f = BlockStorageObject()
-
-if __name__ == "__main__":
-    main()
\ No newline at end of file
@@ -1,6 +1,12 @@
 package clients
 
-import "net/http"
+import (
+	"net/http"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
 
 const (
 	StatusMethodUnmatch         = 700 //method不匹配
@@ -15,6 +21,13 @@ const (
 	StatusDownloadError         = 709 //下载object失败
 )
 
+//应答中的请求ID、旧的状态码和说明
+const (
+	HeaderRequestId = "x-oss-request-id"
+	HeaderErrCode   = "x-oss-errcode"
+	HeaderErrMsg    = "x-oss-errmsg"
+)
+
 var statusText = map[int]string{
 	StatusMethodUnmatch:        "Method Unmatch.",
 	StatusInvalidBucket:        "Invalid Bucket Name.",
@@ -28,12 +41,129 @@ var statusText = map[int]string{
 	StatusDownloadError:        "Download Failed",
 }
 
+//错误对应的HTTP状态码、稳定的错误码和客户端能否重试
+type ossError struct {
+	status    int
+	code      string
+	retryable bool
+}
+
+var statusErrors = map[int]ossError{
+	http.StatusBadRequest:          {http.StatusBadRequest, "InvalidRequest", false},
+	http.StatusNotFound:            {http.StatusNotFound, "NotFound", false},
+	http.StatusMethodNotAllowed:    {http.StatusMethodNotAllowed, "MethodNotAllowed", false},
+	http.StatusInternalServerError: {http.StatusInternalServerError, "InternalError", true},
+	StatusMethodUnmatch:            {http.StatusMethodNotAllowed, "MethodNotAllowed", false},
+	StatusInvalidBucket:            {http.StatusBadRequest, "InvalidBucketName", false},
+	StatusInvalidParam:             {http.StatusBadRequest, "InvalidArgument", false},
+	StatusCreateBucketError:        {http.StatusInternalServerError, "CreateBucketFailed", true},
+	StatusDelBucketError:           {http.StatusInternalServerError, "DeleteBucketFailed", true},
+	StatusListBucketError:          {http.StatusInternalServerError, "ListBucketsFailed", true},
+	StatusTooManyParam:             {http.StatusBadRequest, "TooManyParameters", false},
+	StatusListObjError:             {http.StatusInternalServerError, "ListObjectsFailed", true},
+	StatusDelObjError:              {http.StatusInternalServerError, "DeleteObjectFailed", true},
+	StatusDownloadError:            {http.StatusInternalServerError, "DownloadFailed", true},
+}
+
+//RGW返回的S3错误码
+var awsErrors = map[string]ossError{
+	"NoSuchBucket":            {http.StatusNotFound, "BucketNotFound", false},
+	"NoSuchKey":               {http.StatusNotFound, "ObjectNotFound", false},
+	"NotFound":                {http.StatusNotFound, "ObjectNotFound", false},
+	"NoSuchUpload":            {http.StatusNotFound, "UploadNotFound", false},
+	"BucketAlreadyExists":     {http.StatusConflict, "BucketAlreadyExists", false},
+	"BucketAlreadyOwnedByYou": {http.StatusConflict, "BucketAlreadyExists", false},
+	"BucketNotEmpty":          {http.StatusConflict, "BucketNotEmpty", false},
+	"InvalidBucketName":       {http.StatusBadRequest, "InvalidBucketName", false},
+	"InvalidArgument":         {http.StatusBadRequest, "InvalidArgument", false},
+	"InvalidRange":            {http.StatusRequestedRangeNotSatisfiable, "InvalidRange", false},
+	"AccessDenied":            {http.StatusForbidden, "AccessDenied", false},
+	"InvalidAccessKeyId":      {http.StatusForbidden, "AccessDenied", false},
+	"SignatureDoesNotMatch":   {http.StatusForbidden, "AccessDenied", false},
+	"QuotaExceeded":           {http.StatusForbidden, "QuotaExceeded", false},
+	"RequestTimeout":          {http.StatusRequestTimeout, "RequestTimeout", true},
+	"SlowDown":                {http.StatusServiceUnavailable, "SlowDown", true},
+	"ServiceUnavailable":      {http.StatusServiceUnavailable, "ServiceUnavailable", true},
+	"InternalError":           {http.StatusInternalServerError, "InternalError", true},
+	"RequestError":            {http.StatusBadGateway, "BackendUnavailable", true},
+}
+
+type ErrorDetail struct {
+	Code      string
+	Message   string
+	RequestId string
+	Retryable bool
+}
+
+type ErrorReply struct {
+	Error ErrorDetail
+}
+
+/*
+错误应答：HTTP状态码为4xx/5xx，x-oss-errcode为旧的状态码，例如
+HTTP /1.1 404 Not Found
+x-oss-request-id: 9b2f61c04d7e3a58
+x-oss-errcode: 704
+x-oss-errmsg: Remove Bucket Failed
+
+{"Error":{"Code":"BucketNotFound","Message":"The specified bucket does not exist","RequestId":"9b2f61c04d7e3a58","Retryable":false}}
+*/
+func sendError(w http.ResponseWriter, statusCode int, e ossError, message string) {
+	errmsg, ok := statusText[statusCode]
+	if !ok {
+		errmsg = http.StatusText(e.status)
+	}
+	if message == "" {
+		message = errmsg
+	}
+	payload, _ := json.Marshal(ErrorReply{Error: ErrorDetail{
+		Code:      e.code,
+		Message:   message,
+		RequestId: w.Header().Get(HeaderRequestId),
+		Retryable: e.retryable,
+	}})
+
+	w.Header().Set(HeaderErrCode, strconv.Itoa(statusCode))
+	w.Header().Set(HeaderErrMsg, errmsg)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	fmt.Fprintln(w, string(payload))
+}
+
+//未列出的标准状态码原样返回，自定义码为500
+func errorOf(statusCode int) ossError {
+	if e, ok := statusErrors[statusCode]; ok {
+		return e
+	}
+	if statusCode < 600 {
+		return ossError{statusCode, "InternalError", statusCode >= 500}
+	}
+	return statusErrors[http.StatusInternalServerError]
+}
+
 //发送自定义HTTP错误信息
 func SendUDFStatus(w http.ResponseWriter, statusCode int) {
-	http.Error(w, statusText[statusCode], statusCode)
+	sendError(w, statusCode, errorOf(statusCode), "")
 }
 
 //发送标准HTTP错误信息
 func SendStatus(w http.ResponseWriter, statusCode int) {
+	if statusCode >= http.StatusBadRequest {
+		sendError(w, statusCode, errorOf(statusCode), "")
+		return
+	}
 	http.Error(w, http.StatusText(statusCode), statusCode)
 }
+
+//发送RGW返回的错误，未知的错误码按RGW的HTTP状态码判断能否重试，statusCode为旧的状态码
+func SendAWSError(w http.ResponseWriter, aerr awserr.Error, statusCode int) {
+	e, ok := awsErrors[aerr.Code()]
+	if !ok {
+		e = errorOf(statusCode)
+		if rerr, ok := aerr.(awserr.RequestFailure); ok && rerr.StatusCode() >= http.StatusBadRequest {
+			e = ossError{rerr.StatusCode(), aerr.Code(), rerr.StatusCode() >= http.StatusInternalServerError}
+		}
+	}
+	sendError(w, statusCode, e, aerr.Message())
+}
@@ -58,7 +58,7 @@ func (c *RGWconfig) CreateBucket(w http.ResponseWriter, r *http.Request) {
 	if _, err := s3util.S3CreateBucket(c.s3ctx, bucket); err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			osslog.Errorf("%v\n", aerr.Error())
-			http.Error(w, aerr.Code(), StatusCreateBucketError)
+			SendAWSError(w, aerr, StatusCreateBucketError)
 		} else {
 			osslog.Errorf("Create bucket %v failed: %v\n", bucket, err)
 			SendUDFStatus(w, StatusCreateBucketError)
@@ -88,7 +88,7 @@ func (c *RGWconfig) DelBucket(w http.ResponseWriter, r *http.Request) {
 	if err := s3util.S3DeleteBucket(c.s3ctx, bucket); err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			osslog.Errorf("%v\n", aerr.Error())
-			http.Error(w, aerr.Code(), StatusCreateBucketError)
+			SendAWSError(w, aerr, StatusDelBucketError)
 		} else {
 			osslog.Errorf("Delete Bucket %v failed: %v\n", bucket, err)
 			SendUDFStatus(w, StatusDelBucketError)
@@ -121,11 +121,12 @@ func (c *RGWconfig) ListBuckets(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			osslog.Errorf("%v\n", aerr.Error())
-			http.Error(w, aerr.Code(), StatusListBucketError)
+			SendAWSError(w, aerr, StatusListBucketError)
 		} else {
 			osslog.Errorf("List Buckets failed: %v\n", err)
 			SendUDFStatus(w, StatusListBucketError)
 		}
+		return
 	}
 
 	buckets := make([]string, len(content.Buckets))
@@ -194,7 +195,7 @@ func (c *RGWconfig) ListObjects(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			osslog.Errorf("%v\n", aerr.Error())
-			http.Error(w, aerr.Code(), StatusListObjError)
+			SendAWSError(w, aerr, StatusListObjError)
 		} else {
 			osslog.Errorf("List Objects failed: %v\n", err)
 			SendUDFStatus(w, StatusListObjError)
@@ -284,7 +285,7 @@ func (c *RGWconfig) DelObject(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			osslog.Errorf("%v\n", aerr.Error())
-			http.Error(w, aerr.Code(), StatusDelObjError)
+			SendAWSError(w, aerr, StatusDelObjError)
 		} else {
 			osslog.Errorf("Delete Objects %v failed: %v\n", r.RequestURI, err)
 			SendUDFStatus(w, StatusDelObjError)
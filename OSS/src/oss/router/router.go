@@ -6,10 +6,13 @@ import (
 	"oss/log"
 	"regexp"
 	"strings"
+	"crypto/rand"
+	"encoding/hex"
 )
 
 var BucketRegexp *regexp.Regexp
 var ObjectRegexp *regexp.Regexp
+var RequestIdRegexp = regexp.MustCompile("^[[:alnum:]._-]{1,64}$")
 
 func Init() {
 	BucketRegexp = regexp.MustCompile("^/[[:lower:]][[:alnum:]-]*[[:lower:]]$")
@@ -18,6 +21,7 @@ func Init() {
 	s3user := clients.S3InitUser("default")
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(clients.HeaderRequestId, requestId(r))
 		switch {
 		case matchPutBucketRequest(r):
 			s3user.CreateBucket(w, r)
@@ -40,6 +44,16 @@ func Init() {
 	})
 }
 
+//客户端传入的合法请求ID原样使用，否则生成一个
+func requestId(r *http.Request) string {
+	if id := r.Header.Get(clients.HeaderRequestId); RequestIdRegexp.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func matchPutBucketRequest(r *http.Request) bool {
 	if strings.Compare(r.Method, http.MethodPut) != 0 || BucketRegexp.MatchString(r.RequestURI) != true {
 		return false